@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const activeTokenStoragePrefix = "active-tokens/"
+
+// activeToken is the last token issued to an instance by a role with
+// single_active_token set, as it's reflected in Vault's storage system.
+type activeToken struct {
+	LoginID  string    `json:"login_id"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// outlivedTokens reports whether the max lease TTL has passed since the token was
+// issued. The tokens issued before it haven't been renewable since, so none of them
+// can still be live, and the entry is no longer needed to refuse their renewals.
+func (a *activeToken) outlivedTokens(maxLeaseTTL time.Duration, now time.Time) bool {
+	return maxLeaseTTL > 0 && now.After(a.IssuedAt.Add(maxLeaseTTL))
+}
+
+func activeTokenStorageKey(roleName, instanceID string) string {
+	return activeTokenStoragePrefix + roleName + "/" + instanceID
+}
+
+func getActiveToken(ctx context.Context, storage logical.Storage, key string) (*activeToken, error) {
+	entry, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	active := &activeToken{}
+	if err := entry.DecodeJSON(active); err != nil {
+		return nil, err
+	}
+	return active, nil
+}
+
+// recordActiveToken makes the auth the instance's only renewable token for the role.
+// Nodes that can't write to storage return logical.ErrReadOnly, so that the login is
+// forwarded to one that can.
+func recordActiveToken(ctx context.Context, storage logical.Storage, roleName, instanceID string, auth *logical.Auth, now time.Time) error {
+	loginID, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	entry, err := logical.StorageEntryJSON(activeTokenStorageKey(roleName, instanceID), &activeToken{
+		LoginID:  loginID,
+		IssuedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		return err
+	}
+	auth.InternalData["login_id"] = loginID
+	return nil
+}
+
+// isActiveToken reports whether the auth is the newest token the role has issued to
+// the instance. Tokens issued before single_active_token was set are treated as active.
+func isActiveToken(ctx context.Context, storage logical.Storage, roleName, instanceID string, auth *logical.Auth) (bool, error) {
+	loginID, ok := auth.InternalData["login_id"].(string)
+	if !ok {
+		return true, nil
+	}
+	active, err := getActiveToken(ctx, storage, activeTokenStorageKey(roleName, instanceID))
+	if err != nil {
+		return false, err
+	}
+	return active == nil || active.LoginID == loginID, nil
+}
+
+// tidyActiveTokens drops the active tokens that have outlived the tokens issued
+// before them, returning how many were dropped.
+func tidyActiveTokens(ctx context.Context, storage logical.Storage, maxLeaseTTL time.Duration, now time.Time) (int, error) {
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, activeTokenStoragePrefix)
+	if err != nil {
+		return 0, err
+	}
+	tidied := 0
+	for _, key := range keys {
+		active, err := getActiveToken(ctx, storage, key)
+		if err != nil {
+			return tidied, err
+		}
+		if active == nil || !active.outlivedTokens(maxLeaseTTL, now) {
+			continue
+		}
+		if err := storage.Delete(ctx, key); err != nil {
+			return tidied, err
+		}
+		tidied++
+	}
+	return tidied, nil
+}
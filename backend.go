@@ -10,15 +10,24 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/cloudfoundry-community/go-cfclient"
+	metrics "github.com/armon/go-metrics"
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	cfconfig "github.com/cloudfoundry/go-cfclient/v3/config"
 	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/version"
 )
 
 const (
@@ -33,22 +42,54 @@ const (
 )
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	b := &backend{}
+	b := &backend{
+		cfAPIBreaker:        newCircuitBreaker(),
+		cfAPIEndpointHealth: newEndpointHealth(),
+		cfClientStatus:      newCFClientStatus(),
+		seenSignatures:      newSeenSignatures(),
+		usedNonces:          newSeenSignatures(),
+		loginActivity:       newLoginActivity(loginActivitySize),
+		loginThrottle:       newLoginThrottle(),
+	}
 	b.Backend = &framework.Backend{
-		AuthRenew: b.pathLoginRenew,
-		Help:      backendHelp,
+		AuthRenew:      b.pathLoginRenew,
+		RunningVersion: "v" + version.GetVersion(),
+		Help:           backendHelp,
 		PathsSpecial: &logical.Paths{
-			SealWrapStorage: []string{"config"},
-			Unauthenticated: []string{"login"},
+			SealWrapStorage: []string{"config", credentialSaltStorageKey, loginChallengeKeyStorageKey},
+			Unauthenticated: []string{"login", "login/challenge", "login-jwt"},
 		},
 		Paths: []*framework.Path{
 			b.pathConfig(),
+			b.pathConfigCheck(),
+			b.pathConfigClientStatus(),
+			b.pathConfigRotateCA(),
 			b.pathListRoles(),
+			b.pathGenerateRole(),
+			b.pathExportRoles(),
+			b.pathImportRoles(),
 			b.pathRoles(),
 			b.pathLogin(),
+			b.pathLoginChallenge(),
+			b.pathLoginJWT(),
+			b.pathCircuitBreaker(),
+			b.pathFlushCache(),
+			b.pathTidy(),
+			b.pathRevoke(),
+			b.pathListPolicyMap(),
+			b.pathPolicyMap(),
+			b.pathListTTLCaps(),
+			b.pathTTLCaps(),
+			b.pathLoginActivity(),
+			b.pathLoginThrottle(),
+			b.pathChangeHistory(),
+			b.pathSimulateLogin(),
+			b.pathVerifySignature(),
 		},
 		BackendType:    logical.TypeCredential,
 		InitializeFunc: b.initialize,
+		PeriodicFunc:   b.periodicFunc,
+		WALRollback:    b.walRollback,
 	}
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
@@ -63,6 +104,44 @@ type backend struct {
 	cfClientMu      sync.RWMutex
 	lastConfigHash  *[32]byte
 	cfClientTainted bool
+
+	// cfClientRefreshGroup ensures that concurrent logins finding the CF client
+	// missing or tainted only build one new client, and so only authenticate to
+	// UAA once, between them.
+	cfClientRefreshGroup singleflight.Group
+
+	// nameCache and validationCache are rebuilt along with the CF client, so
+	// that a configuration change never serves resources looked up using the
+	// previous configuration.
+	nameCache       *resourceCache
+	validationCache *resourceCache
+
+	// cfAPIBreaker, cfAPIEndpointHealth, and cfClientStatus live as long as the
+	// backend, so that their state survives the CF client being rebuilt.
+	cfAPIBreaker        *circuitBreaker
+	cfAPIEndpointHealth *endpointHealth
+	cfClientStatus      *cfClientStatus
+
+	seenSignatures *seenSignatures
+	loginActivity  *loginActivity
+
+	// changeHistoryMu keeps changes from being recorded over each other.
+	changeHistoryMu sync.Mutex
+
+	// usedNonces remembers the login challenge nonces that have been logged in
+	// with, so that each is only used once on this node.
+	usedNonces    *seenSignatures
+	loginThrottle *loginThrottle
+
+	// reconciliationMu guards lastReconciliation, and keeps reconciliation runs
+	// from overlapping.
+	reconciliationMu   sync.Mutex
+	lastReconciliation time.Time
+
+	// tidyRunning keeps tidies from overlapping, and lastTidy, which is only used
+	// while it's set, is when the periodic tidy last ran.
+	tidyRunning atomic.Bool
+	lastTidy    time.Time
 }
 
 const backendHelp = `
@@ -87,7 +166,10 @@ func (b *backend) updateCFClient(ctx context.Context, config *models.Configurati
 	b.cfClientMu.Lock()
 	defer b.cfClientMu.Unlock()
 
-	configHash, err := config.Hash()
+	if config == nil {
+		return false, fmt.Errorf("configuration is nil")
+	}
+	configHash, err := config.ClientHash()
 	if err != nil {
 		return false, err
 	}
@@ -98,59 +180,163 @@ func (b *backend) updateCFClient(ctx context.Context, config *models.Configurati
 		}
 	}
 
-	b.cfClientTainted = false
-	if b.cfClient != nil {
-		if b.cfClient.Config.HttpClient != nil {
-			b.cfClient.Config.HttpClient.CloseIdleConnections()
+	if b.cfClient != nil && b.cfClient.Config != nil {
+		if httpClient := b.cfClient.HTTPClient(); httpClient != nil {
+			httpClient.CloseIdleConnections()
 		}
 	}
 
 	cfClient, err := b.newCFClient(ctx, config)
+	b.cfClientStatus.refreshed(err)
+	if err != nil {
+		metrics.IncrCounterWithLabels(metricCFClientRefresh, 1, []metrics.Label{{Name: "result", Value: "failure"}})
+		// Keep using the current client, if there is one, but have the next login
+		// that needs it try to build one from this config again.
+		b.cfClientTainted = b.cfClient != nil
+		return false, err
+	}
+	metrics.IncrCounterWithLabels(metricCFClientRefresh, 1, []metrics.Label{{Name: "result", Value: "success"}})
+
+	nameCache, err := newResourceCache(config.NameCacheTTL, config.NameCacheMaxEntries)
 	if err != nil {
 		return false, err
 	}
 
+	validationCache, err := newResourceCache(config.ValidationCacheTTL, defaultResourceCacheMaxEntries)
+	if err != nil {
+		return false, err
+	}
+
+	if b.cfAPIBreaker != nil {
+		b.cfAPIBreaker.configure(config.CFCircuitBreakerFailureThreshold, config.CFCircuitBreakerResetTimeout)
+	}
+
 	b.cfClient = cfClient
+	b.cfClientTainted = false
+	b.nameCache = nameCache
+	b.validationCache = validationCache
 	b.lastConfigHash = &configHash
 
 	return true, nil
 }
 
+func (b *backend) getNameCache() *resourceCache {
+	b.cfClientMu.RLock()
+	defer b.cfClientMu.RUnlock()
+	return b.nameCache
+}
+
+func (b *backend) getValidationCache() *resourceCache {
+	b.cfClientMu.RLock()
+	defer b.cfClientMu.RUnlock()
+	return b.validationCache
+}
+
 func (b *backend) getCFClientOrRefresh(ctx context.Context, config *models.Configuration) (*cfclient.Client, error) {
 	if config == nil {
 		return nil, fmt.Errorf("configuration is nil")
 	}
 
 	client, err := b.getCFClient(ctx)
+	if err != nil && !errors.Is(err, errCFClientNotInitialized) {
+		return nil, err
+	}
+	if err == nil && !b.isCFClientTainted() {
+		return client, nil
+	}
+
+	_, err, _ = b.cfClientRefreshGroup.Do("refresh", func() (interface{}, error) {
+		_, err := b.updateCFClient(ctx, config)
+		return nil, err
+	})
 	if err != nil {
-		if errors.Is(err, errCFClientNotInitialized) {
-			if _, err := b.updateCFClient(ctx, config); err != nil {
-				return nil, err
-			}
-			return b.getCFClient(ctx)
+		if client != nil {
+			// A tainted client may well still work, so keep using it until a
+			// refresh succeeds.
+			b.Logger().Warn("failed to refresh tainted CF client", "error", err)
+			return client, nil
 		}
 		return nil, err
 	}
 
-	return client, nil
+	return b.getCFClient(ctx)
+}
+
+// cfTokenRefreshWindow is how long before the CF client's UAA token expires that the
+// periodic func replaces the client, so that logins don't wait on UAA when it does.
+const cfTokenRefreshWindow = 5 * time.Minute
+
+// refreshCFClientToken replaces the CF client with one holding a fresh UAA token if
+// its token is about to expire. The new client is built without holding the client
+// lock, so that logins keep using the current client in the meantime.
+func (b *backend) refreshCFClientToken(ctx context.Context, config *models.Configuration, now time.Time) {
+	if !b.cfClientStatus.tokenRefreshDue(now, cfTokenRefreshWindow) {
+		return
+	}
+	configHash, err := config.ClientHash()
+	if err != nil {
+		b.Logger().Warn("failed to hash config to refresh CF client token", "error", err)
+		return
+	}
+	b.cfClientMu.RLock()
+	current := b.cfClient != nil && !b.cfClientTainted && b.lastConfigHash != nil && *b.lastConfigHash == configHash
+	b.cfClientMu.RUnlock()
+	if !current {
+		// A client that's missing, tainted, or built from other client settings is
+		// rebuilt by the next login that needs it: a client is only left built from
+		// other settings when rebuilding it failed, which taints it.
+		return
+	}
+
+	_, err, _ = b.cfClientRefreshGroup.Do("refresh", func() (interface{}, error) {
+		cfClient, err := b.newCFClient(ctx, config)
+		b.cfClientStatus.refreshed(err)
+		if err != nil {
+			metrics.IncrCounterWithLabels(metricCFClientRefresh, 1, []metrics.Label{{Name: "result", Value: "failure"}})
+			return nil, err
+		}
+		metrics.IncrCounterWithLabels(metricCFClientRefresh, 1, []metrics.Label{{Name: "result", Value: "success"}})
+
+		b.cfClientMu.Lock()
+		defer b.cfClientMu.Unlock()
+		if b.cfClientTainted || b.lastConfigHash == nil || *b.lastConfigHash != configHash {
+			// The client was replaced or tainted while the new one was being built.
+			return nil, nil
+		}
+		if b.cfClient != nil && b.cfClient.Config != nil {
+			if httpClient := b.cfClient.HTTPClient(); httpClient != nil {
+				httpClient.CloseIdleConnections()
+			}
+		}
+		b.cfClient = cfClient
+		return nil, nil
+	})
+	if err != nil {
+		// The current client refreshes its own token when it expires, so keep it.
+		b.Logger().Warn("failed to refresh CF client token", "error", err)
+	}
+}
+
+// taintCFClient marks the CF client to be rebuilt the next time it's needed.
+func (b *backend) taintCFClient() {
+	b.cfClientMu.Lock()
+	defer b.cfClientMu.Unlock()
+	b.cfClientTainted = true
+}
+
+func (b *backend) isCFClientTainted() bool {
+	b.cfClientMu.RLock()
+	defer b.cfClientMu.RUnlock()
+	return b.cfClientTainted
 }
 
-func (b *backend) newCFClient(_ context.Context, config *models.Configuration) (*cfclient.Client, error) {
+func (b *backend) newCFClient(ctx context.Context, config *models.Configuration) (*cfclient.Client, error) {
 	if config == nil {
 		return nil, fmt.Errorf("configuration is nil")
 	}
 
 	httpClient := cleanhttp.DefaultClient()
-	httpClient.Timeout = config.CFTimeout * time.Second
 
-	clientConf := &cfclient.Config{
-		ApiAddress:   config.CFAPIAddr,
-		Username:     config.CFUsername,
-		Password:     config.CFPassword,
-		ClientID:     config.CFClientID,
-		ClientSecret: config.CFClientSecret,
-		HttpClient:   httpClient,
-	}
 	rootCAs, err := x509.SystemCertPool()
 	if err != nil {
 		return nil, err
@@ -166,7 +352,10 @@ func (b *backend) newCFClient(_ context.Context, config *models.Configuration) (
 		}
 	}
 	tlsConfig := &tls.Config{
-		RootCAs: rootCAs,
+		RootCAs:            rootCAs,
+		MinVersion:         tlsVersions[cfAPITLSMinVersion(config)],
+		ServerName:         config.CFAPITLSServerName,
+		InsecureSkipVerify: config.CFAPITLSSkipVerify,
 	}
 
 	if config.CFMutualTLSCertificate != "" && config.CFMutualTLSKey != "" {
@@ -182,25 +371,179 @@ func (b *backend) newCFClient(_ context.Context, config *models.Configuration) (
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	clientConf.HttpClient.Transport = &http.Transport{
+	transport := &http.Transport{
 		TLSClientConfig: tlsConfig,
 	}
+	if config.CFProxyURL != "" {
+		proxy, err := newProxyFunc(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+	var apiTransport http.RoundTripper = transport
+	if len(config.CFAPIFailoverAddrs) > 0 {
+		health := b.cfAPIEndpointHealth
+		if health == nil {
+			health = newEndpointHealth()
+		}
+		apiTransport, err = newFailoverRoundTripper(transport, config.CFAPIAddrs(), health)
+		if err != nil {
+			return nil, err
+		}
+	}
+	apiTransport = &headerRoundTripper{
+		RoundTripper: apiTransport,
+		userAgent:    config.CFAPIUserAgent,
+	}
+	apiTransport = &tokenExpiryRoundTripper{
+		RoundTripper: apiTransport,
+		status:       b.cfClientStatus,
+	}
+	httpClient.Transport = apiTransport
+
+	// Calls to the CF API, including those made to fetch and refresh tokens, are
+	// retried with exponential backoff on connection errors and 5xx responses.
+	if config.CFMaxRetries > 0 {
+		retryClient := retryablehttp.NewClient()
+		retryClient.HTTPClient = &http.Client{
+			Transport: apiTransport,
+		}
+		retryClient.Logger = nil
+		retryClient.RetryMax = config.CFMaxRetries
+		if config.CFRetryWaitMin > 0 {
+			retryClient.RetryWaitMin = config.CFRetryWaitMin
+		}
+		if config.CFRetryWaitMax > 0 {
+			retryClient.RetryWaitMax = config.CFRetryWaitMax
+		}
+		// Hand the last response back as is, so that errors from the CF API
+		// are reported the same way whether or not retries are enabled.
+		retryClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+		// Rate limited calls are waited out by the rateLimitRoundTripper instead, which
+		// only does so when the CF API says how long to wait.
+		retryClient.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+				return false, nil
+			}
+			return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+		}
+		httpClient.Transport = &retryRoundTripper{
+			RoundTripper: &retryablehttp.RoundTripper{Client: retryClient},
+			transport:    transport,
+		}
+	}
+	httpClient.Transport = &rateLimitRoundTripper{RoundTripper: httpClient.Transport}
+
+	opts := []cfconfig.Option{
+		cfconfig.HttpClient(httpClient),
+	}
+	if config.CFTimeout > 0 {
+		opts = append(opts, cfconfig.RequestTimeout(config.CFTimeout))
+	}
+	// The CF client also sets whether TLS is verified on the transport, if it isn't
+	// wrapped.
+	if config.CFAPITLSSkipVerify {
+		opts = append(opts, cfconfig.SkipTLSValidation())
+	}
+
+	// A JWT bearer signing key or pre-issued token is used when it's provided, and
+	// otherwise client credentials are preferred, which matches the behavior of
+	// the v2 client this backend previously used.
+	switch {
+	case config.CFJWTBearerSigningKey != "":
+		// The token is issued for a JWT signed now, and can't be refreshed, so the
+		// client is rebuilt before it expires.
+		accessToken, loginURL, uaaURL, err := jwtBearerToken(ctx, httpClient, config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, cfconfig.AuthTokenURL(loginURL, uaaURL), cfconfig.Token(accessToken, ""))
+	case config.CFAccessToken != "":
+		opts = append(opts, cfconfig.Token(config.CFAccessToken, config.CFRefreshToken))
+	case config.CFClientID != "" && config.CFClientSecret != "":
+		opts = append(opts, cfconfig.ClientCredentials(config.CFClientID, config.CFClientSecret))
+	default:
+		opts = append(opts, cfconfig.UserPassword(config.CFUsername, config.CFPassword))
+	}
+
+	// cfconfig.New() reaches out to the CF API's root endpoint to discover the
+	// UAA and login endpoints, and authenticates against UAA. That means that the
+	// CF API must be reachable at the time of the call.
+	clientConf, err := cfconfig.New(config.CFAPIAddr, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-	// unfortunately, cfclient.NewClient() has a nasty side effect of reaching out
-	// to the CF API. That means that the CF API must be reachable at the time of
-	// the call. The v3 of go-cfclient does not have this issue. Updating to v3
-	// should be a priority.
-	return cfclient.NewClient(clientConf)
+	return cfclient.New(clientConf)
 }
 
-func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// tlsVersions are the TLS versions that may be the minimum used with the CF API.
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// cfAPITLSMinVersion returns the minimum TLS version used with the CF API.
+func cfAPITLSMinVersion(config *models.Configuration) string {
+	if config.CFAPITLSMinVersion != "" {
+		return config.CFAPITLSMinVersion
+	}
+	return "tls12"
+}
 
+// newProxyFunc returns the function used by the CF client's transport to pick
+// the configured proxy for requests to hosts that are not in the no proxy list.
+func newProxyFunc(config *models.Configuration) (func(*http.Request) (*url.URL, error), error) {
+	proxyURL, err := url.Parse(config.CFProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse proxy URL: %w", err)
+	}
+	if config.CFProxyUsername != "" {
+		proxyURL.User = url.UserPassword(config.CFProxyUsername, config.CFProxyPassword)
+	}
+
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(config.CFNoProxy, ","),
+	}
+	proxyForURL := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}, nil
+}
+
+// retryRoundTripper retries requests to the CF API, while still allowing the idle
+// connections of the underlying transport to be closed when the client is replaced.
+type retryRoundTripper struct {
+	*retryablehttp.RoundTripper
+	transport *http.Transport
+}
+
+func (rt *retryRoundTripper) CloseIdleConnections() {
+	rt.transport.CloseIdleConnections()
+}
+
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
 	if req == nil {
 		return fmt.Errorf("initialization request is nil")
 	}
 
+	b.mu.Lock()
+	err := b.upgradeStorage(ctx, req.Storage)
+	b.mu.Unlock()
+	if err != nil {
+		// Entries that weren't upgraded are still migrated as they're read, so the
+		// plugin can come up, and the upgrade is tried again when it's next set up.
+		b.Logger().Warn("init: failed to upgrade storage", "error", err)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	config, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		b.Logger().Warn("init: failed to get the config from storage", "error", err)
@@ -5,16 +5,25 @@ package cf
 
 import (
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/cloudfoundry-community/go-cfclient"
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/vault/sdk/framework"
@@ -59,6 +68,7 @@ func TestBackend(t *testing.T) {
 		CFPassword:             cf.AuthPassword,
 		CFClientID:             cf.AuthClientID,
 		CFClientSecret:         cf.AuthClientSecret,
+		CFTimeout:              15 * time.Second,
 		LoginMaxSecNotBefore:   5,
 		LoginMaxSecNotAfter:    1,
 	}
@@ -109,12 +119,54 @@ func TestBackend(t *testing.T) {
 	t.Run("update role", env.UpdateRole)
 	t.Run("read role", env.ReadRole)
 	t.Run("list roles", env.ListRoles)
+	t.Run("list roles by bound IDs", env.ListRolesByBoundIDs)
+	t.Run("create unconstrained role", env.CreateUnconstrainedRole)
 	t.Run("delete role", env.DeleteRole)
 
 	// Actually perform the flow needed to log in.
 	t.Run("create config", env.CreateConfig)
 	t.Run("create role", env.CreateRole)
 	t.Run("login", env.Login)
+	t.Run("login with required signature hash", env.LoginRequiredSignatureHash)
+	t.Run("login with audience", env.LoginAudience)
+	t.Run("login with role signing time window", env.LoginRoleSigningTimeWindow)
+	t.Run("login with JWT", env.LoginJWT)
+	t.Run("login without CF API checks", env.LoginWithoutCFAPIChecks)
+	t.Run("login without name resolution", env.LoginWithoutNameResolution)
+	t.Run("login with bound cert IP CIDRs", env.LoginBoundCertIPCIDRs)
+	t.Run("login verifying instance IDs", env.LoginVerifyInstanceIDs)
+	t.Run("login with TTL capped at identity expiry", env.LoginCapTTLAtIdentityExpiry)
+	t.Run("login with configured alias metadata", env.LoginAliasMetadata)
+	t.Run("login with configured auth metadata", env.LoginAuthMetadata)
+	t.Run("login with instance details", env.LoginInstanceDetails)
+	t.Run("login with bound process types", env.LoginBoundProcessTypes)
+	t.Run("login with bound instance indexes", env.LoginBoundInstanceIndexes)
+	t.Run("login with bound stacks", env.LoginBoundStacks)
+	t.Run("login with bound buildpacks", env.LoginBoundBuildpacks)
+	t.Run("login with bound current droplets", env.LoginBoundCurrentDroplets)
+	t.Run("login with bound lifecycle types", env.LoginBoundLifecycleTypes)
+	t.Run("login with required service instance", env.LoginRequiredServiceInstance)
+	t.Run("login requiring ssh disabled", env.LoginRequireSSHDisabled)
+	t.Run("login with allowed source cidrs", env.LoginAllowedSourceCIDRs)
+	t.Run("login with enforced key usage", env.LoginEnforceIdentityCertKeyUsage)
+	t.Run("login with enforced FIPS signatures", env.LoginEnforceFIPSSignatures)
+	t.Run("login with challenge", env.LoginChallenge)
+	t.Run("login with expiry warnings", env.LoginExpiryWarnings)
+	t.Run("login with templated policies", env.LoginTemplatedPolicies)
+	t.Run("login with mapped policies", env.LoginMappedPolicies)
+	t.Run("login with ttl caps", env.LoginTTLCaps)
+	t.Run("login with single active token", env.LoginSingleActiveToken)
+	t.Run("login with base64 encoded certificate", env.LoginBase64Certificate)
+	t.Run("login with CF metadata", env.LoginIncludeCFMetadata)
+	t.Run("login with default role", env.LoginDefaultRole)
+	t.Run("login denied", env.LoginDenied)
+	t.Run("resolve role", env.ResolveRole)
+	t.Run("login revoked", env.LoginRevoked)
+	t.Run("read login activity", env.ReadLoginActivity)
+	t.Run("simulate login", env.SimulateLogin)
+	t.Run("verify signature", env.VerifySignature)
+	t.Run("check config", env.CheckConfig)
+	t.Run("update config verifying the connection", env.UpdateConfigVerifyConnection)
 }
 
 func TestBackendMTLS(t *testing.T) {
@@ -278,6 +330,7 @@ func (e *Env) CreateConfig(t *testing.T) {
 			"cf_password":                   e.TestConf.CFPassword,
 			"cf_client_id":                  e.TestConf.CFClientID,
 			"cf_client_secret":              e.TestConf.CFClientSecret,
+			"cf_timeout":                    int(e.TestConf.CFTimeout / time.Second),
 			"login_max_seconds_not_before":  12,
 			"login_max_seconds_not_after":   13,
 		},
@@ -333,6 +386,21 @@ func (e *Env) ReadConfig(t *testing.T) {
 	if resp.Data["cf_client_secret"] != nil {
 		t.Fatalf("expected %s but received %s", "nil", resp.Data["cf_client_secret"])
 	}
+	if resp.Data["cf_password_set"] != true || resp.Data["cf_proxy_password_set"] != false || resp.Data["cf_access_token_set"] != false {
+		t.Fatalf("expected only cf_password to be reported as set but received %v, %v and %v", resp.Data["cf_password_set"], resp.Data["cf_proxy_password_set"], resp.Data["cf_access_token_set"])
+	}
+	if hash, _ := resp.Data["cf_password_hash"].(string); !strings.HasPrefix(hash, "hmac-sha256:") || strings.Contains(hash, e.TestConf.CFPassword) {
+		t.Fatalf("expected an HMAC of cf_password but received %q", resp.Data["cf_password_hash"])
+	}
+	if _, ok := resp.Data["cf_proxy_password_hash"]; ok {
+		t.Fatalf("expected no hash of the unset cf_proxy_password but received %q", resp.Data["cf_proxy_password_hash"])
+	}
+	if resp.Data["cf_timeout"] != e.TestConf.CFTimeout/time.Second {
+		t.Fatalf("expected %d but received %v", e.TestConf.CFTimeout/time.Second, resp.Data["cf_timeout"])
+	}
+	if resp.Data["login_signature_hash"] != signatures.HashSHA256 {
+		t.Fatalf("expected %s but received %v", signatures.HashSHA256, resp.Data["login_signature_hash"])
+	}
 }
 
 func (e *Env) UpdateConfig(t *testing.T) {
@@ -510,128 +578,1728 @@ func (e *Env) UpdateRole(t *testing.T) {
 	if err := entry.DecodeJSON(role); err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(e.TestRole.BoundAppIDs, role.BoundAppIDs) {
-		t.Fatalf("expected %s but received %s", e.TestRole.BoundAppIDs, role.BoundAppIDs)
-	}
-	if !reflect.DeepEqual([]string{}, role.BoundSpaceIDs) {
-		t.Fatalf("expected %s but received %s", []string{}, role.BoundSpaceIDs)
+	if !reflect.DeepEqual(e.TestRole.BoundAppIDs, role.BoundAppIDs) {
+		t.Fatalf("expected %s but received %s", e.TestRole.BoundAppIDs, role.BoundAppIDs)
+	}
+	if !reflect.DeepEqual([]string{}, role.BoundSpaceIDs) {
+		t.Fatalf("expected %s but received %s", []string{}, role.BoundSpaceIDs)
+	}
+	if !reflect.DeepEqual([]string{"foo"}, role.BoundOrgIDs) {
+		t.Fatalf("expected %s but received %s", []string{"foo"}, role.BoundOrgIDs)
+	}
+	if !reflect.DeepEqual(e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs) {
+		t.Fatalf("expected %s but received %s", e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs)
+	}
+	if len(role.BoundCIDRs) != 0 {
+		t.Fatalf("expected %s but received %s", []string{}, role.BoundCIDRs)
+	}
+	if !reflect.DeepEqual(e.TestRole.Policies, role.Policies) {
+		t.Fatalf("expected %s but received %s", e.TestRole.Policies, role.Policies)
+	}
+	if e.TestRole.TTL*time.Second != role.TTL {
+		t.Fatalf("expected %s but received %s", e.TestRole.TTL*time.Second, role.TTL)
+	}
+	if time.Duration(180)*time.Second != role.MaxTTL {
+		t.Fatalf("expected %s but received %s", e.TestRole.MaxTTL*time.Second, role.MaxTTL)
+	}
+	if e.TestRole.Period*time.Second != role.Period {
+		t.Fatalf("expected %s but received %s", e.TestRole.Period*time.Second, role.Period)
+	}
+}
+
+func (e *Env) ReadRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Ctx, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("response shouldn't be nil")
+	}
+
+	// Convert token_type since in JSON it needs to be the corresponding uint
+	resp.Data["token_type"] = logical.TokenTypeDefault
+
+	// To reuse the logic above, convert this into a role.
+	b, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role := &models.RoleEntry{}
+	if err := json.Unmarshal(b, role); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.TestRole.BoundAppIDs, role.BoundAppIDs) {
+		t.Fatalf("expected %s but received %s", e.TestRole.BoundAppIDs, role.BoundAppIDs)
+	}
+	if !reflect.DeepEqual([]string{}, role.BoundSpaceIDs) {
+		t.Fatalf("expected %s but received %s", []string{}, role.BoundSpaceIDs)
+	}
+	if !reflect.DeepEqual([]string{"foo"}, role.BoundOrgIDs) {
+		t.Fatalf("expected %s but received %s", []string{"foo"}, role.BoundOrgIDs)
+	}
+	if !reflect.DeepEqual(e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs) {
+		t.Fatalf("expected %s but received %s", e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs)
+	}
+	if len(role.BoundCIDRs) != 0 {
+		t.Fatalf("expected %s but received %s", []string{}, role.BoundCIDRs)
+	}
+	if !reflect.DeepEqual(e.TestRole.Policies, role.Policies) {
+		t.Fatalf("expected %s but received %s", e.TestRole.Policies, role.Policies)
+	}
+	if time.Duration(60) != role.TTL {
+		t.Fatalf("expected %s but received %s", time.Duration(60), role.TTL)
+	}
+	if time.Duration(180) != role.MaxTTL {
+		t.Fatalf("expected %s but received %s", time.Duration(180), role.MaxTTL)
+	}
+	if time.Duration(300) != role.Period {
+		t.Fatalf("expected %s but received %s", time.Duration(300), role.Period)
+	}
+}
+
+func (e *Env) ListRoles(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "roles",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Ctx, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp == nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+	if fmt.Sprintf("%s", resp.Data["keys"]) != "[test-role]" {
+		t.Fatalf("expected %s but received %s", "[test-role]", resp.Data["keys"])
+	}
+}
+
+func (e *Env) ListRolesByBoundIDs(t *testing.T) {
+	for roleName, data := range map[string]map[string]interface{}{
+		"any-app":    {"allow_unconstrained": true},
+		"other-org":  {"bound_organization_ids": "some-other-org"},
+		"same-space": {"bound_space_ids": cf.FoundSpaceGUID + ",some-other-space"},
+	} {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/" + roleName,
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+		}
+		defer func(roleName string) {
+			if _, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+				Operation: logical.DeleteOperation,
+				Path:      "roles/" + roleName,
+				Storage:   e.Storage,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}(roleName)
+	}
+
+	// Roles that bind no IDs of a kind admit any. The test role has been updated to
+	// bind the org "foo" and no spaces.
+	for _, tt := range []struct {
+		data map[string]interface{}
+		want []string
+	}{
+		{data: nil, want: []string{"any-app", "other-org", "same-space", "test-role"}},
+		{data: map[string]interface{}{"bound_space_id": cf.FoundSpaceGUID}, want: []string{"any-app", "other-org", "same-space", "test-role"}},
+		{data: map[string]interface{}{"bound_space_id": "yet-another-space"}, want: []string{"any-app", "other-org", "test-role"}},
+		{data: map[string]interface{}{"bound_organization_id": "foo"}, want: []string{"any-app", "same-space", "test-role"}},
+		{data: map[string]interface{}{"bound_organization_id": "foo", "bound_space_id": "some-other-space"}, want: []string{"any-app", "same-space", "test-role"}},
+		{data: map[string]interface{}{"bound_organization_id": "some-other-org", "bound_application_id": cf.FoundAppGUID}, want: []string{"any-app", "other-org", "same-space"}},
+	} {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "roles",
+			Storage:   e.Storage,
+			Data:      tt.data,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+		}
+		if keys, _ := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, tt.want) {
+			t.Fatalf("%v: expected %v but received %v", tt.data, tt.want, resp.Data["keys"])
+		}
+	}
+}
+
+func (e *Env) CreateUnconstrainedRole(t *testing.T) {
+	write := func(data map[string]interface{}) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/unconstrained-role",
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	defer func() {
+		if _, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/unconstrained-role",
+			Storage:   e.Storage,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	resp := write(map[string]interface{}{"policies": "default"})
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "allow_unconstrained") {
+		t.Fatalf("expected a role without bound constraints to be rejected but received %#v", resp)
+	}
+
+	resp = write(map[string]interface{}{"policies": "default", "allow_unconstrained": true})
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "any app on the foundation") {
+		t.Fatalf("expected the unconstrained role to be written with a warning but received %#v", resp)
+	}
+	// The opt-in is kept, so later updates don't need to repeat it.
+	resp = write(map[string]interface{}{"policies": "default,other"})
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 {
+		t.Fatalf("expected the unconstrained role to be updated with a warning but received %#v", resp)
+	}
+	// There's no warning once the role binds something.
+	if resp := write(map[string]interface{}{"bound_space_names": "some-space"}); resp != nil {
+		t.Fatalf("expected nil response to represent a 204 but received %#v", resp)
+	}
+}
+
+func (e *Env) DeleteRole(t *testing.T) {
+	req := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+	}
+	resp, err := e.Backend.HandleRequest(e.Ctx, req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	if resp != nil {
+		t.Fatal("expected nil response to represent a 204")
+	}
+	val, err := e.Storage.Get(e.Ctx, "roles/test-role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != nil {
+		t.Fatal("role shouldn't still be in storage")
+	}
+}
+
+func (e *Env) LoginRequiredSignatureHash(t *testing.T) {
+	e.updateConfig(t, map[string]interface{}{
+		"login_signature_hash": signatures.HashSHA512,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"login_signature_hash": signatures.HashSHA256,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected a sha256 signature to be rejected but received %#v", resp)
+	}
+	if !strings.Contains(resp.Error().Error(), `requires v2 signatures using the "sha512" hash`) {
+		t.Fatalf("expected the required hash to be advertised but received %q", resp.Error())
+	}
+
+	resp = e.signAndLogin(t, "", nil, func(signer crypto.Signer, data *signatures.SignatureData) (string, error) {
+		return signatures.SignV2WithHash(signer, data, signatures.HashSHA512)
+	})
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected a sha512 signature to log in but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginAudience(t *testing.T) {
+	const vaultAddress = "https://vault.example.com:8200"
+	e.updateConfig(t, map[string]interface{}{
+		"login_audience_vault_address": vaultAddress,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"login_audience_vault_address": "",
+	})
+
+	for name, audience := range map[string]*signatures.Audience{
+		"no audience":       nil,
+		"different cluster": {VaultAddress: "https://other.example.com:8200", MountAccessor: "auth_cf_1234"},
+		"different mount":   {VaultAddress: vaultAddress, MountAccessor: "auth_cf_5678"},
+	} {
+		resp := e.signAndLogin(t, "auth_cf_1234", audience, signatures.Sign)
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("expected a signature with %s to be rejected but received %#v", name, resp)
+		}
+	}
+
+	// Only a signature that verifies without the audience is said not to be bound to it;
+	// one that doesn't verify at all is just invalid.
+	resp := e.signAndLogin(t, "auth_cf_1234", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected an unbound signature to be rejected but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeSignatureAudienceMismatch) {
+		t.Fatalf("expected error code %s for an unbound signature but received %q", errCodeSignatureAudienceMismatch, code)
+	}
+	resp = e.signAndLogin(t, "auth_cf_1234", &signatures.Audience{
+		VaultAddress:  vaultAddress,
+		MountAccessor: "auth_cf_1234",
+	}, func(signer crypto.Signer, data *signatures.SignatureData) (string, error) {
+		tampered := *data
+		tampered.Role = "another-role"
+		return signatures.Sign(signer, &tampered)
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected a bad signature to be rejected but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeInvalidSignature) {
+		t.Fatalf("expected error code %s for a bad signature but received %q", errCodeInvalidSignature, code)
+	}
+
+	resp = e.signAndLogin(t, "auth_cf_1234", &signatures.Audience{
+		VaultAddress:  vaultAddress,
+		MountAccessor: "auth_cf_1234",
+	}, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected a signature bound to the mount to log in but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginRoleSigningTimeWindow(t *testing.T) {
+	signedAt := func(age time.Duration) *logical.Response {
+		return e.signAndLoginAt(t, time.Now().Add(-age), "", nil, signatures.Sign)
+	}
+
+	// The config allows signing times up to 12 seconds old.
+	if resp := signedAt(time.Minute); resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "allowable seconds old is 12") {
+		t.Fatalf("expected a request signed a minute ago to be too old but received %#v", resp)
+	} else if code := parseErrorCode(resp.Error().Error()); code != string(errCodeSigningTimeSkew) {
+		t.Fatalf("expected error code %s but received %q", errCodeSigningTimeSkew, code)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"login_max_seconds_not_before": "1h",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"login_max_seconds_not_before": 0,
+	})
+
+	if resp := signedAt(time.Minute); resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected a request signed a minute ago to log in but received %#v", resp)
+	}
+	if resp := signedAt(2 * time.Hour); resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "allowable seconds old is 3600") {
+		t.Fatalf("expected a request signed two hours ago to be too old but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginWithoutCFAPIChecks(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{
+		"disable_cf_api_checks": true,
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"disable_cf_api_checks": false,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	// The names come from the CF API, so they're missing when it isn't called.
+	if _, ok := resp.Auth.Alias.Metadata["app_name"]; ok {
+		t.Fatalf("expected no app name without CF API checks but received %#v", resp.Auth.Alias.Metadata)
+	}
+	if resp.Auth.Alias.Metadata["app_id"] != cf.FoundAppGUID {
+		t.Fatalf("expected app ID %s but received %s", cf.FoundAppGUID, resp.Auth.Alias.Metadata["app_id"])
+	}
+
+	// The role's constraints still apply.
+	e.updateRole(t, map[string]interface{}{
+		"bound_application_ids": []string{"some-other-app"},
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_application_ids": e.TestRole.BoundAppIDs,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "doesn't match role constraints") {
+		t.Fatalf("expected the role's constraints to apply but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundAppMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundAppMismatch, code)
+	}
+}
+
+func (e *Env) LoginCapTTLAtIdentityExpiry(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{
+		"cap_ttl_at_identity_expiry": true,
+		// Longer than the test instance certificate is valid for.
+		"token_max_ttl": "1000000h",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"cap_ttl_at_identity_expiry": false,
+		"token_max_ttl":              0,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	identityExpiry, ok := getTimeData(resp.Auth.InternalData, "identity_expiry")
+	if !ok {
+		t.Fatalf("expected the identity expiry to be recorded but received %#v", resp.Auth.InternalData)
+	}
+	if untilExpiry := time.Until(identityExpiry); resp.Auth.MaxTTL > untilExpiry+time.Minute || resp.Auth.MaxTTL < untilExpiry-time.Minute {
+		t.Fatalf("expected the max TTL to be capped at the certificate's expiry of %s but received %s", identityExpiry, resp.Auth.MaxTTL)
+	}
+}
+
+func (e *Env) LoginAliasMetadata(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{
+		"alias_metadata":                    "app_id,space_name",
+		"static_alias_metadata":             "platform=cf-prod",
+		"alias_custom_metadata_labels":      "team,unset-label",
+		"alias_custom_metadata_annotations": "cost-center",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"alias_metadata":                    []string{},
+		"static_alias_metadata":             map[string]string{},
+		"alias_custom_metadata_labels":      []string{},
+		"alias_custom_metadata_annotations": []string{},
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	expected := map[string]string{
+		"app_id":     cf.FoundAppGUID,
+		"space_name": cf.FoundSpaceName,
+		"platform":   "cf-prod",
+	}
+	if !reflect.DeepEqual(resp.Auth.Alias.Metadata, expected) {
+		t.Fatalf("expected alias metadata %v but received %v", expected, resp.Auth.Alias.Metadata)
+	}
+	expected = map[string]string{
+		"team":        cf.FoundAppTeamLabel,
+		"cost-center": cf.FoundAppCostCenterAnnotation,
+	}
+	if !reflect.DeepEqual(resp.Auth.Alias.CustomMetadata, expected) {
+		t.Fatalf("expected alias custom metadata %v but received %v", expected, resp.Auth.Alias.CustomMetadata)
+	}
+
+	// Renewals don't rely on the alias metadata to identify the instance.
+	cfCert, err := getCFCertificate(resp.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfCert.OrgID != cf.FoundOrgGUID {
+		t.Fatalf("expected org ID %s but received %s", cf.FoundOrgGUID, cfCert.OrgID)
+	}
+
+	resp, err = e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"static_alias_metadata": "app_id=spoofed",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected static alias metadata overriding a field to be rejected but received %#v, %v", resp, err)
+	}
+}
+
+func (e *Env) LoginAuthMetadata(t *testing.T) {
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	for field, expected := range map[string]string{
+		"org_id":     cf.FoundOrgGUID,
+		"space_id":   cf.FoundSpaceGUID,
+		"app_id":     cf.FoundAppGUID,
+		"space_name": cf.FoundSpaceName,
+	} {
+		if resp.Auth.Metadata[field] != expected {
+			t.Fatalf("expected %s %s in the token's metadata but received %v", field, expected, resp.Auth.Metadata)
+		}
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"auth_metadata":  "app_id,org_name",
+		"alias_metadata": "app_id",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"auth_metadata":  []string{},
+		"alias_metadata": []string{},
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	expected := map[string]string{
+		"app_id":   cf.FoundAppGUID,
+		"org_name": cf.FoundOrgName,
+	}
+	if !reflect.DeepEqual(resp.Auth.Metadata, expected) {
+		t.Fatalf("expected token metadata %v but received %v", expected, resp.Auth.Metadata)
+	}
+	if expected := map[string]string{"app_id": cf.FoundAppGUID}; !reflect.DeepEqual(resp.Auth.Alias.Metadata, expected) {
+		t.Fatalf("expected alias metadata %v but received %v", expected, resp.Auth.Alias.Metadata)
+	}
+
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"auth_metadata": "instance_id",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an unknown auth metadata field to be rejected but received %#v, %v", resp, err)
+	}
+}
+
+func (e *Env) LoginVerifyInstanceIDs(t *testing.T) {
+	e.updateConfig(t, map[string]interface{}{
+		"verify_instance_ids": true,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"verify_instance_ids": false,
+	})
+
+	// The mock CF API reports the certificate's instance as running.
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginBoundCertIPCIDRs(t *testing.T) {
+	// The certificate's IP address is 10.255.181.105.
+	e.updateRole(t, map[string]interface{}{
+		"bound_cert_ip_cidrs": "10.0.0.0/16,fd00::/8",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_cert_ip_cidrs": "",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_BOUND_CERT_IP_MISMATCH]") {
+		t.Fatalf("expected login from outside the bound CIDRs to be rejected but received %#v", resp)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_cert_ip_cidrs": "10.0.0.0/16,10.255.0.0/16",
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"bound_cert_ip_cidrs": "10.255.0.0",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an invalid CIDR to be rejected but received %#v, %v", resp, err)
+	}
+}
+
+func (e *Env) LoginWithoutNameResolution(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{
+		"disable_name_resolution": true,
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"disable_name_resolution": false,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	// The certificate doesn't carry the names, so only the IDs are known.
+	for _, field := range []string{"org_name", "space_name", "app_name"} {
+		if _, ok := resp.Auth.Alias.Metadata[field]; ok {
+			t.Fatalf("expected no %s without name resolution but received %#v", field, resp.Auth.Alias.Metadata)
+		}
+	}
+	if resp.Auth.Alias.Metadata["org_id"] != cf.FoundOrgGUID {
+		t.Fatalf("expected org ID %s but received %s", cf.FoundOrgGUID, resp.Auth.Alias.Metadata["org_id"])
+	}
+}
+
+func (e *Env) LoginInstanceDetails(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{
+		"include_instance_details": true,
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"include_instance_details": false,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	for _, metadata := range []map[string]string{resp.Auth.Metadata, resp.Auth.Alias.Metadata} {
+		if metadata["instance_index"] != cf.FoundInstanceIndex || metadata["process_type"] != cf.FoundProcessType {
+			t.Fatalf("expected instance index %s and process type %s but received %v", cf.FoundInstanceIndex, cf.FoundProcessType, metadata)
+		}
+	}
+}
+
+func (e *Env) LoginBoundProcessTypes(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_process_types": "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_process_types": "worker",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login as another process type to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundProcessTypeMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundProcessTypeMismatch, code)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_process_types": "worker," + cf.FoundProcessType,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"disable_cf_api_checks": true,
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected bound process types without CF API checks to be rejected but received %#v, %v", resp, err)
+	}
+}
+
+func (e *Env) LoginBoundInstanceIndexes(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_instance_indexes": "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_instance_indexes": "0",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login as another instance index to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundIndexMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundIndexMismatch, code)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_instance_indexes": "0," + cf.FoundInstanceIndex,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"bound_instance_indexes": "-1"},
+		{"disable_cf_api_checks": true},
+	} {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/test-role",
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected %v to be rejected but received %#v, %v", data, resp, err)
+		}
+	}
+}
+
+func (e *Env) LoginBoundStacks(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_stacks": "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_stacks": "cflinuxfs3",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from an app on another stack to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundStackMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundStackMismatch, code)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_stacks": cf.FoundAppStack,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginBoundBuildpacks(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_buildpacks": "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_buildpacks": "go_buildpack",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from an app built with another buildpack to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundBuildpackMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundBuildpackMismatch, code)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_buildpacks": "go_buildpack," + cf.FoundAppBuildpack,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginBoundCurrentDroplets(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_current_droplets":   "",
+		"require_current_revision": false,
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_current_droplets": "rolled-back-droplet",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from an app with another current droplet to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundDropletMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundDropletMismatch, code)
+	}
+
+	// The app's only deployed revision is of its current droplet.
+	e.updateRole(t, map[string]interface{}{
+		"bound_current_droplets":   "rolled-back-droplet," + cf.FoundDropletGUID,
+		"require_current_revision": true,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginBoundLifecycleTypes(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_lifecycle_types": "",
+		"bound_docker_images":   "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_lifecycle_types": "docker",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from a buildpack app to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeBoundLifecycleMismatch) {
+		t.Fatalf("expected error code %s but received %q", errCodeBoundLifecycleMismatch, code)
+	}
+
+	// Docker images are only checked for Docker apps.
+	e.updateRole(t, map[string]interface{}{
+		"bound_lifecycle_types": "buildpack,docker",
+		"bound_docker_images":   "registry.example.com/*",
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginRequiredServiceInstance(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"required_service_instance": "",
+	})
+
+	e.updateRole(t, map[string]interface{}{
+		"required_service_instance": "other-service",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from an app without the binding to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeServiceBindingRequired) {
+		t.Fatalf("expected error code %s but received %q", errCodeServiceBindingRequired, code)
+	}
+
+	for _, serviceInstance := range []string{cf.BoundServiceInstanceName, cf.BoundServiceInstanceGUID} {
+		e.updateRole(t, map[string]interface{}{
+			"required_service_instance": serviceInstance,
+		})
+		resp = e.signAndLogin(t, "", nil, signatures.Sign)
+		if resp == nil || resp.IsError() || resp.Auth == nil {
+			t.Fatalf("expected login requiring %q to succeed but received %#v", serviceInstance, resp)
+		}
+	}
+}
+
+func (e *Env) LoginRequireSSHDisabled(t *testing.T) {
+	defer e.updateRole(t, map[string]interface{}{
+		"require_ssh_disabled": false,
+	})
+
+	// The mock CF API reports SSH as enabled for the app.
+	e.updateRole(t, map[string]interface{}{
+		"require_ssh_disabled": true,
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from an app accepting SSH connections to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeSSHEnabled) {
+		t.Fatalf("expected error code %s but received %q", errCodeSSHEnabled, code)
+	}
+
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"disable_cf_api_checks": true,
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected requiring ssh disabled without CF API checks to be rejected but received %#v, %v", resp, err)
+	}
+}
+
+func (e *Env) LoginAllowedSourceCIDRs(t *testing.T) {
+	defer e.updateConfig(t, map[string]interface{}{
+		"allowed_source_cidrs": "",
+	})
+
+	e.updateConfig(t, map[string]interface{}{
+		"allowed_source_cidrs": "192.168.0.0/16",
+	})
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected login from outside the allowed source CIDRs to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeSourceNotAllowed) {
+		t.Fatalf("expected error code %s but received %q", errCodeSourceNotAllowed, code)
+	}
+
+	e.updateConfig(t, map[string]interface{}{
+		"allowed_source_cidrs": "192.168.0.0/16,10.255.0.0/16",
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginEnforceIdentityCertKeyUsage(t *testing.T) {
+	e.updateConfig(t, map[string]interface{}{
+		"enforce_identity_cert_key_usage": true,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"enforce_identity_cert_key_usage": false,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login with a certificate issued for client authentication to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginEnforceFIPSSignatures(t *testing.T) {
+	e.updateConfig(t, map[string]interface{}{
+		"enforce_fips_signatures": true,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"enforce_fips_signatures": false,
+	})
+
+	// v1 signatures with RSA keys use the longest salt that fits, rather than one as
+	// long as the hash.
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_SIGNATURE_NOT_FIPS_APPROVED]") {
+		t.Fatalf("expected login with a v1 signature to be rejected but received %#v", resp)
+	}
+	resp = e.signAndLogin(t, "", nil, signatures.SignV2)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login with a v2 signature to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginChallenge(t *testing.T) {
+	e.updateConfig(t, map[string]interface{}{
+		"require_login_challenge": true,
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"require_login_challenge": false,
+	})
+
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_CHALLENGE_REQUIRED]") {
+		t.Fatalf("expected login without a nonce to be rejected but received %#v", resp)
+	}
+
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login/challenge",
+		Storage:   e.Storage,
+		Connection: &logical.Connection{
+			RemoteAddr: "10.255.181.105",
+		},
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
+	}
+	nonce := resp.Data["nonce"].(string)
+
+	// The signing time isn't checked against the clock when a nonce is signed.
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(signingTime time.Time, nonce, signedNonce string) *logical.Response {
+		signature, err := signatures.Sign(signer, &signatures.SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "test-role",
+			CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+			Nonce:                  signedNonce,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role":             "test-role",
+				"signature":        signature,
+				"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+				"cf_instance_cert": e.TestCerts.InstanceCertificate,
+				"nonce":            nonce,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	signingTime := time.Now().Add(-24 * time.Hour)
+	resp = login(signingTime, nonce, "")
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_INVALID_SIGNATURE]") {
+		t.Fatalf("expected login with a signature leaving out the nonce to be rejected but received %#v", resp)
+	}
+	resp = login(signingTime, nonce, nonce)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login with the nonce to succeed but received %#v", resp)
+	}
+	resp = login(signingTime.Add(time.Second), nonce, nonce)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_CHALLENGE_REUSED]") {
+		t.Fatalf("expected login reusing the nonce to be rejected but received %#v", resp)
+	}
+	resp = login(signingTime, "not-a-nonce", "not-a-nonce")
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "[ERR_INVALID_CHALLENGE]") {
+		t.Fatalf("expected login with a nonce the mount didn't issue to be rejected but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginExpiryWarnings(t *testing.T) {
+	resp := e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 0 {
+		t.Fatalf("expected login to succeed without warnings but received %#v", resp)
+	}
+
+	// The test certificates are valid for 100 years.
+	e.updateConfig(t, map[string]interface{}{
+		"identity_cert_expiry_warning": fmt.Sprintf("%dh", 101*365*24),
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "instance identity certificate") {
+		t.Fatalf("expected a warning about the instance certificate but received %#v", resp)
+	}
+
+	e.updateConfig(t, map[string]interface{}{
+		"identity_cert_expiry_warning": 0,
+		"identity_ca_expiry_warning":   fmt.Sprintf("%dh", 101*365*24),
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"identity_ca_expiry_warning": 0,
+	})
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "identity CA certificate") {
+		t.Fatalf("expected a warning about the identity CA but received %#v", resp.Warnings)
+	}
+}
+
+func (e *Env) LoginTemplatedPolicies(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"token_policies": "cf-{{instance_id}}",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected a policy with an unknown placeholder to be rejected but received %#v, %v", resp, err)
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"token_policies": "cf-{{org_name}}-{{ space_name }},app-{{app_id}},default",
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"token_policies": strings.Join(e.TestRole.Policies, ","),
+	})
+
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	expected := []string{"cf-" + cf.FoundOrgName + "-" + cf.FoundSpaceName, "app-" + cf.FoundAppGUID, "default"}
+	if !reflect.DeepEqual(resp.Auth.Policies, expected) {
+		t.Fatalf("expected policies %v but received %v", expected, resp.Auth.Policies)
+	}
+}
+
+func (e *Env) LoginMappedPolicies(t *testing.T) {
+	mapPolicies := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := mapPolicies(logical.UpdateOperation, "map/apps/"+cf.FoundAppGUID, map[string]interface{}{"policies": "app-policy"}); resp == nil || !resp.IsError() {
+		t.Fatalf("expected mapping an unknown type to fail but received %#v", resp)
+	}
+	mapPolicies(logical.UpdateOperation, "map/orgs/"+cf.FoundOrgGUID, map[string]interface{}{"policies": "org-policy,foo"})
+	mapPolicies(logical.UpdateOperation, "map/spaces/"+cf.FoundSpaceGUID, map[string]interface{}{"policies": "space-policy"})
+	defer mapPolicies(logical.DeleteOperation, "map/orgs/"+cf.FoundOrgGUID, nil)
+	defer mapPolicies(logical.DeleteOperation, "map/spaces/"+cf.FoundSpaceGUID, nil)
+
+	resp := mapPolicies(logical.ReadOperation, "map/spaces/"+cf.FoundSpaceGUID, nil)
+	if resp == nil || !reflect.DeepEqual(resp.Data["policies"], []string{"space-policy"}) {
+		t.Fatalf("expected to read the space's mapping but received %#v", resp)
+	}
+	resp = mapPolicies(logical.ListOperation, "map/orgs/", nil)
+	if resp == nil || !reflect.DeepEqual(resp.Data["keys"], []string{cf.FoundOrgGUID}) {
+		t.Fatalf("expected to list the org's mapping but received %#v", resp)
+	}
+
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	expected := append(append([]string{}, e.TestRole.Policies...), "org-policy", "space-policy")
+	if !reflect.DeepEqual(resp.Auth.Policies, expected) {
+		t.Fatalf("expected policies %v but received %v", expected, resp.Auth.Policies)
+	}
+}
+
+func (e *Env) LoginTTLCaps(t *testing.T) {
+	capTTLs := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, data := range []map[string]interface{}{
+		{},
+		{"ttl": "2h", "max_ttl": "1h"},
+	} {
+		if resp := capTTLs(logical.UpdateOperation, "ttl-caps/orgs/"+cf.FoundOrgGUID, data); resp == nil || !resp.IsError() {
+			t.Fatalf("expected capping TTLs with %v to fail but received %#v", data, resp)
+		}
+	}
+	capTTLs(logical.UpdateOperation, "ttl-caps/orgs/"+cf.FoundOrgGUID, map[string]interface{}{"ttl": "30s", "max_ttl": "1h"})
+	capTTLs(logical.UpdateOperation, "ttl-caps/spaces/"+cf.FoundSpaceGUID, map[string]interface{}{"ttl": "20s"})
+	defer capTTLs(logical.DeleteOperation, "ttl-caps/orgs/"+cf.FoundOrgGUID, nil)
+	defer capTTLs(logical.DeleteOperation, "ttl-caps/spaces/"+cf.FoundSpaceGUID, nil)
+
+	resp := capTTLs(logical.ReadOperation, "ttl-caps/orgs/"+cf.FoundOrgGUID, nil)
+	if resp == nil || resp.Data["ttl"] != int64(30) || resp.Data["max_ttl"] != int64(3600) {
+		t.Fatalf("expected to read the org's caps but received %#v", resp)
+	}
+	resp = capTTLs(logical.ListOperation, "ttl-caps/spaces/", nil)
+	if resp == nil || !reflect.DeepEqual(resp.Data["keys"], []string{cf.FoundSpaceGUID}) {
+		t.Fatalf("expected to list the space's caps but received %#v", resp)
+	}
+
+	// The shorter of the org's and space's caps applies.
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	if resp.Auth.TTL != 20*time.Second || resp.Auth.MaxTTL != time.Hour || resp.Auth.ExplicitMaxTTL != time.Hour {
+		t.Fatalf("expected the token's TTLs to be capped but they were %s, %s, %s", resp.Auth.TTL, resp.Auth.MaxTTL, resp.Auth.ExplicitMaxTTL)
+	}
+}
+
+func (e *Env) LoginSingleActiveToken(t *testing.T) {
+	e.updateRole(t, map[string]interface{}{"single_active_token": true})
+	defer e.updateRole(t, map[string]interface{}{"single_active_token": false})
+
+	renew := func(auth *logical.Auth) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation:  logical.RenewOperation,
+			Path:       "login",
+			Storage:    e.Storage,
+			Auth:       auth,
+			Connection: &logical.Connection{RemoteAddr: "10.255.181.105"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := e.signAndLogin(t, "", nil, signatures.Sign)
+	if first == nil || first.IsError() {
+		t.Fatalf("expected the first login to succeed but received %#v", first)
+	}
+	if resp := renew(first.Auth); resp == nil || resp.IsError() {
+		t.Fatalf("expected the only token to be renewed but received %#v", resp)
+	}
+
+	// Once the instance logs in again, only the new token can be renewed.
+	second := e.signAndLogin(t, "", nil, signatures.Sign)
+	if second == nil || second.IsError() {
+		t.Fatalf("expected the second login to succeed but received %#v", second)
+	}
+	if resp := renew(first.Auth); resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "newer token") {
+		t.Fatalf("expected the first token's renewal to be refused but received %#v", resp)
+	}
+	if resp := renew(second.Auth); resp == nil || resp.IsError() {
+		t.Fatalf("expected the newest token to be renewed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginBase64Certificate(t *testing.T) {
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(e.TestCerts.InstanceCertificate))
+
+	// The encoding is detected unless it's given, and the signature is over the PEM.
+	for _, encoding := range []string{"", "base64", "pem"} {
+		signingTime := time.Now()
+		signature, err := signatures.Sign(signer, &signatures.SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "test-role",
+			CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := map[string]interface{}{
+			"role":             "test-role",
+			"signature":        signature,
+			"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+			"cf_instance_cert": encoded,
+		}
+		if encoding != "" {
+			data["encoding"] = encoding
+		}
+		e.forgetLogins()
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   e.Storage,
+			Data:      data,
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding == "pem" {
+			if !resp.IsError() {
+				t.Fatal("expected base64 encoded contents sent as PEM to be refused")
+			}
+			continue
+		}
+		if resp.IsError() {
+			t.Fatalf("expected a base64 encoded certificate to log in with encoding %q but received %s", encoding, resp.Error())
+		}
+		if resp.Auth.InternalData["cf_instance_cert"] != e.TestCerts.InstanceCertificate {
+			t.Fatal("expected the decoded certificate to be kept for renewals")
+		}
+	}
+}
+
+func (e *Env) LoginIncludeCFMetadata(t *testing.T) {
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, include := range []bool{false, true} {
+		signingTime := time.Now()
+		signature, err := signatures.Sign(signer, &signatures.SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "test-role",
+			CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.forgetLogins()
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role":                "test-role",
+				"signature":           signature,
+				"signing_time":        signingTime.UTC().Format(signatures.TimeFormat),
+				"cf_instance_cert":    e.TestCerts.InstanceCertificate,
+				"include_cf_metadata": include,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsError() {
+			t.Fatal(resp.Error())
+		}
+		if !include {
+			if len(resp.Data) != 0 {
+				t.Fatalf("expected no data unless it's asked for but received %v", resp.Data)
+			}
+			continue
+		}
+		for field, expected := range map[string]string{
+			"org_id":     cf.FoundOrgGUID,
+			"space_id":   cf.FoundSpaceGUID,
+			"app_id":     cf.FoundAppGUID,
+			"org_name":   cf.FoundOrgName,
+			"space_name": cf.FoundSpaceName,
+			"app_name":   cf.FoundAppName,
+		} {
+			if resp.Data[field] != expected {
+				t.Fatalf("expected %s to be %q but received %v", field, expected, resp.Data[field])
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, resp.Data["identity_expiry"].(string)); err != nil {
+			t.Fatalf("expected the identity expiry but received %v: %s", resp.Data["identity_expiry"], err)
+		}
+	}
+}
+
+func (e *Env) LoginDefaultRole(t *testing.T) {
+	login := func() *logical.Response {
+		signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signingTime := time.Now()
+		signature, err := signatures.Sign(signer, &signatures.SignatureData{
+			SigningTime:            signingTime,
+			CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.forgetLogins()
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"signature":        signature,
+				"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+				"cf_instance_cert": e.TestCerts.InstanceCertificate,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login()
+	if resp == nil || !resp.IsError() || parseErrorCode(resp.Error().Error()) != string(errCodeInvalidRequest) {
+		t.Fatalf("expected login without a role to fail but received %#v", resp)
+	}
+
+	e.updateConfig(t, map[string]interface{}{
+		"default_role": "test-role",
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"default_role": "",
+	})
+	resp = login()
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login with the default role to succeed but received %#v", resp)
+	}
+	if resp.Auth.InternalData["role"] != "test-role" {
+		t.Fatalf("expected the default role to be used but received %v", resp.Auth.InternalData["role"])
+	}
+}
+
+func (e *Env) LoginDenied(t *testing.T) {
+	login := func() *logical.Response {
+		signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signingTime := time.Now()
+		signature, err := signatures.Sign(signer, &signatures.SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "test-role",
+			CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.forgetLogins()
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role":             "test-role",
+				"signature":        signature,
+				"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+				"cf_instance_cert": e.TestCerts.InstanceCertificate,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	defer e.updateConfig(t, map[string]interface{}{
+		"denied_organization_ids": "",
+		"denied_space_ids":        "",
+	})
+	for _, denied := range []map[string]interface{}{
+		{"denied_organization_ids": cf.FoundOrgGUID},
+		{"denied_organization_ids": "", "denied_space_ids": "some-other-space," + cf.FoundSpaceGUID},
+	} {
+		e.updateConfig(t, denied)
+		resp := login()
+		if resp == nil || !resp.IsError() || parseErrorCode(resp.Error().Error()) != string(errCodeDenied) {
+			t.Fatalf("expected login with %v to be denied but received %#v", denied, resp)
+		}
+	}
+
+	// Other orgs and spaces aren't denied.
+	e.updateConfig(t, map[string]interface{}{
+		"denied_organization_ids": "some-other-org",
+		"denied_space_ids":        "some-other-space",
+	})
+	if resp := login(); resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+}
+
+func (e *Env) LoginRevoked(t *testing.T) {
+	revoke := func(operation logical.Operation, path string) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   e.Storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := revoke(logical.UpdateOperation, "revoke/instance/"+cf.FoundServiceGUID); resp == nil || !resp.IsError() {
+		t.Fatalf("expected revoking an unknown type to fail but received %#v", resp)
+	}
+
+	resp := revoke(logical.UpdateOperation, "revoke/space/"+cf.FoundSpaceGUID)
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 {
+		t.Fatalf("expected the revocation to succeed with a warning but received %#v", resp)
+	}
+	resp = revoke(logical.ReadOperation, "revoke/space/"+cf.FoundSpaceGUID)
+	if resp == nil || resp.Data["revoked_at"] == nil {
+		t.Fatalf("expected to read the revocation but received %#v", resp)
+	}
+
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "were revoked") {
+		t.Fatalf("expected login to a revoked space to fail but received %#v", resp)
+	}
+	if code := parseErrorCode(resp.Error().Error()); code != string(errCodeRevoked) {
+		t.Fatalf("expected error code %s but received %q", errCodeRevoked, code)
+	}
+
+	revoke(logical.DeleteOperation, "revoke/space/"+cf.FoundSpaceGUID)
+	if resp := revoke(logical.ReadOperation, "revoke/space/"+cf.FoundSpaceGUID); resp != nil {
+		t.Fatalf("expected the revocation to be deleted but received %#v", resp)
+	}
+	resp = e.signAndLogin(t, "", nil, signatures.Sign)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected login to succeed once the revocation is deleted but received %#v", resp)
+	}
+}
+
+func (e *Env) ReadLoginActivity(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "login-activity",
+		Storage:   e.Storage,
+		Data: map[string]interface{}{
+			"app_id": cf.FoundAppGUID,
+		},
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("expected to read the login activity but received %#v, %v", resp, err)
+	}
+	attempts := resp.Data["attempts"].([]map[string]interface{})
+	var succeeded, failed bool
+	for _, attempt := range attempts {
+		if attempt["app_id"] != cf.FoundAppGUID {
+			t.Fatalf("expected only attempts by %s but received %#v", cf.FoundAppGUID, attempt)
+		}
+		if attempt["success"] == true {
+			succeeded = true
+		} else if attempt["reason"] != "" {
+			failed = true
+		}
+	}
+	// The earlier subtests made both successful and failed logins.
+	if !succeeded || !failed {
+		t.Fatalf("expected successful and failed attempts but received %#v", attempts)
+	}
+}
+
+func (e *Env) SimulateLogin(t *testing.T) {
+	simulate := func(cfInstanceCert, remoteAddr string) map[string]interface{} {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "simulate-login",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role":             "test-role",
+				"cf_instance_cert": cfInstanceCert,
+				"remote_address":   remoteAddr,
+			},
+		})
+		if err != nil || resp == nil || resp.IsError() || resp.Auth != nil {
+			t.Fatalf("expected a report without a token but received %#v, %v", resp, err)
+		}
+		return resp.Data
+	}
+	checkResults := func(report map[string]interface{}) map[string]string {
+		results := make(map[string]string)
+		for _, check := range report["checks"].([]map[string]interface{}) {
+			results[check["name"].(string)] = check["result"].(string)
+		}
+		return results
+	}
+
+	report := simulate(e.TestCerts.InstanceCertificate, "10.255.181.105")
+	if report["would_succeed"] != true {
+		t.Fatalf("expected the login to succeed but received %#v", report)
+	}
+	for name, result := range checkResults(report) {
+		if result != checkPassed {
+			t.Fatalf("expected the %s check to pass but it %s: %#v", name, result, report)
+		}
+	}
+
+	e.updateRole(t, map[string]interface{}{
+		"bound_application_ids": []string{"some-other-app"},
+	})
+	defer e.updateRole(t, map[string]interface{}{
+		"bound_application_ids": e.TestRole.BoundAppIDs,
+	})
+	report = simulate(e.TestCerts.InstanceCertificate, "10.0.0.1")
+	results := checkResults(report)
+	if report["would_succeed"] != false || results["bound_application_ids"] != checkFailed || results["ip_address"] != checkFailed {
+		t.Fatalf("expected the app ID and IP address checks to fail but received %#v", report)
+	}
+	if results["cf_api"] != checkPassed {
+		t.Fatalf("expected the remaining checks to still run but received %#v", report)
+	}
+
+	report = simulate("not a certificate", "")
+	if results := checkResults(report); results["certificate_chain"] != checkFailed || results["instance_identity"] != checkSkipped {
+		t.Fatalf("expected the certificate checks to fail but received %#v", report)
+	}
+}
+
+func (e *Env) VerifySignature(t *testing.T) {
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingTime := time.Now()
+	signatureData := &signatures.SignatureData{
+		SigningTime:            signingTime,
+		Role:                   "test-role",
+		CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+	}
+	signature, err := signatures.SignV2(signer, signatureData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.forgetLogins()
+	verify := func(path, role string) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role":             role,
+				"signature":        signature,
+				"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+				"cf_instance_cert": e.TestCerts.InstanceCertificate,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("expected a response but received %#v, %v", resp, err)
+		}
+		return resp
 	}
-	if !reflect.DeepEqual([]string{"foo"}, role.BoundOrgIDs) {
-		t.Fatalf("expected %s but received %s", []string{"foo"}, role.BoundOrgIDs)
+
+	resp := verify("verify-signature", "test-role")
+	if resp.IsError() || resp.Auth != nil || resp.Data["verified"] != true {
+		t.Fatalf("expected the signature to verify without a token but received %#v", resp)
 	}
-	if !reflect.DeepEqual(e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs) {
-		t.Fatalf("expected %s but received %s", e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs)
+	if resp.Data["signed_payload"] != signatureData.Payload() || resp.Data["signature_version"] != "v2" || resp.Data["signature_hash"] != signatures.HashSHA256 {
+		t.Fatalf("expected the signed payload and signature format but received %#v", resp.Data)
 	}
-	if len(role.BoundCIDRs) != 0 {
-		t.Fatalf("expected %s but received %s", []string{}, role.BoundCIDRs)
+	digest, err := signatureData.Digest(signatures.HashSHA256)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(e.TestRole.Policies, role.Policies) {
-		t.Fatalf("expected %s but received %s", e.TestRole.Policies, role.Policies)
+	if resp.Data["signed_digest"] != hex.EncodeToString(digest) {
+		t.Fatalf("expected the signed digest but received %#v", resp.Data["signed_digest"])
 	}
-	if e.TestRole.TTL*time.Second != role.TTL {
-		t.Fatalf("expected %s but received %s", e.TestRole.TTL*time.Second, role.TTL)
+	if signingCert := resp.Data["signing_certificate"].(map[string]interface{}); signingCert["is_identity"] != true {
+		t.Fatalf("expected the identity certificate to have signed but received %#v", signingCert)
 	}
-	if time.Duration(180)*time.Second != role.MaxTTL {
-		t.Fatalf("expected %s but received %s", e.TestRole.MaxTTL*time.Second, role.MaxTTL)
+
+	// Signatures of other payloads don't verify.
+	resp = verify("verify-signature", "other-role")
+	if resp.IsError() || resp.Data["verified"] != false {
+		t.Fatalf("expected the signature not to verify but received %#v", resp)
 	}
-	if e.TestRole.Period*time.Second != role.Period {
-		t.Fatalf("expected %s but received %s", e.TestRole.Period*time.Second, role.Period)
+
+	// The signature isn't remembered, so it can still log in.
+	if resp = verify("login", "test-role"); resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected the verified signature to log in but received %#v", resp)
 	}
 }
 
-func (e *Env) ReadRole(t *testing.T) {
-	req := &logical.Request{
+func (e *Env) CheckConfig(t *testing.T) {
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
 		Operation: logical.ReadOperation,
-		Path:      "roles/test-role",
+		Path:      "config/check",
 		Storage:   e.Storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("expected to check the config but received %#v, %v", resp, err)
 	}
-	resp, err := e.Backend.HandleRequest(e.Ctx, req)
-	if err != nil || (resp != nil && resp.IsError()) {
-		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
-	}
-	if resp == nil {
-		t.Fatal("response shouldn't be nil")
-	}
-
-	// Convert token_type since in JSON it needs to be the corresponding uint
-	resp.Data["token_type"] = logical.TokenTypeDefault
-
-	// To reuse the logic above, convert this into a role.
-	b, err := json.Marshal(resp.Data)
-	if err != nil {
-		t.Fatal(err)
-	}
-	role := &models.RoleEntry{}
-	if err := json.Unmarshal(b, role); err != nil {
-		t.Fatal(err)
-	}
-	if !reflect.DeepEqual(e.TestRole.BoundAppIDs, role.BoundAppIDs) {
-		t.Fatalf("expected %s but received %s", e.TestRole.BoundAppIDs, role.BoundAppIDs)
+	results := make(map[string]string)
+	for _, check := range resp.Data["checks"].([]map[string]interface{}) {
+		results[check["name"].(string)] = check["result"].(string)
 	}
-	if !reflect.DeepEqual([]string{}, role.BoundSpaceIDs) {
-		t.Fatalf("expected %s but received %s", []string{}, role.BoundSpaceIDs)
+	for _, name := range []string{"identity_ca_certificates[0]", "cf_api", "uaa_credentials"} {
+		if results[name] != checkPassed {
+			t.Fatalf("expected the %s check to pass but received %#v", name, resp.Data)
+		}
 	}
-	if !reflect.DeepEqual([]string{"foo"}, role.BoundOrgIDs) {
-		t.Fatalf("expected %s but received %s", []string{"foo"}, role.BoundOrgIDs)
+	// The second identity CA is a real one from testdata that has since expired.
+	if results["identity_ca_certificates[1]"] != checkFailed || resp.Data["healthy"] != false {
+		t.Fatalf("expected the expired CA to make the config unhealthy but received %#v", resp.Data)
 	}
-	if !reflect.DeepEqual(e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs) {
-		t.Fatalf("expected %s but received %s", e.TestRole.BoundInstanceIDs, role.BoundInstanceIDs)
+}
+
+func (e *Env) UpdateConfigVerifyConnection(t *testing.T) {
+	writeAddr := func(addr string, verify bool) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"cf_api_addr":       addr,
+				"verify_connection": verify,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
 	}
-	if len(role.BoundCIDRs) != 0 {
-		t.Fatalf("expected %s but received %s", []string{}, role.BoundCIDRs)
+	cfAPIAddr := func() string {
+		config, err := getConfig(e.Ctx, e.Storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.CFAPIAddr
 	}
-	if !reflect.DeepEqual(e.TestRole.Policies, role.Policies) {
-		t.Fatalf("expected %s but received %s", e.TestRole.Policies, role.Policies)
+	originalAddr := cfAPIAddr()
+	defer e.updateConfig(t, map[string]interface{}{
+		"cf_api_addr": originalAddr,
+	})
+
+	// Nothing is listening on port 1.
+	resp := writeAddr("http://127.0.0.1:1", true)
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "wasn't saved") {
+		t.Fatalf("expected the unreachable address to be rejected but received %#v", resp)
 	}
-	if time.Duration(60) != role.TTL {
-		t.Fatalf("expected %s but received %s", time.Duration(60), role.TTL)
+	if addr := cfAPIAddr(); addr != originalAddr {
+		t.Fatalf("expected the address to remain %s but received %s", originalAddr, addr)
 	}
-	if time.Duration(180) != role.MaxTTL {
-		t.Fatalf("expected %s but received %s", time.Duration(180), role.MaxTTL)
+
+	resp = writeAddr("http://127.0.0.1:1", false)
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 {
+		t.Fatalf("expected the address to be saved with a warning but received %#v", resp)
 	}
-	if time.Duration(300) != role.Period {
-		t.Fatalf("expected %s but received %s", time.Duration(300), role.Period)
+	if addr := cfAPIAddr(); addr != "http://127.0.0.1:1" {
+		t.Fatalf("expected the address to be saved but received %s", addr)
 	}
 }
 
-func (e *Env) ListRoles(t *testing.T) {
-	req := &logical.Request{
-		Operation: logical.ListOperation,
-		Path:      "roles",
+func (e *Env) updateRole(t *testing.T, data map[string]interface{}) {
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/test-role",
 		Storage:   e.Storage,
-	}
-	resp, err := e.Backend.HandleRequest(e.Ctx, req)
+		Data:      data,
+	})
 	if err != nil || (resp != nil && resp.IsError()) {
 		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
 	}
-	if resp == nil {
-		t.Fatal("expected nil response to represent a 204")
-	}
-	if fmt.Sprintf("%s", resp.Data["keys"]) != "[test-role]" {
-		t.Fatalf("expected %s but received %s", "[test-role]", resp.Data["keys"])
-	}
 }
 
-func (e *Env) DeleteRole(t *testing.T) {
-	req := &logical.Request{
-		Operation: logical.DeleteOperation,
-		Path:      "roles/test-role",
+func (e *Env) updateConfig(t *testing.T, data map[string]interface{}) {
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
 		Storage:   e.Storage,
-	}
-	resp, err := e.Backend.HandleRequest(e.Ctx, req)
+		Data:      data,
+	})
 	if err != nil || (resp != nil && resp.IsError()) {
 		t.Fatalf("bad: resp: %#v\nerr:%v", resp, err)
 	}
-	if resp != nil {
-		t.Fatal("expected nil response to represent a 204")
+}
+
+// forgetLogins drops the login requests the backend remembers to refuse replays. The
+// subtests sign requests for the same role and certificate, often within the same
+// second, which would otherwise be refused as replays of each other.
+func (e *Env) forgetLogins() {
+	seen := e.Backend.(*backend).seenSignatures
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	seen.expirations = make(map[[sha256.Size]byte]time.Time)
+}
+
+// signAndLogin logs in to the mount with the given accessor using a fresh signature.
+func (e *Env) signAndLogin(t *testing.T, mountAccessor string, audience *signatures.Audience, sign func(crypto.Signer, *signatures.SignatureData) (string, error)) *logical.Response {
+	return e.signAndLoginAt(t, time.Now(), mountAccessor, audience, sign)
+}
+
+// signAndLoginAt is like signAndLogin, but signs the request at the given time.
+func (e *Env) signAndLoginAt(t *testing.T, signingTime time.Time, mountAccessor string, audience *signatures.Audience, sign func(crypto.Signer, *signatures.SignatureData) (string, error)) *logical.Response {
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
 	}
-	val, err := e.Storage.Get(e.Ctx, "roles/test-role")
+	signature, err := sign(signer, &signatures.SignatureData{
+		SigningTime:            signingTime,
+		Role:                   "test-role",
+		CFInstanceCertContents: e.TestCerts.InstanceCertificate,
+		Audience:               audience,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if val != nil {
-		t.Fatal("role shouldn't still be in storage")
+	e.forgetLogins()
+	resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+		Operation:     logical.UpdateOperation,
+		Path:          "login",
+		Storage:       e.Storage,
+		MountAccessor: mountAccessor,
+		Data: map[string]interface{}{
+			"role":             "test-role",
+			"signature":        signature,
+			"signing_time":     signingTime.UTC().Format(signatures.TimeFormat),
+			"cf_instance_cert": e.TestCerts.InstanceCertificate,
+		},
+		Connection: &logical.Connection{
+			RemoteAddr: "10.255.181.105",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	return resp
 }
 
 func (e *Env) Login(t *testing.T) {
@@ -641,7 +2309,11 @@ func (e *Env) Login(t *testing.T) {
 		Role:                   "test-role",
 		CFInstanceCertContents: e.TestCerts.InstanceCertificate,
 	}
-	signature, err := signatures.Sign(e.TestCerts.PathToInstanceKey, signatureData)
+	signer, err := signatures.LoadPrivateKey(e.TestCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signatures.Sign(signer, signatureData)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -709,6 +2381,18 @@ func (e *Env) Login(t *testing.T) {
 	if resp.Auth.LeaseOptions.MaxTTL != time.Minute*2 {
 		t.Fatalf("expected 2 minutes but received %s", resp.Auth.LeaseOptions.MaxTTL)
 	}
+
+	// Replaying the same login request should fail.
+	resp, err = e.Backend.HandleRequest(e.Ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected replayed login to fail but received %#v", resp)
+	}
+	if !strings.Contains(resp.Error().Error(), "already been used") {
+		t.Fatalf("expected a replay error but received %q", resp.Error())
+	}
 }
 
 // In testing, we found that some string arrays get their trailing \n stripped when
@@ -734,7 +2418,7 @@ func Test_backend_updateCFClient(t *testing.T) {
 	t.Parallel()
 
 	defaultConfig := newConfig(t)
-	defaultConfigHash, err := defaultConfig.Hash()
+	defaultConfigHash, err := defaultConfig.ClientHash()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -801,7 +2485,7 @@ func Test_backend_updateCFClient(t *testing.T) {
 				})
 
 				tt.config.CFAPIAddr = s.URL
-				expectConfigHash, err = tt.config.Hash()
+				expectConfigHash, err = tt.config.ClientHash()
 				if err != nil {
 					require.FailNow(t, err.Error())
 				}
@@ -856,11 +2540,10 @@ func Test_backend_newCFClient(t *testing.T) {
 				CFPassword: "password",
 			},
 			wantErr: func(t assert.TestingT, err error, msgAndArgs ...any) bool {
-				// expect the error returned by the call to cfclient.NewClient(), which gets the
-				// /v2/info on initialization. We will need to adapt/drop this test when we
-				// upgrade to v3 of the client.
+				// expect the error returned by the call to cfconfig.New(), which gets the
+				// API root on initialization to discover the UAA endpoints.
 				return assert.ErrorContains(t, err,
-					"Could not get api /v2/info: Get", msgAndArgs...)
+					"error while discovering token service URL", msgAndArgs...)
 			},
 		},
 		{
@@ -927,17 +2610,283 @@ func Test_backend_newCFClient(t *testing.T) {
 	}
 }
 
-func Test_backend_getCFClient(t *testing.T) {
+func Test_backend_newCFClient_retries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tests := []struct {
+		name         string
+		maxRetries   int
+		wantRequests int
+		wantErr      assert.ErrorAssertionFunc
+	}{
+		{
+			name:         "retries-disabled",
+			wantRequests: 1,
+			wantErr:      assert.Error,
+		},
+		{
+			// The API root is requested again, and then a UAA token.
+			name:         "retries-enabled",
+			maxRetries:   2,
+			wantRequests: 3,
+			wantErr:      assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first request for the API root fails as though the CF API had a blip.
+			faults := &cf.Faults{}
+			faults.Add(cf.Fault{Status: http.StatusServiceUnavailable, Count: 1})
+			s := cf.MockServerWithFaults(false, nil, faults)
+			t.Cleanup(s.Close)
+
+			config := newConfig(t)
+			config.CFAPIAddr = s.URL
+			config.CFMaxRetries = tt.maxRetries
+			config.CFRetryWaitMin = time.Millisecond
+			config.CFRetryWaitMax = time.Millisecond
+
+			b := &backend{}
+			_, err := b.newCFClient(ctx, config)
+			tt.wantErr(t, err, fmt.Sprintf("newCFClient(%v, %v)", ctx, config))
+			assert.Equal(t, tt.wantRequests, faults.Requests())
+		})
+	}
+}
+
+func Test_backend_newCFClient_proxy(t *testing.T) {
 	t.Parallel()
 
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	var proxied int32
+	var proxyAuthorization atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		proxyAuthorization.Store(r.Header.Get("Proxy-Authorization"))
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	config := newConfig(t)
+	// The API address isn't resolvable, so the client can only reach it through the proxy.
+	config.CFAPIAddr = "http://api.cf.invalid"
+	config.CFProxyURL = proxy.URL
+	config.CFProxyUsername = "proxy-user"
+	config.CFProxyPassword = "proxy-password"
+
+	b := &backend{}
 	ctx := context.Background()
+	_, err := b.newCFClient(ctx, config)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+	assert.Equal(t, "Basic cHJveHktdXNlcjpwcm94eS1wYXNzd29yZA==", proxyAuthorization.Load())
+
+	config.CFNoProxy = []string{"api.cf.invalid"}
+	_, err = b.newCFClient(ctx, config)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+}
+
+func Test_backend_newCFClient_token(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	// The mock server names itself as UAA, so only the calls to the CF API are made
+	// through the recorder.
+	var mu sync.Mutex
+	var authorizations []string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3/apps") {
+			mu.Lock()
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			mu.Unlock()
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+
+	accessToken := func(expiry time.Time) string {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expiry.Unix())))
+		return "eyJhbGciOiJub25lIn0." + payload + ".c2lnbmF0dXJl"
+	}
+	getApp := func(config *models.Configuration) error {
+		b := &backend{}
+		ctx := context.Background()
+		client, err := b.newCFClient(ctx, config)
+		require.NoError(t, err)
+		_, err = client.Applications.Get(ctx, cf.FoundAppGUID)
+		return err
+	}
+
+	// A token that hasn't expired is used as is.
+	liveToken := accessToken(time.Now().Add(time.Hour))
+	config := &models.Configuration{
+		CFAPIAddr:     recorder.URL,
+		CFAccessToken: liveToken,
+	}
+	require.NoError(t, getApp(config))
+	assert.Equal(t, []string{"Bearer " + liveToken}, authorizations)
+
+	// An expired one is refreshed with the refresh token, for the one UAA issues.
+	expiredToken := accessToken(time.Now().Add(-time.Hour))
+	config.CFAccessToken = expiredToken
+	config.CFRefreshToken = "refresh-token"
+	require.NoError(t, getApp(config))
+	require.Len(t, authorizations, 2)
+	assert.True(t, strings.HasPrefix(authorizations[1], "Bearer "), authorizations[1])
+	assert.NotEqual(t, "Bearer "+expiredToken, authorizations[1])
+
+	// And without one, calls fail.
+	config.CFRefreshToken = ""
+	assert.Error(t, getApp(config))
+}
 
-	defaultClient := &cfclient.Client{
-		Config: cfclient.Config{
-			ApiAddress: "https://api.example.com",
+func Test_backend_newCFClient_tls(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	// httptest's certificate is for example.com and the loopback addresses.
+	tlsServer := httptest.NewUnstartedServer(s.Config.Handler)
+	tlsServer.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+	serverCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw}))
+
+	tests := []struct {
+		name    string
+		setup   func(config *models.Configuration)
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			name:    "untrusted",
+			setup:   func(config *models.Configuration) {},
+			wantErr: assert.Error,
+		},
+		{
+			name: "trusted",
+			setup: func(config *models.Configuration) {
+				config.CFAPICertificates = []string{serverCert}
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "skip-verify",
+			setup: func(config *models.Configuration) {
+				config.CFAPITLSSkipVerify = true
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "skip-verify-with-retries",
+			setup: func(config *models.Configuration) {
+				config.CFAPITLSSkipVerify = true
+				config.CFMaxRetries = 1
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "server-name",
+			setup: func(config *models.Configuration) {
+				config.CFAPICertificates = []string{serverCert}
+				config.CFAPITLSServerName = "example.com"
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "server-name-mismatch",
+			setup: func(config *models.Configuration) {
+				config.CFAPICertificates = []string{serverCert}
+				config.CFAPITLSServerName = "api.cf.invalid"
+			},
+			wantErr: assert.Error,
 		},
-		Endpoint: cfclient.Endpoint{},
+		{
+			name: "min-version-unsupported",
+			setup: func(config *models.Configuration) {
+				config.CFAPICertificates = []string{serverCert}
+				config.CFAPITLSMinVersion = "tls13"
+			},
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConfig(t)
+			config.CFAPIAddr = tlsServer.URL
+			tt.setup(config)
+
+			b := &backend{}
+			ctx := context.Background()
+			_, err := b.newCFClient(ctx, config)
+			tt.wantErr(t, err, fmt.Sprintf("newCFClient(%v, %v)", ctx, config))
+		})
 	}
+}
+
+func Test_backend_newCFClient_headers(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	var mu sync.Mutex
+	var userAgents, requestIDs []string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		requestIDs = append(requestIDs, r.Header.Get(vaultRequestIDHeader))
+		mu.Unlock()
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+
+	config := newConfig(t)
+	config.CFAPIAddr = recorder.URL
+	b := &backend{}
+	client, err := b.newCFClient(context.Background(), config)
+	require.NoError(t, err)
+
+	// Calls made for a Vault request name its mount and carry its ID.
+	ctx := withRequestInfo(context.Background(), &logical.Request{ID: "vault-request-id", MountPoint: "auth/cf/"})
+	_, err = client.Applications.Get(ctx, cf.FoundAppGUID)
+	require.NoError(t, err)
+
+	last := func() (string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return userAgents[len(userAgents)-1], requestIDs[len(requestIDs)-1]
+	}
+	mu.Lock()
+	assert.Equal(t, defaultUserAgent(""), userAgents[0])
+	assert.Equal(t, "", requestIDs[0])
+	mu.Unlock()
+	userAgent, requestID := last()
+	assert.Equal(t, defaultUserAgent("auth/cf/"), userAgent)
+	assert.Contains(t, userAgent, "(auth/cf)")
+	assert.Equal(t, "vault-request-id", requestID)
+
+	config.CFAPIUserAgent = "custom-agent"
+	client, err = b.newCFClient(context.Background(), config)
+	require.NoError(t, err)
+	_, err = client.Applications.Get(ctx, cf.FoundAppGUID)
+	require.NoError(t, err)
+	userAgent, _ = last()
+	assert.Equal(t, "custom-agent", userAgent)
+}
+
+func Test_backend_getCFClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	defaultClient := &cfclient.Client{}
 	tests := []struct {
 		name     string
 		cfClient *cfclient.Client
@@ -1028,7 +2977,7 @@ func Test_backend_getCFClientOrRefresh(t *testing.T) {
 				})
 
 				tt.config.CFAPIAddr = s.URL
-				expectConfigHash, err = tt.config.Hash()
+				expectConfigHash, err = tt.config.ClientHash()
 				if err != nil {
 					require.FailNow(t, err.Error())
 				}
@@ -1060,6 +3009,100 @@ func Test_backend_getCFClientOrRefresh(t *testing.T) {
 	}
 }
 
+func Test_backend_getCFClientOrRefresh_tainted(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	var rootRequests int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			atomic.AddInt32(&rootRequests, 1)
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(counting.Close)
+
+	config := newConfig(t)
+	config.CFAPIAddr = counting.URL
+	configHash, err := config.ClientHash()
+	require.NoError(t, err)
+
+	tainted := &cfclient.Client{}
+	b := &backend{
+		cfClient:        tainted,
+		cfClientTainted: true,
+		lastConfigHash:  &configHash,
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	clients := make([]*cfclient.Client, 10)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := b.getCFClientOrRefresh(ctx, config)
+			assert.NoError(t, err)
+			clients[i] = c
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&rootRequests))
+	assert.False(t, b.isCFClientTainted())
+	for _, c := range clients {
+		assert.NotSame(t, tainted, c)
+		assert.Same(t, b.cfClient, c)
+	}
+}
+
+func Test_backend_flushCaches(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	ctx := context.Background()
+	config := newConfig(t)
+	config.CFAPIAddr = s.URL
+	config.NameCacheTTL = time.Hour
+	config.ValidationCacheTTL = time.Hour
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	_, err = b.updateCFClient(ctx, config)
+	require.NoError(t, err)
+	flushed := b.cfClient
+	b.getNameCache().add(cf.FoundAppGUID, &cfResources{})
+	b.getValidationCache().add(cf.FoundAppGUID, &cfResources{})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "flush-cache",
+		Storage:   &logical.InmemStorage{},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+	_, ok := b.getNameCache().get(cf.FoundAppGUID)
+	assert.False(t, ok)
+	_, ok = b.getValidationCache().get(cf.FoundAppGUID)
+	assert.False(t, ok)
+
+	// The client is rebuilt when it's next needed.
+	assert.True(t, b.isCFClientTainted())
+	client, err := b.getCFClientOrRefresh(ctx, config)
+	require.NoError(t, err)
+	assert.NotSame(t, flushed, client)
+	assert.False(t, b.isCFClientTainted())
+}
+
 func Test_backend_initialize(t *testing.T) {
 	t.Parallel()
 
@@ -1129,7 +3172,7 @@ func Test_backend_initialize(t *testing.T) {
 				})
 
 				tt.config.CFAPIAddr = s.URL
-				expectConfigHash, err = tt.config.Hash()
+				expectConfigHash, err = tt.config.ClientHash()
 				if err != nil {
 					require.FailNow(t, err.Error())
 				}
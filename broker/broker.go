@@ -0,0 +1,383 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package broker is an Open Service Broker that keeps the CF auth method's roles in
+// step with the platform. Binding an instance of its "vault" service to an app writes
+// a role bound to the app, its space and its org, with the policies of the instance's
+// plan, and unbinding it deletes the role.
+//
+//	b, err := broker.NewBroker(vaultClient, []broker.Plan{{
+//		ID:            "5c2a4a5e-1f4b-4f0e-9a43-1c1f0b8f9e2d",
+//		Name:          "default",
+//		TokenPolicies: []string{"apps"},
+//	}}, broker.WithCredentials(username, password))
+//	if err != nil {
+//		return err
+//	}
+//	http.ListenAndServe(":8080", b)
+//
+// The broker writes roles through the mount's roles API, so its Vault token needs a
+// policy allowing it to read, write and delete auth/<mount>/roles/<prefix>*. It keeps
+// no state of its own, since each binding's role is named after the binding.
+package broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultServiceID and DefaultServiceName are the catalog's service, unless
+	// WithService names another.
+	DefaultServiceID   = "0a3b6f73-8d5c-4a8e-b4a0-5f0e7d7c2b1e"
+	DefaultServiceName = "vault"
+
+	// HeaderAPIVersion is the header the platform sends the version of the Open Service
+	// Broker API it speaks in.
+	HeaderAPIVersion = "X-Broker-API-Version"
+
+	defaultMountPath  = "cf"
+	defaultRolePrefix = "binding-"
+)
+
+// Plan is a plan of the catalog's service. Apps bound to its instances get roles with
+// its policies and token TTLs.
+type Plan struct {
+	ID          string
+	Name        string
+	Description string
+
+	// TokenPolicies are the policies of the roles written for the plan's bindings.
+	TokenPolicies []string
+
+	// TokenTTL and TokenMaxTTL are the roles' token TTLs. If zero, the mount's are used.
+	TokenTTL    time.Duration
+	TokenMaxTTL time.Duration
+}
+
+// Broker serves the Open Service Broker API, writing a role for each binding.
+type Broker struct {
+	vault       *api.Client
+	plans       []Plan
+	mountPath   string
+	rolePrefix  string
+	serviceID   string
+	serviceName string
+	username    string
+	password    string
+}
+
+var _ http.Handler = (*Broker)(nil)
+
+// Option configures a Broker.
+type Option func(b *Broker) error
+
+// NewBroker returns a Broker that offers the plans and writes roles with the Vault
+// client, which must have a token allowed to manage them.
+func NewBroker(vaultClient *api.Client, plans []Plan, opts ...Option) (*Broker, error) {
+	if vaultClient == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+	if len(plans) == 0 {
+		return nil, errors.New("at least one plan is required")
+	}
+	seen := make(map[string]bool)
+	for _, plan := range plans {
+		if plan.ID == "" || plan.Name == "" {
+			return nil, errors.New("plans must have an ID and a name")
+		}
+		if seen[plan.ID] {
+			return nil, fmt.Errorf("plan ID %q is used more than once", plan.ID)
+		}
+		seen[plan.ID] = true
+	}
+	b := &Broker{
+		vault:       vaultClient,
+		plans:       plans,
+		mountPath:   defaultMountPath,
+		rolePrefix:  defaultRolePrefix,
+		serviceID:   DefaultServiceID,
+		serviceName: DefaultServiceName,
+	}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// WithMountPath sets the path the CF auth method is mounted at, "cf" by default.
+func WithMountPath(mountPath string) Option {
+	return func(b *Broker) error {
+		b.mountPath = strings.Trim(mountPath, "/")
+		return nil
+	}
+}
+
+// WithRolePrefix sets what the names of the roles written for bindings start with,
+// "binding-" by default. They end with the binding's ID.
+func WithRolePrefix(prefix string) Option {
+	return func(b *Broker) error {
+		b.rolePrefix = prefix
+		return nil
+	}
+}
+
+// WithService sets the ID and name of the catalog's service, instead of
+// DefaultServiceID and DefaultServiceName.
+func WithService(id, name string) Option {
+	return func(b *Broker) error {
+		if id == "" || name == "" {
+			return errors.New("the service's ID and name are required")
+		}
+		b.serviceID = id
+		b.serviceName = name
+		return nil
+	}
+}
+
+// WithCredentials requires the platform to authenticate with the username and
+// password, as registered with cf create-service-broker.
+func WithCredentials(username, password string) Option {
+	return func(b *Broker) error {
+		if username == "" || password == "" {
+			return errors.New("the username and password are both required")
+		}
+		b.username = username
+		b.password = password
+		return nil
+	}
+}
+
+// brokerError is the body of the broker's error responses.
+type brokerError struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+// bindRequest is what a binding request gives, as far as it's needed to write its
+// role.
+type bindRequest struct {
+	ServiceID    string `json:"service_id"`
+	PlanID       string `json:"plan_id"`
+	BindResource struct {
+		AppGUID string `json:"app_guid"`
+	} `json:"bind_resource"`
+	Context struct {
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+	} `json:"context"`
+}
+
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(b.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(b.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="vault-cf-broker"`)
+			writeJSON(w, http.StatusUnauthorized, &brokerError{Description: "the broker's credentials are required"})
+			return
+		}
+	}
+	if r.Header.Get(HeaderAPIVersion) == "" {
+		writeJSON(w, http.StatusPreconditionFailed, &brokerError{Description: HeaderAPIVersion + " is required"})
+		return
+	}
+
+	// The paths are /v2/catalog, /v2/service_instances/:instance_id, and
+	// /v2/service_instances/:instance_id/service_bindings/:binding_id.
+	fields := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(fields) == 2 && fields[0] == "v2" && fields[1] == "catalog" && r.Method == http.MethodGet:
+		b.catalog(w)
+	case len(fields) == 3 && fields[0] == "v2" && fields[1] == "service_instances":
+		b.serviceInstance(w, r)
+	case len(fields) == 5 && fields[0] == "v2" && fields[1] == "service_instances" && fields[3] == "service_bindings":
+		switch r.Method {
+		case http.MethodPut:
+			b.bind(w, r, fields[2], fields[4])
+		case http.MethodDelete:
+			b.unbind(w, r, fields[4])
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, &brokerError{Description: "bindings are only created and deleted"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, &brokerError{Description: "not found"})
+	}
+}
+
+func (b *Broker) catalog(w http.ResponseWriter) {
+	plans := make([]map[string]interface{}, 0, len(b.plans))
+	for _, plan := range b.plans {
+		description := plan.Description
+		if description == "" {
+			description = fmt.Sprintf("Vault policies %s", strings.Join(plan.TokenPolicies, ", "))
+		}
+		plans = append(plans, map[string]interface{}{
+			"id":          plan.ID,
+			"name":        plan.Name,
+			"description": description,
+			"free":        true,
+			"bindable":    true,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"services": []map[string]interface{}{{
+			"id":              b.serviceID,
+			"name":            b.serviceName,
+			"description":     "Lets bound apps log in to Vault with their instance identity",
+			"bindable":        true,
+			"plan_updateable": false,
+			"requires":        []string{},
+			"plans":           plans,
+		}},
+	})
+}
+
+// serviceInstance provisions and deprovisions instances. Instances have nothing of
+// their own, their bindings' roles are all there is, so these only check the request.
+func (b *Broker) serviceInstance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			ServiceID string `json:"service_id"`
+			PlanID    string `json:"plan_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, &brokerError{Description: fmt.Sprintf("invalid request body: %s", err)})
+			return
+		}
+		if _, err := b.plan(req.ServiceID, req.PlanID); err != nil {
+			writeJSON(w, http.StatusBadRequest, &brokerError{Description: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct{}{})
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, &brokerError{Description: "instances are only created and deleted"})
+	}
+}
+
+// bind writes the binding's role. Binding again with the same app is accepted, as
+// the platform retries bindings it isn't sure were made.
+func (b *Broker) bind(w http.ResponseWriter, r *http.Request, instanceID, bindingID string) {
+	var req bindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &brokerError{Description: fmt.Sprintf("invalid request body: %s", err)})
+		return
+	}
+	plan, err := b.plan(req.ServiceID, req.PlanID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &brokerError{Description: err.Error()})
+		return
+	}
+	if req.BindResource.AppGUID == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, &brokerError{Error: "RequiresApp", Description: "bindings must be to an app"})
+		return
+	}
+
+	roleName := b.rolePrefix + bindingID
+	rolePath := b.rolePath(roleName)
+	existing, err := b.vault.Logical().ReadWithContext(r.Context(), rolePath)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &brokerError{Description: fmt.Sprintf("unable to read role %q: %s", roleName, err)})
+		return
+	}
+	status := http.StatusCreated
+	if existing != nil {
+		if !boundToApp(existing, req.BindResource.AppGUID) {
+			writeJSON(w, http.StatusConflict, &brokerError{Description: fmt.Sprintf("role %q already exists for another app", roleName)})
+			return
+		}
+		status = http.StatusOK
+	}
+
+	role := map[string]interface{}{
+		"bound_application_ids": []string{req.BindResource.AppGUID},
+		// Unbinding stops the app from logging in even before the role is deleted.
+		"required_service_instance": instanceID,
+		"token_policies":            plan.TokenPolicies,
+	}
+	if req.Context.SpaceGUID != "" {
+		role["bound_space_ids"] = []string{req.Context.SpaceGUID}
+	}
+	if req.Context.OrganizationGUID != "" {
+		role["bound_organization_ids"] = []string{req.Context.OrganizationGUID}
+	}
+	if plan.TokenTTL > 0 {
+		role["token_ttl"] = plan.TokenTTL.String()
+	}
+	if plan.TokenMaxTTL > 0 {
+		role["token_max_ttl"] = plan.TokenMaxTTL.String()
+	}
+	if _, err := b.vault.Logical().WriteWithContext(r.Context(), rolePath, role); err != nil {
+		writeJSON(w, http.StatusInternalServerError, &brokerError{Description: fmt.Sprintf("unable to write role %q: %s", roleName, err)})
+		return
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"credentials": map[string]interface{}{
+			"vault_addr":       b.vault.Address(),
+			"vault_auth_mount": b.mountPath,
+			"vault_role":       roleName,
+		},
+	})
+}
+
+// unbind deletes the binding's role, responding with 410 Gone if there's none.
+func (b *Broker) unbind(w http.ResponseWriter, r *http.Request, bindingID string) {
+	roleName := b.rolePrefix + bindingID
+	rolePath := b.rolePath(roleName)
+	existing, err := b.vault.Logical().ReadWithContext(r.Context(), rolePath)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &brokerError{Description: fmt.Sprintf("unable to read role %q: %s", roleName, err)})
+		return
+	}
+	if existing == nil {
+		writeJSON(w, http.StatusGone, struct{}{})
+		return
+	}
+	if _, err := b.vault.Logical().DeleteWithContext(r.Context(), rolePath); err != nil {
+		writeJSON(w, http.StatusInternalServerError, &brokerError{Description: fmt.Sprintf("unable to delete role %q: %s", roleName, err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// plan returns the broker's plan with the ID, if the service is the broker's.
+func (b *Broker) plan(serviceID, planID string) (*Plan, error) {
+	if serviceID != b.serviceID {
+		return nil, fmt.Errorf("service %q isn't offered by this broker", serviceID)
+	}
+	for i := range b.plans {
+		if b.plans[i].ID == planID {
+			return &b.plans[i], nil
+		}
+	}
+	return nil, fmt.Errorf("plan %q isn't offered by this broker", planID)
+}
+
+func (b *Broker) rolePath(roleName string) string {
+	return path.Join("auth", b.mountPath, "roles", roleName)
+}
+
+// boundToApp returns whether the role read from Vault is bound to the app.
+func boundToApp(role *api.Secret, appGUID string) bool {
+	appIDs, _ := role.Data["bound_application_ids"].([]interface{})
+	return len(appIDs) == 1 && appIDs[0] == appGUID
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
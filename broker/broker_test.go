@@ -0,0 +1,195 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	testPlanID     = "plan-id"
+	testInstanceID = "instance-id"
+	testBindingID  = "binding-id"
+	testAppGUID    = "app-guid"
+)
+
+// vaultServer mocks the roles API of the CF auth method mounted at cf, keeping the
+// roles written to it.
+func vaultServer(t *testing.T) (*api.Client, map[string]map[string]interface{}) {
+	var mu sync.Mutex
+	roles := make(map[string]map[string]interface{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/v1/auth/cf/roles/")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			role, ok := roles[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": role})
+		case http.MethodPut, http.MethodPost:
+			role := make(map[string]interface{})
+			if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+				t.Error(err)
+			}
+			roles[name] = role
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			delete(roles, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	config := api.DefaultConfig()
+	config.Address = s.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, roles
+}
+
+func newTestBroker(t *testing.T) (*Broker, map[string]map[string]interface{}) {
+	vaultClient, roles := vaultServer(t)
+	b, err := NewBroker(vaultClient, []Plan{{
+		ID:            testPlanID,
+		Name:          "default",
+		TokenPolicies: []string{"apps"},
+		TokenTTL:      time.Hour,
+	}}, WithCredentials("broker", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, roles
+}
+
+// request sends the request to the broker as the platform would, returning the
+// response's status and body.
+func request(t *testing.T, b *Broker, method, path, body string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth("broker", "secret")
+	r.Header.Set(HeaderAPIVersion, "2.17")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	respBody, _ := io.ReadAll(w.Result().Body)
+	return w.Code, string(respBody)
+}
+
+func TestBrokerBindings(t *testing.T) {
+	b, roles := newTestBroker(t)
+
+	status, body := request(t, b, http.MethodGet, "/v2/catalog", "")
+	if status != http.StatusOK || !strings.Contains(body, `"id":"`+testPlanID+`"`) {
+		t.Fatalf("expected the catalog to list the plan but received %d %s", status, body)
+	}
+	status, body = request(t, b, http.MethodPut, "/v2/service_instances/"+testInstanceID,
+		`{"service_id":"`+DefaultServiceID+`","plan_id":"`+testPlanID+`"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected the instance to be provisioned but received %d %s", status, body)
+	}
+
+	bind := `{"service_id":"` + DefaultServiceID + `","plan_id":"` + testPlanID + `","bind_resource":{"app_guid":"` + testAppGUID + `"},` +
+		`"context":{"platform":"cloudfoundry","organization_guid":"org-guid","space_guid":"space-guid"}}`
+	status, body = request(t, b, http.MethodPut, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID, bind)
+	if status != http.StatusCreated {
+		t.Fatalf("expected the binding to be created but received %d %s", status, body)
+	}
+	var resp struct {
+		Credentials map[string]string `json:"credentials"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Credentials["vault_role"] != "binding-"+testBindingID || resp.Credentials["vault_auth_mount"] != "cf" {
+		t.Fatalf("expected the binding's credentials to name its role but received %v", resp.Credentials)
+	}
+	expected := map[string]interface{}{
+		"bound_application_ids":     []interface{}{testAppGUID},
+		"bound_space_ids":           []interface{}{"space-guid"},
+		"bound_organization_ids":    []interface{}{"org-guid"},
+		"required_service_instance": testInstanceID,
+		"token_policies":            []interface{}{"apps"},
+		"token_ttl":                 "1h0m0s",
+	}
+	if role := roles["binding-"+testBindingID]; !reflect.DeepEqual(role, expected) {
+		t.Fatalf("expected the role %v but it was %v", expected, role)
+	}
+
+	// Binding again to the same app is accepted, but not to another one.
+	status, _ = request(t, b, http.MethodPut, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID, bind)
+	if status != http.StatusOK {
+		t.Fatalf("expected binding again to succeed but received %d", status)
+	}
+	status, _ = request(t, b, http.MethodPut, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID,
+		strings.Replace(bind, testAppGUID, "other-app-guid", 1))
+	if status != http.StatusConflict {
+		t.Fatalf("expected binding another app to conflict but received %d", status)
+	}
+
+	status, _ = request(t, b, http.MethodDelete, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID+"?service_id="+DefaultServiceID+"&plan_id="+testPlanID, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected the binding to be deleted but received %d", status)
+	}
+	if _, ok := roles["binding-"+testBindingID]; ok {
+		t.Fatal("expected the binding's role to be deleted")
+	}
+	status, _ = request(t, b, http.MethodDelete, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID, "")
+	if status != http.StatusGone {
+		t.Fatalf("expected deleting the binding again to be gone but received %d", status)
+	}
+}
+
+func TestBrokerRefusals(t *testing.T) {
+	b, roles := newTestBroker(t)
+
+	// Bindings must be to apps of the broker's plans.
+	for bind, expected := range map[string]int{
+		`{"service_id":"` + DefaultServiceID + `","plan_id":"` + testPlanID + `"}`:                                       http.StatusUnprocessableEntity,
+		`{"service_id":"` + DefaultServiceID + `","plan_id":"other","bind_resource":{"app_guid":"` + testAppGUID + `"}}`: http.StatusBadRequest,
+		`{"service_id":"other","plan_id":"` + testPlanID + `","bind_resource":{"app_guid":"` + testAppGUID + `"}}`:       http.StatusBadRequest,
+	} {
+		status, body := request(t, b, http.MethodPut, "/v2/service_instances/"+testInstanceID+"/service_bindings/"+testBindingID, bind)
+		if status != expected {
+			t.Fatalf("expected %s to be refused with %d but received %d %s", bind, expected, status, body)
+		}
+	}
+	if len(roles) != 0 {
+		t.Fatalf("expected no roles to be written but they were %v", roles)
+	}
+
+	// The platform must authenticate and name the API version.
+	r := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	r.Header.Set(HeaderAPIVersion, "2.17")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unauthenticated request to be refused but received %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	r.SetBasicAuth("broker", "secret")
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected a request without the API version to be refused but received %d", w.Code)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// cfAPIEndpointUnhealthyPeriod is how long a CF API endpoint that failed a request is
+// tried after the healthy ones.
+const cfAPIEndpointUnhealthyPeriod = 30 * time.Second
+
+// endpointHealth tracks which of the CF API endpoints recently failed requests. It
+// lives as long as the backend, so that rebuilding the CF client doesn't send
+// requests to an endpoint that is down again.
+type endpointHealth struct {
+	mu sync.Mutex
+
+	// unhealthyUntil and lastError are keyed by the endpoint's address.
+	unhealthyUntil map[string]time.Time
+	lastError      map[string]error
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+func newEndpointHealth() *endpointHealth {
+	return &endpointHealth{
+		unhealthyUntil: make(map[string]time.Time),
+		lastError:      make(map[string]error),
+		now:            time.Now,
+	}
+}
+
+// order returns the endpoints with the healthy ones first, otherwise in the order given.
+func (h *endpointHealth) order(endpoints []*url.URL) []*url.URL {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	ordered := make([]*url.URL, 0, len(endpoints))
+	var unhealthy []*url.URL
+	for _, endpoint := range endpoints {
+		if now.Before(h.unhealthyUntil[endpoint.String()]) {
+			unhealthy = append(unhealthy, endpoint)
+		} else {
+			ordered = append(ordered, endpoint)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
+
+func (h *endpointHealth) record(endpoint *url.URL, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		delete(h.unhealthyUntil, endpoint.String())
+		delete(h.lastError, endpoint.String())
+		return
+	}
+	h.unhealthyUntil[endpoint.String()] = h.now().Add(cfAPIEndpointUnhealthyPeriod)
+	h.lastError[endpoint.String()] = err
+}
+
+// status returns the health of each endpoint for the circuit breaker endpoint.
+func (h *endpointHealth) status(endpoints []string) []map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	statuses := make([]map[string]interface{}, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		status := map[string]interface{}{
+			"addr":    endpoint,
+			"healthy": !now.Before(h.unhealthyUntil[endpoint]),
+		}
+		if err := h.lastError[endpoint]; err != nil {
+			status["last_error"] = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// failoverRoundTripper sends the requests made to the first CF API endpoint, which the
+// CF client is built for, to the first healthy endpoint instead, and fails over to the
+// next endpoint on connection errors and 5xx responses. Requests to other hosts, such
+// as UAA, are sent as they are.
+type failoverRoundTripper struct {
+	http.RoundTripper
+	endpoints []*url.URL
+	health    *endpointHealth
+}
+
+// newFailoverRoundTripper returns a round tripper that fails over between the CF API
+// addresses, the first of which the CF client is built for.
+func newFailoverRoundTripper(transport http.RoundTripper, addrs []string, health *endpointHealth) (*failoverRoundTripper, error) {
+	endpoints := make([]*url.URL, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoint, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return &failoverRoundTripper{
+		RoundTripper: transport,
+		endpoints:    endpoints,
+		health:       health,
+	}, nil
+}
+
+func (rt *failoverRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != rt.endpoints[0].Host {
+		return rt.RoundTripper.RoundTrip(req)
+	}
+
+	endpoints := rt.health.order(rt.endpoints)
+	for i, endpoint := range endpoints {
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme = endpoint.Scheme
+		attempt.URL.Host = endpoint.Host
+		attempt.Host = endpoint.Host
+		if i > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+
+		resp, err := rt.RoundTripper.RoundTrip(attempt)
+		failed := err
+		if err == nil && resp.StatusCode >= 500 {
+			failed = errors.New(resp.Status)
+		}
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		rt.health.record(endpoint, failed)
+
+		// A request whose body can't be read again isn't failed over.
+		last := i == len(endpoints)-1 || (req.Body != nil && req.GetBody == nil)
+		if failed == nil || last {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	// There's always at least one endpoint.
+	return nil, errors.New("no CF API endpoints")
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport, so
+// that they're closed when the client is replaced.
+func (rt *failoverRoundTripper) CloseIdleConnections() {
+	if closer, ok := rt.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	var primaryCalls, secondaryCalls int
+	primaryUp := false
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		if !primaryUp {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("primary"))
+	}))
+	t.Cleanup(primary.Close)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryCalls++
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("secondary"), body...))
+	}))
+	t.Cleanup(secondary.Close)
+
+	now := time.Now()
+	health := newEndpointHealth()
+	health.now = func() time.Time { return now }
+	rt, err := newFailoverRoundTripper(http.DefaultTransport, []string{primary.URL, secondary.URL}, health)
+	require.NoError(t, err)
+	client := &http.Client{Transport: rt}
+
+	get := func() string {
+		resp, err := client.Get(primary.URL + "/v3/apps")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// A 5xx from the primary fails over to the secondary, with the request's body.
+	resp, err := client.Post(primary.URL+"/v3/apps", "text/plain", strings.NewReader(" body"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "secondary body", string(body))
+	assert.Equal(t, 1, primaryCalls)
+
+	// While the primary is unhealthy, it isn't tried first.
+	primaryUp = true
+	assert.Equal(t, "secondary", get())
+	assert.Equal(t, 1, primaryCalls)
+	assert.Equal(t, false, health.status([]string{primary.URL})[0]["healthy"])
+
+	// Once the unhealthy period has passed, the primary is tried first again.
+	now = now.Add(cfAPIEndpointUnhealthyPeriod)
+	assert.Equal(t, "primary", get())
+	assert.Equal(t, 2, primaryCalls)
+	assert.Equal(t, 2, secondaryCalls)
+	assert.Equal(t, true, health.status([]string{primary.URL})[0]["healthy"])
+
+	// When every endpoint fails, the last failure is returned.
+	primaryUp = false
+	secondary.Close()
+	resp, err = client.Get(primary.URL + "/v3/apps")
+	require.Error(t, err)
+	assert.Nil(t, resp)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/version"
+)
+
+// vaultRequestIDHeader carries the ID of the Vault request that a CF API call is made
+// for, so that the call can be traced back to the request in Vault's audit log.
+const vaultRequestIDHeader = "X-Vault-Request-Id"
+
+// requestInfo is what's known about the Vault request that CF API calls are made for.
+type requestInfo struct {
+	id         string
+	mountPoint string
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns a context carrying the Vault request's ID and mount point,
+// which are sent along with the CF API calls made with it.
+func withRequestInfo(ctx context.Context, req *logical.Request) context.Context {
+	if req == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestInfoKey{}, requestInfo{
+		id:         req.ID,
+		mountPoint: req.MountPoint,
+	})
+}
+
+// defaultUserAgent returns the User-Agent sent to the CF API and UAA when none is
+// configured, naming the plugin's version and, if it's known, its mount.
+func defaultUserAgent(mountPoint string) string {
+	userAgent := "vault-plugin-auth-cf/" + version.GetVersion()
+	if mountPoint = strings.TrimSuffix(mountPoint, "/"); mountPoint != "" {
+		userAgent = fmt.Sprintf("%s (%s)", userAgent, mountPoint)
+	}
+	return userAgent
+}
+
+// headerRoundTripper sets the User-Agent of the requests made to the CF API and UAA,
+// and the ID of the Vault request they were made for.
+type headerRoundTripper struct {
+	http.RoundTripper
+
+	// userAgent is the configured User-Agent. If empty, the default is used.
+	userAgent string
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, _ := req.Context().Value(requestInfoKey{}).(requestInfo)
+	userAgent := rt.userAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent(info.mountPoint)
+	}
+
+	// Round trippers mustn't change the request they're given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent)
+	if info.id != "" {
+		req.Header.Set(vaultRequestIDHeader, info.id)
+	}
+	return rt.RoundTripper.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport, so
+// that they're closed when the client is replaced.
+func (rt *headerRoundTripper) CloseIdleConnections() {
+	if closer, ok := rt.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+const (
+	// cfAPIRateLimitRetries is how many times a call the CF API rate limited is made
+	// again after waiting as long as the CF API's Retry-After asks.
+	cfAPIRateLimitRetries = 2
+
+	// cfAPIRateLimitMaxWait is the longest a call waits on a Retry-After before it's
+	// failed instead, so that logins aren't held up for long.
+	cfAPIRateLimitMaxWait = 10 * time.Second
+)
+
+var errCFAPIRateLimited = errors.New("CF API rate limited the request")
+
+// rateLimitedError is the error for a call that the CF API rate limited, and that
+// couldn't be made again within its deadline.
+type rateLimitedError struct {
+	// retryAfter is how long the CF API asked to wait before calling it again, or zero
+	// if it didn't say.
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	if e.retryAfter <= 0 {
+		return errCFAPIRateLimited.Error()
+	}
+	return fmt.Sprintf("%s, retry after %s", errCFAPIRateLimited, e.retryAfter)
+}
+
+func (e *rateLimitedError) Unwrap() error {
+	return errCFAPIRateLimited
+}
+
+// rateLimitRoundTripper waits out the CF API's and UAA's 429 responses as long as
+// their Retry-After asks, if the request's deadline allows it, and fails the requests
+// it can't make again with a rateLimitedError.
+type rateLimitRoundTripper struct {
+	http.RoundTripper
+}
+
+func (rt *rateLimitRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := rt.RoundTripper.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		metrics.IncrCounter(metricCFAPIThrottled, 1)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok || attempt >= cfAPIRateLimitRetries || !canWait(req.Context(), retryAfter) {
+			return nil, &rateLimitedError{retryAfter: retryAfter}
+		}
+		if req.Body != nil && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport, so
+// that they're closed when the client is replaced.
+func (rt *rateLimitRoundTripper) CloseIdleConnections() {
+	if closer, ok := rt.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// canWait reports whether a request with the context can wait for the duration, and
+// still be made before its deadline.
+func canWait(ctx context.Context, wait time.Duration) bool {
+	if wait > cfAPIRateLimitMaxWait {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Now().Add(wait).Before(deadline)
+}
+
+// parseRetryAfter returns how long a Retry-After header, in seconds or as an HTTP
+// date, asks to wait from now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait.Round(time.Second), true
+	}
+	return 0, true
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestRateLimitedCFAPICalls(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	faults := &cf.Faults{}
+	s := cf.MockServerWithFaults(false, nil, faults)
+	t.Cleanup(s.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:                          1,
+		CFAPIAddr:                        s.URL,
+		CFUsername:                       cf.AuthUsername,
+		CFPassword:                       cf.AuthPassword,
+		CFMaxRetries:                     2,
+		CFRetryWaitMin:                   time.Millisecond,
+		CFRetryWaitMax:                   time.Millisecond,
+		CFCircuitBreakerFailureThreshold: 1,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	require.NoError(t, err)
+	role := &models.RoleEntry{}
+
+	// A lookup the CF API asks to wait a moment for is made again once it has.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusTooManyRequests, RetryAfter: time.Second, Count: 1})
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	require.NoError(t, err)
+	assert.Equal(t, 1, faults.Faulted(http.StatusTooManyRequests))
+
+	// One that it doesn't say how long to wait for isn't made again, even by the
+	// retries of 5xx responses.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusTooManyRequests, Count: 1})
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errCFAPIRateLimited), err)
+	assert.Equal(t, errCodeCFAPIRateLimited, errorCodeOf(err, errCodeInternal))
+	assert.Equal(t, 2, faults.Faulted(http.StatusTooManyRequests))
+
+	// Nor is one that it asks to wait longer for than a login would.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusTooManyRequests, RetryAfter: time.Hour, Count: 1})
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CF API rate limited the request, retry after 1h0m0s")
+	assert.Equal(t, 3, faults.Faulted(http.StatusTooManyRequests))
+
+	// Rate limited lookups don't open the breaker, and fail logins with a 429 so that
+	// clients try them again.
+	assert.Equal(t, circuitBreakerClosed, b.cfAPIBreaker.status()["state"])
+	resp, err := loginFailure(err, errCodeInternal)
+	assert.Nil(t, resp)
+	var coded logical.HTTPCodedError
+	require.True(t, errors.As(err, &coded), err)
+	assert.Equal(t, http.StatusTooManyRequests, coded.Code())
+	assert.True(t, strings.HasPrefix(err.Error(), "[ERR_CF_API_RATE_LIMITED] "), err)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "30", wait: 30 * time.Second, ok: true},
+		{value: "0", wait: 0, ok: true},
+		{value: "-1", ok: false},
+		{value: "Mon, 01 Jan 2024 00:01:00 GMT", wait: time.Minute, ok: true},
+		{value: "Sun, 31 Dec 2023 23:59:00 GMT", wait: 0, ok: true},
+		{value: "soon", ok: false},
+	} {
+		wait, ok := parseRetryAfter(tc.value, now)
+		assert.Equal(t, tc.ok, ok, tc.value)
+		assert.Equal(t, tc.wait, wait, tc.value)
+	}
+}
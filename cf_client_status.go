@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cfClientStatus is what's known of the health of the CF client, so that operators can
+// see why logins are slow or failing. It lives as long as the backend, so that it
+// survives the CF client being rebuilt. A nil *cfClientStatus records nothing.
+type cfClientStatus struct {
+	mu            sync.Mutex
+	lastRefresh   time.Time
+	tokenIssuedAt time.Time
+	tokenExpiry   time.Time
+	lastError     error
+	lastErrorAt   time.Time
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+func newCFClientStatus() *cfClientStatus {
+	return &cfClientStatus{now: time.Now}
+}
+
+// refreshed records the outcome of building a new CF client.
+func (s *cfClientStatus) refreshed(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.failed(err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRefresh = s.now()
+}
+
+// failed records an error that kept the CF client from serving a call.
+func (s *cfClientStatus) failed(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	s.lastErrorAt = s.now()
+}
+
+// tokenIssued records that UAA issued the client a token that expires in the given time.
+func (s *cfClientStatus) tokenIssued(expiresIn time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenIssuedAt = s.now()
+	s.tokenExpiry = s.tokenIssuedAt.Add(expiresIn)
+}
+
+// tokenRefreshDue returns whether the client's token expires within the given window
+// of now, or within half its lifetime for tokens that don't last twice the window.
+func (s *cfClientStatus) tokenRefreshDue(now time.Time, window time.Duration) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenExpiry.IsZero() {
+		return false
+	}
+	if lifetime := s.tokenExpiry.Sub(s.tokenIssuedAt); lifetime < 2*window {
+		window = lifetime / 2
+	}
+	return !now.Before(s.tokenExpiry.Add(-window))
+}
+
+func (s *cfClientStatus) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := make(map[string]interface{})
+	if !s.lastRefresh.IsZero() {
+		status["last_refresh_time"] = s.lastRefresh.UTC().Format(time.RFC3339)
+	}
+	if !s.tokenExpiry.IsZero() {
+		status["uaa_token_expiry"] = s.tokenExpiry.UTC().Format(time.RFC3339)
+		status["uaa_token_expired"] = !s.now().Before(s.tokenExpiry)
+	}
+	if s.lastError != nil {
+		status["last_error"] = s.lastError.Error()
+		status["last_error_time"] = s.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// tokenExpiryRoundTripper records when the tokens UAA issues to the CF client expire.
+type tokenExpiryRoundTripper struct {
+	http.RoundTripper
+	status *cfClientStatus
+}
+
+func (rt *tokenExpiryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.RoundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, "/oauth/token") {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var token struct {
+		ExpiresIn int64 `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err == nil && token.ExpiresIn > 0 {
+		rt.status.tokenIssued(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport, so
+// that they're closed when the client is replaced.
+func (rt *tokenExpiryRoundTripper) CloseIdleConnections() {
+	if closer, ok := rt.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
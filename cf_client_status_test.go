@@ -0,0 +1,173 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestConfigClientStatus(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	faults := &cf.Faults{}
+	s := cf.MockServerWithFaults(false, nil, faults)
+	t.Cleanup(s.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	readStatus := func() map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config/client-status",
+			Storage:   &logical.InmemStorage{},
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp.Data
+	}
+
+	status := readStatus()
+	assert.Equal(t, false, status["initialized"])
+	assert.NotContains(t, status, "last_refresh_time")
+
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  s.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	_, err = b.updateCFClient(ctx, config)
+	require.NoError(t, err)
+	status = readStatus()
+	assert.Equal(t, true, status["initialized"])
+	assert.Equal(t, false, status["tainted"])
+	assert.Contains(t, status, "last_refresh_time")
+	assert.NotContains(t, status, "last_error")
+
+	// The mock UAA issues tokens that expire in 599 seconds.
+	tokenExpiry, err := time.Parse(time.RFC3339, status["uaa_token_expiry"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(599*time.Second), tokenExpiry, 5*time.Second)
+	assert.Equal(t, false, status["uaa_token_expired"])
+
+	// Calls that the CF API fails are reported, as is the client being marked to be rebuilt.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusBadGateway})
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	require.NoError(t, err)
+	_, err = b.validateWithCFAPI(ctx, config, &models.RoleEntry{}, cfCert)
+	require.Error(t, err)
+	b.taintCFClient()
+	status = readStatus()
+	assert.Equal(t, true, status["tainted"])
+	assert.Contains(t, status["last_error"], "502")
+	assert.Contains(t, status, "last_error_time")
+}
+
+func TestRefreshCFClientToken(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  s.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	_, err = b.updateCFClient(ctx, config)
+	require.NoError(t, err)
+	client, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+	nameCache := b.getNameCache()
+
+	// The client is kept while its token has long to live.
+	b.refreshCFClientToken(ctx, config, time.Now())
+	unchanged, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+	assert.Same(t, client, unchanged)
+
+	// The mock UAA issues tokens that expire in 599 seconds, so the client is replaced
+	// once there are less than 5 minutes to go, and its caches are kept.
+	b.refreshCFClientToken(ctx, config, time.Now().Add(5*time.Minute))
+	refreshed, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+	assert.NotSame(t, client, refreshed)
+	assert.Same(t, nameCache, b.getNameCache())
+
+	// A tainted client is left for the next login to rebuild.
+	b.taintCFClient()
+	b.refreshCFClientToken(ctx, config, time.Now().Add(time.Hour))
+	tainted, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+	assert.Same(t, refreshed, tainted)
+}
+
+func TestRefreshCFClientTokenAfterIdentityCARefresh(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	require.NoError(t, err)
+	t.Cleanup(func() { testCerts.Close() })
+	caServer := identityCAServer(t, testCerts.CACertificate)
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	config := identityCAURLConfig(caServer)
+	config.CFAPIAddr = s.URL
+	config.CFUsername = cf.AuthUsername
+	config.CFPassword = cf.AuthPassword
+	require.NoError(t, storeConfig(ctx, storage, config))
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	_, err = b.updateCFClient(ctx, config)
+	require.NoError(t, err)
+	client, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+
+	// Refreshing the identity CA changes the stored config, but not the settings the
+	// client is built from, so the client's token is still refreshed afterwards.
+	require.NoError(t, b.refreshIdentityCAURLs(ctx, storage, time.Now()))
+	config, err = getConfig(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, []string{testCerts.CACertificate}, config.URLIdentityCACertificates)
+	b.refreshCFClientToken(ctx, config, time.Now().Add(5*time.Minute))
+	refreshed, err := b.getCFClient(ctx)
+	require.NoError(t, err)
+	assert.NotSame(t, client, refreshed)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+// jwtBearerGrantType is the OAuth grant, from RFC 7523, that UAA issues a token for in
+// exchange for a JWT signed by an identity provider it trusts.
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// jwtBearerAssertionTTL is how long the JWTs exchanged for UAA tokens are valid for.
+// UAA only has to accept each once, right after it's signed.
+const jwtBearerAssertionTTL = 5 * time.Minute
+
+// parseJWTBearerSigningKey parses the PEM-encoded key that the JWTs exchanged for UAA
+// tokens are signed with, and returns the algorithm they're signed with using it.
+func parseJWTBearerSigningKey(pemKey string) (crypto.Signer, jose.SignatureAlgorithm, error) {
+	signer, err := util.ParsePrivateKey([]byte(pemKey), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		return signer, jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return signer, jose.ES256, nil
+		case elliptic.P384():
+			return signer, jose.ES384, nil
+		case elliptic.P521():
+			return signer, jose.ES512, nil
+		}
+		return nil, "", fmt.Errorf("unsupported elliptic curve %s", key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return signer, jose.EdDSA, nil
+	}
+	return nil, "", fmt.Errorf("unsupported private key type %T", signer)
+}
+
+// jwtBearerPublicKey returns the PEM-encoded public key of the JWT bearer signing key,
+// for configuring UAA's identity provider with.
+func jwtBearerPublicKey(config *models.Configuration) (string, error) {
+	signer, _, err := parseJWTBearerSigningKey(config.CFJWTBearerSigningKey)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// newJWTBearerAssertion returns a JWT asserting the configured subject, signed with the
+// configured key, for UAA's token endpoint at tokenURL to exchange for a token.
+func newJWTBearerAssertion(config *models.Configuration, tokenURL string, now time.Time) (string, error) {
+	key, alg, err := parseJWTBearerSigningKey(config.CFJWTBearerSigningKey)
+	if err != nil {
+		return "", err
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if config.CFJWTBearerKeyID != "" {
+		opts.WithHeader(jose.HeaderKey("kid"), config.CFJWTBearerKeyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	audience := config.CFJWTBearerAudience
+	if audience == "" {
+		audience = tokenURL
+	}
+	claims := jwt.Claims{
+		ID:        jti,
+		Issuer:    config.CFJWTBearerIssuer,
+		Subject:   config.CFJWTBearerSubject,
+		Audience:  jwt.Audience{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(jwtBearerAssertionTTL)),
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// jwtBearerToken discovers UAA from the CF API's root, and exchanges a newly signed JWT
+// for a UAA access token using the JWT bearer grant. It returns the token along with
+// the login and UAA addresses, so that the CF client doesn't discover them again.
+func jwtBearerToken(ctx context.Context, httpClient *http.Client, config *models.Configuration) (accessToken, loginURL, uaaURL string, err error) {
+	var root struct {
+		Links struct {
+			Login struct {
+				Href string `json:"href"`
+			} `json:"login"`
+			UAA struct {
+				Href string `json:"href"`
+			} `json:"uaa"`
+		} `json:"links"`
+	}
+	if err := getCFAPIJSON(ctx, httpClient, strings.TrimRight(config.CFAPIAddr, "/")+"/", &root); err != nil {
+		return "", "", "", fmt.Errorf("error while discovering token service URL: %w", err)
+	}
+	loginURL, uaaURL = root.Links.Login.Href, root.Links.UAA.Href
+	if uaaURL == "" {
+		return "", "", "", errors.New("error while discovering token service URL: the CF API root doesn't link to UAA")
+	}
+	tokenURL := strings.TrimRight(uaaURL, "/") + "/oauth/token"
+
+	assertion, err := newJWTBearerAssertion(config, tokenURL, time.Now())
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to sign JWT bearer assertion: %w", err)
+	}
+	form := url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {assertion},
+	}
+	if config.CFClientSecret == "" {
+		form.Set("client_id", config.CFClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.CFClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.CFClientID), url.QueryEscape(config.CFClientSecret))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to exchange JWT bearer assertion for a UAA token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", "", "", fmt.Errorf("UAA refused the JWT bearer assertion with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", "", "", fmt.Errorf("failed to decode UAA token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", "", "", errors.New("UAA didn't return an access token for the JWT bearer assertion")
+	}
+	return token.AccessToken, loginURL, uaaURL, nil
+}
+
+// getCFAPIJSON decodes the JSON response to a GET for the URL into v.
+func getCFAPIJSON(ctx context.Context, httpClient *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the CF API responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
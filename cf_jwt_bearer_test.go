@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func Test_backend_newCFClient_jwtBearer(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	// UAA is served in front of the mock server, to check the grants made to it, and to
+	// issue a token that's still valid.
+	accessToken := "eyJhbGciOiJub25lIn0." +
+		base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))) + ".c2lnbmF0dXJl"
+	var mu sync.Mutex
+	var grants []*http.Request
+	var uaa *httptest.Server
+	uaa = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(fmt.Sprintf(`{"links":{"login":{"href":%q},"uaa":{"href":%q}}}`, uaa.URL, uaa.URL)))
+		case "/oauth/token":
+			r.ParseForm()
+			mu.Lock()
+			grants = append(grants, r)
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(fmt.Sprintf(`{"access_token":%q,"token_type":"bearer","expires_in":3600}`, accessToken)))
+		default:
+			s.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(uaa.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	config := &models.Configuration{
+		CFAPIAddr:             uaa.URL,
+		CFClientID:            "vault",
+		CFJWTBearerSigningKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CFJWTBearerKeyID:      "vault-key",
+		CFJWTBearerIssuer:     "https://vault.example.com",
+		CFJWTBearerSubject:    "vault-cf-auth",
+	}
+
+	b := &backend{}
+	ctx := context.Background()
+	client, err := b.newCFClient(ctx, config)
+	require.NoError(t, err)
+	_, err = client.Applications.Get(ctx, cf.FoundAppGUID)
+	require.NoError(t, err)
+
+	require.Len(t, grants, 1)
+	grant := grants[0]
+	assert.Equal(t, jwtBearerGrantType, grant.PostForm.Get("grant_type"))
+	assert.Equal(t, "vault", grant.PostForm.Get("client_id"))
+
+	// The assertion is signed with the key whose public half config reads return.
+	publicKeyPEM, err := jwtBearerPublicKey(config)
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	require.NotNil(t, block)
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+	assertion, err := jwt.ParseSigned(grant.PostForm.Get("assertion"), []jose.SignatureAlgorithm{jose.ES256})
+	require.NoError(t, err)
+	assert.Equal(t, "vault-key", assertion.Headers[0].KeyID)
+	claims := jwt.Claims{}
+	require.NoError(t, assertion.Claims(publicKey, &claims))
+	require.NoError(t, claims.Validate(jwt.Expected{
+		Issuer:      "https://vault.example.com",
+		Subject:     "vault-cf-auth",
+		AnyAudience: jwt.Audience{uaa.URL + "/oauth/token"},
+		Time:        time.Now(),
+	}))
+	assert.NotEmpty(t, claims.ID)
+
+	// With a client secret, the client authenticates with it instead.
+	config.CFClientSecret = "secret"
+	_, err = b.newCFClient(ctx, config)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	username, password, ok := grants[1].BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "vault", username)
+	assert.Equal(t, "secret", password)
+	assert.Empty(t, grants[1].PostForm.Get("client_id"))
+}
+
+func TestParseJWTBearerSigningKey(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	_, alg, err := parseJWTBearerSigningKey(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	require.NoError(t, err)
+	assert.Equal(t, jose.ES384, alg)
+
+	_, _, err = parseJWTBearerSigningKey("not a key")
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// cfLoginAnnotationTimeout is how long writing a login's annotation to the app may take.
+// It's written after the login succeeds, so it doesn't hold the login up.
+const cfLoginAnnotationTimeout = 10 * time.Second
+
+var (
+	// annotationPrefixRegex and annotationNameRegex match the prefix, a DNS subdomain,
+	// and the name of the annotation keys that CF accepts.
+	annotationPrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	annotationNameRegex   = regexp.MustCompile(`^[A-Za-z0-9]([-_.A-Za-z0-9]*[A-Za-z0-9])?$`)
+)
+
+// loginAnnotation is what's recorded of a login in the app's annotation.
+type loginAnnotation struct {
+	Time          string `json:"time"`
+	Role          string `json:"role"`
+	InstanceID    string `json:"instance_id"`
+	MountAccessor string `json:"mount_accessor,omitempty"`
+}
+
+// validateAnnotationKey ensures that CF accepts the annotation key.
+func validateAnnotationKey(key string) error {
+	prefix, name, found := strings.Cut(key, "/")
+	if !found {
+		prefix, name = "", key
+	}
+	if found && (len(prefix) > 253 || !annotationPrefixRegex.MatchString(prefix)) {
+		return fmt.Errorf("prefix %q must be a DNS subdomain of at most 253 characters", prefix)
+	}
+	if len(name) > 63 || !annotationNameRegex.MatchString(name) {
+		return errors.New("name must be at most 63 alphanumeric characters, dashes, underscores or dots, and start and end with an alphanumeric character")
+	}
+	return nil
+}
+
+// annotateLogin writes the annotation with the key to the app that logged in, recording
+// the login. Writing it is best effort, a failure to do so doesn't fail the login.
+func (b *backend) annotateLogin(ctx context.Context, client *cfclient.Client, key string, app *resource.App, login *loginAnnotation) {
+	value, err := json.Marshal(login)
+	if err != nil {
+		b.Logger().Warn("unable to encode login annotation", "app_id", app.GUID, "error", err)
+		return
+	}
+	// Updates that leave the app's name out rename it, so it's written as it is.
+	update := &resource.AppUpdate{
+		Name:     app.Name,
+		Metadata: resource.NewMetadata().WithAnnotation("", key, string(value)),
+	}
+	err = b.callCFAPI("update_app_annotation", func() error {
+		_, err := client.Applications.Update(ctx, app.GUID, update)
+		return err
+	})
+	if err != nil {
+		b.Logger().Warn("unable to write login annotation to app", "app_id", app.GUID, "annotation", key, "error", err)
+	}
+}
+
+// annotateLoginInBackground writes the login's annotation to the app, if the config
+// records logins and the login looked the app up, without waiting for it.
+func (b *backend) annotateLoginInBackground(ctx context.Context, config *models.Configuration, cfResources *cfResources, roleName, instanceID, mountAccessor string) {
+	if config.CFLoginAnnotation == "" || cfResources.app == nil {
+		return
+	}
+	client, err := b.getCFClientOrRefresh(ctx, config)
+	if err != nil {
+		b.Logger().Warn("unable to write login annotation to app", "app_id", cfResources.app.GUID, "error", err)
+		return
+	}
+	key, app := config.CFLoginAnnotation, cfResources.app
+	login := &loginAnnotation{
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Role:          roleName,
+		InstanceID:    instanceID,
+		MountAccessor: mountAccessor,
+	}
+	// The annotation is written after the login returns, so it can't use the login's
+	// context.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfLoginAnnotationTimeout)
+		defer cancel()
+		b.annotateLogin(ctx, client, key, app, login)
+	}()
+}
@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestValidateAnnotationKey(t *testing.T) {
+	t.Parallel()
+
+	for key, valid := range map[string]bool{
+		"last-vault-login":               true,
+		"vault.hashicorp.com/last-login": true,
+		"example.com/Last_Login.v2":      true,
+		"-last-login":                    false,
+		"Example.com/last-login":         false,
+		"/last-login":                    false,
+		"vault.hashicorp.com/":           false,
+		strings.Repeat("a", 64):          false,
+	} {
+		err := validateAnnotationKey(key)
+		assert.Equal(t, valid, err == nil, "%q: %v", key, err)
+	}
+}
+
+func TestAnnotateLogin(t *testing.T) {
+	t.Parallel()
+
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	// The app's updates are recorded before the mock server answers them.
+	var updates []string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			updates = append(updates, r.URL.Path+" "+string(body))
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+
+	ctx := context.Background()
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	client, err := b.newCFClient(ctx, &models.Configuration{
+		CFAPIAddr:  recorder.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	})
+	require.NoError(t, err)
+
+	app := &resource.App{Resource: resource.Resource{GUID: cf.FoundAppGUID}, Name: cf.FoundAppName}
+	b.annotateLogin(ctx, client, "vault.hashicorp.com/last-login", app, &loginAnnotation{
+		Time:          "2026-10-14T12:00:00Z",
+		Role:          "payments",
+		InstanceID:    "instance-id",
+		MountAccessor: "auth_cf_1234",
+	})
+
+	require.Len(t, updates, 1)
+	path, body, _ := strings.Cut(updates[0], " ")
+	assert.Equal(t, "/v3/apps/"+cf.FoundAppGUID, path)
+	var update struct {
+		Name     string `json:"name"`
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &update))
+	assert.Equal(t, cf.FoundAppName, update.Name)
+	assert.JSONEq(t, `{"time":"2026-10-14T12:00:00Z","role":"payments","instance_id":"instance-id","mount_accessor":"auth_cf_1234"}`,
+		update.Metadata.Annotations["vault.hashicorp.com/last-login"])
+}
@@ -0,0 +1,163 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const changeHistoryStorageKey = "change-history"
+
+// changeHistorySize is how many changes are kept, after which the oldest ones are
+// dropped.
+const changeHistorySize = 200
+
+// configChange is a write to the config or a role, as it's reflected in Vault's storage
+// system. Only the names of the fields that changed are kept, never their values.
+type configChange struct {
+	Time          time.Time `json:"time"`
+	Path          string    `json:"path"`
+	Operation     string    `json:"operation"`
+	Role          string    `json:"role,omitempty"`
+	EntityID      string    `json:"entity_id,omitempty"`
+	DisplayName   string    `json:"display_name,omitempty"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	ChangedFields []string  `json:"changed_fields"`
+}
+
+// newConfigChange returns the change the request makes, attributed to whoever made it.
+func newConfigChange(req *logical.Request, roleName string) *configChange {
+	change := &configChange{
+		Path:        req.Path,
+		Operation:   string(req.Operation),
+		Role:        roleName,
+		EntityID:    req.EntityID,
+		DisplayName: req.DisplayName,
+	}
+	if req.Connection != nil {
+		change.RemoteAddress = req.Connection.RemoteAddr
+	}
+	return change
+}
+
+// changeSnapshot returns the config or role's fields as they're stored, to compare
+// with them once they've been changed. A nil config or role has no fields.
+func changeSnapshot(v interface{}) (map[string]interface{}, error) {
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// changedFields returns the sorted names of the fields that differ between the
+// snapshots. Fields missing from one are compared as unset.
+func changedFields(before, after map[string]interface{}) []string {
+	fields := []string{}
+	for field, value := range after {
+		if !sameFieldValue(before[field], value) {
+			fields = append(fields, field)
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok && !sameFieldValue(value, nil) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// sameFieldValue compares the JSON values of a field, treating the zero values that
+// unset fields are stored as the same as missing ones.
+func sameFieldValue(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b) || (isUnsetFieldValue(a) && isUnsetFieldValue(b))
+}
+
+func isUnsetFieldValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == "" || v == (time.Time{}).Format(time.RFC3339)
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// recordChange adds the change from the before snapshot to the config or role after
+// it, if any of its fields changed, to the change history, dropping the oldest changes
+// beyond changeHistorySize. The change has already been stored, so a failure to record
+// it is logged rather than failing the request.
+func (b *backend) recordChange(ctx context.Context, storage logical.Storage, change *configChange, before map[string]interface{}, after interface{}) {
+	if err := b.storeChange(ctx, storage, change, before, after); err != nil {
+		b.Logger().Error("unable to record the change in the change history", "path", change.Path, "role", change.Role, "error", err)
+	}
+}
+
+func (b *backend) storeChange(ctx context.Context, storage logical.Storage, change *configChange, before map[string]interface{}, after interface{}) error {
+	afterSnapshot, err := changeSnapshot(after)
+	if err != nil {
+		return err
+	}
+	change.ChangedFields = changedFields(before, afterSnapshot)
+	if len(change.ChangedFields) == 0 {
+		return nil
+	}
+	if change.Time.IsZero() {
+		change.Time = time.Now().UTC()
+	}
+
+	b.changeHistoryMu.Lock()
+	defer b.changeHistoryMu.Unlock()
+	changes, err := getChangeHistory(ctx, storage)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, change)
+	if len(changes) > changeHistorySize {
+		changes = changes[len(changes)-changeHistorySize:]
+	}
+	entry, err := logical.StorageEntryJSON(changeHistoryStorageKey, changes)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, entry)
+}
+
+// getChangeHistory returns the recorded changes, oldest first.
+func getChangeHistory(ctx context.Context, storage logical.Storage) ([]*configChange, error) {
+	entry, err := storage.Get(ctx, changeHistoryStorageKey)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var changes []*configChange
+	if err := entry.DecodeJSON(&changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
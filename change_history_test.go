@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestChangeHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{DefaultLeaseTTLVal: 24 * time.Hour, MaxLeaseTTLVal: 32 * 24 * time.Hour},
+	})
+	require.NoError(t, err)
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := lb.HandleRequest(ctx, &logical.Request{
+			Operation:   op,
+			Path:        path,
+			Storage:     storage,
+			Data:        data,
+			EntityID:    "operator-entity",
+			DisplayName: "userpass-operator",
+			Connection:  &logical.Connection{RemoteAddr: "10.0.0.1"},
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	request(logical.CreateOperation, "roles/payments", map[string]interface{}{
+		"bound_space_ids": cf.FoundSpaceGUID,
+		"token_policies":  "payments",
+	})
+	request(logical.UpdateOperation, "roles/payments", map[string]interface{}{
+		"bound_space_ids": cf.FoundSpaceGUID,
+	})
+	request(logical.UpdateOperation, "roles/payments", map[string]interface{}{
+		"bound_space_ids": "another-space",
+		"token_ttl":       "1h",
+	})
+	request(logical.DeleteOperation, "roles/payments", nil)
+	request(logical.CreateOperation, "roles/billing", map[string]interface{}{
+		"bound_organization_ids": cf.FoundOrgGUID,
+	})
+
+	resp := request(logical.ReadOperation, "change-history", map[string]interface{}{"role": "payments"})
+	changes := resp.Data["changes"].([]map[string]interface{})
+	// The update that changed nothing isn't recorded, and the latest change is first.
+	require.Len(t, changes, 3)
+	assert.Equal(t, "delete", changes[0]["operation"])
+	assert.Contains(t, changes[0]["changed_fields"], "bound_space_ids")
+	assert.Equal(t, "update", changes[1]["operation"])
+	assert.Equal(t, []string{"bound_space_ids", "token_ttl"}, changes[1]["changed_fields"])
+	assert.Equal(t, "create", changes[2]["operation"])
+	assert.Contains(t, changes[2]["changed_fields"], "token_policies")
+	assert.NotContains(t, changes[2]["changed_fields"], "token_ttl")
+	for _, change := range changes {
+		assert.Equal(t, "roles/payments", change["path"])
+		assert.Equal(t, "operator-entity", change["entity_id"])
+		assert.Equal(t, "userpass-operator", change["display_name"])
+		assert.Equal(t, "10.0.0.1", change["remote_address"])
+	}
+
+	resp = request(logical.ReadOperation, "change-history", nil)
+	changes = resp.Data["changes"].([]map[string]interface{})
+	require.Len(t, changes, 4)
+	assert.Equal(t, "billing", changes[0]["role"])
+
+	// The values of the fields that changed are never recorded.
+	entry, err := storage.Get(ctx, changeHistoryStorageKey)
+	require.NoError(t, err)
+	assert.NotContains(t, string(entry.Value), cf.FoundSpaceGUID)
+	assert.NotContains(t, string(entry.Value), "another-space")
+}
+
+func TestChangeHistoryIsBounded(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+
+	for i := 0; i < changeHistorySize+10; i++ {
+		b.recordChange(ctx, storage, &configChange{Path: "roles/test", Operation: "update"}, nil, &models.RoleEntry{BoundAppIDs: []string{fmt.Sprintf("app-%d", i)}})
+	}
+	changes, err := getChangeHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, changes, changeHistorySize)
+}
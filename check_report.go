@@ -0,0 +1,42 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+const (
+	checkPassed  = "passed"
+	checkWarning = "warning"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// checkReport collects the outcome of a series of checks, such as those a login
+// makes, for the endpoints reporting them.
+type checkReport struct {
+	checks []map[string]interface{}
+	failed bool
+}
+
+// add records the outcome of a check, and returns it so that details can be added.
+func (r *checkReport) add(name, result string, err error) map[string]interface{} {
+	check := map[string]interface{}{
+		"name":   name,
+		"result": result,
+	}
+	if err != nil {
+		check["error"] = err.Error()
+	}
+	if result == checkFailed {
+		r.failed = true
+	}
+	r.checks = append(r.checks, check)
+	return check
+}
+
+// check records a check that passed if err is nil, and failed otherwise.
+func (r *checkReport) check(name string, err error) map[string]interface{} {
+	if err != nil {
+		return r.add(name, checkFailed, err)
+	}
+	return r.add(name, checkPassed, nil)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+)
+
+const (
+	circuitBreakerClosed   = "closed"
+	circuitBreakerOpen     = "open"
+	circuitBreakerHalfOpen = "half-open"
+
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerResetTimeout     = 30 * time.Second
+)
+
+var errCFAPIUnavailable = errors.New("CF API unavailable")
+
+// circuitBreaker stops calls to the CF API after it has failed a number of times in
+// a row, so that logins fail fast instead of piling up behind a CF API that is down.
+// Once the reset timeout has passed, a single call is let through to probe whether
+// the CF API has recovered.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	// failureThreshold is the number of consecutive failures that opens the
+	// breaker. Zero disables the breaker.
+	failureThreshold int
+	resetTimeout     time.Duration
+
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	lastError           error
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		state: circuitBreakerClosed,
+		now:   time.Now,
+	}
+}
+
+// configure updates the breaker's settings without resetting its state, so that
+// rebuilding the CF client doesn't close a breaker that has opened.
+func (c *circuitBreaker) configure(failureThreshold int, resetTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failureThreshold = failureThreshold
+	c.resetTimeout = resetTimeout
+	if c.resetTimeout <= 0 {
+		c.resetTimeout = defaultCircuitBreakerResetTimeout
+	}
+	if c.failureThreshold <= 0 {
+		c.reset()
+	}
+}
+
+// call runs the given call to the CF API, unless the breaker is open.
+func (c *circuitBreaker) call(fn func() error) error {
+	if err := c.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	c.record(err)
+	return err
+}
+
+func (c *circuitBreaker) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitBreakerOpen:
+		if c.now().Before(c.openedAt.Add(c.resetTimeout)) {
+			return fmt.Errorf("%w: %d consecutive calls failed, most recently with: %s",
+				errCFAPIUnavailable, c.consecutiveFailures, c.lastError)
+		}
+		// Let this call through to see whether the CF API has recovered.
+		c.state = circuitBreakerHalfOpen
+	case circuitBreakerHalfOpen:
+		return fmt.Errorf("%w: waiting on a call to check whether it has recovered", errCFAPIUnavailable)
+	}
+	return nil
+}
+
+func (c *circuitBreaker) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failureThreshold <= 0 {
+		return
+	}
+	if !isCFAPIFailure(err) {
+		c.reset()
+		return
+	}
+
+	c.consecutiveFailures++
+	c.lastError = err
+	if c.state == circuitBreakerHalfOpen || c.consecutiveFailures >= c.failureThreshold {
+		c.state = circuitBreakerOpen
+		c.openedAt = c.now()
+	}
+}
+
+func (c *circuitBreaker) reset() {
+	c.state = circuitBreakerClosed
+	c.consecutiveFailures = 0
+	c.openedAt = time.Time{}
+	c.lastError = nil
+}
+
+// status returns the breaker's state for the circuit breaker endpoint.
+func (c *circuitBreaker) status() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := map[string]interface{}{
+		"enabled":              c.failureThreshold > 0,
+		"state":                c.state,
+		"consecutive_failures": c.consecutiveFailures,
+		"failure_threshold":    c.failureThreshold,
+		"reset_timeout":        int64(c.resetTimeout / time.Second),
+	}
+	if !c.openedAt.IsZero() {
+		status["opened_at"] = c.openedAt.UTC().Format(time.RFC3339)
+	}
+	if c.lastError != nil {
+		status["last_error"] = c.lastError.Error()
+	}
+	return status
+}
+
+// cfAPIError marks an error meaning the CF API couldn't serve a call as errCFAPIUnavailable,
+// so that it can be told apart from the CF API answering that an instance isn't valid.
+func cfAPIError(err error) error {
+	if errors.Is(err, errCFAPIUnavailable) || !isCFAPIFailure(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", errCFAPIUnavailable, err)
+}
+
+// isCFAPIFailure reports whether the error means the CF API couldn't serve the
+// call, as opposed to the CF API answering it with an error such as a 404.
+func isCFAPIFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, errCFAPIRateLimited) {
+		return false
+	}
+	var cfError resource.CloudFoundryError
+	if errors.As(err, &cfError) {
+		return false
+	}
+	var cfHTTPError resource.CloudFoundryHTTPError
+	if errors.As(err, &cfHTTPError) {
+		return cfHTTPError.StatusCode >= 500
+	}
+	return true
+}
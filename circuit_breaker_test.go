@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	unavailable := resource.CloudFoundryHTTPError{StatusCode: 503, Status: "503 Service Unavailable"}
+	notFound := resource.CloudFoundryError{Code: 10010, Title: "CF-ResourceNotFound"}
+
+	now := time.Now()
+	c := newCircuitBreaker()
+	c.now = func() time.Time { return now }
+	c.configure(2, time.Minute)
+
+	calls := 0
+	failWith := func(err error) func() error {
+		return func() error {
+			calls++
+			return err
+		}
+	}
+
+	// The CF API answering with an error isn't a failure of the CF API.
+	assert.Equal(t, notFound, c.call(failWith(notFound)))
+	assert.Equal(t, circuitBreakerClosed, c.status()["state"])
+
+	assert.Equal(t, unavailable, c.call(failWith(unavailable)))
+	assert.Equal(t, circuitBreakerClosed, c.status()["state"])
+	assert.Equal(t, unavailable, c.call(failWith(unavailable)))
+	assert.Equal(t, circuitBreakerOpen, c.status()["state"])
+
+	// While open, calls fail without reaching the CF API.
+	err := c.call(failWith(nil))
+	assert.True(t, errors.Is(err, errCFAPIUnavailable))
+	assert.Equal(t, 3, calls)
+
+	// Once the reset timeout has passed a failed probe opens the breaker again.
+	now = now.Add(time.Minute)
+	assert.Equal(t, unavailable, c.call(failWith(unavailable)))
+	assert.Equal(t, circuitBreakerOpen, c.status()["state"])
+	assert.Equal(t, 4, calls)
+
+	// And a successful probe closes it.
+	now = now.Add(time.Minute)
+	assert.NoError(t, c.call(failWith(nil)))
+	assert.Equal(t, circuitBreakerClosed, c.status()["state"])
+	assert.Equal(t, 0, c.status()["consecutive_failures"])
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	t.Parallel()
+
+	c := newCircuitBreaker()
+	c.configure(0, 0)
+	for i := 0; i < 10; i++ {
+		assert.Error(t, c.call(func() error { return errors.New("connection refused") }))
+	}
+	assert.Equal(t, circuitBreakerClosed, c.status()["state"])
+	assert.Equal(t, false, c.status()["enabled"])
+}
+
+func TestCircuitBreakerOpensOnCFAPIOutage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	faults := &cf.Faults{}
+	s := cf.MockServerWithFaults(false, nil, faults)
+	t.Cleanup(s.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:                          1,
+		CFAPIAddr:                        s.URL,
+		CFUsername:                       cf.AuthUsername,
+		CFPassword:                       cf.AuthPassword,
+		CFCircuitBreakerFailureThreshold: 2,
+		CFCircuitBreakerResetTimeout:     time.Hour,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	require.NoError(t, err)
+	role := &models.RoleEntry{}
+
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	require.NoError(t, err)
+
+	// Rate limited lookups are answers from the CF API, so they don't open the breaker.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusTooManyRequests, Count: 3})
+	for i := 0; i < 3; i++ {
+		_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, circuitBreakerClosed, b.cfAPIBreaker.status()["state"])
+
+	// Failing app lookups do, after which they aren't made.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusBadGateway})
+	for i := 0; i < 2; i++ {
+		_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, circuitBreakerOpen, b.cfAPIBreaker.status()["state"])
+	failed := faults.Faulted(http.StatusBadGateway)
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	assert.True(t, errors.Is(err, errCFAPIUnavailable), err)
+	assert.Equal(t, failed, faults.Faulted(http.StatusBadGateway))
+}
+
+func TestIsCFAPIFailure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: context.Canceled, want: false},
+		{err: resource.CloudFoundryError{Code: 10010}, want: false},
+		{err: resource.CloudFoundryHTTPError{StatusCode: 404}, want: false},
+		{err: resource.CloudFoundryHTTPError{StatusCode: 502}, want: true},
+		{err: context.DeadlineExceeded, want: true},
+		{err: errors.New("connection refused"), want: true},
+	}
+	for _, tt := range tests {
+		assert.Equalf(t, tt.want, isCFAPIFailure(tt.err), "isCFAPIFailure(%v)", tt.err)
+	}
+}
@@ -4,14 +4,13 @@
 package cf
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
-	"time"
 
-	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+	"github.com/hashicorp/vault-plugin-auth-cf/client"
 	"github.com/hashicorp/vault/api"
 )
 
@@ -23,10 +22,8 @@ func (h *CLIHandler) Auth(c *api.Client, m map[string]string) (*api.Secret, erro
 		mount = "cf"
 	}
 
+	// If no role is given, the mount's default role is used.
 	role := m["role"]
-	if role == "" {
-		return nil, errors.New(`"role" is required`)
-	}
 
 	pathToInstanceCert := m["cf_instance_cert"]
 	if pathToInstanceCert == "" {
@@ -44,40 +41,25 @@ func (h *CLIHandler) Auth(c *api.Client, m map[string]string) (*api.Secret, erro
 		return nil, errors.New(`"cf_instance_key" is required`)
 	}
 
-	certBytes, err := ioutil.ReadFile(pathToInstanceCert)
-	if err != nil {
-		return nil, err
-	}
-	cfInstanceCertContents := string(certBytes)
-
-	signingTime := time.Now().UTC()
-	signatureData := &signatures.SignatureData{
-		SigningTime:            signingTime,
-		Role:                   role,
-		CFInstanceCertContents: cfInstanceCertContents,
+	opts := []client.LoginOption{
+		client.WithMountPath(mount),
+		client.WithInstanceCertPath(pathToInstanceCert),
+		client.WithInstanceKeyPath(pathToInstanceKey),
+		client.WithHash(m["hash"]),
+		// The CLI reports a failed login rather than retrying it.
+		client.WithRetries(0, 0),
 	}
-	signature, err := signatures.Sign(pathToInstanceKey, signatureData)
-	if err != nil {
-		return nil, err
+	if mountAccessor := m["mount_accessor"]; mountAccessor != "" {
+		opts = append(opts, client.WithAudience(m["vault_address"], mountAccessor))
 	}
-
-	loginData := map[string]interface{}{
-		"role":             role,
-		"cf_instance_cert": cfInstanceCertContents,
-		"signing_time":     signingTime.Format(signatures.TimeFormat),
-		"signature":        signature,
+	if challenge, _ := strconv.ParseBool(m["challenge"]); challenge {
+		opts = append(opts, client.WithChallenge())
 	}
-
-	path := fmt.Sprintf("auth/%s/login", mount)
-
-	secret, err := c.Logical().Write(path, loginData)
+	auth, err := client.NewCFAuth(role, opts...)
 	if err != nil {
 		return nil, err
 	}
-	if secret == nil {
-		return nil, errors.New("empty response from credential provider")
-	}
-	return secret, nil
+	return auth.Login(context.Background(), c)
 }
 
 func (h *CLIHandler) Help() string {
@@ -98,20 +80,42 @@ Usage: vault login -method=cf [CONFIG K=V...]
 
 Configuration:
 
+  challenge=<bool>
+      Whether to sign a nonce from the mount's "login/challenge" endpoint, so
+      that the login doesn't depend on the instance's clock. Required when the
+      mount sets "require_login_challenge".
+
   cf_instance_cert=<string>
       Explicit value to use for the path to the CF instance certificate.
 
   cf_instance_key=<string>
       Explicit value to use for the path to the CF instance key.
 
+  hash=<string>
+      Hash to use when signing the login request, one of "sha256", "sha384" or
+      "sha512". If specified, a v2 signature is sent, which requires a version of
+      the CF auth method that understands them. Only needed when the mount
+      requires "sha384" or "sha512" signatures.
+
   mount=<string>
       Path where the CF credential method is mounted. This is usually provided
       via the -path flag in the "vault login" command, but it can be specified
       here as well. If specified here, it takes precedence over the value for
       -path. The default value is "cf".
 
+  mount_accessor=<string>
+      Accessor of the CF auth mount. If specified, the signature is bound to
+      this mount and to the Vault address, so that it can't be used to log in
+      anywhere else. Required when the mount sets "login_audience_vault_address".
+
   role=<string>
-      Name of the role to request a token against
+      Name of the role to request a token against. If unset, the mount's
+      "default_role" is used.
+
+  vault_address=<string>
+      Vault address to bind the signature to when "mount_accessor" is
+      specified. It must match the mount's "login_audience_vault_address". The
+      default value is the address of the Vault client.
 `
 
 	return strings.TrimSpace(help)
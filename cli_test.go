@@ -55,6 +55,53 @@ func TestCLIHandler_Auth(t *testing.T) {
 	}
 }
 
+func TestCLIHandler_Auth_InstanceCredentials(t *testing.T) {
+	testCerts, err := certificates.Generate(testInstanceID, testOrgID, testSpaceID, testAppID, testIPAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ts := httptest.NewServer(http.HandlerFunc(handleLogin(t, testCerts)))
+	defer ts.Close()
+
+	cliHandler := &CLIHandler{}
+	client, err := api.NewClient(&api.Config{
+		Address: ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the environment, the instance's certificate and key must be given.
+	t.Setenv(EnvVarInstanceCertificate, "")
+	t.Setenv(EnvVarInstanceKey, "")
+	if _, err := cliHandler.Auth(client, map[string]string{"role": "test-role"}); err == nil {
+		t.Fatal("expected a missing instance certificate to fail")
+	}
+	if _, err := cliHandler.Auth(client, map[string]string{
+		"role":             "test-role",
+		"cf_instance_cert": testCerts.PathToInstanceCertificate,
+	}); err == nil {
+		t.Fatal("expected a missing instance key to fail")
+	}
+
+	// Paths given explicitly take precedence over the environment.
+	t.Setenv(EnvVarInstanceCertificate, "/nonexistent/instance.crt")
+	t.Setenv(EnvVarInstanceKey, "/nonexistent/instance.key")
+	if _, err := cliHandler.Auth(client, map[string]string{
+		"role":             "test-role",
+		"cf_instance_cert": testCerts.PathToInstanceCertificate,
+		"cf_instance_key":  testCerts.PathToInstanceKey,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func handleLogin(t *testing.T, testCerts *certificates.TestCertificates) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body := make(map[string]string)
@@ -0,0 +1,358 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package client logs CF app instances in to Vault's CF auth method. It signs the
+// login request with the instance's identity certificate and key, which CF provides
+// in the files named by CF_INSTANCE_CERT and CF_INSTANCE_KEY.
+//
+//	auth, err := client.NewCFAuth("my-role")
+//	if err != nil {
+//		return err
+//	}
+//	secret, err := vaultClient.Auth().Login(ctx, auth)
+//
+// A CFAuth is an api.AuthMethod, so logging in with it sets the token on the Vault
+// client. To keep the token live for as long as the app runs, use KeepLoggedIn.
+package client
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+const (
+	// EnvVarInstanceCertificate and EnvVarInstanceKey name the files CF puts the
+	// instance's identity certificate and key in.
+	EnvVarInstanceCertificate = "CF_INSTANCE_CERT"
+	EnvVarInstanceKey         = "CF_INSTANCE_KEY"
+
+	defaultMountPath  = "cf"
+	defaultMaxRetries = 2
+	defaultRetryWait  = time.Second
+)
+
+// CFAuth logs in to the CF auth method as the app instance it runs in.
+type CFAuth struct {
+	role       string
+	mountPath  string
+	certPath   string
+	keyPath    string
+	signer     crypto.Signer
+	hash       string
+	audience   *signatures.Audience
+	challenge  bool
+	maxRetries int
+	retryWait  time.Duration
+
+	// watchInterval is how often KeepLoggedIn checks for rotated credentials.
+	watchInterval time.Duration
+}
+
+var _ api.AuthMethod = (*CFAuth)(nil)
+
+// LoginOption configures a CFAuth.
+type LoginOption func(a *CFAuth) error
+
+// NewCFAuth returns a CFAuth that logs in against the role. If the role is empty, the
+// mount's default role is used. The instance's certificate and key are read from the
+// files named by CF_INSTANCE_CERT and CF_INSTANCE_KEY, unless options name others.
+func NewCFAuth(role string, opts ...LoginOption) (*CFAuth, error) {
+	a := &CFAuth{
+		role:       role,
+		mountPath:  defaultMountPath,
+		certPath:   os.Getenv(EnvVarInstanceCertificate),
+		keyPath:    os.Getenv(EnvVarInstanceKey),
+		maxRetries: defaultMaxRetries,
+		retryWait:  defaultRetryWait,
+	}
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+	a.certPath = util.CleanPath(a.certPath)
+	a.keyPath = util.CleanPath(a.keyPath)
+	if a.certPath == "" {
+		return nil, fmt.Errorf("the instance certificate's path is required, set %s or use WithInstanceCertPath", EnvVarInstanceCertificate)
+	}
+	if a.keyPath == "" && a.signer == nil {
+		return nil, fmt.Errorf("the instance key's path is required, set %s or use WithInstanceKeyPath", EnvVarInstanceKey)
+	}
+	return a, nil
+}
+
+// WithMountPath sets the path the CF auth method is mounted at, "cf" by default.
+func WithMountPath(mountPath string) LoginOption {
+	return func(a *CFAuth) error {
+		a.mountPath = mountPath
+		return nil
+	}
+}
+
+// WithInstanceCertPath sets the path of the instance's identity certificate, instead
+// of the one named by CF_INSTANCE_CERT.
+func WithInstanceCertPath(certPath string) LoginOption {
+	return func(a *CFAuth) error {
+		a.certPath = certPath
+		return nil
+	}
+}
+
+// WithInstanceKeyPath sets the path of the instance's private key, instead of the one
+// named by CF_INSTANCE_KEY.
+func WithInstanceKeyPath(keyPath string) LoginOption {
+	return func(a *CFAuth) error {
+		a.keyPath = keyPath
+		return nil
+	}
+}
+
+// WithSigner signs logins with the signer, such as a key kept in an HSM, instead of
+// the key read from the instance key's path.
+func WithSigner(signer crypto.Signer) LoginOption {
+	return func(a *CFAuth) error {
+		a.signer = signer
+		return nil
+	}
+}
+
+// WithHash signs logins with the hash, one of "sha256", "sha384" or "sha512", for
+// mounts that require "sha384" or "sha512" signatures.
+func WithHash(hash string) LoginOption {
+	return func(a *CFAuth) error {
+		a.hash = hash
+		return nil
+	}
+}
+
+// WithAudience binds the login signatures to the mount's accessor and the Vault
+// address, which must match the mount's "login_audience_vault_address". If the
+// address is empty, the Vault client's is used.
+func WithAudience(vaultAddress, mountAccessor string) LoginOption {
+	return func(a *CFAuth) error {
+		if mountAccessor == "" {
+			return errors.New("the mount accessor is required for an audience")
+		}
+		a.audience = &signatures.Audience{
+			VaultAddress:  vaultAddress,
+			MountAccessor: mountAccessor,
+		}
+		return nil
+	}
+}
+
+// WithChallenge has each login sign a nonce from the mount's login/challenge
+// endpoint, which mounts that set "require_login_challenge" require. Logins signing a
+// nonce don't depend on the instance's clock.
+func WithChallenge() LoginOption {
+	return func(a *CFAuth) error {
+		a.challenge = true
+		return nil
+	}
+}
+
+// WithRetries sets how many times a login that failed because Vault couldn't serve it
+// is tried again, and how long is waited before the first retry, doubling for each
+// one after. Each retry is signed anew, since Vault refuses signatures it has seen.
+// By default a login is retried twice, after a second.
+func WithRetries(maxRetries int, wait time.Duration) LoginOption {
+	return func(a *CFAuth) error {
+		if maxRetries < 0 || wait < 0 {
+			return errors.New("the retries and their wait must not be negative")
+		}
+		a.maxRetries = maxRetries
+		a.retryWait = wait
+		return nil
+	}
+}
+
+// WithWatchInterval sets how often KeepLoggedIn checks whether the instance's
+// certificate and key have been rotated, DefaultWatchInterval by default.
+func WithWatchInterval(interval time.Duration) LoginOption {
+	return func(a *CFAuth) error {
+		a.watchInterval = interval
+		return nil
+	}
+}
+
+// Login logs in to the CF auth method, retrying logins that failed because Vault
+// couldn't serve them. The instance's certificate and key are read on each login, as
+// CF rotates them.
+func (a *CFAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	wait := a.retryWait
+	for attempt := 0; ; attempt++ {
+		secret, err := a.login(ctx, client)
+		if err == nil || attempt >= a.maxRetries || !retryable(err) {
+			return secret, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (a *CFAuth) login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	nonce := ""
+	if a.challenge {
+		challenge, err := client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login/challenge", a.mountPath), nil)
+		if err != nil {
+			return nil, err
+		}
+		if challenge == nil || challenge.Data["nonce"] == nil {
+			return nil, errors.New("empty response from the login challenge")
+		}
+		nonce, _ = challenge.Data["nonce"].(string)
+	}
+	loginData, err := a.LoginDataWithNonce(client.Address(), nonce)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.mountPath), loginData)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from credential provider")
+	}
+	return secret, nil
+}
+
+// LoginData returns the data of a signed request to the CF auth method's login
+// endpoint, for callers that make the request themselves. The Vault address is the one
+// the signature is bound to, if an audience is set without one.
+func (a *CFAuth) LoginData(vaultAddress string) (map[string]interface{}, error) {
+	return a.LoginDataWithNonce(vaultAddress, "")
+}
+
+// LoginDataWithNonce is like LoginData, but signs the nonce issued by the CF auth
+// method's login/challenge endpoint, if it's set.
+func (a *CFAuth) LoginDataWithNonce(vaultAddress, nonce string) (map[string]interface{}, error) {
+	certBytes, err := os.ReadFile(a.certPath)
+	if err != nil {
+		return nil, err
+	}
+	signer := a.signer
+	if signer == nil {
+		if signer, err = signatures.LoadPrivateKey(a.keyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	signingTime := time.Now().UTC()
+	signatureData := &signatures.SignatureData{
+		SigningTime:            signingTime,
+		Role:                   a.role,
+		CFInstanceCertContents: string(certBytes),
+		Nonce:                  nonce,
+	}
+	if a.audience != nil {
+		audience := *a.audience
+		if audience.VaultAddress == "" {
+			audience.VaultAddress = vaultAddress
+		}
+		signatureData.Audience = &audience
+	}
+	var signature string
+	if a.hash != "" {
+		signature, err = signatures.SignV2WithHash(signer, signatureData, a.hash)
+	} else {
+		signature, err = signatures.Sign(signer, signatureData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	loginData := map[string]interface{}{
+		"role":             a.role,
+		"cf_instance_cert": string(certBytes),
+		"signing_time":     signingTime.Format(signatures.TimeFormat),
+		"signature":        signature,
+	}
+	if nonce != "" {
+		loginData["nonce"] = nonce
+	}
+	return loginData, nil
+}
+
+// retryable reports whether the login failed because Vault couldn't serve it, rather
+// than because it was refused.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500 || respErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// KeepLoggedIn logs in, setting the token on the client, and keeps it live until the
+// context is done. The token is renewed as its TTL runs out, and once it can't be
+// renewed any longer, such as at its max TTL, or once CF has rotated the instance's
+// certificate and key, a new one is logged in for. The onLogin func, if not nil, is
+// called with each new token's secret. It returns nil once the context is done, or the
+// error a login failed with.
+func (a *CFAuth) KeepLoggedIn(ctx context.Context, client *api.Client, onLogin func(*api.Secret)) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rotated, err := a.WatchCredentials(watchCtx, a.watchInterval)
+	if err != nil {
+		return err
+	}
+	for {
+		secret, err := client.Auth().Login(ctx, a)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if onLogin != nil {
+			onLogin(secret)
+		}
+
+		watcher, err := client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+		if err != nil {
+			return err
+		}
+		go watcher.Start()
+		done := watchLifetime(ctx, watcher, rotated)
+		watcher.Stop()
+		if done {
+			return nil
+		}
+	}
+}
+
+// watchLifetime waits for the watcher to stop renewing the token, or for the instance's
+// credentials to be rotated, and reports whether it stopped because the context is done.
+func watchLifetime(ctx context.Context, watcher *api.LifetimeWatcher, rotated <-chan struct{}) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-watcher.DoneCh():
+			return false
+		case _, ok := <-rotated:
+			// The channel is closed once the context is done.
+			return !ok
+		case <-watcher.RenewCh():
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+)
+
+const testNonce = "test-nonce"
+
+const loginResponse = `{
+	"auth": {
+		"client_token": "s.JvMmUR9OmjhB7XWtQzSiJBra",
+		"accessor": "35rHkAVgFtpNKZvFucAz66iL",
+		"policies": ["default"],
+		"lease_duration": 1,
+		"renewable": false,
+		"token_type": "service"
+	}
+}`
+
+// vaultServer mocks Vault's login endpoint at auth/cf/login, responding to each login
+// with the status the statuses func returns for it, and checking the login's signature.
+// Its login/challenge endpoint always issues testNonce.
+func vaultServer(t *testing.T, statuses func(login int) int) (*api.Client, func() int) {
+	var mu sync.Mutex
+	logins := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/cf/login/challenge" {
+			w.Write([]byte(`{"data": {"nonce": "` + testNonce + `"}}`))
+			return
+		}
+		if r.URL.Path != "/v1/auth/cf/login" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		signingTime, err := time.Parse(signatures.TimeFormat, body["signing_time"])
+		if err != nil {
+			t.Error(err)
+		}
+		if _, err := signatures.Verify(body["signature"], &signatures.SignatureData{
+			SigningTime:            signingTime,
+			Role:                   body["role"],
+			CFInstanceCertContents: body["cf_instance_cert"],
+			Nonce:                  body["nonce"],
+		}); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		logins++
+		status := statuses(logins)
+		mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"errors": ["login failed"]}`))
+			return
+		}
+		w.Write([]byte(loginResponse))
+	}))
+	t.Cleanup(s.Close)
+
+	client, err := api.NewClient(&api.Config{Address: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return logins
+	}
+}
+
+func testCFAuth(t *testing.T) *CFAuth {
+	testCerts, err := certificates.Generate("instance-id", "org-id", "space-id", "app-id", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := testCerts.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	auth, err := NewCFAuth("test-role",
+		WithInstanceCertPath(testCerts.PathToInstanceCertificate),
+		WithInstanceKeyPath(testCerts.PathToInstanceKey),
+		WithRetries(2, time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestNewCFAuth(t *testing.T) {
+	t.Setenv(EnvVarInstanceCertificate, "")
+	t.Setenv(EnvVarInstanceKey, "")
+	if _, err := NewCFAuth("test-role"); err == nil {
+		t.Fatal("expected a missing instance certificate to fail")
+	}
+
+	t.Setenv(EnvVarInstanceCertificate, "/etc/cf-instance-credentials/instance.crt")
+	t.Setenv(EnvVarInstanceKey, "/etc/cf-instance-credentials/instance.key")
+	auth, err := NewCFAuth("test-role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.certPath != "/etc/cf-instance-credentials/instance.crt" || auth.keyPath != "/etc/cf-instance-credentials/instance.key" {
+		t.Fatalf("expected the paths to be read from the environment but received %q and %q", auth.certPath, auth.keyPath)
+	}
+	if _, err := NewCFAuth("test-role", WithRetries(-1, 0)); err == nil {
+		t.Fatal("expected negative retries to fail")
+	}
+}
+
+func TestCFAuth_Login(t *testing.T) {
+	auth := testCFAuth(t)
+
+	// Logins Vault couldn't serve are retried.
+	client, logins := vaultServer(t, func(login int) int {
+		if login < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	secret, err := client.Auth().Login(context.Background(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logins() != 3 {
+		t.Fatalf("expected 3 logins but received %d", logins())
+	}
+	if client.Token() != secret.Auth.ClientToken {
+		t.Fatalf("expected the client's token to be %q but received %q", secret.Auth.ClientToken, client.Token())
+	}
+
+	// Until the retries run out.
+	client, logins = vaultServer(t, func(int) int { return http.StatusInternalServerError })
+	if _, err := auth.Login(context.Background(), client); err == nil {
+		t.Fatal("expected the login to fail")
+	}
+	if logins() != 3 {
+		t.Fatalf("expected 3 logins but received %d", logins())
+	}
+
+	// Logins Vault refused aren't.
+	client, logins = vaultServer(t, func(int) int { return http.StatusForbidden })
+	if _, err := auth.Login(context.Background(), client); err == nil {
+		t.Fatal("expected the login to fail")
+	}
+	if logins() != 1 {
+		t.Fatalf("expected 1 login but received %d", logins())
+	}
+}
+
+func TestCFAuth_LoginChallenge(t *testing.T) {
+	auth := testCFAuth(t)
+	if err := WithChallenge()(auth); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mock server fails the test for signatures that leave out the nonce it issued.
+	client, logins := vaultServer(t, func(int) int { return http.StatusOK })
+	if _, err := client.Auth().Login(context.Background(), auth); err != nil {
+		t.Fatal(err)
+	}
+	if logins() != 1 {
+		t.Fatalf("expected 1 login but received %d", logins())
+	}
+
+	loginData, err := auth.LoginDataWithNonce(client.Address(), testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loginData["nonce"] != testNonce {
+		t.Fatalf("expected the login data to include the nonce but received %v", loginData)
+	}
+}
+
+func TestCFAuth_KeepLoggedIn(t *testing.T) {
+	auth := testCFAuth(t)
+	client, logins := vaultServer(t, func(int) int { return http.StatusOK })
+
+	// The token can't be renewed and lasts a second, so it's logged in for again.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var secrets []*api.Secret
+	err := auth.KeepLoggedIn(ctx, client, func(secret *api.Secret) {
+		secrets = append(secrets, secret)
+		if len(secrets) == 2 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || logins() != 2 {
+		t.Fatalf("expected 2 logins but received %d", logins())
+	}
+
+	// A refused login is returned.
+	client, _ = vaultServer(t, func(int) int { return http.StatusForbidden })
+	if err := auth.KeepLoggedIn(context.Background(), client, nil); err == nil {
+		t.Fatal("expected the login to fail")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+// DefaultWatchInterval is how often the instance's certificate and key are checked
+// for rotation if no interval is given.
+const DefaultWatchInterval = time.Minute
+
+// WatchInstanceCredentials checks the instance's certificate and key files every
+// interval, and sends on the returned channel when CF has rotated them, so that the
+// app can log in again before its certificate expires. Diego rotates them about once
+// a day, writing the certificate and key one after the other, so a rotation is only
+// signaled once the key matches the new certificate. If the key path is empty, as when
+// logins are signed with another signer, only the certificate is watched.
+//
+// The channel holds at most one rotation that hasn't been received, and is closed
+// once the context is done. An error is returned if the files can't be read to begin
+// with.
+func WatchInstanceCredentials(ctx context.Context, certPath, keyPath string, interval time.Duration) (<-chan struct{}, error) {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	last, err := readInstanceCredentials(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := make(chan struct{}, 1)
+	go func() {
+		defer close(rotated)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// The files are briefly missing or mismatched while they're rotated, so
+			// failing to read them is only tried again on the next tick.
+			current, err := readInstanceCredentials(certPath, keyPath)
+			if err != nil || bytes.Equal(current, last) {
+				continue
+			}
+			last = current
+			select {
+			case rotated <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return rotated, nil
+}
+
+// WatchCredentials watches the certificate and key the CFAuth logs in with, as
+// WatchInstanceCredentials does.
+func (a *CFAuth) WatchCredentials(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+	keyPath := a.keyPath
+	if a.signer != nil {
+		keyPath = ""
+	}
+	return WatchInstanceCredentials(ctx, a.certPath, keyPath, interval)
+}
+
+// readInstanceCredentials returns a digest of the certificate and key, if the key
+// belongs to the certificate.
+func readInstanceCredentials(certPath, keyPath string) ([]byte, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.New()
+	digest.Write(certPEM)
+	if keyPath != "" {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKeyPair(string(certPEM), keyPEM); err != nil {
+			return nil, err
+		}
+		digest.Write(keyPEM)
+	}
+	return digest.Sum(nil), nil
+}
+
+// checkKeyPair returns an error unless the key belongs to the identity certificate.
+func checkKeyPair(certPEM string, keyPEM []byte) error {
+	_, identityCert, err := util.ExtractCertificates(certPEM)
+	if err != nil {
+		return err
+	}
+	signer, err := util.ParsePrivateKey(keyPEM, nil)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(identityCert.PublicKey) {
+		return errors.New("the instance key doesn't belong to the instance certificate")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+)
+
+func TestWatchInstanceCredentials(t *testing.T) {
+	var generated []*certificates.TestCertificates
+	for i := 0; i < 2; i++ {
+		testCerts, err := certificates.Generate("instance-id", "org-id", "space-id", "app-id", "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := testCerts.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+		generated = append(generated, testCerts)
+	}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "instance.crt")
+	keyPath := filepath.Join(dir, "instance.key")
+	write := func(path, contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(certPath, generated[0].InstanceCertificate)
+	write(keyPath, generated[0].InstanceKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rotated, err := WatchInstanceCredentials(ctx, certPath, keyPath, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate whose key hasn't been written yet isn't a rotation.
+	write(certPath, generated[1].InstanceCertificate)
+	select {
+	case <-rotated:
+		t.Fatal("expected no rotation until the key matches the certificate")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	write(keyPath, generated[1].InstanceKey)
+	select {
+	case <-rotated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a rotation")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-rotated:
+		if ok {
+			t.Fatal("expected no further rotation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the channel to be closed")
+	}
+
+	if _, err := WatchInstanceCredentials(context.Background(), filepath.Join(dir, "missing.crt"), keyPath, 0); err == nil {
+		t.Fatal("expected a missing certificate to fail")
+	}
+}
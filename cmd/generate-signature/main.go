@@ -52,7 +52,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	signature, err := signatures.Sign(pathToInstanceKey, &signatures.SignatureData{
+	signer, err := signatures.LoadPrivateKey(pathToInstanceKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signature, err := signatures.Sign(signer, &signatures.SignatureData{
 		SigningTime:            signingTime,
 		CFInstanceCertContents: string(instanceCertBytes),
 		Role:                   roleName,
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/broker"
+)
+
+// plan is a plan as it's given in BROKER_PLANS, with its TTLs as durations like "1h".
+type plan struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description"`
+	TokenPolicies []string `json:"token_policies"`
+	TokenTTL      string   `json:"token_ttl"`
+	TokenMaxTTL   string   `json:"token_max_ttl"`
+}
+
+// The broker is configured by the environment, so that it can be pushed as a CF app:
+// VAULT_ADDR and VAULT_TOKEN, along with the Vault client's other variables, BROKER_PLANS
+// as a JSON list of plans, BROKER_USERNAME and BROKER_PASSWORD, and optionally
+// CF_AUTH_MOUNT, BROKER_ROLE_PREFIX, and PORT.
+func main() {
+	logger := hclog.New(&hclog.LoggerOptions{Name: "vault-cf-broker"})
+	if err := run(logger); err != nil {
+		logger.Error("broker shutting down", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger hclog.Logger) error {
+	vaultClient, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	var rawPlans []plan
+	if err := json.Unmarshal([]byte(os.Getenv("BROKER_PLANS")), &rawPlans); err != nil {
+		return err
+	}
+	plans := make([]broker.Plan, 0, len(rawPlans))
+	for _, raw := range rawPlans {
+		p := broker.Plan{
+			ID:            raw.ID,
+			Name:          raw.Name,
+			Description:   raw.Description,
+			TokenPolicies: raw.TokenPolicies,
+		}
+		if raw.TokenTTL != "" {
+			if p.TokenTTL, err = time.ParseDuration(raw.TokenTTL); err != nil {
+				return err
+			}
+		}
+		if raw.TokenMaxTTL != "" {
+			if p.TokenMaxTTL, err = time.ParseDuration(raw.TokenMaxTTL); err != nil {
+				return err
+			}
+		}
+		plans = append(plans, p)
+	}
+
+	opts := []broker.Option{broker.WithCredentials(os.Getenv("BROKER_USERNAME"), os.Getenv("BROKER_PASSWORD"))}
+	if mountPath := os.Getenv("CF_AUTH_MOUNT"); mountPath != "" {
+		opts = append(opts, broker.WithMountPath(mountPath))
+	}
+	if prefix := os.Getenv("BROKER_ROLE_PREFIX"); prefix != "" {
+		opts = append(opts, broker.WithRolePrefix(prefix))
+	}
+	b, err := broker.NewBroker(vaultClient, plans, opts...)
+	if err != nil {
+		return err
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	logger.Info("broker listening", "port", port, "plans", len(plans))
+	return http.ListenAndServe(":"+port, b)
+}
@@ -69,8 +69,13 @@ func main() {
 		Role:                   "test-role",
 	}
 
+	signer, err := signatures.LoadPrivateKey(dir + "/" + *pathToInstanceKey)
+	if err != nil {
+		log.Fatalf("couldn't read %s: %s\n", *pathToInstanceKey, err)
+	}
+
 	// Create a signature.
-	signature, err := signatures.Sign(dir+"/"+*pathToInstanceKey, signatureData)
+	signature, err := signatures.Sign(signer, signatureData)
 	if err != nil {
 		log.Fatalf(`couldn't perform signature: %s\n`, err)
 	}
@@ -81,12 +86,12 @@ func main() {
 		log.Fatalf(`couldn't verify signature: %s\n`, err)
 	}
 
-	intermediateCert, identityCert, err := util.ExtractCertificates(string(instanceCertBytes))
+	intermediateCerts, identityCert, err := util.ExtractCertificates(string(instanceCertBytes))
 	if err != nil {
 		log.Fatalf(`couldn't extract certificates from %s: %s'`, instanceCertBytes, err)
 	}
 
-	if err := util.Validate([]string{string(caCertBytes)}, intermediateCert, identityCert, signingCert); err != nil {
+	if err := util.Validate([]string{string(caCertBytes)}, intermediateCerts, identityCert, signingCert); err != nil {
 		log.Fatalf(`couldn't validate cert chain: %s'`, err)
 	}
 
@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/helper/salt"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// credentialSaltStorageKey is where the salt that config reads hash the credentials with
+// is stored. It's written along with the config, so that reads don't write to storage.
+const credentialSaltStorageKey = "credential-salt"
+
+// configCredentials returns the config's credentials by the name of their field. Config
+// reads never return them.
+func configCredentials(config *models.Configuration) map[string]string {
+	return map[string]string{
+		"cf_password":               config.CFPassword,
+		"cf_client_secret":          config.CFClientSecret,
+		"cf_access_token":           config.CFAccessToken,
+		"cf_refresh_token":          config.CFRefreshToken,
+		"cf_jwt_bearer_signing_key": config.CFJWTBearerSigningKey,
+		"cf_proxy_password":         config.CFProxyPassword,
+		"cf_api_mutual_tls_key":     config.CFMutualTLSKey,
+		"credhub_client_secret":     config.CredHubClientSecret,
+	}
+}
+
+// credentialSalt returns the salt the credentials are hashed with. It's only created if
+// create is set, and is otherwise nil if it doesn't exist yet.
+func credentialSalt(ctx context.Context, storage logical.Storage, create bool) (*salt.Salt, error) {
+	if !create {
+		entry, err := storage.Get(ctx, credentialSaltStorageKey)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+	}
+	return salt.NewSalt(ctx, storage, &salt.Config{Location: credentialSaltStorageKey})
+}
+
+// addCredentialStatus adds whether each of the config's credentials is set to the data of
+// a config read, and for those that are, their HMAC, so that changes to them can be told
+// without them being returned.
+func addCredentialStatus(ctx context.Context, storage logical.Storage, config *models.Configuration, data map[string]interface{}) error {
+	credSalt, err := credentialSalt(ctx, storage, false)
+	if err != nil {
+		return err
+	}
+	for field, value := range configCredentials(config) {
+		data[field+"_set"] = value != ""
+		if value != "" && credSalt != nil {
+			data[field+"_hash"] = credSalt.GetIdentifiedHMAC(value)
+		}
+	}
+	return nil
+}
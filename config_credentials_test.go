@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestAddCredentialStatus(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	config := &models.Configuration{CFPassword: "password", CFClientSecret: "secret"}
+
+	// Configs written before the salt existed only report which credentials are set,
+	// since reads don't write to storage.
+	data := map[string]interface{}{}
+	if err := addCredentialStatus(ctx, storage, config, data); err != nil {
+		t.Fatal(err)
+	}
+	if data["cf_password_set"] != true || data["cf_api_mutual_tls_key_set"] != false {
+		t.Fatalf("expected only the set credentials to be reported as set but received %v", data)
+	}
+	if _, ok := data["cf_password_hash"]; ok {
+		t.Fatalf("expected no hashes without a salt but received %v", data)
+	}
+	if keys, err := storage.List(ctx, ""); err != nil || len(keys) != 0 {
+		t.Fatalf("expected the read not to write to storage but received %v, %v", keys, err)
+	}
+
+	if _, err := credentialSalt(ctx, storage, true); err != nil {
+		t.Fatal(err)
+	}
+	data = map[string]interface{}{}
+	if err := addCredentialStatus(ctx, storage, config, data); err != nil {
+		t.Fatal(err)
+	}
+	passwordHash, _ := data["cf_password_hash"].(string)
+	if passwordHash == "" || passwordHash == data["cf_client_secret_hash"] {
+		t.Fatalf("expected distinct hashes of the credentials but received %v", data)
+	}
+
+	// The hash only changes with the credential.
+	sameData := map[string]interface{}{}
+	if err := addCredentialStatus(ctx, storage, config, sameData); err != nil {
+		t.Fatal(err)
+	}
+	if sameData["cf_password_hash"] != passwordHash {
+		t.Fatalf("expected the hash %s to be stable but received %v", passwordHash, sameData["cf_password_hash"])
+	}
+	config.CFPassword = "rotated"
+	rotatedData := map[string]interface{}{}
+	if err := addCredentialStatus(ctx, storage, config, rotatedData); err != nil {
+		t.Fatal(err)
+	}
+	if rotatedData["cf_password_hash"] == passwordHash {
+		t.Fatal("expected the hash to change along with the credential")
+	}
+}
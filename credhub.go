@@ -0,0 +1,223 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// defaultCredHubRefreshInterval is how often the identity CA is read from CredHub
+// again if no interval is configured.
+const defaultCredHubRefreshInterval = time.Hour
+
+// credHubRefreshInterval returns how often the identity CA is read from CredHub.
+func credHubRefreshInterval(config *models.Configuration) time.Duration {
+	if config.CredHubRefreshInterval > 0 {
+		return config.CredHubRefreshInterval
+	}
+	return defaultCredHubRefreshInterval
+}
+
+// defaultCredHubTimeout bounds each request to CredHub and its UAA if no cf_timeout is
+// configured.
+const defaultCredHubTimeout = 30 * time.Second
+
+// fetchCredHubIdentityCA reads the identity CA bundle from the configured CredHub path,
+// authenticating to the UAA that CredHub names with the configured client credentials.
+func fetchCredHubIdentityCA(ctx context.Context, config *models.Configuration) ([]string, error) {
+	httpClient, err := newCredHubHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	addr := strings.TrimSuffix(config.CredHubAddr, "/")
+
+	var info struct {
+		AuthServer struct {
+			URL string `json:"url"`
+		} `json:"auth-server"`
+	}
+	if err := getCredHubJSON(ctx, httpClient, addr+"/info", &info); err != nil {
+		return nil, err
+	}
+	if info.AuthServer.URL == "" {
+		return nil, errors.New("CredHub's info doesn't name its auth server")
+	}
+
+	tokenConfig := &clientcredentials.Config{
+		ClientID:     config.CredHubClientID,
+		ClientSecret: config.CredHubClientSecret,
+		TokenURL:     strings.TrimSuffix(info.AuthServer.URL, "/") + "/oauth/token",
+	}
+	authClient := tokenConfig.Client(context.WithValue(ctx, oauth2.HTTPClient, httpClient))
+
+	var credentials struct {
+		Data []struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"data"`
+	}
+	query := url.Values{"name": {config.CredHubIdentityCAPath}, "current": {"true"}}
+	if err := getCredHubJSON(ctx, authClient, addr+"/api/v1/data?"+query.Encode(), &credentials); err != nil {
+		return nil, err
+	}
+	if len(credentials.Data) == 0 {
+		return nil, fmt.Errorf("CredHub has no credential at %q", config.CredHubIdentityCAPath)
+	}
+
+	// The identity CA is usually stored as a certificate credential, whose own CA is
+	// also trusted if it has one, but may be stored as a plain value.
+	var caCerts []string
+	credential := credentials.Data[0]
+	switch credential.Type {
+	case "certificate":
+		var value struct {
+			CA          string `json:"ca"`
+			Certificate string `json:"certificate"`
+		}
+		if err := json.Unmarshal(credential.Value, &value); err != nil {
+			return nil, err
+		}
+		for _, cert := range []string{value.Certificate, value.CA} {
+			if cert != "" && !slices.Contains(caCerts, cert) {
+				caCerts = append(caCerts, cert)
+			}
+		}
+	case "value":
+		var value string
+		if err := json.Unmarshal(credential.Value, &value); err != nil {
+			return nil, err
+		}
+		caCerts = append(caCerts, value)
+	default:
+		return nil, fmt.Errorf("CredHub's credential at %q is a %s, rather than a certificate or value", config.CredHubIdentityCAPath, credential.Type)
+	}
+	for _, caCert := range caCerts {
+		if _, err := parseCertificatesPEM(caCert); err != nil {
+			return nil, fmt.Errorf("CredHub's credential at %q isn't a CA bundle: %w", config.CredHubIdentityCAPath, err)
+		}
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("CredHub's credential at %q is empty", config.CredHubIdentityCAPath)
+	}
+	return caCerts, nil
+}
+
+// newCredHubHTTPClient returns a client that trusts the configured CredHub CA
+// certificates, as well as the system's.
+func newCredHubHTTPClient(config *models.Configuration) (*http.Client, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	for idx, certificate := range config.CredHubCACertificates {
+		if ok := rootCAs.AppendCertsFromPEM([]byte(certificate)); !ok {
+			return nil, fmt.Errorf("failed to append CredHub cert to cert pool, index=%d", idx)
+		}
+	}
+	httpClient := cleanhttp.DefaultClient()
+	httpClient.Timeout = defaultCredHubTimeout
+	if config.CFTimeout > 0 {
+		httpClient.Timeout = config.CFTimeout
+	}
+	transport := cleanhttp.DefaultTransport()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: rootCAs,
+	}
+	httpClient.Transport = transport
+	return httpClient, nil
+}
+
+// getCredHubJSON decodes the JSON response to a GET for the URL into v.
+func getCredHubJSON(ctx context.Context, httpClient *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("CredHub couldn't be reached: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("CredHub responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refreshCredHubIdentityCA reads the identity CA from CredHub again once the refresh
+// interval has passed, and stores it in the config. If CredHub can't be read, the
+// identity CA it last returned remains trusted, and it's read again on the next call.
+// CredHub is read without holding the config lock, so that logins and config writes
+// don't wait on it.
+func (b *backend) refreshCredHubIdentityCA(ctx context.Context, storage logical.Storage, now time.Time) error {
+	b.mu.RLock()
+	config, err := getConfig(ctx, storage)
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if config == nil || config.CredHubIdentityCAPath == "" || !b.canReconcile() {
+		return nil
+	}
+	if now.Before(config.CredHubRefreshedAt.Add(credHubRefreshInterval(config))) {
+		return nil
+	}
+
+	caCerts, err := fetchCredHubIdentityCA(ctx, config)
+	if err != nil {
+		b.Logger().Warn("unable to refresh the identity CA from CredHub", "path", config.CredHubIdentityCAPath, "error", err)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fetchedFrom := config
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.CredHubAddr != fetchedFrom.CredHubAddr || config.CredHubIdentityCAPath != fetchedFrom.CredHubIdentityCAPath {
+		// The config was changed while CredHub was being read, so what it returned may
+		// no longer be what's meant to be trusted.
+		return nil
+	}
+	before, err := changeSnapshot(config)
+	if err != nil {
+		return err
+	}
+	caCertsUpdated := !slices.Equal(caCerts, config.CredHubIdentityCACertificates)
+	config.CredHubIdentityCACertificates = caCerts
+	config.CredHubRefreshedAt = now
+	if err := storeConfig(ctx, storage, config); err != nil {
+		return err
+	}
+	if caCertsUpdated {
+		b.Logger().Info("refreshed the identity CA from CredHub", "path", config.CredHubIdentityCAPath)
+		b.sendEvent(ctx, eventTypeConfigWrite, "path", "config", "modified", "true", "identity_ca_certificates_updated", "true")
+		b.recordChange(ctx, storage, &configChange{Path: "config", Operation: "refresh", Time: now}, before, config)
+	}
+	return nil
+}
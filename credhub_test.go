@@ -0,0 +1,276 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+const (
+	credHubClientID     = "vault-cf-auth"
+	credHubClientSecret = "credhub-secret"
+	credHubCAPath       = "/cf/diego-instance-identity-root-ca"
+)
+
+// credHubServer mocks a CredHub, and the UAA it names, that has the CA certificate
+// at credHubCAPath.
+func credHubServer(t *testing.T, caCert string) *httptest.Server {
+	return credHubServerWithHook(t, caCert, nil)
+}
+
+// credHubServerWithHook is credHubServer, but calls onRead, if it's set, before
+// answering each read of a credential.
+func credHubServerWithHook(t *testing.T, caCert string, onRead func()) *httptest.Server {
+	mux := http.NewServeMux()
+	var s *httptest.Server
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]interface{}{
+			"auth-server": map[string]string{"url": s.URL + "/uaa"},
+		})
+	})
+	mux.HandleFunc("/uaa/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != credHubClientID || clientSecret != credHubClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(t, w, map[string]interface{}{
+			"access_token": "credhub-token",
+			"token_type":   "bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/api/v1/data", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer credhub-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if onRead != nil {
+			onRead()
+		}
+		if r.URL.Query().Get("name") != credHubCAPath {
+			writeJSON(t, w, map[string]interface{}{"data": []interface{}{}})
+			return
+		}
+		writeJSON(t, w, map[string]interface{}{
+			"data": []interface{}{
+				map[string]interface{}{
+					"type": "certificate",
+					"value": map[string]string{
+						"ca":          caCert,
+						"certificate": caCert,
+					},
+				},
+			},
+		})
+	})
+	s = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func credHubConfig(s *httptest.Server) *models.Configuration {
+	return &models.Configuration{
+		Version:               1,
+		CredHubAddr:           s.URL,
+		CredHubIdentityCAPath: credHubCAPath,
+		CredHubClientID:       credHubClientID,
+		CredHubClientSecret:   credHubClientSecret,
+		CredHubCACertificates: []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}))},
+	}
+}
+
+func TestFetchCredHubIdentityCA(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	s := credHubServer(t, testCerts.CACertificate)
+	config := credHubConfig(s)
+
+	caCerts, err := fetchCredHubIdentityCA(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate and its CA are the same, so it's only trusted once.
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(caCerts, expected) {
+		t.Fatalf("expected %q but received %q", expected, caCerts)
+	}
+
+	config.CredHubIdentityCAPath = "/cf/missing"
+	if _, err := fetchCredHubIdentityCA(context.Background(), config); err == nil {
+		t.Fatal("expected a missing credential to fail")
+	}
+	config.CredHubIdentityCAPath = credHubCAPath
+	config.CredHubClientSecret = "wrong"
+	if _, err := fetchCredHubIdentityCA(context.Background(), config); err == nil {
+		t.Fatal("expected the wrong client secret to fail")
+	}
+	config.CredHubClientSecret = credHubClientSecret
+	config.CredHubCACertificates = nil
+	if _, err := fetchCredHubIdentityCA(context.Background(), config); err == nil {
+		t.Fatal("expected an untrusted CredHub to fail")
+	}
+}
+
+func TestRefreshCredHubIdentityCA(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	s := credHubServer(t, testCerts.CACertificate)
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	config := credHubConfig(s)
+	config.CredHubIdentityCACertificates = []string{"a previous CA"}
+	if err := storeConfig(ctx, storage, config); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	now := time.Now().UTC()
+	if err := b.refreshCredHubIdentityCA(ctx, storage, now); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(config.CredHubIdentityCACertificates, expected) {
+		t.Fatalf("expected %q but received %q", expected, config.CredHubIdentityCACertificates)
+	}
+	if !config.CredHubRefreshedAt.Equal(now) {
+		t.Fatalf("expected the refresh time to be %s but received %s", now, config.CredHubRefreshedAt)
+	}
+
+	// Once CredHub can't be read, the identity CA it last returned remains trusted.
+	s.Close()
+	if err := b.refreshCredHubIdentityCA(ctx, storage, now.Add(2*defaultCredHubRefreshInterval)); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(config.CredHubIdentityCACertificates, expected) {
+		t.Fatalf("expected %q to remain trusted but received %q", expected, config.CredHubIdentityCACertificates)
+	}
+	if !config.CredHubRefreshedAt.Equal(now) {
+		t.Fatalf("expected the refresh time to remain %s but received %s", now, config.CredHubRefreshedAt)
+	}
+}
+
+func TestRefreshCredHubIdentityCAConfigChanged(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	var b *backend
+	// While CredHub is read, the CredHub path is changed by a config write, which
+	// mustn't have to wait for the read to finish.
+	s := credHubServerWithHook(t, testCerts.CACertificate, func() {
+		locked := make(chan struct{})
+		go func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			defer close(locked)
+			config, err := getConfig(ctx, storage)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			config.CredHubIdentityCAPath = "/cf/another-ca"
+			if err := storeConfig(ctx, storage, config); err != nil {
+				t.Error(err)
+			}
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Error("the config lock was held while CredHub was read")
+		}
+	})
+	config := credHubConfig(s)
+	config.CredHubIdentityCACertificates = []string{"a previous CA"}
+	if err := storeConfig(ctx, storage, config); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = lb.(*backend)
+
+	if err := b.refreshCredHubIdentityCA(ctx, storage, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a previous CA"}; !reflect.DeepEqual(config.CredHubIdentityCACertificates, expected) {
+		t.Fatalf("expected the CA read from the previous path not to be stored, but received %q", config.CredHubIdentityCACertificates)
+	}
+	if !config.CredHubRefreshedAt.IsZero() {
+		t.Fatalf("expected no refresh time but received %s", config.CredHubRefreshedAt)
+	}
+}
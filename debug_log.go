@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// debugLogCertDetail returns how much of the instance certificate logins log at the
+// debug level.
+func debugLogCertDetail(config *models.Configuration) string {
+	if config.DebugLogCertDetail == "" {
+		return models.DebugLogCertFull
+	}
+	return config.DebugLogCertDetail
+}
+
+// logLoginAttempt logs the certificate a login is made with at the debug level, with as
+// much detail as the config allows.
+func (b *backend) logLoginAttempt(config *models.Configuration, msg string, cfCert *models.CFCertificate) {
+	if !b.Logger().IsDebug() {
+		return
+	}
+	if debugLogCertDetail(config) == models.DebugLogCertFull {
+		b.Logger().Debug(fmt.Sprintf("%s from %+v", msg, cfCert))
+		return
+	}
+	b.Logger().Debug(msg,
+		"instance_id", debugLogID(config, cfCert.InstanceID),
+		"app_id", debugLogID(config, cfCert.AppID),
+		"space_id", debugLogID(config, cfCert.SpaceID),
+		"org_id", debugLogID(config, cfCert.OrgID))
+}
+
+// debugLogID returns the GUID as the config allows it to be logged at the debug level,
+// which is hashed if the config calls for hashed identifiers. The hashes are short, but
+// long enough to tell apart the GUIDs in a foundation.
+func debugLogID(config *models.Configuration, id string) string {
+	if debugLogCertDetail(config) != models.DebugLogCertHashed {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
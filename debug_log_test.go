@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestLogLoginAttempt(t *testing.T) {
+	cfCert, err := models.NewCFCertificate("instance-guid", "org-guid", "space-guid", "app-guid", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfCert.AppName = "app-name"
+
+	tests := []struct {
+		detail   string
+		want     []string
+		dontWant []string
+	}{
+		{
+			detail: "",
+			want:   []string{"instance-guid", "app-guid", "10.255.181.105", "app-name"},
+		},
+		{
+			detail: models.DebugLogCertFull,
+			want:   []string{"instance-guid", "app-guid", "10.255.181.105", "app-name"},
+		},
+		{
+			detail:   models.DebugLogCertGUIDs,
+			want:     []string{"instance-guid", "app-guid", "space-guid", "org-guid"},
+			dontWant: []string{"10.255.181.105", "app-name"},
+		},
+		{
+			detail:   models.DebugLogCertHashed,
+			want:     []string{"instance_id=sha256:", debugLogID(&models.Configuration{DebugLogCertDetail: models.DebugLogCertHashed}, "app-guid")},
+			dontWant: []string{"instance-guid", "app-guid", "space-guid", "org-guid", "10.255.181.105", "app-name"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.detail, func(t *testing.T) {
+			var buf bytes.Buffer
+			lb, err := Factory(context.Background(), &logical.BackendConfig{
+				StorageView: &logical.InmemStorage{},
+				Logger:      hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Debug}),
+				System:      &logical.StaticSystemView{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb.(*backend).logLoginAttempt(&models.Configuration{DebugLogCertDetail: tt.detail}, "handling login attempt", cfCert)
+
+			logged := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(logged, want) {
+					t.Errorf("expected %q to be logged but received %q", want, logged)
+				}
+			}
+			for _, dontWant := range tt.dontWant {
+				if strings.Contains(logged, dontWant) {
+					t.Errorf("expected %q not to be logged but received %q", dontWant, logged)
+				}
+			}
+		})
+	}
+}
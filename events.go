@@ -0,0 +1,33 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The types of the events published to Vault's event system. Vault adds the mount the
+// event came from, so they can be subscribed to per mount.
+const (
+	eventTypeLogin        = "cf/login"
+	eventTypeLoginFailed  = "cf/login-failed"
+	eventTypeConfigWrite  = "cf/config-write"
+	eventTypeConfigDelete = "cf/config-delete"
+	eventTypeRoleWrite    = "cf/role-write"
+	eventTypeRoleDelete   = "cf/role-delete"
+)
+
+// sendEvent publishes an event with the given metadata, as key and value pairs.
+// Events are best effort, so a failure to send one is logged rather than failing
+// the request, and nothing is sent if Vault's event system isn't enabled.
+func (b *backend) sendEvent(ctx context.Context, eventType string, metadataPairs ...string) {
+	err := logical.SendEvent(ctx, b, eventType, metadataPairs...)
+	if err != nil && !errors.Is(err, framework.ErrNoEvents) {
+		b.Logger().Warn("unable to send event", "event_type", eventType, "error", err)
+	}
+}
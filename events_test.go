@@ -0,0 +1,69 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	events := logical.NewMockEventSender()
+
+	backend, err := Factory(ctx, &logical.BackendConfig{
+		StorageView:  storage,
+		Logger:       hclog.Default(),
+		EventsSender: events,
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: time.Hour,
+			MaxLeaseTTLVal:     time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*logical.Request{
+		{Operation: logical.CreateOperation, Path: "roles/test-role", Data: map[string]interface{}{"disable_ip_matching": true, "allow_unconstrained": true}},
+		{Operation: logical.UpdateOperation, Path: "login", Data: map[string]interface{}{"role": "test-role"}},
+		{Operation: logical.DeleteOperation, Path: "roles/test-role"},
+	} {
+		req.Storage = storage
+		req.Connection = &logical.Connection{RemoteAddr: "127.0.0.1"}
+		if _, err := backend.HandleRequest(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []struct {
+		eventType string
+		metadata  map[string]string
+	}{
+		{eventTypeRoleWrite, map[string]string{"role": "test-role", "modified": "true"}},
+		{eventTypeLoginFailed, map[string]string{"path": "login", "role": "test-role", "reason": "invalid_request"}},
+		{eventTypeRoleDelete, map[string]string{"role": "test-role", "modified": "true"}},
+	}
+	if len(events.Events) != len(expected) {
+		t.Fatalf("expected %d events but received %d", len(expected), len(events.Events))
+	}
+	for i, want := range expected {
+		event := events.Events[i]
+		if string(event.Type) != want.eventType {
+			t.Fatalf("expected event %d to be %s but received %s", i, want.eventType, event.Type)
+		}
+		for key, value := range want.metadata {
+			if actual := event.Event.Metadata.Fields[key].GetStringValue(); actual != value {
+				t.Fatalf("expected %s event's %s to be %q but received %q", event.Type, key, value, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const headerForwardedFor = "X-Forwarded-For"
+
+// clientRemoteAddr returns the address of the client that made the request. If the
+// request came through a trusted proxy, that's the rightmost address in the
+// X-Forwarded-For header that isn't a trusted proxy's, otherwise it's the address
+// of the connection. Vault only passes the header to the plugin if it's listed in
+// the mount's passthrough_request_headers.
+func clientRemoteAddr(config *models.Configuration, req *logical.Request) string {
+	if req.Connection == nil {
+		return ""
+	}
+	remoteAddr := req.Connection.RemoteAddr
+	if len(config.TrustedProxyCIDRs) == 0 || !remoteAddrInCIDRs(remoteAddr, config.TrustedProxyCIDRs) {
+		return remoteAddr
+	}
+
+	var forwarded []string
+	for name, values := range req.Headers {
+		if textproto.CanonicalMIMEHeaderKey(name) != headerForwardedFor {
+			continue
+		}
+		for _, value := range values {
+			for _, addr := range strings.Split(value, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					forwarded = append(forwarded, addr)
+				}
+			}
+		}
+	}
+	// Each proxy appends the address it received the request from, so only the
+	// addresses added by trusted proxies can be relied on.
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if !remoteAddrInCIDRs(forwarded[i], config.TrustedProxyCIDRs) {
+			return forwarded[i]
+		}
+		remoteAddr = forwarded[i]
+	}
+	return remoteAddr
+}
+
+// remoteAddrInCIDRs reports whether the address is within one of the CIDRs.
+func remoteAddrInCIDRs(remoteAddr string, cidrs []string) bool {
+	ip := parseRemoteIP(remoteAddr)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestClientRemoteAddr(t *testing.T) {
+	t.Parallel()
+
+	config := &models.Configuration{
+		TrustedProxyCIDRs: []string{"10.0.0.0/24", "2001:db8::/64"},
+	}
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "no forwarded header",
+			remoteAddr: "10.0.0.1",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "192.168.0.1",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.255.181.105"}},
+			expected:   "192.168.0.1",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.255.181.105"}},
+			expected:   "10.255.181.105",
+		},
+		{
+			name:       "trusted IPv6 proxy with a port",
+			remoteAddr: "[2001:db8::1]:52314",
+			headers:    map[string][]string{"x-forwarded-for": {"10.255.181.105"}},
+			expected:   "10.255.181.105",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.255.181.105, 10.0.0.2", "10.0.0.3"}},
+			expected:   "10.255.181.105",
+		},
+		{
+			name:       "spoofed addresses before the client",
+			remoteAddr: "10.0.0.1",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.255.181.106, 10.255.181.105"}},
+			expected:   "10.255.181.105",
+		},
+		{
+			name:       "only trusted proxies",
+			remoteAddr: "10.0.0.1",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			expected:   "10.0.0.3",
+		},
+	} {
+		req := &logical.Request{
+			Connection: &logical.Connection{RemoteAddr: tc.remoteAddr},
+			Headers:    tc.headers,
+		}
+		if actual := clientRemoteAddr(config, req); actual != tc.expected {
+			t.Fatalf("%s: expected %q but received %q", tc.name, tc.expected, actual)
+		}
+	}
+
+	// Without trusted proxies, the header is ignored.
+	req := &logical.Request{
+		Connection: &logical.Connection{RemoteAddr: "10.0.0.1"},
+		Headers:    map[string][]string{"X-Forwarded-For": {"10.255.181.105"}},
+	}
+	if actual := clientRemoteAddr(&models.Configuration{}, req); actual != "10.0.0.1" {
+		t.Fatalf("expected %q but received %q", "10.0.0.1", actual)
+	}
+	if actual := clientRemoteAddr(config, &logical.Request{}); actual != "" {
+		t.Fatalf("expected no address without a connection but received %q", actual)
+	}
+}
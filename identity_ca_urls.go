@@ -0,0 +1,224 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// defaultIdentityCAURLRefreshInterval is how often the identity CA bundles are downloaded
+// again if no interval is configured.
+const defaultIdentityCAURLRefreshInterval = time.Hour
+
+// defaultIdentityCAURLTimeout bounds each identity CA bundle download if no cf_timeout
+// is configured.
+const defaultIdentityCAURLTimeout = 30 * time.Second
+
+// maxIdentityCABundleSize is the most that's read of a downloaded identity CA bundle.
+const maxIdentityCABundleSize = 1 << 20
+
+// identityCAURLRefreshInterval returns how often the identity CA bundles are downloaded.
+func identityCAURLRefreshInterval(config *models.Configuration) time.Duration {
+	if config.IdentityCAURLRefreshInterval > 0 {
+		return config.IdentityCAURLRefreshInterval
+	}
+	return defaultIdentityCAURLRefreshInterval
+}
+
+// isIdentityCAURL reports whether an "identity_ca_certificates" entry is the URL of a
+// CA bundle, rather than the PEM-encoded bundle itself.
+func isIdentityCAURL(entry string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	return strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "http://")
+}
+
+// splitIdentityCAURLs separates the URLs in the "identity_ca_certificates" from the
+// PEM-encoded certificates, erroring if a URL isn't an HTTPS one.
+func splitIdentityCAURLs(entries []string) ([]string, []string, error) {
+	var caCerts, urls []string
+	for _, entry := range entries {
+		if !isIdentityCAURL(entry) {
+			caCerts = append(caCerts, entry)
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, nil, err
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, nil, fmt.Errorf("%q must be an HTTPS URL", entry)
+		}
+		urls = append(urls, u.String())
+	}
+	return caCerts, urls, nil
+}
+
+// normalizeSPKIPin returns the pin as lowercase hex without separators, erroring if it
+// isn't a SHA-256 digest.
+func normalizeSPKIPin(pin string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+	if b, err := hex.DecodeString(normalized); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q isn't a hex-encoded SHA-256 digest", pin)
+	}
+	return normalized, nil
+}
+
+// fetchIdentityCAURLs downloads the identity CA bundle from each configured URL.
+func fetchIdentityCAURLs(ctx context.Context, config *models.Configuration) ([]string, error) {
+	httpClient, err := newIdentityCAURLHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	var caCerts []string
+	for _, u := range config.IdentityCAURLs {
+		caCert, err := fetchIdentityCABundle(ctx, httpClient, u)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(caCerts, caCert) {
+			caCerts = append(caCerts, caCert)
+		}
+	}
+	return caCerts, nil
+}
+
+func fetchIdentityCABundle(ctx context.Context, httpClient *http.Client, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("the identity CA bundle at %q couldn't be downloaded: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the identity CA bundle at %q couldn't be downloaded: the server responded with %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIdentityCABundleSize+1))
+	if err != nil {
+		return "", fmt.Errorf("the identity CA bundle at %q couldn't be downloaded: %w", u, err)
+	}
+	if len(body) > maxIdentityCABundleSize {
+		return "", fmt.Errorf("the identity CA bundle at %q is larger than %d bytes", u, maxIdentityCABundleSize)
+	}
+	caCert := string(body)
+	if _, err := parseCertificatesPEM(caCert); err != nil {
+		return "", fmt.Errorf("%q isn't a CA bundle: %w", u, err)
+	}
+	return caCert, nil
+}
+
+// newIdentityCAURLHTTPClient returns a client that trusts the configured CA certificates
+// for downloading the identity CA, as well as the system's, and that, if pins are
+// configured, requires the server's chain to have a certificate with a pinned key.
+func newIdentityCAURLHTTPClient(config *models.Configuration) (*http.Client, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	for idx, certificate := range config.IdentityCAURLCACertificates {
+		if ok := rootCAs.AppendCertsFromPEM([]byte(certificate)); !ok {
+			return nil, fmt.Errorf("failed to append identity CA URL cert to cert pool, index=%d", idx)
+		}
+	}
+	tlsConfig := &tls.Config{
+		RootCAs: rootCAs,
+	}
+	if len(config.IdentityCAURLPinnedSHA256) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.Contains(config.IdentityCAURLPinnedSHA256, hex.EncodeToString(digest[:])) {
+					return nil
+				}
+			}
+			return errors.New("none of the server's certificates have a pinned public key")
+		}
+	}
+	httpClient := cleanhttp.DefaultClient()
+	httpClient.Timeout = defaultIdentityCAURLTimeout
+	if config.CFTimeout > 0 {
+		httpClient.Timeout = config.CFTimeout
+	}
+	transport := cleanhttp.DefaultTransport()
+	transport.TLSClientConfig = tlsConfig
+	httpClient.Transport = transport
+	return httpClient, nil
+}
+
+// refreshIdentityCAURLs downloads the identity CA bundles again once the refresh interval
+// has passed, and stores them in the config. If a bundle can't be downloaded, the ones
+// last downloaded remain trusted, and they're downloaded again on the next call.
+// The bundles are downloaded without holding the config lock, so that logins and
+// config writes don't wait on them.
+func (b *backend) refreshIdentityCAURLs(ctx context.Context, storage logical.Storage, now time.Time) error {
+	b.mu.RLock()
+	config, err := getConfig(ctx, storage)
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if config == nil || len(config.IdentityCAURLs) == 0 || !b.canReconcile() {
+		return nil
+	}
+	if now.Before(config.IdentityCAURLsRefreshedAt.Add(identityCAURLRefreshInterval(config))) {
+		return nil
+	}
+
+	caCerts, err := fetchIdentityCAURLs(ctx, config)
+	if err != nil {
+		b.Logger().Warn("unable to refresh the identity CA from its URLs", "urls", config.IdentityCAURLs, "error", err)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fetchedFrom := config
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if config == nil || !slices.Equal(config.IdentityCAURLs, fetchedFrom.IdentityCAURLs) {
+		// The config was changed while the bundles were being downloaded, so they may
+		// no longer be what's meant to be trusted.
+		return nil
+	}
+	before, err := changeSnapshot(config)
+	if err != nil {
+		return err
+	}
+	caCertsUpdated := !slices.Equal(caCerts, config.URLIdentityCACertificates)
+	config.URLIdentityCACertificates = caCerts
+	config.IdentityCAURLsRefreshedAt = now
+	if err := storeConfig(ctx, storage, config); err != nil {
+		return err
+	}
+	if caCertsUpdated {
+		b.Logger().Info("refreshed the identity CA from its URLs", "urls", config.IdentityCAURLs)
+		b.sendEvent(ctx, eventTypeConfigWrite, "path", "config", "modified", "true", "identity_ca_certificates_updated", "true")
+		b.recordChange(ctx, storage, &configChange{Path: "config", Operation: "refresh", Time: now}, before, config)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+// identityCAServer serves the CA certificate at /ca.pem.
+func identityCAServer(t *testing.T, caCert string) *httptest.Server {
+	return identityCAServerWithHook(t, caCert, nil)
+}
+
+// identityCAServerWithHook is identityCAServer, but calls onDownload, if it's set,
+// before serving the CA certificate.
+func identityCAServerWithHook(t *testing.T, caCert string, onDownload func()) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		if onDownload != nil {
+			onDownload()
+		}
+		w.Write([]byte(caCert))
+	})
+	s := httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func identityCAURLConfig(s *httptest.Server) *models.Configuration {
+	return &models.Configuration{
+		Version:                     1,
+		IdentityCAURLs:              []string{s.URL + "/ca.pem"},
+		IdentityCAURLCACertificates: []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}))},
+	}
+}
+
+func TestSplitIdentityCAURLs(t *testing.T) {
+	t.Parallel()
+
+	caCerts, urls, err := splitIdentityCAURLs([]string{"-----BEGIN CERTIFICATE-----", " https://ca.example.com/ca.pem "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"-----BEGIN CERTIFICATE-----"}; !reflect.DeepEqual(caCerts, expected) {
+		t.Fatalf("expected %q but received %q", expected, caCerts)
+	}
+	if expected := []string{"https://ca.example.com/ca.pem"}; !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %q but received %q", expected, urls)
+	}
+	if _, _, err := splitIdentityCAURLs([]string{"http://ca.example.com/ca.pem"}); err == nil {
+		t.Fatal("expected an HTTP URL to be invalid")
+	}
+}
+
+func TestFetchIdentityCAURLs(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	s := identityCAServer(t, testCerts.CACertificate)
+	config := identityCAURLConfig(s)
+
+	caCerts, err := fetchIdentityCAURLs(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(caCerts, expected) {
+		t.Fatalf("expected %q but received %q", expected, caCerts)
+	}
+
+	// The server's key is pinned.
+	digest := sha256.Sum256(s.Certificate().RawSubjectPublicKeyInfo)
+	config.IdentityCAURLPinnedSHA256 = []string{hex.EncodeToString(digest[:])}
+	if _, err := fetchIdentityCAURLs(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	config.IdentityCAURLPinnedSHA256 = []string{hex.EncodeToString(make([]byte, sha256.Size))}
+	if _, err := fetchIdentityCAURLs(context.Background(), config); err == nil {
+		t.Fatal("expected a server without a pinned key to fail")
+	}
+	config.IdentityCAURLPinnedSHA256 = nil
+
+	config.IdentityCAURLs = []string{s.URL + "/missing.pem"}
+	if _, err := fetchIdentityCAURLs(context.Background(), config); err == nil {
+		t.Fatal("expected a missing bundle to fail")
+	}
+	config.IdentityCAURLs = []string{s.URL + "/ca.pem"}
+	config.IdentityCAURLCACertificates = nil
+	if _, err := fetchIdentityCAURLs(context.Background(), config); err == nil {
+		t.Fatal("expected an untrusted server to fail")
+	}
+}
+
+func TestRefreshIdentityCAURLs(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	s := identityCAServer(t, testCerts.CACertificate)
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	config := identityCAURLConfig(s)
+	config.URLIdentityCACertificates = []string{"a previous CA"}
+	if err := storeConfig(ctx, storage, config); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	now := time.Now().UTC()
+	if err := b.refreshIdentityCAURLs(ctx, storage, now); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(config.URLIdentityCACertificates, expected) {
+		t.Fatalf("expected %q but received %q", expected, config.URLIdentityCACertificates)
+	}
+	if !config.IdentityCAURLsRefreshedAt.Equal(now) {
+		t.Fatalf("expected the refresh time to be %s but received %s", now, config.IdentityCAURLsRefreshedAt)
+	}
+
+	// Once the bundle can't be downloaded, the one last downloaded remains trusted.
+	s.Close()
+	if err := b.refreshIdentityCAURLs(ctx, storage, now.Add(2*defaultIdentityCAURLRefreshInterval)); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testCerts.CACertificate}; !reflect.DeepEqual(config.URLIdentityCACertificates, expected) {
+		t.Fatalf("expected %q to remain trusted but received %q", expected, config.URLIdentityCACertificates)
+	}
+	if !config.IdentityCAURLsRefreshedAt.Equal(now) {
+		t.Fatalf("expected the refresh time to remain %s but received %s", now, config.IdentityCAURLsRefreshedAt)
+	}
+}
+
+func TestRefreshIdentityCAURLsConfigChanged(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	var b *backend
+	// While the bundle is downloaded, the URLs are changed by a config write, which
+	// mustn't have to wait for the download to finish.
+	s := identityCAServerWithHook(t, testCerts.CACertificate, func() {
+		locked := make(chan struct{})
+		go func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			defer close(locked)
+			config, err := getConfig(ctx, storage)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			config.IdentityCAURLs = []string{"https://ca.example.com/ca.pem"}
+			if err := storeConfig(ctx, storage, config); err != nil {
+				t.Error(err)
+			}
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Error("the config lock was held while the identity CA was downloaded")
+		}
+	})
+	config := identityCAURLConfig(s)
+	config.URLIdentityCACertificates = []string{"a previous CA"}
+	if err := storeConfig(ctx, storage, config); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = lb.(*backend)
+
+	if err := b.refreshIdentityCAURLs(ctx, storage, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	config, err = getConfig(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a previous CA"}; !reflect.DeepEqual(config.URLIdentityCACertificates, expected) {
+		t.Fatalf("expected the bundle from the previous URLs not to be stored, but received %q", config.URLIdentityCACertificates)
+	}
+	if !config.IdentityCAURLsRefreshedAt.IsZero() {
+		t.Fatalf("expected no refresh time but received %s", config.IdentityCAURLsRefreshedAt)
+	}
+}
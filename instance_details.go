@@ -0,0 +1,142 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// instanceDetails are what CF's API reports about the running app instance that
+// logged in.
+type instanceDetails struct {
+	index       int
+	processType string
+	state       string
+}
+
+// liveInstanceStates are the states of instances that are starting or running, which
+// mounts verifying instance IDs accept logins from. Instances may log in as they
+// start, before their health check passes.
+var liveInstanceStates = []string{"STARTING", "RUNNING"}
+
+// processStats are the stats of a process's instances, as far as they're needed to
+// find an instance. go-cfclient's ProcessStat doesn't include the instance GUID,
+// which only recent versions of CF's API report.
+type processStats struct {
+	Resources []struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		State        string `json:"state"`
+		InstanceGUID string `json:"instance_guid"`
+	} `json:"resources"`
+}
+
+// withInstanceDetails returns the resources along with the details of the instance, if
+// the role includes them, checks the instance's process type and index against the
+// role's bound process types and instance indexes, and, if the config verifies instance
+// IDs, checks that the instance is live. Looking the details up is best effort for roles
+// that only include them, so that logins don't fail against CF APIs that don't report
+// instance GUIDs, but roles bound to process types or indexes refuse instances whose
+// details aren't known.
+func (b *backend) withInstanceDetails(ctx context.Context, config *models.Configuration, role *models.RoleEntry, cfCert *models.CFCertificate, resources *cfResources) (*cfResources, error) {
+	bound := len(role.BoundProcessTypes) > 0 || len(role.BoundInstanceIndexes) > 0
+	verify := config.VerifyInstanceIDs
+	if (!role.IncludeInstanceDetails && !bound && !verify) || role.DisableCFAPIChecks {
+		return resources, nil
+	}
+	details, err := b.lookupInstanceDetails(ctx, config, cfCert)
+	switch {
+	case err != nil && (bound || verify):
+		return nil, cfAPILookupError(err)
+	case details == nil && verify:
+		return nil, withErrorCode(errCodeInstanceNotLive, fmt.Errorf("instance %s wasn't found in its app's process stats", cfCert.InstanceID))
+	case err != nil:
+		b.Logger().Warn("unable to look up the instance's index and process type", "instance_id", cfCert.InstanceID, "error", err)
+		return resources, nil
+	case details == nil && len(role.BoundProcessTypes) == 0 && bound:
+		return nil, withErrorCode(errCodeBoundIndexMismatch, fmt.Errorf("instance %s wasn't found in its app's process stats, so its index can't be checked against role constraints of %v", cfCert.InstanceID, role.BoundInstanceIndexes))
+	case details == nil && bound:
+		return nil, withErrorCode(errCodeBoundProcessTypeMismatch, fmt.Errorf("instance %s wasn't found in its app's process stats, so its process type can't be checked against role constraints of %s", cfCert.InstanceID, role.BoundProcessTypes))
+	case details == nil:
+		b.Logger().Debug("instance not found in its app's process stats", "instance_id", debugLogID(config, cfCert.InstanceID))
+		return resources, nil
+	}
+	if verify && !strutil.StrListContains(liveInstanceStates, details.state) {
+		return nil, withErrorCode(errCodeInstanceNotLive, fmt.Errorf("instance %s is %s rather than starting or running", cfCert.InstanceID, details.state))
+	}
+	if !meetsBoundConstraints(details.processType, role.BoundProcessTypes) {
+		return nil, withErrorCode(errCodeBoundProcessTypeMismatch, fmt.Errorf("process type %s doesn't match role constraints of %s", details.processType, role.BoundProcessTypes))
+	}
+	if len(role.BoundInstanceIndexes) > 0 && !slices.Contains(role.BoundInstanceIndexes, details.index) {
+		return nil, withErrorCode(errCodeBoundIndexMismatch, fmt.Errorf("instance index %d doesn't match role constraints of %v", details.index, role.BoundInstanceIndexes))
+	}
+	if !role.IncludeInstanceDetails {
+		return resources, nil
+	}
+	// The resources may be cached, so they're copied rather than changed.
+	withDetails := *resources
+	withDetails.instance = details
+	return &withDetails, nil
+}
+
+// lookupInstanceDetails finds the instance among the stats of its app's processes. It
+// returns nil if the instance isn't found.
+func (b *backend) lookupInstanceDetails(ctx context.Context, config *models.Configuration, cfCert *models.CFCertificate) (*instanceDetails, error) {
+	client, err := b.getCFClientOrRefresh(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	var details *instanceDetails
+	err = b.callCFAPI("get_instance_details", func() error {
+		processes, err := client.Processes.ListForAppAll(ctx, cfCert.AppID, nil)
+		if err != nil {
+			return err
+		}
+		for _, process := range processes {
+			stats, err := getProcessStats(ctx, client, config.CFAPIAddr, process.GUID)
+			if err != nil {
+				return err
+			}
+			for _, stat := range stats.Resources {
+				if stat.InstanceGUID == cfCert.InstanceID {
+					details = &instanceDetails{index: stat.Index, processType: stat.Type, state: stat.State}
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return details, err
+}
+
+func getProcessStats(ctx context.Context, client *cfclient.Client, cfAPIAddr, processGUID string) (*processStats, error) {
+	statsURL, err := url.JoinPath(cfAPIAddr, "v3", "processes", processGUID, "stats")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.ExecuteAuthRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	stats := &processStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
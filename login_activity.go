@@ -0,0 +1,65 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"sync"
+	"time"
+)
+
+// loginActivitySize is how many of the most recent login attempts are remembered.
+const loginActivitySize = 100
+
+// loginAttempt is a login that succeeded or failed.
+type loginAttempt struct {
+	Time   time.Time
+	Path   string
+	Role   string
+	AppID  string
+	Failed bool
+	Reason string
+
+	// ErrorCode is the failure's loginErrorCode, if it has one.
+	ErrorCode string
+}
+
+// loginActivity remembers the most recent login attempts, so that operators can see
+// why an app can't log in. Attempts are only kept in memory on the node that handled
+// them.
+type loginActivity struct {
+	mu       sync.Mutex
+	attempts []loginAttempt
+	next     int
+}
+
+func newLoginActivity(size int) *loginActivity {
+	return &loginActivity{
+		attempts: make([]loginAttempt, 0, size),
+	}
+}
+
+// add records the attempt, replacing the oldest one once the buffer is full.
+func (l *loginActivity) add(attempt loginAttempt) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.attempts) < cap(l.attempts) {
+		l.attempts = append(l.attempts, attempt)
+		return
+	}
+	l.attempts[l.next] = attempt
+	l.next = (l.next + 1) % len(l.attempts)
+}
+
+// list returns the remembered attempts, most recent first.
+func (l *loginActivity) list() []loginAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	attempts := make([]loginAttempt, 0, len(l.attempts))
+	for i := len(l.attempts) - 1; i >= 0; i-- {
+		attempts = append(attempts, l.attempts[(l.next+i)%len(l.attempts)])
+	}
+	return attempts
+}
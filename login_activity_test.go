@@ -0,0 +1,33 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoginActivity(t *testing.T) {
+	t.Parallel()
+
+	l := newLoginActivity(3)
+	if attempts := l.list(); len(attempts) != 0 {
+		t.Fatalf("expected no attempts but received %v", attempts)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.add(loginAttempt{Role: fmt.Sprintf("role-%d", i)})
+	}
+
+	// Only the most recent attempts are kept, newest first.
+	attempts := l.list()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts but received %d", len(attempts))
+	}
+	for i, want := range []string{"role-4", "role-3", "role-2"} {
+		if attempts[i].Role != want {
+			t.Fatalf("expected attempt %d to be for %s but received %s", i, want, attempts[i].Role)
+		}
+	}
+}
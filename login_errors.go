@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// loginErrorCode is a stable code for why a login failed, so that tooling can tell
+// failures apart without parsing their messages. Codes must not be changed once
+// released, though new ones may be added.
+type loginErrorCode string
+
+const (
+	errCodeInvalidRequest            loginErrorCode = "ERR_INVALID_REQUEST"
+	errCodeRoleNotFound              loginErrorCode = "ERR_ROLE_NOT_FOUND"
+	errCodeNotConfigured             loginErrorCode = "ERR_NOT_CONFIGURED"
+	errCodeSigningTimeSkew           loginErrorCode = "ERR_SIGNING_TIME_SKEW"
+	errCodeInvalidSignature          loginErrorCode = "ERR_INVALID_SIGNATURE"
+	errCodeSignatureHashMismatch     loginErrorCode = "ERR_SIGNATURE_HASH_MISMATCH"
+	errCodeSignatureAudienceMismatch loginErrorCode = "ERR_SIGNATURE_AUDIENCE_MISMATCH"
+	errCodeSignatureReused           loginErrorCode = "ERR_SIGNATURE_REUSED"
+	errCodeSignatureNotFIPSApproved  loginErrorCode = "ERR_SIGNATURE_NOT_FIPS_APPROVED"
+	errCodeChallengeRequired         loginErrorCode = "ERR_CHALLENGE_REQUIRED"
+	errCodeInvalidChallenge          loginErrorCode = "ERR_INVALID_CHALLENGE"
+	errCodeChallengeReused           loginErrorCode = "ERR_CHALLENGE_REUSED"
+	errCodeInvalidCertificate        loginErrorCode = "ERR_INVALID_CERTIFICATE"
+	errCodeUntrustedCertificate      loginErrorCode = "ERR_UNTRUSTED_CERTIFICATE"
+	errCodeCertificateKeyUsage       loginErrorCode = "ERR_CERTIFICATE_KEY_USAGE"
+	errCodeInvalidJWT                loginErrorCode = "ERR_INVALID_JWT"
+	errCodeRevoked                   loginErrorCode = "ERR_REVOKED"
+	errCodeDenied                    loginErrorCode = "ERR_DENIED"
+	errCodeAppDeleted                loginErrorCode = "ERR_APP_DELETED"
+	errCodeIPAddressMismatch         loginErrorCode = "ERR_IP_ADDRESS_MISMATCH"
+	errCodeSourceNotAllowed          loginErrorCode = "ERR_SOURCE_NOT_ALLOWED"
+	errCodeBoundInstanceMismatch     loginErrorCode = "ERR_BOUND_INSTANCE_MISMATCH"
+	errCodeBoundCertIPMismatch       loginErrorCode = "ERR_BOUND_CERT_IP_MISMATCH"
+	errCodeBoundSPIFFEIDMismatch     loginErrorCode = "ERR_BOUND_SPIFFE_ID_MISMATCH"
+	errCodeBoundAppMismatch          loginErrorCode = "ERR_BOUND_APP_MISMATCH"
+	errCodeBoundSpaceMismatch        loginErrorCode = "ERR_BOUND_SPACE_MISMATCH"
+	errCodeBoundOrgMismatch          loginErrorCode = "ERR_BOUND_ORG_MISMATCH"
+	errCodeBoundProcessTypeMismatch  loginErrorCode = "ERR_BOUND_PROCESS_TYPE_MISMATCH"
+	errCodeBoundIndexMismatch        loginErrorCode = "ERR_BOUND_INDEX_MISMATCH"
+	errCodeBoundStackMismatch        loginErrorCode = "ERR_BOUND_STACK_MISMATCH"
+	errCodeBoundBuildpackMismatch    loginErrorCode = "ERR_BOUND_BUILDPACK_MISMATCH"
+	errCodeBoundDropletMismatch      loginErrorCode = "ERR_BOUND_DROPLET_MISMATCH"
+	errCodeStaleRevision             loginErrorCode = "ERR_STALE_REVISION"
+	errCodeBoundLifecycleMismatch    loginErrorCode = "ERR_BOUND_LIFECYCLE_MISMATCH"
+	errCodeBoundDockerImageMismatch  loginErrorCode = "ERR_BOUND_DOCKER_IMAGE_MISMATCH"
+	errCodeServiceBindingRequired    loginErrorCode = "ERR_SERVICE_BINDING_REQUIRED"
+	errCodeSSHEnabled                loginErrorCode = "ERR_SSH_ENABLED"
+	errCodeCFAPIUnavailable          loginErrorCode = "ERR_CF_API_UNAVAILABLE"
+	errCodeCFAPILookupFailed         loginErrorCode = "ERR_CF_API_LOOKUP_FAILED"
+	errCodeCFAPIRateLimited          loginErrorCode = "ERR_CF_API_RATE_LIMITED"
+	errCodeCFAPIMismatch             loginErrorCode = "ERR_CF_API_MISMATCH"
+	errCodeNoLiveInstances           loginErrorCode = "ERR_NO_LIVE_INSTANCES"
+	errCodeInstanceNotLive           loginErrorCode = "ERR_INSTANCE_NOT_LIVE"
+	errCodeAppNotStarted             loginErrorCode = "ERR_APP_NOT_STARTED"
+	errCodeTooFewInstances           loginErrorCode = "ERR_TOO_FEW_INSTANCES"
+	errCodeTooManyFailedLogins       loginErrorCode = "ERR_TOO_MANY_FAILED_LOGINS"
+	errCodePolicyTemplate            loginErrorCode = "ERR_POLICY_TEMPLATE"
+	errCodeInternal                  loginErrorCode = "ERR_INTERNAL"
+)
+
+// loginError is an error a login can fail with, along with its code.
+type loginError struct {
+	code loginErrorCode
+	err  error
+}
+
+func (e *loginError) Error() string {
+	return e.err.Error()
+}
+
+func (e *loginError) Unwrap() error {
+	return e.err
+}
+
+// withErrorCode attaches the code to the error, for when it fails a login.
+func withErrorCode(code loginErrorCode, err error) error {
+	return &loginError{code: code, err: err}
+}
+
+// errorCodeOf returns the code attached to the error, falling back to the given one
+// for errors without a code.
+func errorCodeOf(err error, fallback loginErrorCode) loginErrorCode {
+	var loginErr *loginError
+	if errors.As(err, &loginErr) {
+		return loginErr.code
+	}
+	if errors.Is(err, errCFAPIUnavailable) {
+		return errCodeCFAPIUnavailable
+	}
+	if errors.Is(err, errCFAPIRateLimited) {
+		return errCodeCFAPIRateLimited
+	}
+	return fallback
+}
+
+// cfAPILookupError attaches the code for an error from looking up the instance in the
+// CF API, telling apart the CF API being unavailable or rate limiting the lookup from
+// it answering with an error.
+func cfAPILookupError(err error) error {
+	err = cfAPIError(err)
+	if errors.Is(err, errCFAPIUnavailable) {
+		return withErrorCode(errCodeCFAPIUnavailable, err)
+	}
+	if errors.Is(err, errCFAPIRateLimited) {
+		return withErrorCode(errCodeCFAPIRateLimited, err)
+	}
+	return withErrorCode(errCodeCFAPILookupFailed, err)
+}
+
+// loginErrorResponse returns the response for a login that failed with the code and
+// message. Vault only treats responses whose data holds nothing but the message as
+// errors, and only passes the message on to clients, so the code leads the message
+// in brackets, as in "[ERR_SIGNING_TIME_SKEW] request is too old; ...".
+func loginErrorResponse(code loginErrorCode, message string) *logical.Response {
+	return logical.ErrorResponse(loginErrorMessage(code, message))
+}
+
+// loginErrorMessage returns the message with the code leading it.
+func loginErrorMessage(code loginErrorCode, message string) string {
+	return fmt.Sprintf("[%s] %s", code, message)
+}
+
+// loginErrorResponseFromErr returns the response for a login that failed with the
+// error, using the error's code or else the fallback.
+func loginErrorResponseFromErr(err error, fallback loginErrorCode) *logical.Response {
+	return loginErrorResponse(errorCodeOf(err, fallback), err.Error())
+}
+
+// loginFailure returns the response for a login that failed with the error, as
+// loginErrorResponseFromErr does, unless the CF API rate limited the login's calls. As
+// the login may then succeed if tried again, it fails with a 429 instead.
+func loginFailure(err error, fallback loginErrorCode) (*logical.Response, error) {
+	if errors.Is(err, errCFAPIRateLimited) {
+		return nil, logical.CodedError(http.StatusTooManyRequests, loginErrorMessage(errCodeCFAPIRateLimited, err.Error()))
+	}
+	return loginErrorResponseFromErr(err, fallback), nil
+}
+
+var errorCodePrefix = regexp.MustCompile(`^\[(ERR_[A-Z_]+)\] `)
+
+// parseErrorCode returns the code leading a login error's message, if it has one.
+func parseErrorCode(message string) string {
+	if m := errorCodePrefix.FindStringSubmatch(message); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		code loginErrorCode
+	}{
+		{"coded", withErrorCode(errCodeBoundSpaceMismatch, errors.New("mismatch")), errCodeBoundSpaceMismatch},
+		{"wrapped", fmt.Errorf("wrapped: %w", withErrorCode(errCodeRevoked, errors.New("revoked"))), errCodeRevoked},
+		{"CF API unavailable", cfAPIError(fmt.Errorf("%w: timed out", errCFAPIUnavailable)), errCodeCFAPIUnavailable},
+		{"uncoded", errors.New("something unexpected"), errCodeInternal},
+	} {
+		if code := errorCodeOf(tc.err, errCodeInternal); code != tc.code {
+			t.Errorf("%s: expected %s but received %s", tc.name, tc.code, code)
+		}
+	}
+}
+
+func TestLoginErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	resp := loginErrorResponseFromErr(withErrorCode(errCodeIPAddressMismatch, errors.New("no matching IP address")), errCodeInternal)
+	if !resp.IsError() {
+		t.Fatalf("expected an error response but received %#v", resp)
+	}
+	message := resp.Error().Error()
+	if message != "[ERR_IP_ADDRESS_MISMATCH] no matching IP address" {
+		t.Fatalf("unexpected message %q", message)
+	}
+	if code := parseErrorCode(message); code != string(errCodeIPAddressMismatch) {
+		t.Fatalf("expected %s but received %q", errCodeIPAddressMismatch, code)
+	}
+	if code := parseErrorCode("no matching IP address"); code != "" {
+		t.Fatalf("expected no code but received %q", code)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const (
+	defaultLoginFailureWindow   = time.Minute
+	defaultLoginFailureCooldown = 5 * time.Minute
+
+	// defaultLoginFailureAddressLimitFactor is how many times the login failure limit
+	// an address may fail to log in as any app, if no address limit is configured.
+	defaultLoginFailureAddressLimitFactor = 10
+
+	// maxLoginThrottleEntries is how many apps and addresses failures are counted for
+	// at once, so that failed logins claiming ever more app IDs or from ever more
+	// addresses can't grow the node's memory without bound.
+	maxLoginThrottleEntries = 10000
+)
+
+// loginThrottle counts failed logins per app and address, and per address whichever
+// app they claim, and refuses further logins from those that fail too often, so that a
+// misbehaving workload can't use the mount to hammer the CF API or guess at roles.
+// Failures are only counted in memory on the node that handled them.
+type loginThrottle struct {
+	mu         sync.Mutex
+	failures   map[string]*loginFailures
+	maxEntries int
+	lastSweep  time.Time
+}
+
+// loginFailures are the consecutive failed logins counted for a key within the current
+// window, and the cooldowns they've led to.
+type loginFailures struct {
+	windowStart  time.Time
+	count        int
+	blockedUntil time.Time
+	lastFailure  time.Time
+
+	// cooldowns is how many cooldowns in a row the key has been refused for, each
+	// twice as long as the last. It's reset once a cooldown has passed again since the
+	// last one ended without the key being refused.
+	cooldowns  int
+	cooldown   time.Duration
+	backoffEnd time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		failures:   make(map[string]*loginFailures),
+		maxEntries: maxLoginThrottleEntries,
+	}
+}
+
+// loginThrottleKey returns the key failed logins are counted under. The app ID is as
+// claimed by the login, so failures are counted per address too, keeping a workload
+// claiming another app's ID from getting that app's logins refused elsewhere.
+func loginThrottleKey(appID, remoteAddr string) string {
+	return appID + "|" + remoteAddr
+}
+
+// loginAddressThrottleKey returns the key failed logins from the address are counted
+// under whichever app they claim, so that a workload can't claim a new app ID for each
+// attempt to go on failing.
+func loginAddressThrottleKey(remoteAddr string) string {
+	return remoteAddr
+}
+
+// splitLoginThrottleKey returns the app ID and address of the key, and whether it
+// counts the app's failures rather than the address's. The claimed app ID may contain
+// anything, but the address never contains the separator.
+func splitLoginThrottleKey(key string) (string, string, bool) {
+	i := strings.LastIndex(key, "|")
+	if i < 0 {
+		return "", key, false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// blockedUntil returns when logins for the key will be accepted again, and whether
+// they're refused until then.
+func (l *loginThrottle) blockedUntil(key string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[key]
+	if !ok || !now.Before(f.blockedUntil) {
+		return time.Time{}, false
+	}
+	return f.blockedUntil, true
+}
+
+// addFailure counts a failed login for the key, and refuses its logins for the
+// cooldown once its failures within the window reach the limit. Keys that reach the
+// limit again soon after a cooldown are refused for twice as long each time, up to the
+// max cooldown.
+func (l *loginThrottle) addFailure(key string, limit int, window, cooldown, maxCooldown time.Duration, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= window {
+		l.sweepLocked(window, now)
+	}
+
+	f, ok := l.failures[key]
+	if !ok {
+		if len(l.failures) >= l.maxEntries {
+			l.sweepLocked(window, now)
+		}
+		if len(l.failures) >= l.maxEntries {
+			l.evictLocked()
+		}
+		f = &loginFailures{windowStart: now}
+		l.failures[key] = f
+	}
+	f.lastFailure = now
+	if !now.Before(f.windowStart.Add(window)) {
+		f.windowStart = now
+		f.count = 0
+	}
+	f.count++
+	if f.count >= limit {
+		if f.cooldowns == 0 || !now.Before(f.backoffEnd) {
+			f.cooldowns = 0
+			f.cooldown = cooldown
+		} else if f.cooldown < maxCooldown {
+			f.cooldown = min(2*f.cooldown, maxCooldown)
+		}
+		f.cooldowns++
+		// Failures start being counted again once the cooldown begins.
+		f.blockedUntil = now.Add(f.cooldown)
+		f.backoffEnd = f.blockedUntil.Add(f.cooldown)
+		f.windowStart = now
+		f.count = 0
+	}
+}
+
+// evictLocked drops the app and address whose last failure is the oldest, to make room
+// for another. Addresses are only dropped once no apps are left, as their failures are
+// what keep a workload claiming new app IDs from failing without end.
+func (l *loginThrottle) evictLocked() {
+	var oldestKey string
+	var oldest *loginFailures
+	oldestPerApp := false
+	for key, f := range l.failures {
+		_, _, perApp := splitLoginThrottleKey(key)
+		if oldest == nil || (perApp && !oldestPerApp) || (perApp == oldestPerApp && f.lastFailure.Before(oldest.lastFailure)) {
+			oldestKey, oldest, oldestPerApp = key, f, perApp
+		}
+	}
+	delete(l.failures, oldestKey)
+}
+
+// reset forgets the failures counted for the key, as a successful login breaks the
+// run of failures.
+func (l *loginThrottle) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// throttledLogins are the failures counted for an app and address, or for an address
+// whichever app they claim, as they're shown to operators.
+type throttledLogins struct {
+	AppID        string
+	RemoteAddr   string
+	AnyApp       bool
+	Failures     int
+	Cooldowns    int
+	BlockedUntil time.Time
+}
+
+// list returns the failures counted for each app and address, refused ones first
+// and sorted by app ID and address.
+func (l *loginThrottle) list(now time.Time) []throttledLogins {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	throttled := make([]throttledLogins, 0, len(l.failures))
+	for key, f := range l.failures {
+		appID, remoteAddr, perApp := splitLoginThrottleKey(key)
+		t := throttledLogins{
+			AppID:      appID,
+			RemoteAddr: remoteAddr,
+			AnyApp:     !perApp,
+			Failures:   f.count,
+			Cooldowns:  f.cooldowns,
+		}
+		if now.Before(f.blockedUntil) {
+			t.BlockedUntil = f.blockedUntil
+		}
+		throttled = append(throttled, t)
+	}
+	sort.Slice(throttled, func(i, j int) bool {
+		if blockedI, blockedJ := !throttled[i].BlockedUntil.IsZero(), !throttled[j].BlockedUntil.IsZero(); blockedI != blockedJ {
+			return blockedI
+		}
+		if throttled[i].AppID != throttled[j].AppID {
+			return throttled[i].AppID < throttled[j].AppID
+		}
+		return throttled[i].RemoteAddr < throttled[j].RemoteAddr
+	})
+	return throttled
+}
+
+// clear forgets the failures counted for the app, from any address if the address is
+// empty, returning how many keys were forgotten. The failures counted for the addresses
+// the app failed from are forgotten too, so that the app's logins are accepted again.
+func (l *loginThrottle) clear(appID, remoteAddr string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cleared := 0
+	for key := range l.failures {
+		keyAppID, keyRemoteAddr, perApp := splitLoginThrottleKey(key)
+		if perApp && keyAppID == appID && (remoteAddr == "" || keyRemoteAddr == remoteAddr) {
+			delete(l.failures, key)
+			delete(l.failures, loginAddressThrottleKey(keyRemoteAddr))
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// sweep drops the failures whose window has passed and that aren't refusing logins,
+// returning how many keys were dropped.
+func (l *loginThrottle) sweep(window time.Duration, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sweepLocked(window, now)
+}
+
+func (l *loginThrottle) sweepLocked(window time.Duration, now time.Time) int {
+	swept := 0
+	for k, f := range l.failures {
+		if !now.Before(f.windowStart.Add(window)) && !now.Before(f.blockedUntil) && !now.Before(f.backoffEnd) {
+			delete(l.failures, k)
+			swept++
+		}
+	}
+	l.lastSweep = now
+	return swept
+}
+
+// loginFailureAddressLimit returns how many failed logins an address may make as any
+// app before its logins are refused. Zero doesn't limit them.
+func loginFailureAddressLimit(config *models.Configuration) int {
+	if config.LoginFailureAddressLimit == 0 {
+		return defaultLoginFailureAddressLimitFactor * config.LoginFailureLimit
+	}
+	return config.LoginFailureAddressLimit
+}
+
+// loginFailureWindow returns how long failed logins are counted for.
+func loginFailureWindow(config *models.Configuration) time.Duration {
+	if config.LoginFailureWindow == 0 {
+		return defaultLoginFailureWindow
+	}
+	return config.LoginFailureWindow
+}
+
+// loginFailureCooldown returns how long logins are refused for once too many failed.
+func loginFailureCooldown(config *models.Configuration) time.Duration {
+	if config.LoginFailureCooldown == 0 {
+		return defaultLoginFailureCooldown
+	}
+	return config.LoginFailureCooldown
+}
+
+// loginFailureMaxCooldown returns the longest that consecutive cooldowns grow to. If
+// it isn't longer than the cooldown, cooldowns don't grow.
+func loginFailureMaxCooldown(config *models.Configuration) time.Duration {
+	return max(config.LoginFailureMaxCooldown, loginFailureCooldown(config))
+}
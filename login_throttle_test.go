@@ -0,0 +1,314 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	t.Parallel()
+
+	l := newLoginThrottle()
+	now := time.Now()
+	key := loginThrottleKey("app", "10.0.0.1")
+	addFailure := func(at time.Time) {
+		l.addFailure(key, 3, time.Minute, 5*time.Minute, 0, at)
+	}
+
+	// Failures that fall in different windows don't add up.
+	addFailure(now)
+	addFailure(now.Add(10 * time.Second))
+	addFailure(now.Add(2 * time.Minute))
+	if _, blocked := l.blockedUntil(key, now.Add(2*time.Minute)); blocked {
+		t.Fatal("expected failures in different windows not to block logins")
+	}
+
+	addFailure(now.Add(2*time.Minute + time.Second))
+	addFailure(now.Add(2*time.Minute + 2*time.Second))
+	until, blocked := l.blockedUntil(key, now.Add(3*time.Minute))
+	if !blocked {
+		t.Fatal("expected the third failure within a window to block logins")
+	}
+	if expected := now.Add(7*time.Minute + 2*time.Second); !until.Equal(expected) {
+		t.Fatalf("expected logins to be blocked until %s but received %s", expected, until)
+	}
+	if _, blocked := l.blockedUntil(loginThrottleKey("app", "10.0.0.2"), now.Add(3*time.Minute)); blocked {
+		t.Fatal("expected the same app from another address not to be blocked")
+	}
+	if _, blocked := l.blockedUntil(key, until); blocked {
+		t.Fatal("expected logins to be accepted again after the cooldown")
+	}
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	t.Parallel()
+
+	l := newLoginThrottle()
+	now := time.Now()
+	key := loginThrottleKey("app", "10.0.0.1")
+	block := func(at time.Time) time.Time {
+		l.addFailure(key, 1, time.Minute, time.Minute, 3*time.Minute, at)
+		until, blocked := l.blockedUntil(key, at)
+		if !blocked {
+			t.Fatal("expected the failure to block logins")
+		}
+		return until
+	}
+
+	// Each cooldown reached soon after the last doubles, up to the max cooldown.
+	until := block(now)
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		next := block(until)
+		if next.Sub(until) != expected {
+			t.Fatalf("expected a cooldown of %s but received %s", expected, next.Sub(until))
+		}
+		until = next
+	}
+	if throttled := l.list(until.Add(-time.Second)); len(throttled) != 1 || throttled[0].AppID != "app" || throttled[0].RemoteAddr != "10.0.0.1" || throttled[0].Cooldowns != 4 {
+		t.Fatalf("expected the app's four cooldowns to be listed but received %+v", throttled)
+	}
+
+	// Once a cooldown has passed since the last one, it's back to the first cooldown.
+	if next := block(until.Add(3 * time.Minute)); next.Sub(until.Add(3*time.Minute)) != time.Minute {
+		t.Fatalf("expected the cooldown to be reset but received %s", next.Sub(until.Add(3*time.Minute)))
+	}
+
+	// A successful login forgets the failures.
+	l.reset(key)
+	if throttled := l.list(now); len(throttled) != 0 {
+		t.Fatalf("expected the reset failures to be forgotten but received %+v", throttled)
+	}
+}
+
+func TestWithLoginActivityThrottlesFailedLogins(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	if err := storeConfig(ctx, storage, &models.Configuration{LoginFailureLimit: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	login := b.withLoginActivity("login", func(context.Context, *logical.Request, *framework.FieldData) (*logical.Response, error) {
+		calls++
+		return nil, errors.New("no matching role")
+	}, func(*models.Configuration, *framework.FieldData) string { return "app" })
+	data := &framework.FieldData{
+		Raw:    map[string]interface{}{"role": "test-role"},
+		Schema: map[string]*framework.FieldSchema{"role": {Type: framework.TypeString}},
+	}
+	req := &logical.Request{Storage: storage, Connection: &logical.Connection{RemoteAddr: "10.0.0.1"}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := login(ctx, req, data); err == nil {
+			t.Fatal("expected the login to fail")
+		}
+	}
+	_, err = login(ctx, req, data)
+	var coded logical.HTTPCodedError
+	if !errors.As(err, &coded) || coded.Code() != http.StatusTooManyRequests || !strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected the login to be throttled but received %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected the throttled login not to be attempted, but it was attempted %d times", calls)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "login-throttle",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps := resp.Data["apps"].([]map[string]interface{})
+	if len(apps) != 1 || apps[0]["app_id"] != "app" || apps[0]["blocked"] != true || apps[0]["cooldowns"] != 1 {
+		t.Fatalf("expected the app to be listed as blocked but received %v", apps)
+	}
+
+	// Operators can let the app log in again right away.
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "login-throttle",
+		Storage:   storage,
+		Data:      map[string]interface{}{"app_id": "app"},
+	})
+	if err != nil || resp.Data["cleared"] != 1 {
+		t.Fatalf("expected the app's failures to be cleared but received %#v, %v", resp, err)
+	}
+	if _, err := login(ctx, req, data); err == nil || strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected the login to be attempted again but received %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected the login to be attempted once the failures were cleared, but it was attempted %d times", calls)
+	}
+}
+
+func TestWithLoginActivityThrottlesForwardedAddresses(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	if err := storeConfig(ctx, storage, &models.Configuration{
+		LoginFailureLimit: 1,
+		TrustedProxyCIDRs: []string{"10.0.0.0/24"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	login := b.withLoginActivity("login", func(context.Context, *logical.Request, *framework.FieldData) (*logical.Response, error) {
+		return nil, errors.New("no matching role")
+	}, func(*models.Configuration, *framework.FieldData) string { return "app" })
+	data := &framework.FieldData{
+		Raw:    map[string]interface{}{"role": "test-role"},
+		Schema: map[string]*framework.FieldSchema{"role": {Type: framework.TypeString}},
+	}
+	throughProxy := func(clientAddr string) *logical.Request {
+		return &logical.Request{
+			Storage:    storage,
+			Connection: &logical.Connection{RemoteAddr: "10.0.0.1"},
+			Headers:    map[string][]string{"X-Forwarded-For": {clientAddr}},
+		}
+	}
+
+	login(ctx, throughProxy("10.255.0.1"), data)
+	if _, err := login(ctx, throughProxy("10.255.0.1"), data); err == nil || !strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected the client to be throttled but received %v", err)
+	}
+	// Other clients behind the same proxy aren't throttled by its failures.
+	if _, err := login(ctx, throughProxy("10.255.0.2"), data); err == nil || strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected another client behind the proxy not to be throttled but received %v", err)
+	}
+}
+
+func TestWithLoginActivityThrottlesAddresses(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	if err := storeConfig(ctx, storage, &models.Configuration{
+		LoginFailureLimit:        2,
+		LoginFailureAddressLimit: 3,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each login claims another app's ID, so no app's failures reach the limit.
+	var calls int
+	login := b.withLoginActivity("login", func(context.Context, *logical.Request, *framework.FieldData) (*logical.Response, error) {
+		calls++
+		return nil, errors.New("no matching role")
+	}, func(*models.Configuration, *framework.FieldData) string { return fmt.Sprintf("app-%d", calls) })
+	data := &framework.FieldData{
+		Raw:    map[string]interface{}{"role": "test-role"},
+		Schema: map[string]*framework.FieldSchema{"role": {Type: framework.TypeString}},
+	}
+	from := func(remoteAddr string) *logical.Request {
+		return &logical.Request{Storage: storage, Connection: &logical.Connection{RemoteAddr: remoteAddr}}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := login(ctx, from("10.0.0.1"), data); err == nil || strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+			t.Fatalf("expected the login to be attempted but received %v", err)
+		}
+	}
+	if _, err := login(ctx, from("10.0.0.1"), data); err == nil || !strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected the address to be throttled but received %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected the throttled login not to be attempted, but it was attempted %d times", calls)
+	}
+	if _, err := login(ctx, from("10.0.0.2"), data); err == nil || strings.HasPrefix(err.Error(), "[ERR_TOO_MANY_FAILED_LOGINS]") {
+		t.Fatalf("expected another address not to be throttled but received %v", err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "login-throttle",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := resp.Data["addresses"].([]map[string]interface{})
+	if len(addresses) != 2 || addresses[0]["remote_address"] != "10.0.0.1" || addresses[0]["blocked"] != true {
+		t.Fatalf("expected the address to be listed as blocked but received %v", addresses)
+	}
+}
+
+func TestLoginThrottleMaxEntries(t *testing.T) {
+	t.Parallel()
+
+	l := newLoginThrottle()
+	l.maxEntries = 3
+	now := time.Now()
+	addFailure := func(key string, at time.Time) {
+		l.addFailure(key, 1, time.Minute, time.Minute, 0, at)
+	}
+
+	// Once full, the app that failed longest ago is forgotten to count another, even
+	// if its logins are still refused.
+	addFailure(loginAddressThrottleKey("10.0.0.1"), now)
+	addFailure(loginThrottleKey("app-0", "10.0.0.1"), now.Add(time.Second))
+	addFailure(loginThrottleKey("app-1", "10.0.0.1"), now.Add(2*time.Second))
+	addFailure(loginThrottleKey("app-2", "10.0.0.1"), now.Add(3*time.Second))
+	if throttled := l.list(now.Add(3 * time.Second)); len(throttled) != 3 {
+		t.Fatalf("expected 3 entries to be kept but received %+v", throttled)
+	}
+	if _, blocked := l.blockedUntil(loginThrottleKey("app-0", "10.0.0.1"), now.Add(3*time.Second)); blocked {
+		t.Fatal("expected the app that failed longest ago to be forgotten")
+	}
+	for _, key := range []string{loginAddressThrottleKey("10.0.0.1"), loginThrottleKey("app-1", "10.0.0.1"), loginThrottleKey("app-2", "10.0.0.1")} {
+		if _, blocked := l.blockedUntil(key, now.Add(3*time.Second)); !blocked {
+			t.Fatalf("expected %q to be kept", key)
+		}
+	}
+
+	// Entries that have run their course are swept before any are evicted.
+	addFailure(loginThrottleKey("app-3", "10.0.0.2"), now.Add(5*time.Minute))
+	if throttled := l.list(now.Add(5 * time.Minute)); len(throttled) != 1 || throttled[0].AppID != "app-3" {
+		t.Fatalf("expected only the new app to be kept but received %+v", throttled)
+	}
+}
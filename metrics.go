@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Metrics are emitted to go-metrics' global sink, which is Vault's own when the
+// plugin is built into Vault.
+var (
+	metricLoginAttempt    = []string{"auth", "cf", "login", "attempt"}
+	metricLoginFailure    = []string{"auth", "cf", "login", "failure"}
+	metricLoginDuration   = []string{"auth", "cf", "login", "duration"}
+	metricCFAPICall       = []string{"auth", "cf", "cf_api", "call"}
+	metricCFAPIThrottled  = []string{"auth", "cf", "cf_api", "throttled"}
+	metricCFClientRefresh = []string{"auth", "cf", "cf_client", "refresh"}
+)
+
+// loginFailureReasons map parts of the messages logins fail with to the reason
+// reported in metrics, keeping the number of distinct labels small. The first match
+// wins, and failures that match none are reported as "other".
+var loginFailureReasons = []struct {
+	substring string
+	reason    string
+}{
+	{"required", "invalid_request"},
+	{"no matching role", "role"},
+	{"invalid role name", "role"},
+	{"were revoked", "revoked"},
+	{"no longer exists in CF", "revoked"},
+	{"denied by the mount's config", "denied"},
+	{errCFAPIUnavailable.Error(), "cf_api_unavailable"},
+	{errCFAPIRateLimited.Error(), "cf_api_rate_limited"},
+	{"request is too old", "signing_time"},
+	{"request is too far in the future", "signing_time"},
+	{"signature", "signature"},
+	{"certificate", "certificate"},
+	{"x509", "certificate"},
+	{"JWT", "jwt"},
+	{"IP address", "ip_address"},
+	{"role constraints", "bound_constraints"},
+	{"that the role requires", "bound_constraints"},
+	{"API's expected", "cf_api_mismatch"},
+	{"live instances", "cf_api_mismatch"},
+	{"rather than STARTED", "cf_api_mismatch"},
+	{"permission denied", "permission_denied"},
+	{"too many failed logins", "throttled"},
+}
+
+// loginFailureReason returns the reason a login failed with the given message, as
+// reported in metrics.
+func loginFailureReason(message string) string {
+	for _, r := range loginFailureReasons {
+		if strings.Contains(message, r.substring) {
+			return r.reason
+		}
+	}
+	return "other"
+}
+
+// emitLoginMetrics emits the metrics for a login attempt that started at start.
+func emitLoginMetrics(attempt loginAttempt, start time.Time) {
+	result := "success"
+	if attempt.Failed {
+		result = "failure"
+	}
+	labels := []metrics.Label{
+		{Name: "path", Value: attempt.Path},
+		{Name: "result", Value: result},
+	}
+	metrics.IncrCounterWithLabels(metricLoginAttempt, 1, labels)
+	metrics.MeasureSinceWithLabels(metricLoginDuration, start, labels)
+	if attempt.Failed {
+		metrics.IncrCounterWithLabels(metricLoginFailure, 1, []metrics.Label{
+			{Name: "path", Value: attempt.Path},
+			{Name: "reason", Value: loginFailureReason(attempt.Reason)},
+		})
+	}
+}
+
+// callCFAPI makes a call to the CF API through the circuit breaker, and emits its
+// duration and result. The operation names the call in the metrics.
+func (b *backend) callCFAPI(operation string, fn func() error) error {
+	start := time.Now()
+	err := b.cfAPIBreaker.call(fn)
+	result := "success"
+	switch {
+	case isCFAPIFailure(err):
+		result = "unavailable"
+		// Calls refused by the open circuit breaker weren't made with the client.
+		if !errors.Is(err, errCFAPIUnavailable) {
+			b.cfClientStatus.failed(err)
+		}
+	case errors.Is(err, errCFAPIRateLimited):
+		result = "rate_limited"
+		b.cfClientStatus.failed(err)
+	case err != nil:
+		result = "error"
+	}
+	metrics.MeasureSinceWithLabels(metricCFAPICall, start, []metrics.Label{
+		{Name: "operation", Value: operation},
+		{Name: "result", Value: result},
+	})
+	return err
+}
@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoginFailureReason(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		message string
+		reason  string
+	}{
+		{"'signature' is required", "invalid_request"},
+		{`invalid role name "foo"`, "role"},
+		{"request is too old; signed at 2024-01-01T00:00:00Z", "signing_time"},
+		{"signature has already been used to log in, please sign a new request", "signature"},
+		{"x509: certificate signed by unknown authority", "certificate"},
+		{"no matching IP address", "ip_address"},
+		{"app ID foo doesn't match role constraints of [bar]", "bound_constraints"},
+		{"tokens for app foo were revoked at 2024-01-01T00:00:00Z", "revoked"},
+		{fmt.Sprintf("%s: x509: certificate has expired", errCFAPIUnavailable), "cf_api_unavailable"},
+		{"executing GET request for /v3/apps failed: CF API rate limited the request, retry after 30s", "cf_api_rate_limited"},
+		{"cert space ID foo doesn't match API's expected one of bar", "cf_api_mismatch"},
+		{"permission denied", "permission_denied"},
+		{"something unexpected", "other"},
+	} {
+		if reason := loginFailureReason(tc.message); reason != tc.reason {
+			t.Errorf("expected %q to be reported as %q but received %q", tc.message, tc.reason, reason)
+		}
+	}
+}
@@ -11,47 +11,127 @@ import (
 	"strings"
 )
 
+// The fields of a CF certificate that are read from an identity certificate.
+const (
+	CertFieldInstanceID = "instance_id"
+	CertFieldOrgID      = "org_id"
+	CertFieldSpaceID    = "space_id"
+	CertFieldAppID      = "app_id"
+
+	// The names are only carried by some distributions' certificates, so they're
+	// optional.
+	CertFieldOrgName   = "org_name"
+	CertFieldSpaceName = "space_name"
+	CertFieldAppName   = "app_name"
+)
+
+// DefaultCertFieldSources are where CF's instance identity certificates carry each field.
+// A source is the name of a subject attribute, or "uri" for the URI SANs, optionally
+// followed by a colon and the prefix that the value must have, which is removed.
+var DefaultCertFieldSources = map[string]string{
+	CertFieldInstanceID: "cn",
+	CertFieldOrgID:      "ou:organization:",
+	CertFieldSpaceID:    "ou:space:",
+	CertFieldAppID:      "ou:app:",
+	CertFieldOrgName:    "ou:organization-name:",
+	CertFieldSpaceName:  "ou:space-name:",
+	CertFieldAppName:    "ou:app-name:",
+}
+
+// certFieldNames name the fields in errors.
+var certFieldNames = map[string]string{
+	CertFieldInstanceID: "instance",
+	CertFieldOrgID:      "org",
+	CertFieldSpaceID:    "space",
+	CertFieldAppID:      "app",
+	CertFieldOrgName:    "org name",
+	CertFieldSpaceName:  "space name",
+	CertFieldAppName:    "app name",
+}
+
+// certSourceValues return the values a certificate has for each kind of source.
+var certSourceValues = map[string]func(*x509.Certificate) []string{
+	"cn":            func(c *x509.Certificate) []string { return []string{c.Subject.CommonName} },
+	"serial_number": func(c *x509.Certificate) []string { return []string{c.Subject.SerialNumber} },
+	"ou":            func(c *x509.Certificate) []string { return c.Subject.OrganizationalUnit },
+	"o":             func(c *x509.Certificate) []string { return c.Subject.Organization },
+	"l":             func(c *x509.Certificate) []string { return c.Subject.Locality },
+	"st":            func(c *x509.Certificate) []string { return c.Subject.Province },
+	"c":             func(c *x509.Certificate) []string { return c.Subject.Country },
+	"uri": func(c *x509.Certificate) []string {
+		uris := make([]string, 0, len(c.URIs))
+		for _, uri := range c.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	},
+}
+
+// ValidateCertFieldSources returns an error if any of the field sources can't be used.
+func ValidateCertFieldSources(fieldSources map[string]string) error {
+	for field, source := range fieldSources {
+		if _, ok := certFieldNames[field]; !ok {
+			return fmt.Errorf("unknown field %q, expected one of %q, %q, %q, %q, %q, %q, or %q", field,
+				CertFieldInstanceID, CertFieldOrgID, CertFieldSpaceID, CertFieldAppID, CertFieldOrgName, CertFieldSpaceName, CertFieldAppName)
+		}
+		kind, _, _ := strings.Cut(source, ":")
+		if _, ok := certSourceValues[kind]; !ok {
+			return fmt.Errorf("unknown source %q for %q", source, field)
+		}
+	}
+	return nil
+}
+
 // NewCFCertificateFromx509 converts a x509 certificate to a valid, well-formed CF certificate,
 // erroring if this isn't possible.
 func NewCFCertificateFromx509(certificate *x509.Certificate) (*CFCertificate, error) {
-	if len(certificate.IPAddresses) != 1 {
-		return nil, fmt.Errorf("valid CF certs have one IP address, but this has %s", certificate.IPAddresses)
+	return NewCFCertificateFromx509WithFieldSources(certificate, nil)
+}
+
+// NewCFCertificateFromx509WithFieldSources is like NewCFCertificateFromx509, but reads the
+// fields from the given sources, and from the default ones for fields that aren't given.
+func NewCFCertificateFromx509WithFieldSources(certificate *x509.Certificate, fieldSources map[string]string) (*CFCertificate, error) {
+	if len(certificate.IPAddresses) == 0 {
+		return nil, errors.New("valid CF certs have at least one IP address, but this has none")
 	}
 
 	cfCert := &CFCertificate{
-		InstanceID: certificate.Subject.CommonName,
-		IPAddress:  certificate.IPAddresses[0].String(),
-	}
-
-	spaces := 0
-	orgs := 0
-	apps := 0
-	for _, ou := range certificate.Subject.OrganizationalUnit {
-		if strings.HasPrefix(ou, "space:") {
-			cfCert.SpaceID = strings.Split(ou, "space:")[1]
-			spaces++
-			continue
+		IPAddress: certificate.IPAddresses[0].String(),
+	}
+	for _, ipAddress := range certificate.IPAddresses {
+		cfCert.IPAddresses = append(cfCert.IPAddresses, ipAddress.String())
+	}
+
+	for field, value := range map[string]*string{
+		CertFieldInstanceID: &cfCert.InstanceID,
+		CertFieldOrgID:      &cfCert.OrgID,
+		CertFieldSpaceID:    &cfCert.SpaceID,
+		CertFieldAppID:      &cfCert.AppID,
+		CertFieldOrgName:    &cfCert.OrgName,
+		CertFieldSpaceName:  &cfCert.SpaceName,
+		CertFieldAppName:    &cfCert.AppName,
+	} {
+		source := fieldSources[field]
+		if source == "" {
+			source = DefaultCertFieldSources[field]
 		}
-		if strings.HasPrefix(ou, "organization:") {
-			cfCert.OrgID = strings.Split(ou, "organization:")[1]
-			orgs++
-			continue
+		kind, prefix, _ := strings.Cut(source, ":")
+		sourceValues, ok := certSourceValues[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown source %q for %q", source, field)
 		}
-		if strings.HasPrefix(ou, "app:") {
-			cfCert.AppID = strings.Split(ou, "app:")[1]
-			apps++
-			continue
+		matches := 0
+		for _, v := range sourceValues(certificate) {
+			if strings.HasPrefix(v, prefix) {
+				*value = strings.TrimPrefix(v, prefix)
+				matches++
+			}
+		}
+		if matches > 1 {
+			return nil, fmt.Errorf("expected 1 %s but received %d", certFieldNames[field], matches)
 		}
 	}
-	if spaces > 1 {
-		return nil, fmt.Errorf("expected 1 space but received %d", spaces)
-	}
-	if orgs > 1 {
-		return nil, fmt.Errorf("expected 1 org but received %d", orgs)
-	}
-	if apps > 1 {
-		return nil, fmt.Errorf("expected 1 app but received %d", apps)
-	}
+	cfCert.SPIFFEID = spiffeID(certSourceValues["uri"](certificate))
 	if err := cfCert.validate(); err != nil {
 		return nil, err
 	}
@@ -68,6 +148,9 @@ func NewCFCertificate(instanceID, orgID, spaceID, appID, ipAddress string) (*CFC
 		AppID:      appID,
 		IPAddress:  ipAddress,
 	}
+	if ipAddress != "" {
+		cfCert.IPAddresses = []string{ipAddress}
+	}
 	if err := cfCert.validate(); err != nil {
 		return nil, err
 	}
@@ -78,6 +161,24 @@ func NewCFCertificate(instanceID, orgID, spaceID, appID, ipAddress string) (*CFC
 // methods, which contain logic validating that the expected fields exist.
 type CFCertificate struct {
 	InstanceID, OrgID, SpaceID, AppID, IPAddress string
+
+	// IPAddresses are all of the certificate's IP SANs, the first of which is the
+	// IPAddress.
+	IPAddresses []string
+
+	// The names of the org, space, and app, if the certificate carries them.
+	OrgName, SpaceName, AppName string
+
+	// SPIFFEID is the SPIFFE ID in the certificate's URI SANs, if it carries one.
+	SPIFFEID string
+}
+
+// AllIPAddresses returns all of the certificate's IP addresses.
+func (c *CFCertificate) AllIPAddresses() []string {
+	if len(c.IPAddresses) == 0 && c.IPAddress != "" {
+		return []string{c.IPAddress}
+	}
+	return c.IPAddresses
 }
 
 func (c *CFCertificate) validate() error {
@@ -96,8 +197,10 @@ func (c *CFCertificate) validate() error {
 	if c.IPAddress == "" {
 		return errors.New("ip address is unspecified")
 	}
-	if net.ParseIP(c.IPAddress) == nil {
-		return fmt.Errorf("%q could not be parsed as a valid IP address", c.IPAddress)
+	for _, ipAddress := range c.AllIPAddresses() {
+		if net.ParseIP(ipAddress) == nil {
+			return fmt.Errorf("%q could not be parsed as a valid IP address", ipAddress)
+		}
 	}
 	return nil
 }
@@ -5,8 +5,12 @@ package models
 
 import (
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
 	"testing"
 )
 
@@ -133,6 +137,204 @@ func TestNewPcfCertificateFromx509(t *testing.T) {
 	}
 }
 
+func TestNewCFCertificateFromx509MultipleIPAddresses(t *testing.T) {
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{
+			OrganizationalUnit: []string{
+				"organization:34a878d0-c2f9-4521-ba73-a9f664e82c7b",
+				"space:3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
+				"app:2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+			},
+			CommonName: "f9c7cd7d-1612-4f57-63a8-f995",
+		},
+		IPAddresses: []net.IP{net.ParseIP("10.255.181.105"), net.ParseIP("2001:db8::68")},
+	}
+	cfCert, err := NewCFCertificateFromx509(certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfCert.IPAddress != "10.255.181.105" {
+		t.Fatalf("expected %s but received %s", "10.255.181.105", cfCert.IPAddress)
+	}
+	expected := []string{"10.255.181.105", "2001:db8::68"}
+	if !reflect.DeepEqual(cfCert.AllIPAddresses(), expected) {
+		t.Fatalf("expected %s but received %s", expected, cfCert.AllIPAddresses())
+	}
+
+	certificate.IPAddresses = nil
+	if _, err := NewCFCertificateFromx509(certificate); err == nil {
+		t.Fatal("expected a certificate without IP addresses to be invalid")
+	}
+}
+
+func TestNewCFCertificateFromx509WithFieldSources(t *testing.T) {
+	appURI, err := url.Parse("spiffe://cf.example.com/app/2d3e834a-3a25-4591-974c-fa5626d5d0a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization:       []string{"org-34a878d0-c2f9-4521-ba73-a9f664e82c7b"},
+			OrganizationalUnit: []string{"space:3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"},
+			SerialNumber:       "f9c7cd7d-1612-4f57-63a8-f995",
+		},
+		URIs:        []*url.URL{appURI},
+		IPAddresses: []net.IP{net.ParseIP("10.255.181.105")},
+	}
+	fieldSources := map[string]string{
+		CertFieldInstanceID: "serial_number",
+		CertFieldOrgID:      "o:org-",
+		CertFieldAppID:      "uri:spiffe://cf.example.com/app/",
+	}
+	if err := ValidateCertFieldSources(fieldSources); err != nil {
+		t.Fatal(err)
+	}
+	cfCert, err := NewCFCertificateFromx509WithFieldSources(certificate, fieldSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &CFCertificate{
+		InstanceID:  "f9c7cd7d-1612-4f57-63a8-f995",
+		OrgID:       "34a878d0-c2f9-4521-ba73-a9f664e82c7b",
+		SpaceID:     "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
+		AppID:       "2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+		IPAddress:   "10.255.181.105",
+		IPAddresses: []string{"10.255.181.105"},
+		SPIFFEID:    "spiffe://cf.example.com/app/2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+	}
+	if !reflect.DeepEqual(cfCert, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, cfCert)
+	}
+
+	// The default layout doesn't find the org or app in this certificate.
+	if _, err := NewCFCertificateFromx509(certificate); err == nil {
+		t.Fatal("expected the certificate to be invalid with the default field sources")
+	}
+
+	certificate.URIs = append(certificate.URIs, appURI)
+	if _, err := NewCFCertificateFromx509WithFieldSources(certificate, fieldSources); err == nil {
+		t.Fatal("expected a certificate with two app IDs to be invalid")
+	}
+
+	for _, invalid := range []map[string]string{
+		{"instance": "cn"},
+		{CertFieldAppID: "dns:app-"},
+	} {
+		if err := ValidateCertFieldSources(invalid); err == nil {
+			t.Fatalf("expected %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestNewCFCertificateFromx509WithNames(t *testing.T) {
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "f9c7cd7d-1612-4f57-63a8-f995",
+			OrganizationalUnit: []string{
+				"organization:34a878d0-c2f9-4521-ba73-a9f664e82c7b",
+				"organization-name:payments",
+				"space:3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
+				"space-name:production",
+				"app:2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+				"app-name:payments-api",
+			},
+		},
+		IPAddresses: []net.IP{net.ParseIP("10.255.181.105")},
+	}
+	cfCert, err := NewCFCertificateFromx509(certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfCert.OrgName != "payments" || cfCert.SpaceName != "production" || cfCert.AppName != "payments-api" {
+		t.Fatalf("unexpected names in %+v", cfCert)
+	}
+	if cfCert.OrgID != "34a878d0-c2f9-4521-ba73-a9f664e82c7b" {
+		t.Fatalf("expected the org ID not to be confused with the org name, received %q", cfCert.OrgID)
+	}
+}
+
+func TestNewCFCertificateFromx509SPIFFEID(t *testing.T) {
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "f9c7cd7d-1612-4f57-63a8-f995",
+			OrganizationalUnit: []string{
+				"organization:34a878d0-c2f9-4521-ba73-a9f664e82c7b",
+				"space:3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
+				"app:2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+			},
+		},
+		IPAddresses: []net.IP{net.ParseIP("10.255.181.105")},
+	}
+	withURIs := func(uris ...string) *x509.Certificate {
+		certificate.URIs = nil
+		for _, raw := range uris {
+			uri, err := url.Parse(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate.URIs = append(certificate.URIs, uri)
+		}
+		return certificate
+	}
+
+	// Other URI SANs aren't SPIFFE IDs.
+	cfCert, err := NewCFCertificateFromx509(withURIs("https://cf.example.com", "spiffe://cf.example.com/app/payments-api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfCert.SPIFFEID != "spiffe://cf.example.com/app/payments-api" {
+		t.Fatalf("expected the SPIFFE ID to be parsed but received %q", cfCert.SPIFFEID)
+	}
+	if cfCert, err = NewCFCertificateFromx509(withURIs()); err != nil || cfCert.SPIFFEID != "" {
+		t.Fatalf("expected a certificate without a SPIFFE ID to be valid but received %+v, %v", cfCert, err)
+	}
+
+	// Certificates with malformed or several SPIFFE IDs have none.
+	for _, uris := range [][]string{
+		{"spiffe://cf.example.com/app/payments-api", "spiffe://cf.example.com/app/billing"},
+		{"spiffe://CF.example.com/app/payments-api"},
+		{"spiffe://cf.example.com/app//payments-api"},
+	} {
+		cfCert, err := NewCFCertificateFromx509(withURIs(uris...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfCert.SPIFFEID != "" {
+			t.Fatalf("expected a certificate with %v to have no SPIFFE ID but received %q", uris, cfCert.SPIFFEID)
+		}
+	}
+}
+
+func TestParseSPIFFEID(t *testing.T) {
+	for id, expected := range map[string][2]string{
+		"spiffe://cf.example.com":                    {"cf.example.com", ""},
+		"spiffe://cf.example.com/app/payments-api":   {"cf.example.com", "/app/payments-api"},
+		"spiffe://cf_prod-1.example/org/a.b/space_c": {"cf_prod-1.example", "/org/a.b/space_c"},
+	} {
+		trustDomain, path, err := ParseSPIFFEID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trustDomain != expected[0] || path != expected[1] {
+			t.Fatalf("expected %q to have trust domain %q and path %q but received %q and %q", id, expected[0], expected[1], trustDomain, path)
+		}
+	}
+	for _, id := range []string{
+		"https://cf.example.com/app",
+		"spiffe://",
+		"spiffe:///app",
+		"spiffe://cf.example.com:8443/app",
+		"spiffe://user@cf.example.com/app",
+		"spiffe://cf.example.com/",
+		"spiffe://cf.example.com/app/../org",
+		"spiffe://cf.example.com/app?query",
+	} {
+		if _, _, err := ParseSPIFFEID(id); err == nil {
+			t.Fatalf("expected %q to be invalid", id)
+		}
+	}
+}
+
 func TestNewCFCertificate(t *testing.T) {
 	cfCert, err := NewCFCertificate("f9c7cd7d-1612-4f57-63a8-f995", "34a878d0-c2f9-4521-ba73-a9f664e82c7b", "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9", "2d3e834a-3a25-4591-974c-fa5626d5d0a1", "10.255.181.105")
 	if err != nil {
@@ -10,6 +10,20 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
+// How much of the instance certificate logins log at the debug level.
+const (
+	// DebugLogCertGUIDs only logs the instance, app, space, and org GUIDs.
+	DebugLogCertGUIDs = "guids"
+
+	// DebugLogCertHashed logs hashes of the GUIDs in place of them, which still tell
+	// apart the instances logging in.
+	DebugLogCertHashed = "hashed"
+
+	// DebugLogCertFull logs every field of the certificate, including its IP addresses
+	// and the names it carries.
+	DebugLogCertFull = "full"
+)
+
 // Configuration is the config as it's reflected in Vault's storage system.
 type Configuration struct {
 	// Version 0 had the following fields:
@@ -24,12 +38,72 @@ type Configuration struct {
 	//		CFAPIAddr string `json:"cf_api_addr"`
 	//		CFUsername string `json:"cf_username"`
 	//		CFPassword string `json:"cf_password"`
+	// Version 0 fields are removed once the mount's storage is upgraded.
 	// Version 2 is in the future, and we intend to deprecate the fields noted in Version 0.
 	Version int `json:"version"`
 
 	// IdentityCACertificates are the CA certificates that should be used for verifying client certificates.
 	IdentityCACertificates []string `json:"identity_ca_certificates"`
 
+	// Whether the identity certificate and its intermediate must carry the key usages
+	// CF issues them with, as well as chaining to an identity CA.
+	EnforceIdentityCertKeyUsage bool `json:"enforce_identity_cert_key_usage"`
+
+	// Whether login signatures must be made with the algorithms, key sizes, and hashes
+	// FIPS 186-5 approves of, for mounts on Vault's FIPS builds.
+	EnforceFIPSSignatures bool `json:"enforce_fips_signatures"`
+
+	// Whether logins checked against the CF API must be from an instance that its
+	// app's process stats report as starting or running. Only recent versions of CF's
+	// API report instance GUIDs in process stats.
+	VerifyInstanceIDs bool `json:"verify_instance_ids"`
+
+	// How long before the identity certificate presented at login, and the identity CA
+	// and intermediates it chains to, expire that logins return a warning about it.
+	// Zero disables the warnings.
+	IdentityCertExpiryWarning time.Duration `json:"identity_cert_expiry_warning"`
+	IdentityCAExpiryWarning   time.Duration `json:"identity_ca_expiry_warning"`
+
+	// Where the instance, org, space, and app IDs are read from in the identity certificate,
+	// keyed by field. Fields that aren't set are read from where CF puts them.
+	IdentityCertFieldSources map[string]string `json:"identity_cert_field_sources"`
+
+	// CredHubAddr is the address of the CredHub that the identity CA bundle is read from,
+	// at CredHubIdentityCAPath, ex: "https://credhub.service.cf.internal:8844"
+	CredHubAddr           string `json:"credhub_addr"`
+	CredHubIdentityCAPath string `json:"credhub_identity_ca_path"`
+
+	// The client credentials used to authenticate to CredHub's UAA.
+	CredHubClientID     string `json:"credhub_client_id"`
+	CredHubClientSecret string `json:"credhub_client_secret"`
+
+	// The CA certificates that, if presented by CredHub or its UAA, should be trusted.
+	CredHubCACertificates []string `json:"credhub_ca_certificates"`
+
+	// How often the identity CA bundle is read from CredHub again. Zero means the default is used.
+	CredHubRefreshInterval time.Duration `json:"credhub_refresh_interval"`
+
+	// The identity CA bundle as it was last read from CredHub, and when.
+	CredHubIdentityCACertificates []string  `json:"credhub_identity_ca_certificates"`
+	CredHubRefreshedAt            time.Time `json:"credhub_refreshed_at"`
+
+	// IdentityCAURLs are the HTTPS URLs that identity CA bundles are downloaded from,
+	// which are given among the "identity_ca_certificates".
+	IdentityCAURLs []string `json:"identity_ca_urls"`
+
+	// The CA certificates that, if presented by the servers at IdentityCAURLs, should be
+	// trusted, and the hex-encoded SHA-256 digests of the public keys that, if set, one of
+	// the certificates the servers present must have.
+	IdentityCAURLCACertificates []string `json:"identity_ca_url_ca_certificates"`
+	IdentityCAURLPinnedSHA256   []string `json:"identity_ca_url_pinned_sha256"`
+
+	// How often the identity CA bundles are downloaded again. Zero means the default is used.
+	IdentityCAURLRefreshInterval time.Duration `json:"identity_ca_url_refresh_interval"`
+
+	// The identity CA bundles as they were last downloaded, and when.
+	URLIdentityCACertificates []string  `json:"url_identity_ca_certificates"`
+	IdentityCAURLsRefreshedAt time.Time `json:"identity_ca_urls_refreshed_at"`
+
 	// IdentityCACertificates that, if presented by the CF API, should be trusted.
 	CFAPICertificates []string `json:"cf_api_trusted_certificates"`
 
@@ -39,9 +113,22 @@ type Configuration struct {
 	// CFMutualTLSKey is the key that is used to perform mTLS with the CF API.
 	CFMutualTLSKey string `json:"cf_api_mutual_tls_key"`
 
+	// The minimum TLS version used with the CF API, ex: "tls12". If empty, TLS 1.2 is the minimum.
+	CFAPITLSMinVersion string `json:"cf_api_tls_min_version"`
+
+	// The name that the CF API's certificate is verified for, and sent as SNI, instead of its address's host.
+	CFAPITLSServerName string `json:"cf_api_tls_server_name"`
+
+	// Whether the CF API's certificate isn't verified. Only meant for testing.
+	CFAPITLSSkipVerify bool `json:"cf_api_tls_skip_verify"`
+
 	// CFAPIAddr is the address of CF's API, ex: "https://api.dev.cfdev.sh" or "http://127.0.0.1:33671"
 	CFAPIAddr string `json:"cf_api_addr"`
 
+	// CFAPIFailoverAddrs are the addresses of the same CF API that requests fail over to,
+	// in order, when CFAPIAddr fails them.
+	CFAPIFailoverAddrs []string `json:"cf_api_failover_addrs"`
+
 	// The username for the CF API.
 	CFUsername string `json:"cf_username"`
 
@@ -54,9 +141,129 @@ type Configuration struct {
 	// The Client Secret for the CF API auth.
 	CFClientSecret string `json:"cf_client_secret"`
 
+	// CFAccessToken is a pre-issued bearer token for the CF API. When set, it's used
+	// instead of the username and password or client credentials.
+	CFAccessToken string `json:"cf_access_token"`
+
+	// CFRefreshToken, if set, is used to get a new access token from UAA once
+	// CFAccessToken expires.
+	CFRefreshToken string `json:"cf_refresh_token"`
+
+	// CFJWTBearerSigningKey is the PEM-encoded private key that JWTs are signed with to
+	// exchange for UAA tokens using the JWT bearer grant. When set, it's used instead of
+	// the other credentials, with CFClientID, and CFClientSecret if set, as the client.
+	CFJWTBearerSigningKey string `json:"cf_jwt_bearer_signing_key"`
+
+	// CFJWTBearerKeyID, if set, is the kid header of the JWTs.
+	CFJWTBearerKeyID string `json:"cf_jwt_bearer_key_id"`
+
+	// CFJWTBearerIssuer is the iss claim of the JWTs, naming the identity provider that
+	// UAA trusts them from.
+	CFJWTBearerIssuer string `json:"cf_jwt_bearer_issuer"`
+
+	// CFJWTBearerSubject is the sub claim of the JWTs, naming the user UAA issues the
+	// tokens to.
+	CFJWTBearerSubject string `json:"cf_jwt_bearer_subject"`
+
+	// CFJWTBearerAudience, if set, is the aud claim of the JWTs, which is otherwise UAA's
+	// token endpoint.
+	CFJWTBearerAudience string `json:"cf_jwt_bearer_audience"`
+
 	// Timeout for the CF API.
 	CFTimeout time.Duration `json:"cf_timeout"`
 
+	// CFProxyURL is the address of the proxy used to reach the CF API and UAA, ex: "http://proxy.example.com:3128"
+	CFProxyURL string `json:"cf_proxy_url"`
+
+	// The username for the proxy.
+	CFProxyUsername string `json:"cf_proxy_username"`
+
+	// The password for the proxy.
+	CFProxyPassword string `json:"cf_proxy_password"`
+
+	// CFNoProxy are the hosts, domains, and CIDR blocks that are reached without going through the proxy.
+	CFNoProxy []string `json:"cf_no_proxy"`
+
+	// The User-Agent sent to the CF API and UAA. If empty, it names the plugin's version and mount.
+	CFAPIUserAgent string `json:"cf_api_user_agent"`
+
+	// The maximum number of times a failed call to the CF API is retried. Zero disables retries.
+	CFMaxRetries int `json:"cf_max_retries"`
+
+	// The number of consecutive failed calls to the CF API after which logins fail without calling it.
+	// Zero disables the circuit breaker.
+	CFCircuitBreakerFailureThreshold int `json:"cf_circuit_breaker_failure_threshold"`
+
+	// How long logins fail without calling the CF API once the circuit breaker has opened.
+	CFCircuitBreakerResetTimeout time.Duration `json:"cf_circuit_breaker_reset_timeout"`
+
+	// The minimum and maximum time to wait between retries of a failed call to the CF API.
+	CFRetryWaitMin time.Duration `json:"cf_retry_wait_min"`
+	CFRetryWaitMax time.Duration `json:"cf_retry_wait_max"`
+
+	// How long the app, space, and org looked up during login are cached. Zero disables the cache.
+	NameCacheTTL time.Duration `json:"name_cache_ttl"`
+
+	// The maximum number of apps whose app, space, and org are cached.
+	NameCacheMaxEntries int `json:"name_cache_max_entries"`
+
+	// How long an app, space, and org that passed validation against the CF API are trusted
+	// without checking the CF API again. Zero disables the cache.
+	ValidationCacheTTL time.Duration `json:"validation_cache_ttl"`
+
+	// How long after its last successful validation a token may still be renewed while
+	// the CF API is unavailable. Zero disables renewals without the CF API.
+	RenewalGracePeriod time.Duration `json:"renewal_grace_period"`
+
+	// How often the apps that tokens were issued to are checked against the CF API, so
+	// that tokens for deleted apps can no longer be renewed. Zero disables the checks.
+	ReconciliationInterval time.Duration `json:"reconciliation_interval"`
+
+	// How often expired login state is dropped and the apps that have outlived their
+	// tokens stop being tracked, as the tidy endpoint does. Zero disables it.
+	TidyInterval time.Duration `json:"tidy_interval"`
+
+	// The key of the annotation written to the app on each login, recording the login.
+	// Empty doesn't write one.
+	CFLoginAnnotation string `json:"cf_login_annotation"`
+
+	// The number of failed logins an app may make from an address within the login
+	// failure window before its logins are refused for the cooldown. Zero doesn't limit
+	// failed logins. A zero window or cooldown means the default is used.
+	LoginFailureLimit    int           `json:"login_failure_limit"`
+	LoginFailureWindow   time.Duration `json:"login_failure_window"`
+	LoginFailureCooldown time.Duration `json:"login_failure_cooldown"`
+
+	// The number of failed logins an address may make within the login failure window,
+	// whichever apps they claim, before its logins are refused for the cooldown. Zero
+	// means 10 times the login failure limit.
+	LoginFailureAddressLimit int `json:"login_failure_address_limit"`
+
+	// The longest cooldown that apps reaching the login failure limit again soon after
+	// a cooldown are refused for, as the cooldown doubles each time. If it isn't longer
+	// than the cooldown, cooldowns don't grow.
+	LoginFailureMaxCooldown time.Duration `json:"login_failure_max_cooldown"`
+
+	// The role used by logins that don't name one. If empty, logins must name a role.
+	DefaultRole string `json:"default_role"`
+
+	// The template of the display name of tokens issued by roles that don't have their
+	// own. If empty, tokens are named for their instance ID.
+	DisplayNameTemplate string `json:"display_name_template"`
+
+	// The CIDRs of the proxies, such as load balancers, trusted to report the address of
+	// the client that logged in through them in the X-Forwarded-For header.
+	TrustedProxyCIDRs []string `json:"trusted_proxy_cidrs"`
+
+	// The CIDRs that all logins must come from, whatever their role. If empty, logins
+	// may come from anywhere.
+	AllowedSourceCIDRs []string `json:"allowed_source_cidrs"`
+
+	// The orgs and spaces whose apps never log in or renew their tokens, whatever their
+	// role allows.
+	DeniedOrgIDs   []string `json:"denied_organization_ids"`
+	DeniedSpaceIDs []string `json:"denied_space_ids"`
+
 	// The maximum seconds old a login request's signing time can be.
 	// This is configurable because in some test environments we found as much as 2 hours of clock drift.
 	LoginMaxSecNotBefore time.Duration `json:"login_max_seconds_not_before"`
@@ -65,6 +272,35 @@ type Configuration struct {
 	// This is configurable because in some test environments we found as much as 2 hours of clock drift.
 	LoginMaxSecNotAfter time.Duration `json:"login_max_seconds_not_after"`
 
+	// The hash that login signatures must use. If empty, SHA-256 is required.
+	LoginSignatureHash string `json:"login_signature_hash"`
+
+	// How much of the instance certificate logins log at the debug level, one of the
+	// DebugLogCert constants. If empty, the full certificate is logged.
+	DebugLogCertDetail string `json:"debug_log_cert_detail"`
+
+	// The Vault address that login signatures must be bound to, along with the mount's
+	// accessor. If empty, signatures don't need to be bound to an audience.
+	LoginAudienceVaultAddress string `json:"login_audience_vault_address"`
+
+	// Whether logins must sign a nonce issued by the login/challenge endpoint, rather
+	// than only being checked against the signing time.
+	RequireLoginChallenge bool `json:"require_login_challenge"`
+
+	// How long a nonce issued by the login/challenge endpoint can be logged in with.
+	// If zero, it's 30 seconds.
+	LoginChallengeTTL time.Duration `json:"login_challenge_ttl"`
+
+	// The PEM-encoded public keys that instance identity JWTs may be signed with.
+	// If empty, JWT login is disabled.
+	JWTValidationPubKeys []string `json:"jwt_validation_pubkeys"`
+
+	// The issuer that instance identity JWTs must have. If empty, any issuer is accepted.
+	JWTBoundIssuer string `json:"jwt_bound_issuer"`
+
+	// The audiences that instance identity JWTs must have one of. If empty, any audience is accepted.
+	JWTBoundAudiences []string `json:"jwt_bound_audiences"`
+
 	// Deprecated: use CFAPICertificates instead.
 	PCFAPICertificates []string `json:"pcf_api_trusted_certificates"`
 
@@ -78,6 +314,23 @@ type Configuration struct {
 	PCFPassword string `json:"pcf_password"`
 }
 
+// CFAPIAddrs returns the CF API's address followed by those that requests fail over to.
+func (c *Configuration) CFAPIAddrs() []string {
+	if c.CFAPIAddr == "" {
+		return nil
+	}
+	return append([]string{c.CFAPIAddr}, c.CFAPIFailoverAddrs...)
+}
+
+// AllIdentityCACertificates returns the configured identity CA certificates along with
+// those last read from CredHub and downloaded from the identity CA URLs.
+func (c *Configuration) AllIdentityCACertificates() []string {
+	caCerts := make([]string, 0, len(c.IdentityCACertificates)+len(c.CredHubIdentityCACertificates)+len(c.URLIdentityCACertificates))
+	caCerts = append(caCerts, c.IdentityCACertificates...)
+	caCerts = append(caCerts, c.CredHubIdentityCACertificates...)
+	return append(caCerts, c.URLIdentityCACertificates...)
+}
+
 // Hash returns a hash of the configuration as a BLAKE2b-256 checksum.
 func (c *Configuration) Hash() ([32]byte, error) {
 	var configHash [32]byte
@@ -88,3 +341,84 @@ func (c *Configuration) Hash() ([32]byte, error) {
 
 	return blake2b.Sum256(cb), nil
 }
+
+// ClientHash returns a BLAKE2b-256 checksum of the fields the CF client, and the caches
+// and circuit breaker built with it, are made from. Unlike Hash, it doesn't change when
+// the identity CA is refreshed or rotated, which doesn't call for a new client.
+func (c *Configuration) ClientHash() ([32]byte, error) {
+	var clientHash [32]byte
+	cb, err := json.Marshal(struct {
+		CFAPIAddr                        string        `json:"cf_api_addr"`
+		CFAPIFailoverAddrs               []string      `json:"cf_api_failover_addrs"`
+		CFAPICertificates                []string      `json:"cf_api_trusted_certificates"`
+		CFAPITLSMinVersion               string        `json:"cf_api_tls_min_version"`
+		CFAPITLSServerName               string        `json:"cf_api_tls_server_name"`
+		CFAPITLSSkipVerify               bool          `json:"cf_api_tls_skip_verify"`
+		CFAPIUserAgent                   string        `json:"cf_api_user_agent"`
+		CFMutualTLSCertificate           string        `json:"cf_api_mutual_tls_certificate"`
+		CFMutualTLSKey                   string        `json:"cf_api_mutual_tls_key"`
+		CFUsername                       string        `json:"cf_username"`
+		CFPassword                       string        `json:"cf_password"`
+		CFClientID                       string        `json:"cf_client_id"`
+		CFClientSecret                   string        `json:"cf_client_secret"`
+		CFAccessToken                    string        `json:"cf_access_token"`
+		CFRefreshToken                   string        `json:"cf_refresh_token"`
+		CFJWTBearerSigningKey            string        `json:"cf_jwt_bearer_signing_key"`
+		CFJWTBearerKeyID                 string        `json:"cf_jwt_bearer_key_id"`
+		CFJWTBearerIssuer                string        `json:"cf_jwt_bearer_issuer"`
+		CFJWTBearerSubject               string        `json:"cf_jwt_bearer_subject"`
+		CFJWTBearerAudience              string        `json:"cf_jwt_bearer_audience"`
+		CFProxyURL                       string        `json:"cf_proxy_url"`
+		CFProxyUsername                  string        `json:"cf_proxy_username"`
+		CFProxyPassword                  string        `json:"cf_proxy_password"`
+		CFNoProxy                        []string      `json:"cf_no_proxy"`
+		CFTimeout                        time.Duration `json:"cf_timeout"`
+		CFMaxRetries                     int           `json:"cf_max_retries"`
+		CFRetryWaitMin                   time.Duration `json:"cf_retry_wait_min"`
+		CFRetryWaitMax                   time.Duration `json:"cf_retry_wait_max"`
+		NameCacheTTL                     time.Duration `json:"name_cache_ttl"`
+		NameCacheMaxEntries              int           `json:"name_cache_max_entries"`
+		ValidationCacheTTL               time.Duration `json:"validation_cache_ttl"`
+		CFCircuitBreakerFailureThreshold int           `json:"cf_circuit_breaker_failure_threshold"`
+		CFCircuitBreakerResetTimeout     time.Duration `json:"cf_circuit_breaker_reset_timeout"`
+	}{
+		CFAPIAddr:                        c.CFAPIAddr,
+		CFAPIFailoverAddrs:               c.CFAPIFailoverAddrs,
+		CFAPICertificates:                c.CFAPICertificates,
+		CFAPITLSMinVersion:               c.CFAPITLSMinVersion,
+		CFAPITLSServerName:               c.CFAPITLSServerName,
+		CFAPITLSSkipVerify:               c.CFAPITLSSkipVerify,
+		CFAPIUserAgent:                   c.CFAPIUserAgent,
+		CFMutualTLSCertificate:           c.CFMutualTLSCertificate,
+		CFMutualTLSKey:                   c.CFMutualTLSKey,
+		CFUsername:                       c.CFUsername,
+		CFPassword:                       c.CFPassword,
+		CFClientID:                       c.CFClientID,
+		CFClientSecret:                   c.CFClientSecret,
+		CFAccessToken:                    c.CFAccessToken,
+		CFRefreshToken:                   c.CFRefreshToken,
+		CFJWTBearerSigningKey:            c.CFJWTBearerSigningKey,
+		CFJWTBearerKeyID:                 c.CFJWTBearerKeyID,
+		CFJWTBearerIssuer:                c.CFJWTBearerIssuer,
+		CFJWTBearerSubject:               c.CFJWTBearerSubject,
+		CFJWTBearerAudience:              c.CFJWTBearerAudience,
+		CFProxyURL:                       c.CFProxyURL,
+		CFProxyUsername:                  c.CFProxyUsername,
+		CFProxyPassword:                  c.CFProxyPassword,
+		CFNoProxy:                        c.CFNoProxy,
+		CFTimeout:                        c.CFTimeout,
+		CFMaxRetries:                     c.CFMaxRetries,
+		CFRetryWaitMin:                   c.CFRetryWaitMin,
+		CFRetryWaitMax:                   c.CFRetryWaitMax,
+		NameCacheTTL:                     c.NameCacheTTL,
+		NameCacheMaxEntries:              c.NameCacheMaxEntries,
+		ValidationCacheTTL:               c.ValidationCacheTTL,
+		CFCircuitBreakerFailureThreshold: c.CFCircuitBreakerFailureThreshold,
+		CFCircuitBreakerResetTimeout:     c.CFCircuitBreakerResetTimeout,
+	})
+	if err != nil {
+		return clientHash, err
+	}
+
+	return blake2b.Sum256(cb), nil
+}
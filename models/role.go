@@ -4,10 +4,25 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"golang.org/x/crypto/blake2b"
+)
+
+// The app states that a role can require.
+const (
+	// AppStateLiveInstances requires the app to have the role's minimum number of live
+	// instances, or running tasks if the minimum is one.
+	AppStateLiveInstances = "live_instances"
+
+	// AppStateStarted requires the app to be STARTED, even if it's scaled to zero.
+	AppStateStarted = "started"
+
+	// AppStateExists only requires the app to exist.
+	AppStateExists = "exists"
 )
 
 // RoleEntry is a role as it's reflected in Vault's storage system.
@@ -20,6 +35,136 @@ type RoleEntry struct {
 	BoundInstanceIDs  []string `json:"bound_instance_ids"`
 	DisableIPMatching bool     `json:"disable_ip_matching"`
 
+	// BoundCertIPCIDRs are the CIDRs that one of the certificate's IP addresses must
+	// be within, whatever address the login comes from.
+	BoundCertIPCIDRs []string `json:"bound_cert_ip_cidrs"`
+
+	// BoundSPIFFEIDs are the SPIFFE IDs, one of which the certificate's URI SANs must
+	// carry.
+	BoundSPIFFEIDs []string `json:"bound_spiffe_ids"`
+
+	// BoundIDChunks is how many entries of their own the bound IDs of each field are
+	// stored in, by the name of the field, for roles that bind too many of them for
+	// one entry. Those fields are then empty in the role's own entry.
+	BoundIDChunks map[string]int `json:"bound_id_chunks,omitempty"`
+
+	// AllowUnconstrained lets the role be written without binding any app, space,
+	// org, or instance, so that any app on the foundation may log in with it.
+	AllowUnconstrained bool `json:"allow_unconstrained"`
+
+	// BoundAppNames, BoundSpaceNames, and BoundOrgNames are matched against the names
+	// carried by the certificate, for distributions whose certificates have them.
+	BoundAppNames   []string `json:"bound_application_names"`
+	BoundSpaceNames []string `json:"bound_space_names"`
+	BoundOrgNames   []string `json:"bound_organization_names"`
+
+	// DisableCFAPIChecks skips checking the app, space, and org against the CF API,
+	// so that logins rely on the certificate chain, signature, and bound constraints.
+	DisableCFAPIChecks bool `json:"disable_cf_api_checks"`
+
+	// DisableNameResolution leaves the org, space, and app names resolved in the CF API
+	// out of logins, so that only the names the certificate carries are written to the
+	// alias metadata and templated policies. It doesn't skip any of the CF API checks.
+	DisableNameResolution bool `json:"disable_name_resolution"`
+
+	// DisableSpaceAPICheck and DisableOrgAPICheck skip checking the space or the org
+	// against the CF API, while the app is still checked, for CF API users that can't
+	// read them. The app's space is still checked against the certificate's.
+	DisableSpaceAPICheck bool `json:"disable_space_api_check"`
+	DisableOrgAPICheck   bool `json:"disable_org_api_check"`
+
+	// CapTTLAtIdentityExpiry caps tokens' max TTL so they expire no later than the
+	// instance identity certificate or JWT they were issued for.
+	CapTTLAtIdentityExpiry bool `json:"cap_ttl_at_identity_expiry"`
+
+	// SingleActiveToken keeps only the last token issued to each instance renewable,
+	// so that an instance that restarts and logs in again leaves a single live token.
+	SingleActiveToken bool `json:"single_active_token"`
+
+	// How often renewals check the CF API again, as a number of renewals and as a
+	// duration since the token was last checked. Whichever comes first triggers a
+	// check. If both are zero, every renewal checks the CF API.
+	RevalidateEveryNRenewals int           `json:"revalidate_every_n_renewals"`
+	RevalidationInterval     time.Duration `json:"revalidation_interval"`
+
+	// The maximum seconds old and ahead a login request's signing time can be,
+	// overriding the config's. Zero means the config's value is used.
+	LoginMaxSecNotBefore time.Duration `json:"login_max_seconds_not_before"`
+	LoginMaxSecNotAfter  time.Duration `json:"login_max_seconds_not_after"`
+
+	// AliasMetadata are the fields written to the alias metadata of tokens issued
+	// for the role. If empty, all of them are written. StaticAliasMetadata are added
+	// to the alias metadata as they are.
+	AliasMetadata       []string          `json:"alias_metadata"`
+	StaticAliasMetadata map[string]string `json:"static_alias_metadata"`
+
+	// RefreshAliasMetadata updates the org, space, and app names in the alias metadata
+	// when renewals check the CF API, so that they follow renames.
+	RefreshAliasMetadata bool `json:"refresh_alias_metadata"`
+
+	// AuthMetadata are the fields, out of the same ones as AliasMetadata, written to
+	// the metadata of tokens issued for the role. If empty, all of them are written.
+	AuthMetadata []string `json:"auth_metadata"`
+
+	// DisplayNameTemplate is the template of the display name of tokens issued for the
+	// role. If empty, the config's is used.
+	DisplayNameTemplate string `json:"display_name_template"`
+
+	// The keys of the app's CF labels and annotations that are copied to the alias
+	// custom metadata, when the CF API is checked at login.
+	AliasCustomMetadataLabels      []string `json:"alias_custom_metadata_labels"`
+	AliasCustomMetadataAnnotations []string `json:"alias_custom_metadata_annotations"`
+
+	// BoundStacks are the stacks, such as cflinuxfs4, that the app must run on. The
+	// app's stack is checked against the CF API at login.
+	BoundStacks []string `json:"bound_stacks"`
+
+	// BoundLifecycleTypes are the lifecycle types, such as buildpack or docker, that
+	// the app must have. BoundDockerImages are the images, which may end in a "*" to
+	// match a repository or prefix, that Docker apps must run. Both are checked
+	// against the CF API at login.
+	BoundLifecycleTypes []string `json:"bound_lifecycle_types"`
+	BoundDockerImages   []string `json:"bound_docker_images"`
+
+	// BoundBuildpacks are the buildpacks the app's current droplet may have been built
+	// with. It's checked against the CF API at login.
+	BoundBuildpacks []string `json:"bound_buildpacks"`
+
+	// BoundCurrentDroplets are the GUIDs of the droplets that may be the app's current
+	// one, and RequireCurrentRevision refuses apps that still run revisions of another
+	// droplet. Both are checked against the CF API at login.
+	BoundCurrentDroplets   []string `json:"bound_current_droplets"`
+	RequireCurrentRevision bool     `json:"require_current_revision"`
+
+	// RequiredServiceInstance is the name or GUID of a service instance the app must
+	// be bound to. It's checked against the CF API at login.
+	RequiredServiceInstance string `json:"required_service_instance"`
+
+	// RequireSSHDisabled refuses apps that accept SSH connections, whether SSH is
+	// enabled for the app by itself, its space, or globally. It's checked against the
+	// CF API at login.
+	RequireSSHDisabled bool `json:"require_ssh_disabled"`
+
+	// RequiredAppState is what the CF API must report about the app's state for it to
+	// log in, one of the AppState constants.
+	RequiredAppState string `json:"required_app_state"`
+
+	// MinimumInstances is how many live instances the app must have when the role
+	// requires live instances. Zero lets apps that are scaled to zero log in.
+	MinimumInstances int `json:"minimum_instances"`
+
+	// BoundProcessTypes are the process types, such as web or a task's or sidecar's,
+	// that the instance must run as. They're looked up in the CF API at login.
+	BoundProcessTypes []string `json:"bound_process_types"`
+
+	// BoundInstanceIndexes are the indexes that the instance must have, such as 0 for
+	// work only one instance should do. They're looked up in the CF API at login.
+	BoundInstanceIndexes []int `json:"bound_instance_indexes"`
+
+	// IncludeInstanceDetails looks up the instance's index and process type in the CF
+	// API at login, and writes them to the token and alias metadata.
+	IncludeInstanceDetails bool `json:"include_instance_details"`
+
 	// Deprecated by TokenParams
 	TTL        time.Duration                 `json:"ttl"`
 	MaxTTL     time.Duration                 `json:"max_ttl"`
@@ -27,3 +172,87 @@ type RoleEntry struct {
 	Policies   []string                      `json:"policies"`
 	BoundCIDRs []*sockaddr.SockAddrMarshaler `json:"bound_cidrs"`
 }
+
+// IsUnconstrained reports whether the role binds no app, space, org, or instance by
+// ID or name, and no SPIFFE ID, so that any app on the foundation may log in with it.
+func (r *RoleEntry) IsUnconstrained() bool {
+	for _, bound := range [][]string{
+		r.BoundAppIDs, r.BoundSpaceIDs, r.BoundOrgIDs, r.BoundInstanceIDs,
+		r.BoundAppNames, r.BoundSpaceNames, r.BoundOrgNames, r.BoundSPIFFEIDs,
+	} {
+		if len(bound) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ConstraintsHash returns a BLAKE2b-256 checksum of the role's constraints on the
+// CF certificates that may log in with it.
+func (r *RoleEntry) ConstraintsHash() ([32]byte, error) {
+	var constraintsHash [32]byte
+	cb, err := json.Marshal(struct {
+		BoundAppIDs         []string `json:"bound_application_ids"`
+		BoundSpaceIDs       []string `json:"bound_space_ids"`
+		BoundOrgIDs         []string `json:"bound_organization_ids"`
+		BoundInstanceIDs    []string `json:"bound_instance_ids"`
+		DisableIPMatching   bool     `json:"disable_ip_matching"`
+		BoundStacks         []string `json:"bound_stacks,omitempty"`
+		BoundBuildpacks     []string `json:"bound_buildpacks,omitempty"`
+		BoundLifecycleTypes []string `json:"bound_lifecycle_types,omitempty"`
+		BoundDockerImages   []string `json:"bound_docker_images,omitempty"`
+
+		BoundCurrentDroplets   []string `json:"bound_current_droplets,omitempty"`
+		RequireCurrentRevision bool     `json:"require_current_revision,omitempty"`
+
+		RequireSSHDisabled bool `json:"require_ssh_disabled,omitempty"`
+
+		BoundSPIFFEIDs []string `json:"bound_spiffe_ids,omitempty"`
+
+		BoundAppNames   []string `json:"bound_application_names,omitempty"`
+		BoundSpaceNames []string `json:"bound_space_names,omitempty"`
+		BoundOrgNames   []string `json:"bound_organization_names,omitempty"`
+
+		RequiredServiceInstance string `json:"required_service_instance,omitempty"`
+		RequiredAppState        string `json:"required_app_state"`
+		MinimumInstances        int    `json:"minimum_instances"`
+
+		DisableNameResolution bool `json:"disable_name_resolution,omitempty"`
+		DisableSpaceAPICheck  bool `json:"disable_space_api_check,omitempty"`
+		DisableOrgAPICheck    bool `json:"disable_org_api_check,omitempty"`
+	}{
+		BoundAppIDs:         r.BoundAppIDs,
+		BoundSpaceIDs:       r.BoundSpaceIDs,
+		BoundOrgIDs:         r.BoundOrgIDs,
+		BoundInstanceIDs:    r.BoundInstanceIDs,
+		DisableIPMatching:   r.DisableIPMatching,
+		BoundStacks:         r.BoundStacks,
+		BoundBuildpacks:     r.BoundBuildpacks,
+		BoundLifecycleTypes: r.BoundLifecycleTypes,
+		BoundDockerImages:   r.BoundDockerImages,
+
+		BoundCurrentDroplets:   r.BoundCurrentDroplets,
+		RequireCurrentRevision: r.RequireCurrentRevision,
+
+		RequireSSHDisabled: r.RequireSSHDisabled,
+
+		BoundSPIFFEIDs: r.BoundSPIFFEIDs,
+
+		BoundAppNames:   r.BoundAppNames,
+		BoundSpaceNames: r.BoundSpaceNames,
+		BoundOrgNames:   r.BoundOrgNames,
+
+		RequiredServiceInstance: r.RequiredServiceInstance,
+		RequiredAppState:        r.RequiredAppState,
+		MinimumInstances:        r.MinimumInstances,
+
+		DisableNameResolution: r.DisableNameResolution,
+		DisableSpaceAPICheck:  r.DisableSpaceAPICheck,
+		DisableOrgAPICheck:    r.DisableOrgAPICheck,
+	})
+	if err != nil {
+		return constraintsHash, err
+	}
+
+	return blake2b.Sum256(cb), nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const spiffeScheme = "spiffe://"
+
+// ParseSPIFFEID returns the trust domain and path of the SPIFFE ID, erroring if it isn't
+// one as the SPIFFE ID specification defines them. The path may be empty, in which
+// case the ID names the trust domain.
+func ParseSPIFFEID(id string) (string, string, error) {
+	rest, ok := strings.CutPrefix(id, spiffeScheme)
+	if !ok {
+		return "", "", fmt.Errorf("SPIFFE ID %q must start with %q", id, spiffeScheme)
+	}
+	trustDomain, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		trustDomain, path = rest[:i], rest[i:]
+	}
+	if trustDomain == "" {
+		return "", "", fmt.Errorf("SPIFFE ID %q has no trust domain", id)
+	}
+	for _, r := range trustDomain {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return "", "", fmt.Errorf("SPIFFE ID %q has an invalid trust domain, which may only contain lowercase letters, digits, '.', '-', and '_'", id)
+		}
+	}
+	if path == "" {
+		return trustDomain, "", nil
+	}
+	for _, segment := range strings.Split(path[1:], "/") {
+		if err := validateSPIFFEPathSegment(segment); err != nil {
+			return "", "", fmt.Errorf("SPIFFE ID %q has an invalid path: %w", id, err)
+		}
+	}
+	return trustDomain, path, nil
+}
+
+func validateSPIFFEPathSegment(segment string) error {
+	switch segment {
+	case "":
+		return errors.New("its segments must not be empty")
+	case ".", "..":
+		return errors.New("its segments must not be '.' or '..'")
+	}
+	for _, r := range segment {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return errors.New("it may only contain letters, digits, '.', '-', '_', and '/'")
+		}
+	}
+	return nil
+}
+
+// spiffeID returns the SPIFFE ID in the URI SANs, if there is exactly one, as X.509-SVIDs
+// carry. Certificates with a malformed SPIFFE ID, or several, are still valid CF
+// certificates, but have none, so they can't meet SPIFFE ID constraints.
+func spiffeID(uris []string) string {
+	var id string
+	for _, uri := range uris {
+		if !strings.HasPrefix(strings.ToLower(uri), spiffeScheme) {
+			continue
+		}
+		if _, _, err := ParseSPIFFEID(uri); err != nil || id != "" {
+			return ""
+		}
+		id = uri
+	}
+	return id
+}
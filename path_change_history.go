@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathChangeHistory() *framework.Path {
+	return &framework.Path{
+		Pattern: "change-history",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "If set, only changes to this role are returned.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationChangeHistoryRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "change-history",
+				},
+			},
+		},
+		HelpSynopsis:    pathChangeHistorySyn,
+		HelpDescription: pathChangeHistoryDesc,
+	}
+}
+
+func (b *backend) operationChangeHistoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	role := data.Get("role").(string)
+
+	b.changeHistoryMu.Lock()
+	history, err := getChangeHistory(ctx, req.Storage)
+	b.changeHistoryMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []map[string]interface{}{}
+	for i := len(history) - 1; i >= 0; i-- {
+		change := history[i]
+		if role != "" && change.Role != role {
+			continue
+		}
+		c := map[string]interface{}{
+			"time":           change.Time.Format(time.RFC3339),
+			"path":           change.Path,
+			"operation":      change.Operation,
+			"changed_fields": change.ChangedFields,
+		}
+		if change.Role != "" {
+			c["role"] = change.Role
+		}
+		if change.EntityID != "" {
+			c["entity_id"] = change.EntityID
+		}
+		if change.DisplayName != "" {
+			c["display_name"] = change.DisplayName
+		}
+		if change.RemoteAddress != "" {
+			c["remote_address"] = change.RemoteAddress
+		}
+		changes = append(changes, c)
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"changes": changes,
+		},
+	}, nil
+}
+
+const pathChangeHistorySyn = `
+List the recent changes to the config and roles.
+`
+
+const pathChangeHistoryDesc = `
+Returns the most recent 200 changes to the config and roles, newest first, each
+with when it was made, the path and operation that made it, the entity, display
+name, and address of whoever made it, and the names of the fields that changed.
+Their values are never recorded. Changes to the identity CA that are read from
+CredHub or downloaded from its URLs are recorded as "refresh" operations.
+`
@@ -0,0 +1,58 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathCircuitBreaker() *framework.Path {
+	return &framework.Path{
+		Pattern: "circuit-breaker",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationCircuitBreakerRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "circuit-breaker",
+				},
+			},
+		},
+		HelpSynopsis:    pathCircuitBreakerSyn,
+		HelpDescription: pathCircuitBreakerDesc,
+	}
+}
+
+func (b *backend) operationCircuitBreakerRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	b.mu.RLock()
+	config, err := getConfig(ctx, req.Storage)
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	status := b.cfAPIBreaker.status()
+	if config != nil && len(config.CFAPIFailoverAddrs) > 0 {
+		status["cf_api_endpoints"] = b.cfAPIEndpointHealth.status(config.CFAPIAddrs())
+	}
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+const pathCircuitBreakerSyn = `
+Read the state of the circuit breaker around the CF API.
+`
+
+const pathCircuitBreakerDesc = `
+When the CF API fails a number of calls in a row, the circuit breaker opens
+and logins fail right away, without calling the CF API, until the reset timeout
+has passed. This path reports whether the breaker is open, along with the
+number of consecutive failures and the most recent error. When requests fail
+over between several CF API addresses, whether each is healthy is reported too.
+`
@@ -6,12 +6,18 @@ package cf
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 
 	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
 )
 
 const configStorageKey = "config"
@@ -29,7 +35,139 @@ func (b *backend) pathConfig() *framework.Path {
 					Name:  "Identity CA Certificates",
 					Value: `-----BEGIN CERTIFICATE----- ... -----END CERTIFICATE-----`,
 				},
-				Description: "The PEM-format CA certificates that are required to have issued the instance certificates presented for logging in.",
+				Description: `The PEM-format CA certificates that are required to have issued the instance certificates presented
+for logging in, or HTTPS URLs that CA bundles are downloaded from, and downloaded again every
+"identity_ca_url_refresh_interval".`,
+			},
+			"identity_cert_field_sources": {
+				Type: framework.TypeKVPairs,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Identity Certificate Field Sources",
+					Value: "app_id=uri:spiffe://cf/app/",
+				},
+				Description: `Where the "instance_id", "org_id", "space_id", and "app_id" are read from in instance
+certificates, for distributions whose certificates are laid out differently than CF's. A source is a subject
+attribute, one of "cn", "serial_number", "ou", "o", "l", "st", or "c", or "uri" for the URI SANs, optionally followed
+by a colon and a prefix the value must have, which is removed. Fields that aren't set are read from where CF puts
+them, "cn", "ou:organization:", "ou:space:", and "ou:app:". The optional "org_name", "space_name", and "app_name"
+are read from "ou:organization-name:", "ou:space-name:", and "ou:app-name:" by default.`,
+			},
+			"credhub_addr": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CredHub Address",
+					Value: "https://credhub.service.cf.internal:8844",
+				},
+				Description: "The address of the CredHub that the identity CA bundle is read from.",
+			},
+			"credhub_identity_ca_path": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CredHub Identity CA Path",
+					Value: "/cf/diego-instance-identity-root-ca",
+				},
+				Description: `The CredHub path of the identity CA bundle, a certificate or value credential. The
+bundle is trusted along with the "identity_ca_certificates", and read again every "credhub_refresh_interval".`,
+			},
+			"credhub_client_id": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CredHub Client ID",
+				},
+				Description: "The client ID used to authenticate to CredHub's UAA.",
+			},
+			"credhub_client_secret": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CredHub Client Secret",
+					Sensitive: true,
+				},
+				Description: "The client secret used to authenticate to CredHub's UAA.",
+			},
+			"credhub_ca_certificates": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CredHub CA Certificates",
+				},
+				Description: "The PEM-format CA certificates that CredHub's and its UAA's certificates are trusted from.",
+			},
+			"credhub_refresh_interval": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CredHub Refresh Interval",
+				},
+				Description: `Duration in seconds between reads of the identity CA from CredHub. If CredHub can't
+be read, the bundle it last returned remains trusted. Defaults to 1 hour.`,
+				Default: 0,
+			},
+			"identity_ca_url_ca_certificates": {
+				Type: framework.TypeStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity CA URL CA Certificates",
+				},
+				Description: `The PEM-format CA certificates that the certificates of the servers that identity CA
+bundles are downloaded from are trusted from, as well as the system's.`,
+			},
+			"identity_ca_url_pinned_sha256": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity CA URL Pinned SHA-256",
+				},
+				Description: `The hex-encoded SHA-256 digests of public keys, one of which a certificate presented
+by the servers that identity CA bundles are downloaded from must have. If unset, keys aren't pinned.`,
+			},
+			"identity_ca_url_refresh_interval": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity CA URL Refresh Interval",
+				},
+				Description: `Duration in seconds between downloads of the identity CA bundles from their URLs. If a
+bundle can't be downloaded, the ones last downloaded remain trusted. Defaults to 1 hour.`,
+				Default: 0,
+			},
+			"enforce_identity_cert_key_usage": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Enforce Identity Certificate Key Usage",
+				},
+				Description: `If true, instance certificates must allow digital signatures and client authentication, and
+their intermediate must be a CA allowed to sign certificates for client authentication.`,
+			},
+			"enforce_fips_signatures": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Enforce FIPS Signatures",
+				},
+				Description: `If true, login signatures must be made with FIPS approved algorithms, key sizes, and hashes:
+RSA-PSS with a key of at least 2048 bits and a salt as long as the hash, which v2 signatures use, or ECDSA on
+the P-256 or P-384 curve.`,
+			},
+			"verify_instance_ids": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Verify Instance IDs",
+				},
+				Description: `If true, logins for roles that check the CF API must be from an instance that its app's
+process stats report as starting or running. Requires a version of CF's API that reports instance GUIDs.`,
+			},
+			"identity_cert_expiry_warning": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity Certificate Expiry Warning",
+				},
+				Description: `Duration in seconds before the instance identity certificate presented at login expires
+that the login returns a warning about it. CF rotates instance certificates well before they expire, so a warning
+means rotation has stalled. Set to 0 to disable the warning.`,
+				Default: 0,
+			},
+			"identity_ca_expiry_warning": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity CA Expiry Warning",
+				},
+				Description: `Duration in seconds before the identity CA, or an intermediate, that the certificate
+presented at login chains to expires that the login returns a warning about it. Set to 0 to disable the warning.`,
+				Default: 0,
 			},
 			"cf_api_trusted_certificates": {
 				Type: framework.TypeStringSlice,
@@ -55,13 +193,51 @@ func (b *backend) pathConfig() *framework.Path {
 				},
 				Description: "The PEM-format private key that are used for mutual TLS with the CloudFoundry API. If not set, mutual TLS is not used",
 			},
-			"cf_api_addr": {
+			"cf_api_user_agent": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF API User Agent",
+					Value: "vault-plugin-auth-cf/0.20.0 (auth/cf)",
+				},
+				Description: `The User-Agent sent to the CF API and UAA. Defaults to one naming the plugin's version
+and the mount's path.`,
+			},
+			"cf_api_tls_min_version": {
+				Type:          framework.TypeString,
+				AllowedValues: []interface{}{"tls10", "tls11", "tls12", "tls13"},
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF API TLS Min Version",
+					Value: "tls12",
+				},
+				Description: `The minimum TLS version used with the CF API and UAA, one of "tls10", "tls11", "tls12",
+or "tls13". Defaults to "tls12".`,
+			},
+			"cf_api_tls_server_name": {
 				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF API TLS Server Name",
+					Value: "api.sys.example.com",
+				},
+				Description: `The name sent as SNI to the CF API and UAA, and that their certificates are verified
+for, instead of the host of their address. Useful when they're reached through an address their certificates
+don't name.`,
+			},
+			"cf_api_tls_skip_verify": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF API TLS Skip Verify",
+				},
+				Description: `If set to true, the certificates of the CF API and UAA aren't verified. This is
+insecure, and only meant for testing.`,
+			},
+			"cf_api_addr": {
+				Type: framework.TypeCommaStringSlice,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name:  "CF API Address",
 					Value: "https://api.10.244.0.34.xip.io",
 				},
-				Description: "CF’s API address.",
+				Description: `CF’s API address. Further addresses of the same API may follow, separated by
+commas, which requests fail over to in order on connection errors and 5xx responses.`,
 			},
 			"cf_username": {
 				Type: framework.TypeString,
@@ -95,13 +271,306 @@ func (b *backend) pathConfig() *framework.Path {
 				},
 				Description: "The client secret for CF’s API.",
 			},
+			"cf_access_token": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CF API Access Token",
+					Sensitive: true,
+				},
+				Description: "A pre-issued bearer token for CF’s API, used instead of a username and password or client credentials.",
+			},
+			"cf_refresh_token": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CF API Refresh Token",
+					Sensitive: true,
+				},
+				Description: "The refresh token used to get a new CF API access token once 'cf_access_token' expires.",
+			},
+			"cf_jwt_bearer_signing_key": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CF JWT Bearer Signing Key",
+					Sensitive: true,
+				},
+				Description: `The PEM-encoded RSA, EC or Ed25519 private key that JWTs are signed with, to exchange for UAA tokens using the JWT bearer grant as 'cf_client_id'. When set, it's used instead of the other CF API credentials.`,
+			},
+			"cf_jwt_bearer_key_id": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF JWT Bearer Key ID",
+				},
+				Description: "The key ID set as the kid header of the JWTs exchanged for UAA tokens.",
+			},
+			"cf_jwt_bearer_issuer": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF JWT Bearer Issuer",
+				},
+				Description: "The iss claim of the JWTs exchanged for UAA tokens, naming the identity provider UAA trusts them from.",
+			},
+			"cf_jwt_bearer_subject": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF JWT Bearer Subject",
+				},
+				Description: "The sub claim of the JWTs exchanged for UAA tokens, naming the user UAA issues them to.",
+			},
+			"cf_jwt_bearer_audience": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF JWT Bearer Audience",
+				},
+				Description: "The aud claim of the JWTs exchanged for UAA tokens. Defaults to UAA's token endpoint.",
+			},
 			"cf_timeout": {
 				Type: framework.TypeDurationSecond,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name: "CF Timeout",
 				},
-				Description: "The timeout for calls to CF’s API.",
-				Default:     "0s", // 0 means no timeout
+				Description: "Duration in seconds for the timeout of calls to CF’s API. If not set, the CF client's default of 30 seconds is used.",
+				Default:     "0s", // 0 means the CF client's default timeout
+			},
+			"cf_max_retries": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF Max Retries",
+				},
+				Description: `The maximum number of times a call to CF’s API is retried on connection errors and 5xx responses.
+Set to 0 to disable retries.`,
+				Default: 0,
+			},
+			"cf_retry_wait_min": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF Retry Wait Min",
+					Value: "1",
+				},
+				Description: "Duration in seconds to wait before the first retry of a call to CF’s API. The wait doubles on each retry.",
+				Default:     1,
+			},
+			"cf_retry_wait_max": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF Retry Wait Max",
+					Value: "30",
+				},
+				Description: "Duration in seconds for the maximum wait between retries of a call to CF’s API.",
+				Default:     30,
+			},
+			"cf_proxy_url": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF Proxy URL",
+					Value: "http://proxy.example.com:3128",
+				},
+				Description: "The URL of the HTTP(S) proxy used to reach CF’s API and UAA. If not set, no proxy is used.",
+			},
+			"cf_proxy_username": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF Proxy Username",
+				},
+				Description: "The username used to authenticate to the proxy.",
+			},
+			"cf_proxy_password": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CF Proxy Password",
+					Sensitive: true,
+				},
+				Description: "The password used to authenticate to the proxy.",
+			},
+			"cf_no_proxy": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF No Proxy",
+					Value: ".internal.example.com,10.0.0.0/8",
+				},
+				Description: `Comma-separated list of hosts, domains, and CIDR blocks reached without going through the proxy,
+in the same format as the NO_PROXY environment variable.`,
+			},
+			"cf_circuit_breaker_failure_threshold": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF Circuit Breaker Failure Threshold",
+					Value: defaultCircuitBreakerFailureThreshold,
+				},
+				Description: `The number of consecutive failed calls to CF’s API after which logins fail right away without calling it.
+Set to 0 to disable the circuit breaker.`,
+				Default: defaultCircuitBreakerFailureThreshold,
+			},
+			"cf_circuit_breaker_reset_timeout": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "CF Circuit Breaker Reset Timeout",
+					Value: "30",
+				},
+				Description: "Duration in seconds that logins fail without calling CF’s API once the circuit breaker has opened.",
+				Default:     int(defaultCircuitBreakerResetTimeout / time.Second),
+			},
+			"name_cache_ttl": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Name Cache TTL",
+				},
+				Description: `Duration in seconds to cache the app, space, and org looked up from CF’s API during login.
+Apps, spaces, and orgs deleted or renamed in CF may go unnoticed for up to this long. Set to 0 to disable the cache.`,
+				Default: 0,
+			},
+			"name_cache_max_entries": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Name Cache Max Entries",
+					Value: defaultResourceCacheMaxEntries,
+				},
+				Description: "The maximum number of apps whose app, space, and org are cached.",
+				Default:     defaultResourceCacheMaxEntries,
+			},
+			"validation_cache_ttl": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Validation Cache TTL",
+				},
+				Description: `Duration in seconds to skip checking CF’s API for an app, space, and org that recently passed validation.
+Useful to absorb login storms such as platform-wide app restarts. Set to 0 to always check CF’s API.`,
+				Default: 0,
+			},
+			"renewal_grace_period": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Renewal Grace Period",
+				},
+				Description: `Duration in seconds after a token was last validated during which it may still be renewed
+while CF’s API is unreachable. Such renewals return a warning. Set to 0 to fail renewals when CF’s API is unreachable.`,
+				Default: 0,
+			},
+			"reconciliation_interval": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Reconciliation Interval",
+				},
+				Description: `Duration in seconds between background checks of the apps that tokens were issued to
+against CF’s API. Tokens for apps that no longer exist can't be renewed or used to log in again, even by roles
+that don't check CF’s API on every renewal. Set to 0 to disable the background checks.`,
+				Default: 0,
+			},
+			"cf_login_annotation": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF Login Annotation",
+				},
+				Description: `If set, the key of an annotation, such as "vault.hashicorp.com/last-login", written to the app
+through CF’s API on each login, recording when it logged in, with which role and instance, and to which mount, so
+that Vault access can be correlated with CF’s audit events. Writing it is best effort, and requires the CF
+credentials to be able to update the app. Logins to roles that don't check CF’s API don't write it.`,
+			},
+			"tidy_interval": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Tidy Interval",
+				},
+				Description: `Duration in seconds between background tidies, which drop expired login state and stop
+tracking the apps that have outlived their tokens, as writing to "tidy" does. Set to 0 to disable them.`,
+				Default: 0,
+			},
+			"login_failure_limit": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Failure Limit",
+				},
+				Description: `The number of failed logins an app may make from an address within the login failure window
+before its logins are refused for the login failure cooldown. Set to 0 to not limit failed logins.`,
+				Default: 0,
+			},
+			"login_failure_address_limit": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Failure Address Limit",
+				},
+				Description: `The number of failed logins an address may make within the login failure window,
+whichever apps they claim, before its logins are refused for the login failure cooldown. If unset, 10 times
+the login failure limit.`,
+				Default: 0,
+			},
+			"login_failure_window": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Login Failure Window",
+					Value: "60",
+				},
+				Description: "Duration in seconds over which failed logins are counted towards the login failure limit.",
+				Default:     int(defaultLoginFailureWindow / time.Second),
+			},
+			"login_failure_cooldown": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Login Failure Cooldown",
+					Value: "300",
+				},
+				Description: "Duration in seconds that logins are refused for once the login failure limit is reached.",
+				Default:     int(defaultLoginFailureCooldown / time.Second),
+			},
+			"login_failure_max_cooldown": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Failure Max Cooldown",
+				},
+				Description: `Duration in seconds that the cooldown may double up to, each time an app reaches the
+login failure limit again within a cooldown of the last one ending. If unset, the cooldown doesn't grow.`,
+				Default: 0,
+			},
+			"default_role": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Default Role",
+				},
+				Description: "The role used by logins that don't name one. If unset, logins must name a role.",
+			},
+			"display_name_template": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Display Name Template",
+					Value: "{{org_name}}-{{space_name}}-{{app_name}}",
+				},
+				Description: fmt.Sprintf(`The template of the display name of tokens issued by roles that don't have their own,
+referring to %s. If unset, or if a field isn't known for a login, tokens are named for their instance ID.`, strings.Join(displayNameFields, ", ")),
+			},
+			"allowed_source_cidrs": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Allowed Source CIDRs",
+					Value: "10.255.0.0/16",
+				},
+				Description: `The CIDRs, such as CF's container networks, that all logins must come from, whatever
+role they use. Logins through a trusted proxy are checked using the forwarded address. If unset, logins may come
+from anywhere.`,
+			},
+			"denied_organization_ids": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Denied Organization IDs",
+				},
+				Description: `The GUIDs of orgs whose apps can't log in or renew their tokens, whatever role they use.
+They're checked before the role's constraints.`,
+			},
+			"denied_space_ids": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Denied Space IDs",
+				},
+				Description: `The GUIDs of spaces whose apps can't log in or renew their tokens, whatever role they use.
+They're checked before the role's constraints.`,
+			},
+			"trusted_proxy_cidrs": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Trusted Proxy CIDRs",
+					Value: "10.0.0.0/24",
+				},
+				Description: `The CIDRs of proxies, such as load balancers, that are trusted to report the client's address
+in the X-Forwarded-For header. Logins through them are matched against the certificate's IP address using the
+forwarded address. The header must be listed in the mount's "passthrough_request_headers".`,
 			},
 			// These fields were in the original release, but are being deprecated because Cloud Foundry is moving
 			// away from using "PCF" to refer to themselves.
@@ -161,6 +630,88 @@ Set low to reduce the opportunity for replay attacks.`,
 Set low to reduce the opportunity for replay attacks.`,
 				Default: 60,
 			},
+			"login_signature_hash": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Login Signature Hash",
+					Value: signatures.HashSHA256,
+				},
+				Description: `The hash that login signatures must use, one of "sha256", "sha384", or "sha512".
+Requiring "sha384" or "sha512" means clients must send v2 signatures.`,
+				AllowedValues: []interface{}{signatures.HashSHA256, signatures.HashSHA384, signatures.HashSHA512},
+				Default:       signatures.HashSHA256,
+			},
+			"debug_log_cert_detail": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Debug Log Certificate Detail",
+					Value: models.DebugLogCertFull,
+				},
+				Description: `How much of the instance certificate logins log at the debug level: "guids" for only the
+instance, app, space, and org GUIDs, "hashed" for hashes of them, or "full" for every field, including IP
+addresses and names.`,
+				AllowedValues: []interface{}{models.DebugLogCertGUIDs, models.DebugLogCertHashed, models.DebugLogCertFull},
+				Default:       models.DebugLogCertFull,
+			},
+			"login_audience_vault_address": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Login Audience Vault Address",
+					Value: "https://vault.example.com:8200",
+				},
+				Description: `The address clients use to reach this Vault cluster. If set, login signatures must be
+bound to this address and to this mount's accessor, so that they can't be used to log in to another cluster or mount.`,
+			},
+			"require_login_challenge": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Require Login Challenge",
+				},
+				Description: `If true, logins must sign a nonce issued by the "login/challenge" endpoint, and are refused
+without one. Logins signing a nonce are never refused for the client's clock being skewed.`,
+				Default: false,
+			},
+			"login_challenge_ttl": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Challenge TTL",
+				},
+				Description: `Duration in seconds that a nonce issued by the "login/challenge" endpoint can be logged in
+with. Defaults to 30 seconds.`,
+				Default: 30,
+			},
+			"jwt_validation_pubkeys": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "JWT Validation Public Keys",
+				},
+				Description: `PEM-encoded public keys of the issuers of CF instance identity JWTs. If set, instances
+can log in at the "login-jwt" path with a JWT signed by one of these keys.`,
+			},
+			"jwt_bound_issuer": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "JWT Bound Issuer",
+				},
+				Description: `If set, instance identity JWTs must have this "iss" claim.`,
+			},
+			"jwt_bound_audiences": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "JWT Bound Audiences",
+				},
+				Description: `If set, instance identity JWTs must have at least one of these values in their "aud" claim.`,
+			},
+			"verify_connection": {
+				Type:    framework.TypeBool,
+				Default: true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Verify Connection",
+					Value: "true",
+				},
+				Description: `If set to true, the configuration is only saved once Vault has reached CF’s API and
+authenticated to UAA with it. Set to false to save a configuration while CF’s API is unreachable.`,
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
@@ -188,6 +739,7 @@ Set low to reduce the opportunity for replay attacks.`,
 }
 
 func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ctx = withRequestInfo(ctx, req)
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -195,19 +747,47 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 	if err != nil {
 		return nil, err
 	}
+	var previousIdentityCACerts []string
+	if config != nil {
+		previousIdentityCACerts = config.AllIdentityCACertificates()
+	}
+	before, err := changeSnapshot(config)
+	if err != nil {
+		return nil, err
+	}
 	if config == nil {
 		// They're creating a config.
 		// All new configs will be created as config version 1.
 		identityCACerts := data.Get("identity_ca_certificates").([]string)
-		if len(identityCACerts) == 0 {
-			return logical.ErrorResponse("'identity_ca_certificates' is required"), nil
+		credHubIdentityCAPath := data.Get("credhub_identity_ca_path").(string)
+		if len(identityCACerts) == 0 && credHubIdentityCAPath == "" {
+			return logical.ErrorResponse("'identity_ca_certificates' or 'credhub_identity_ca_path' is required"), nil
 		}
+		credHubAddr := data.Get("credhub_addr").(string)
+		credHubClientID := data.Get("credhub_client_id").(string)
+		credHubClientSecret := data.Get("credhub_client_secret").(string)
+		credHubCACerts := data.Get("credhub_ca_certificates").([]string)
+		credHubRefreshInterval := time.Duration(data.Get("credhub_refresh_interval").(int)) * time.Second
+		identityCAURLCACerts := data.Get("identity_ca_url_ca_certificates").([]string)
+		identityCAURLPinnedSHA256 := data.Get("identity_ca_url_pinned_sha256").([]string)
+		identityCAURLRefreshInterval := time.Duration(data.Get("identity_ca_url_refresh_interval").(int)) * time.Second
+		enforceIdentityCertKeyUsage := data.Get("enforce_identity_cert_key_usage").(bool)
+		enforceFIPSSignatures := data.Get("enforce_fips_signatures").(bool)
+		verifyInstanceIDs := data.Get("verify_instance_ids").(bool)
+		identityCertExpiryWarning := time.Duration(data.Get("identity_cert_expiry_warning").(int)) * time.Second
+		identityCAExpiryWarning := time.Duration(data.Get("identity_ca_expiry_warning").(int)) * time.Second
+		identityCertFieldSources := data.Get("identity_cert_field_sources").(map[string]string)
 
 		cfApiAddrIfc, ok := data.GetFirst("cf_api_addr", "pcf_api_addr")
 		if !ok {
 			return logical.ErrorResponse("'cf_api_addr' is required"), nil
 		}
-		cfApiAddr := cfApiAddrIfc.(string)
+		cfApiAddrs := cfAPIAddrs(cfApiAddrIfc)
+		if len(cfApiAddrs) == 0 {
+			return logical.ErrorResponse("'cf_api_addr' is required"), nil
+		}
+		cfApiAddr := cfApiAddrs[0]
+		cfApiFailoverAddrs := cfApiAddrs[1:]
 
 		var cfUsername string
 		cfUsernameIfc, ok := data.GetFirst("cf_username", "pcf_username")
@@ -233,15 +813,26 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 			cfClientSecret = cfClientSecretIfc.(string)
 		}
 
+		cfAccessToken := data.Get("cf_access_token").(string)
+		cfRefreshToken := data.Get("cf_refresh_token").(string)
+		cfJWTBearerSigningKey := data.Get("cf_jwt_bearer_signing_key").(string)
+		cfJWTBearerKeyID := data.Get("cf_jwt_bearer_key_id").(string)
+		cfJWTBearerIssuer := data.Get("cf_jwt_bearer_issuer").(string)
+		cfJWTBearerSubject := data.Get("cf_jwt_bearer_subject").(string)
+		cfJWTBearerAudience := data.Get("cf_jwt_bearer_audience").(string)
+
 		// Before continuing, make sure that we have a pair of cf_username & cf_password,
-		// pcf_username & pcf_password or cf_client_id & cf_client_secret
-		// if none exist, then we should fail right away.
-		if cfUsername == "" && cfClientId == "" {
-			return logical.ErrorResponse("'cf_username' or 'cf_client_id' is required"), nil
-		}
+		// pcf_username & pcf_password or cf_client_id & cf_client_secret, unless
+		// a cf_access_token or cf_jwt_bearer_signing_key was given; if none exist,
+		// then we should fail right away.
+		if cfAccessToken == "" && cfJWTBearerSigningKey == "" {
+			if cfUsername == "" && cfClientId == "" {
+				return logical.ErrorResponse("'cf_username', 'cf_client_id' or 'cf_access_token' is required"), nil
+			}
 
-		if cfPassword == "" && cfClientSecret == "" {
-			return logical.ErrorResponse("'cf_password' or 'cf_client_secret' is required"), nil
+			if cfPassword == "" && cfClientSecret == "" {
+				return logical.ErrorResponse("'cf_password', 'cf_client_secret' or 'cf_access_token' is required"), nil
+			}
 		}
 
 		var cfApiCertificates []string
@@ -252,6 +843,10 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 
 		cfMTLSCertificate, ok := data.Get("cf_api_mutual_tls_certificate").(string)
 		cfMTLSKey, ok := data.Get("cf_api_mutual_tls_key").(string)
+		cfAPIUserAgent := data.Get("cf_api_user_agent").(string)
+		cfAPITLSMinVersion := data.Get("cf_api_tls_min_version").(string)
+		cfAPITLSServerName := data.Get("cf_api_tls_server_name").(string)
+		cfAPITLSSkipVerify := data.Get("cf_api_tls_skip_verify").(bool)
 
 		if (cfMTLSCertificate == "" && cfMTLSKey != "") ||
 			(cfMTLSCertificate != "" && cfMTLSKey == "") {
@@ -270,19 +865,119 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 			loginMaxSecNotAfter = time.Duration(raw.(int)) * time.Second
 		}
 
+		cfTimeout := time.Duration(data.Get("cf_timeout").(int)) * time.Second
+		cfProxyURL := data.Get("cf_proxy_url").(string)
+		cfProxyUsername := data.Get("cf_proxy_username").(string)
+		cfProxyPassword := data.Get("cf_proxy_password").(string)
+		cfNoProxy := data.Get("cf_no_proxy").([]string)
+		cfMaxRetries := data.Get("cf_max_retries").(int)
+		cfCircuitBreakerFailureThreshold := data.Get("cf_circuit_breaker_failure_threshold").(int)
+		cfCircuitBreakerResetTimeout := time.Duration(data.Get("cf_circuit_breaker_reset_timeout").(int)) * time.Second
+		cfRetryWaitMin := time.Duration(data.Get("cf_retry_wait_min").(int)) * time.Second
+		cfRetryWaitMax := time.Duration(data.Get("cf_retry_wait_max").(int)) * time.Second
+		nameCacheTTL := time.Duration(data.Get("name_cache_ttl").(int)) * time.Second
+		nameCacheMaxEntries := data.Get("name_cache_max_entries").(int)
+		validationCacheTTL := time.Duration(data.Get("validation_cache_ttl").(int)) * time.Second
+		renewalGracePeriod := time.Duration(data.Get("renewal_grace_period").(int)) * time.Second
+		reconciliationInterval := time.Duration(data.Get("reconciliation_interval").(int)) * time.Second
+		tidyInterval := time.Duration(data.Get("tidy_interval").(int)) * time.Second
+		cfLoginAnnotation := data.Get("cf_login_annotation").(string)
+		loginFailureLimit := data.Get("login_failure_limit").(int)
+		loginFailureAddressLimit := data.Get("login_failure_address_limit").(int)
+		loginFailureWindow := time.Duration(data.Get("login_failure_window").(int)) * time.Second
+		loginFailureCooldown := time.Duration(data.Get("login_failure_cooldown").(int)) * time.Second
+		loginFailureMaxCooldown := time.Duration(data.Get("login_failure_max_cooldown").(int)) * time.Second
+		defaultRole := data.Get("default_role").(string)
+		displayNameTemplate := data.Get("display_name_template").(string)
+		trustedProxyCIDRs := data.Get("trusted_proxy_cidrs").([]string)
+		allowedSourceCIDRs := data.Get("allowed_source_cidrs").([]string)
+		deniedOrgIDs := data.Get("denied_organization_ids").([]string)
+		deniedSpaceIDs := data.Get("denied_space_ids").([]string)
+		loginSignatureHash := data.Get("login_signature_hash").(string)
+		debugLogCertDetail := data.Get("debug_log_cert_detail").(string)
+		loginAudienceVaultAddress := data.Get("login_audience_vault_address").(string)
+		requireLoginChallenge := data.Get("require_login_challenge").(bool)
+		loginChallengeTTL := time.Duration(data.Get("login_challenge_ttl").(int)) * time.Second
+		jwtValidationPubKeys := data.Get("jwt_validation_pubkeys").([]string)
+		jwtBoundIssuer := data.Get("jwt_bound_issuer").(string)
+		jwtBoundAudiences := data.Get("jwt_bound_audiences").([]string)
+
 		config = &models.Configuration{
-			Version:                1,
-			IdentityCACertificates: identityCACerts,
-			CFAPICertificates:      cfApiCertificates,
-			CFMutualTLSCertificate: cfMTLSCertificate,
-			CFMutualTLSKey:         cfMTLSKey,
-			CFAPIAddr:              cfApiAddr,
-			CFUsername:             cfUsername,
-			CFPassword:             cfPassword,
-			CFClientID:             cfClientId,
-			CFClientSecret:         cfClientSecret,
-			LoginMaxSecNotBefore:   loginMaxSecNotBefore,
-			LoginMaxSecNotAfter:    loginMaxSecNotAfter,
+			Version:                          1,
+			IdentityCACertificates:           identityCACerts,
+			EnforceIdentityCertKeyUsage:      enforceIdentityCertKeyUsage,
+			EnforceFIPSSignatures:            enforceFIPSSignatures,
+			VerifyInstanceIDs:                verifyInstanceIDs,
+			IdentityCertExpiryWarning:        identityCertExpiryWarning,
+			IdentityCAExpiryWarning:          identityCAExpiryWarning,
+			IdentityCertFieldSources:         identityCertFieldSources,
+			CredHubAddr:                      credHubAddr,
+			CredHubIdentityCAPath:            credHubIdentityCAPath,
+			CredHubClientID:                  credHubClientID,
+			CredHubClientSecret:              credHubClientSecret,
+			CredHubCACertificates:            credHubCACerts,
+			CredHubRefreshInterval:           credHubRefreshInterval,
+			IdentityCAURLCACertificates:      identityCAURLCACerts,
+			IdentityCAURLPinnedSHA256:        identityCAURLPinnedSHA256,
+			IdentityCAURLRefreshInterval:     identityCAURLRefreshInterval,
+			CFAPICertificates:                cfApiCertificates,
+			CFMutualTLSCertificate:           cfMTLSCertificate,
+			CFMutualTLSKey:                   cfMTLSKey,
+			CFAPIUserAgent:                   cfAPIUserAgent,
+			CFAPITLSMinVersion:               cfAPITLSMinVersion,
+			CFAPITLSServerName:               cfAPITLSServerName,
+			CFAPITLSSkipVerify:               cfAPITLSSkipVerify,
+			CFAPIAddr:                        cfApiAddr,
+			CFAPIFailoverAddrs:               cfApiFailoverAddrs,
+			CFUsername:                       cfUsername,
+			CFPassword:                       cfPassword,
+			CFClientID:                       cfClientId,
+			CFClientSecret:                   cfClientSecret,
+			CFAccessToken:                    cfAccessToken,
+			CFRefreshToken:                   cfRefreshToken,
+			CFJWTBearerSigningKey:            cfJWTBearerSigningKey,
+			CFJWTBearerKeyID:                 cfJWTBearerKeyID,
+			CFJWTBearerIssuer:                cfJWTBearerIssuer,
+			CFJWTBearerSubject:               cfJWTBearerSubject,
+			CFJWTBearerAudience:              cfJWTBearerAudience,
+			CFTimeout:                        cfTimeout,
+			CFProxyURL:                       cfProxyURL,
+			CFProxyUsername:                  cfProxyUsername,
+			CFProxyPassword:                  cfProxyPassword,
+			CFNoProxy:                        cfNoProxy,
+			CFMaxRetries:                     cfMaxRetries,
+			CFRetryWaitMin:                   cfRetryWaitMin,
+			CFRetryWaitMax:                   cfRetryWaitMax,
+			CFCircuitBreakerFailureThreshold: cfCircuitBreakerFailureThreshold,
+			CFCircuitBreakerResetTimeout:     cfCircuitBreakerResetTimeout,
+			LoginMaxSecNotBefore:             loginMaxSecNotBefore,
+			LoginMaxSecNotAfter:              loginMaxSecNotAfter,
+			LoginSignatureHash:               loginSignatureHash,
+			DebugLogCertDetail:               debugLogCertDetail,
+			LoginAudienceVaultAddress:        loginAudienceVaultAddress,
+			RequireLoginChallenge:            requireLoginChallenge,
+			LoginChallengeTTL:                loginChallengeTTL,
+			JWTValidationPubKeys:             jwtValidationPubKeys,
+			JWTBoundIssuer:                   jwtBoundIssuer,
+			JWTBoundAudiences:                jwtBoundAudiences,
+			NameCacheTTL:                     nameCacheTTL,
+			NameCacheMaxEntries:              nameCacheMaxEntries,
+			ValidationCacheTTL:               validationCacheTTL,
+			RenewalGracePeriod:               renewalGracePeriod,
+			ReconciliationInterval:           reconciliationInterval,
+			TidyInterval:                     tidyInterval,
+			CFLoginAnnotation:                cfLoginAnnotation,
+			LoginFailureLimit:                loginFailureLimit,
+			LoginFailureAddressLimit:         loginFailureAddressLimit,
+			LoginFailureWindow:               loginFailureWindow,
+			LoginFailureCooldown:             loginFailureCooldown,
+			LoginFailureMaxCooldown:          loginFailureMaxCooldown,
+			DefaultRole:                      defaultRole,
+			DisplayNameTemplate:              displayNameTemplate,
+			TrustedProxyCIDRs:                trustedProxyCIDRs,
+			AllowedSourceCIDRs:               allowedSourceCIDRs,
+			DeniedOrgIDs:                     deniedOrgIDs,
+			DeniedSpaceIDs:                   deniedSpaceIDs,
 		}
 	} else {
 		// They're updating a config. Only update the fields that have been sent in the call.
@@ -291,6 +986,51 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 		if raw, ok := data.GetOk("identity_ca_certificates"); ok {
 			config.IdentityCACertificates = raw.([]string)
 		}
+		if raw, ok := data.GetOk("enforce_identity_cert_key_usage"); ok {
+			config.EnforceIdentityCertKeyUsage = raw.(bool)
+		}
+		if raw, ok := data.GetOk("enforce_fips_signatures"); ok {
+			config.EnforceFIPSSignatures = raw.(bool)
+		}
+		if raw, ok := data.GetOk("verify_instance_ids"); ok {
+			config.VerifyInstanceIDs = raw.(bool)
+		}
+		if raw, ok := data.GetOk("identity_cert_expiry_warning"); ok {
+			config.IdentityCertExpiryWarning = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("identity_ca_expiry_warning"); ok {
+			config.IdentityCAExpiryWarning = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("identity_cert_field_sources"); ok {
+			config.IdentityCertFieldSources = raw.(map[string]string)
+		}
+		if raw, ok := data.GetOk("credhub_addr"); ok {
+			config.CredHubAddr = raw.(string)
+		}
+		if raw, ok := data.GetOk("credhub_identity_ca_path"); ok {
+			config.CredHubIdentityCAPath = raw.(string)
+		}
+		if raw, ok := data.GetOk("credhub_client_id"); ok {
+			config.CredHubClientID = raw.(string)
+		}
+		if raw, ok := data.GetOk("credhub_client_secret"); ok {
+			config.CredHubClientSecret = raw.(string)
+		}
+		if raw, ok := data.GetOk("credhub_ca_certificates"); ok {
+			config.CredHubCACertificates = raw.([]string)
+		}
+		if raw, ok := data.GetOk("credhub_refresh_interval"); ok {
+			config.CredHubRefreshInterval = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("identity_ca_url_ca_certificates"); ok {
+			config.IdentityCAURLCACertificates = raw.([]string)
+		}
+		if raw, ok := data.GetOk("identity_ca_url_pinned_sha256"); ok {
+			config.IdentityCAURLPinnedSHA256 = raw.([]string)
+		}
+		if raw, ok := data.GetOk("identity_ca_url_refresh_interval"); ok {
+			config.IdentityCAURLRefreshInterval = time.Duration(raw.(int)) * time.Second
+		}
 		if raw, ok := data.GetFirst("cf_api_trusted_certificates", "pcf_api_trusted_certificates"); ok {
 			config.CFAPICertificates = raw.([]string)
 		}
@@ -300,8 +1040,23 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 		if raw, ok := data.GetOk("cf_api_mutual_tls_key"); ok {
 			config.CFMutualTLSKey = raw.(string)
 		}
+		if raw, ok := data.GetOk("cf_api_user_agent"); ok {
+			config.CFAPIUserAgent = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_api_tls_min_version"); ok {
+			config.CFAPITLSMinVersion = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_api_tls_server_name"); ok {
+			config.CFAPITLSServerName = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_api_tls_skip_verify"); ok {
+			config.CFAPITLSSkipVerify = raw.(bool)
+		}
 		if raw, ok := data.GetFirst("cf_api_addr", "pcf_api_addr"); ok {
-			config.CFAPIAddr = raw.(string)
+			config.CFAPIAddr, config.CFAPIFailoverAddrs = "", nil
+			if addrs := cfAPIAddrs(raw); len(addrs) > 0 {
+				config.CFAPIAddr, config.CFAPIFailoverAddrs = addrs[0], addrs[1:]
+			}
 		}
 		if raw, ok := data.GetFirst("cf_username", "pcf_username"); ok {
 			config.CFUsername = raw.(string)
@@ -315,17 +1070,353 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 		if raw, ok := data.GetOk("login_max_seconds_not_after"); ok {
 			config.LoginMaxSecNotAfter = time.Duration(raw.(int)) * time.Second
 		}
+		if raw, ok := data.GetOk("login_signature_hash"); ok {
+			config.LoginSignatureHash = raw.(string)
+		}
+		if raw, ok := data.GetOk("debug_log_cert_detail"); ok {
+			config.DebugLogCertDetail = raw.(string)
+		}
+		if raw, ok := data.GetOk("login_audience_vault_address"); ok {
+			config.LoginAudienceVaultAddress = raw.(string)
+		}
+		if raw, ok := data.GetOk("require_login_challenge"); ok {
+			config.RequireLoginChallenge = raw.(bool)
+		}
+		if raw, ok := data.GetOk("login_challenge_ttl"); ok {
+			config.LoginChallengeTTL = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("jwt_validation_pubkeys"); ok {
+			config.JWTValidationPubKeys = raw.([]string)
+		}
+		if raw, ok := data.GetOk("jwt_bound_issuer"); ok {
+			config.JWTBoundIssuer = raw.(string)
+		}
+		if raw, ok := data.GetOk("jwt_bound_audiences"); ok {
+			config.JWTBoundAudiences = raw.([]string)
+		}
 		if raw, ok := data.GetOk("cf_client_id"); ok {
 			config.CFClientID = raw.(string)
 		}
 		if raw, ok := data.GetOk("cf_client_secret"); ok {
 			config.CFClientSecret = raw.(string)
 		}
+		if raw, ok := data.GetOk("cf_access_token"); ok {
+			config.CFAccessToken = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_refresh_token"); ok {
+			config.CFRefreshToken = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_jwt_bearer_signing_key"); ok {
+			config.CFJWTBearerSigningKey = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_jwt_bearer_key_id"); ok {
+			config.CFJWTBearerKeyID = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_jwt_bearer_issuer"); ok {
+			config.CFJWTBearerIssuer = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_jwt_bearer_subject"); ok {
+			config.CFJWTBearerSubject = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_jwt_bearer_audience"); ok {
+			config.CFJWTBearerAudience = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_timeout"); ok {
+			config.CFTimeout = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("cf_proxy_url"); ok {
+			config.CFProxyURL = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_proxy_username"); ok {
+			config.CFProxyUsername = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_proxy_password"); ok {
+			config.CFProxyPassword = raw.(string)
+		}
+		if raw, ok := data.GetOk("cf_no_proxy"); ok {
+			config.CFNoProxy = raw.([]string)
+		}
+		if raw, ok := data.GetOk("cf_max_retries"); ok {
+			config.CFMaxRetries = raw.(int)
+		}
+		if raw, ok := data.GetOk("cf_retry_wait_min"); ok {
+			config.CFRetryWaitMin = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("cf_retry_wait_max"); ok {
+			config.CFRetryWaitMax = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("cf_circuit_breaker_failure_threshold"); ok {
+			config.CFCircuitBreakerFailureThreshold = raw.(int)
+		}
+		if raw, ok := data.GetOk("cf_circuit_breaker_reset_timeout"); ok {
+			config.CFCircuitBreakerResetTimeout = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("name_cache_ttl"); ok {
+			config.NameCacheTTL = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("name_cache_max_entries"); ok {
+			config.NameCacheMaxEntries = raw.(int)
+		}
+		if raw, ok := data.GetOk("validation_cache_ttl"); ok {
+			config.ValidationCacheTTL = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("renewal_grace_period"); ok {
+			config.RenewalGracePeriod = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("reconciliation_interval"); ok {
+			config.ReconciliationInterval = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("tidy_interval"); ok {
+			config.TidyInterval = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("cf_login_annotation"); ok {
+			config.CFLoginAnnotation = raw.(string)
+		}
+		if raw, ok := data.GetOk("login_failure_limit"); ok {
+			config.LoginFailureLimit = raw.(int)
+		}
+		if raw, ok := data.GetOk("login_failure_address_limit"); ok {
+			config.LoginFailureAddressLimit = raw.(int)
+		}
+		if raw, ok := data.GetOk("login_failure_window"); ok {
+			config.LoginFailureWindow = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("login_failure_cooldown"); ok {
+			config.LoginFailureCooldown = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("login_failure_max_cooldown"); ok {
+			config.LoginFailureMaxCooldown = time.Duration(raw.(int)) * time.Second
+		}
+		if raw, ok := data.GetOk("default_role"); ok {
+			config.DefaultRole = raw.(string)
+		}
+		if raw, ok := data.GetOk("display_name_template"); ok {
+			config.DisplayNameTemplate = raw.(string)
+		}
+		if raw, ok := data.GetOk("trusted_proxy_cidrs"); ok {
+			config.TrustedProxyCIDRs = raw.([]string)
+		}
+		if raw, ok := data.GetOk("allowed_source_cidrs"); ok {
+			config.AllowedSourceCIDRs = raw.([]string)
+		}
+		if raw, ok := data.GetOk("denied_organization_ids"); ok {
+			config.DeniedOrgIDs = raw.([]string)
+		}
+		if raw, ok := data.GetOk("denied_space_ids"); ok {
+			config.DeniedSpaceIDs = raw.([]string)
+		}
 	}
 
+	switch config.LoginSignatureHash {
+	case "", signatures.HashSHA256, signatures.HashSHA384, signatures.HashSHA512:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("'login_signature_hash' must be one of %q, %q, or %q",
+			signatures.HashSHA256, signatures.HashSHA384, signatures.HashSHA512)), nil
+	}
+	switch config.DebugLogCertDetail {
+	case "", models.DebugLogCertGUIDs, models.DebugLogCertHashed, models.DebugLogCertFull:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("'debug_log_cert_detail' must be one of %q, %q, or %q",
+			models.DebugLogCertGUIDs, models.DebugLogCertHashed, models.DebugLogCertFull)), nil
+	}
+	if config.LoginAudienceVaultAddress != "" {
+		vaultURL, err := url.Parse(config.LoginAudienceVaultAddress)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'login_audience_vault_address' is invalid: %s", err)), nil
+		}
+		if vaultURL.Scheme != "http" && vaultURL.Scheme != "https" {
+			return logical.ErrorResponse("'login_audience_vault_address' must use the http or https scheme"), nil
+		}
+	}
+	if err := models.ValidateCertFieldSources(config.IdentityCertFieldSources); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'identity_cert_field_sources' is invalid: %s", err)), nil
+	}
+	if _, err := parseJWTValidationPubKeys(config.JWTValidationPubKeys); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'jwt_validation_pubkeys' is invalid: %s", err)), nil
+	}
+	if config.CFTimeout < 0 {
+		return logical.ErrorResponse("'cf_timeout' must not be negative"), nil
+	}
+	if config.CFProxyURL != "" {
+		proxyURL, err := url.Parse(config.CFProxyURL)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'cf_proxy_url' is invalid: %s", err)), nil
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+			return logical.ErrorResponse("'cf_proxy_url' must use the http or https scheme"), nil
+		}
+	}
+	if config.CFProxyUsername == "" && config.CFProxyPassword != "" {
+		return logical.ErrorResponse("'cf_proxy_username' must be set if 'cf_proxy_password' is set"), nil
+	}
+	if config.CFMaxRetries < 0 {
+		return logical.ErrorResponse("'cf_max_retries' must not be negative"), nil
+	}
+	if config.CFRetryWaitMax > 0 && config.CFRetryWaitMin > config.CFRetryWaitMax {
+		return logical.ErrorResponse("'cf_retry_wait_min' must not be greater than 'cf_retry_wait_max'"), nil
+	}
+	if config.CFCircuitBreakerFailureThreshold < 0 {
+		return logical.ErrorResponse("'cf_circuit_breaker_failure_threshold' must not be negative"), nil
+	}
+	if config.CFCircuitBreakerResetTimeout < 0 {
+		return logical.ErrorResponse("'cf_circuit_breaker_reset_timeout' must not be negative"), nil
+	}
+	if config.NameCacheTTL < 0 {
+		return logical.ErrorResponse("'name_cache_ttl' must not be negative"), nil
+	}
+	if config.NameCacheMaxEntries < 0 {
+		return logical.ErrorResponse("'name_cache_max_entries' must not be negative"), nil
+	}
+	if config.IdentityCertExpiryWarning < 0 || config.IdentityCAExpiryWarning < 0 {
+		return logical.ErrorResponse("'identity_cert_expiry_warning' and 'identity_ca_expiry_warning' must not be negative"), nil
+	}
+	if config.ValidationCacheTTL < 0 {
+		return logical.ErrorResponse("'validation_cache_ttl' must not be negative"), nil
+	}
+	if config.RenewalGracePeriod < 0 {
+		return logical.ErrorResponse("'renewal_grace_period' must not be negative"), nil
+	}
+	if config.ReconciliationInterval < 0 {
+		return logical.ErrorResponse("'reconciliation_interval' must not be negative"), nil
+	}
+	if config.TidyInterval < 0 {
+		return logical.ErrorResponse("'tidy_interval' must not be negative"), nil
+	}
+	if config.CFLoginAnnotation != "" {
+		if err := validateAnnotationKey(config.CFLoginAnnotation); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'cf_login_annotation' is invalid: %s", err)), nil
+		}
+	}
+	if config.LoginChallengeTTL < 0 {
+		return logical.ErrorResponse("'login_challenge_ttl' must not be negative"), nil
+	}
+	if config.LoginFailureLimit < 0 || config.LoginFailureAddressLimit < 0 || config.LoginFailureWindow < 0 || config.LoginFailureCooldown < 0 || config.LoginFailureMaxCooldown < 0 {
+		return logical.ErrorResponse("'login_failure_limit', 'login_failure_address_limit', 'login_failure_window', 'login_failure_cooldown' and 'login_failure_max_cooldown' must not be negative"), nil
+	}
+	for _, cidr := range config.TrustedProxyCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'trusted_proxy_cidrs' is invalid: %s", err)), nil
+		}
+	}
+	if err := validateDisplayNameTemplate(config.DisplayNameTemplate); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	for _, cidr := range config.AllowedSourceCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'allowed_source_cidrs' is invalid: %s", err)), nil
+		}
+	}
+	if _, ok := tlsVersions[cfAPITLSMinVersion(config)]; !ok {
+		return logical.ErrorResponse(fmt.Sprintf("'cf_api_tls_min_version' must be one of \"tls10\", \"tls11\", \"tls12\" or \"tls13\", not %q", config.CFAPITLSMinVersion)), nil
+	}
+	if len(config.CFAPIFailoverAddrs) > 0 {
+		for _, addr := range config.CFAPIAddrs() {
+			if u, err := url.Parse(addr); err != nil || u.Host == "" {
+				return logical.ErrorResponse(fmt.Sprintf("'cf_api_addr' must only list URLs, and %q isn't one", addr)), nil
+			}
+		}
+	}
+	if config.CFRefreshToken != "" && config.CFAccessToken == "" {
+		return logical.ErrorResponse("'cf_access_token' must be set if 'cf_refresh_token' is set"), nil
+	}
+	if config.CFJWTBearerSigningKey != "" {
+		if _, _, err := parseJWTBearerSigningKey(config.CFJWTBearerSigningKey); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'cf_jwt_bearer_signing_key' is invalid: %s", err)), nil
+		}
+		if config.CFClientID == "" || config.CFJWTBearerIssuer == "" || config.CFJWTBearerSubject == "" {
+			return logical.ErrorResponse("'cf_client_id', 'cf_jwt_bearer_issuer' and 'cf_jwt_bearer_subject' must be set if 'cf_jwt_bearer_signing_key' is set"), nil
+		}
+	}
+	if _, ok := data.GetOk("identity_ca_certificates"); ok {
+		caCerts, urls, err := splitIdentityCAURLs(config.IdentityCACertificates)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'identity_ca_certificates' is invalid: %s", err)), nil
+		}
+		config.IdentityCACertificates, config.IdentityCAURLs = caCerts, urls
+	}
+	if len(config.IdentityCACertificates) == 0 && len(config.IdentityCAURLs) == 0 && config.CredHubIdentityCAPath == "" {
+		return logical.ErrorResponse("'identity_ca_certificates' or 'credhub_identity_ca_path' is required"), nil
+	}
+	for i, pin := range config.IdentityCAURLPinnedSHA256 {
+		normalized, err := normalizeSPKIPin(pin)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'identity_ca_url_pinned_sha256' is invalid: %s", err)), nil
+		}
+		config.IdentityCAURLPinnedSHA256[i] = normalized
+	}
+	if config.IdentityCAURLRefreshInterval < 0 {
+		return logical.ErrorResponse("'identity_ca_url_refresh_interval' must not be negative"), nil
+	}
+	if config.CredHubIdentityCAPath != "" && (config.CredHubAddr == "" || config.CredHubClientID == "" || config.CredHubClientSecret == "") {
+		return logical.ErrorResponse("'credhub_addr', 'credhub_client_id' and 'credhub_client_secret' must be set if 'credhub_identity_ca_path' is set"), nil
+	}
+	if config.CredHubRefreshInterval < 0 {
+		return logical.ErrorResponse("'credhub_refresh_interval' must not be negative"), nil
+	}
+
+	verifyConnection := data.Get("verify_connection").(bool)
+	var warnings []string
+	if config.CFAPITLSSkipVerify {
+		warnings = append(warnings, "'cf_api_tls_skip_verify' is set, so the certificates of the CF API and UAA aren't verified")
+	}
+	if config.CFAccessToken != "" && config.CFRefreshToken == "" {
+		warnings = append(warnings, "'cf_access_token' is set without 'cf_refresh_token', so the CF API can't be called once the token expires")
+	}
+	switch {
+	case config.CredHubIdentityCAPath == "":
+		config.CredHubIdentityCACertificates = nil
+		config.CredHubRefreshedAt = time.Time{}
+	case credHubConfigSent(data) || len(config.CredHubIdentityCACertificates) == 0:
+		caCerts, err := fetchCredHubIdentityCA(ctx, config)
+		switch {
+		case err == nil:
+			config.CredHubIdentityCACertificates = caCerts
+			config.CredHubRefreshedAt = time.Now().UTC()
+		case verifyConnection:
+			return logical.ErrorResponse(fmt.Sprintf("the configuration wasn't saved, as the identity CA couldn't be read from CredHub: %s; set 'verify_connection' to false to save it anyway", err)), nil
+		default:
+			// What was read with the previous settings isn't trusted anymore, and CredHub is
+			// read again on the next periodic refresh.
+			config.CredHubIdentityCACertificates = nil
+			config.CredHubRefreshedAt = time.Time{}
+			warnings = append(warnings, fmt.Sprintf("the configuration was saved, but the identity CA couldn't be read from CredHub: %s", err))
+		}
+	}
+	switch {
+	case len(config.IdentityCAURLs) == 0:
+		config.URLIdentityCACertificates = nil
+		config.IdentityCAURLsRefreshedAt = time.Time{}
+	case identityCAURLConfigSent(data) || len(config.URLIdentityCACertificates) == 0:
+		caCerts, err := fetchIdentityCAURLs(ctx, config)
+		switch {
+		case err == nil:
+			config.URLIdentityCACertificates = caCerts
+			config.IdentityCAURLsRefreshedAt = time.Now().UTC()
+		case verifyConnection:
+			return logical.ErrorResponse(fmt.Sprintf("the configuration wasn't saved, as %s; set 'verify_connection' to false to save it anyway", err)), nil
+		default:
+			// What was downloaded with the previous settings isn't trusted anymore, and the
+			// bundles are downloaded again on the next periodic refresh.
+			config.URLIdentityCACertificates = nil
+			config.IdentityCAURLsRefreshedAt = time.Time{}
+			warnings = append(warnings, fmt.Sprintf("the configuration was saved, but %s", err))
+		}
+	}
+	if verifyConnection {
+		if err := b.verifyCFConnection(ctx, config); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("the configuration wasn't saved, as %s; set 'verify_connection' to false to save it anyway", err)), nil
+		}
+	}
+
+	if _, err := credentialSalt(ctx, req.Storage, true); err != nil {
+		return nil, err
+	}
 	if err := storeConfig(ctx, req.Storage, config); err != nil {
 		return nil, err
 	}
+	caCertsUpdated := !slices.Equal(previousIdentityCACerts, config.AllIdentityCACertificates())
+	b.sendEvent(ctx, eventTypeConfigWrite, "path", req.Path, "modified", "true", "identity_ca_certificates_updated", strconv.FormatBool(caCertsUpdated))
+	b.recordChange(ctx, req.Storage, newConfigChange(req, ""), before, config)
 
 	// read the config back from storage to ensure that the client is updated with
 	// the storage configuration
@@ -335,13 +1426,55 @@ func (b *backend) operationConfigWrite(ctx context.Context, req *logical.Request
 		return nil, err
 	}
 
+	// With 'verify_connection', the connection was verified before the config was saved,
+	// so failing to build the client now doesn't undo the write either. The client is
+	// built again on the next login.
 	if _, err := b.updateCFClient(ctx, config); err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		warnings = append(warnings, fmt.Sprintf("the configuration was saved, but CF’s API couldn't be reached: %s", err))
 	}
 
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
 	return nil, nil
 }
 
+// cfAPIAddrs returns the addresses given as the cf_api_addr list, or as the deprecated
+// pcf_api_addr string.
+func cfAPIAddrs(raw interface{}) []string {
+	switch addrs := raw.(type) {
+	case []string:
+		return addrs
+	case string:
+		if addrs != "" {
+			return []string{addrs}
+		}
+	}
+	return nil
+}
+
+// identityCAURLConfigSent reports whether the request sets any of the fields that the
+// identity CA is downloaded with.
+func identityCAURLConfigSent(data *framework.FieldData) bool {
+	for _, field := range []string{"identity_ca_certificates", "identity_ca_url_ca_certificates", "identity_ca_url_pinned_sha256"} {
+		if _, ok := data.GetOk(field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// credHubConfigSent reports whether the request sets any of the fields that the
+// identity CA is read from CredHub with.
+func credHubConfigSent(data *framework.FieldData) bool {
+	for _, field := range []string{"credhub_addr", "credhub_identity_ca_path", "credhub_client_id", "credhub_client_secret", "credhub_ca_certificates"} {
+		if _, ok := data.GetOk(field); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *backend) operationConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
@@ -355,17 +1488,85 @@ func (b *backend) operationConfigRead(ctx context.Context, req *logical.Request,
 	}
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"version":                       config.Version,
-			"identity_ca_certificates":      config.IdentityCACertificates,
-			"cf_api_trusted_certificates":   config.CFAPICertificates,
-			"cf_api_mutual_tls_certificate": config.CFMutualTLSCertificate,
-			"cf_api_addr":                   config.CFAPIAddr,
-			"cf_username":                   config.CFUsername,
-			"cf_client_id":                  config.CFClientID,
-			"login_max_seconds_not_before":  config.LoginMaxSecNotBefore / time.Second,
-			"login_max_seconds_not_after":   config.LoginMaxSecNotAfter / time.Second,
+			"version":                              config.Version,
+			"identity_ca_certificates":             append(slices.Clone(config.IdentityCACertificates), config.IdentityCAURLs...),
+			"enforce_identity_cert_key_usage":      config.EnforceIdentityCertKeyUsage,
+			"enforce_fips_signatures":              config.EnforceFIPSSignatures,
+			"verify_instance_ids":                  config.VerifyInstanceIDs,
+			"identity_cert_expiry_warning":         config.IdentityCertExpiryWarning / time.Second,
+			"identity_ca_expiry_warning":           config.IdentityCAExpiryWarning / time.Second,
+			"identity_cert_field_sources":          config.IdentityCertFieldSources,
+			"credhub_addr":                         config.CredHubAddr,
+			"credhub_identity_ca_path":             config.CredHubIdentityCAPath,
+			"credhub_client_id":                    config.CredHubClientID,
+			"credhub_ca_certificates":              config.CredHubCACertificates,
+			"credhub_refresh_interval":             credHubRefreshInterval(config) / time.Second,
+			"identity_ca_url_ca_certificates":      config.IdentityCAURLCACertificates,
+			"identity_ca_url_pinned_sha256":        config.IdentityCAURLPinnedSHA256,
+			"identity_ca_url_refresh_interval":     identityCAURLRefreshInterval(config) / time.Second,
+			"cf_api_trusted_certificates":          config.CFAPICertificates,
+			"cf_api_mutual_tls_certificate":        config.CFMutualTLSCertificate,
+			"cf_api_user_agent":                    config.CFAPIUserAgent,
+			"cf_api_tls_min_version":               cfAPITLSMinVersion(config),
+			"cf_api_tls_server_name":               config.CFAPITLSServerName,
+			"cf_api_tls_skip_verify":               config.CFAPITLSSkipVerify,
+			"cf_api_addr":                          strings.Join(config.CFAPIAddrs(), ","),
+			"cf_username":                          config.CFUsername,
+			"cf_client_id":                         config.CFClientID,
+			"cf_jwt_bearer_key_id":                 config.CFJWTBearerKeyID,
+			"cf_jwt_bearer_issuer":                 config.CFJWTBearerIssuer,
+			"cf_jwt_bearer_subject":                config.CFJWTBearerSubject,
+			"cf_jwt_bearer_audience":               config.CFJWTBearerAudience,
+			"login_max_seconds_not_before":         config.LoginMaxSecNotBefore / time.Second,
+			"login_max_seconds_not_after":          config.LoginMaxSecNotAfter / time.Second,
+			"cf_timeout":                           config.CFTimeout / time.Second,
+			"cf_proxy_url":                         config.CFProxyURL,
+			"cf_proxy_username":                    config.CFProxyUsername,
+			"cf_no_proxy":                          config.CFNoProxy,
+			"cf_max_retries":                       config.CFMaxRetries,
+			"cf_retry_wait_min":                    config.CFRetryWaitMin / time.Second,
+			"cf_retry_wait_max":                    config.CFRetryWaitMax / time.Second,
+			"name_cache_ttl":                       config.NameCacheTTL / time.Second,
+			"cf_circuit_breaker_failure_threshold": config.CFCircuitBreakerFailureThreshold,
+			"cf_circuit_breaker_reset_timeout":     config.CFCircuitBreakerResetTimeout / time.Second,
+			"name_cache_max_entries":               config.NameCacheMaxEntries,
+			"validation_cache_ttl":                 config.ValidationCacheTTL / time.Second,
+			"renewal_grace_period":                 config.RenewalGracePeriod / time.Second,
+			"reconciliation_interval":              config.ReconciliationInterval / time.Second,
+			"tidy_interval":                        config.TidyInterval / time.Second,
+			"cf_login_annotation":                  config.CFLoginAnnotation,
+			"login_failure_limit":                  config.LoginFailureLimit,
+			"login_failure_address_limit":          loginFailureAddressLimit(config),
+			"login_failure_window":                 loginFailureWindow(config) / time.Second,
+			"login_failure_cooldown":               loginFailureCooldown(config) / time.Second,
+			"login_failure_max_cooldown":           config.LoginFailureMaxCooldown / time.Second,
+			"default_role":                         config.DefaultRole,
+			"display_name_template":                config.DisplayNameTemplate,
+			"trusted_proxy_cidrs":                  config.TrustedProxyCIDRs,
+			"allowed_source_cidrs":                 config.AllowedSourceCIDRs,
+			"denied_organization_ids":              config.DeniedOrgIDs,
+			"denied_space_ids":                     config.DeniedSpaceIDs,
+			"login_signature_hash":                 loginSignatureHash(config),
+			"debug_log_cert_detail":                debugLogCertDetail(config),
+			"login_audience_vault_address":         config.LoginAudienceVaultAddress,
+			"require_login_challenge":              config.RequireLoginChallenge,
+			"login_challenge_ttl":                  loginChallengeTTL(config) / time.Second,
+			"jwt_validation_pubkeys":               config.JWTValidationPubKeys,
+			"jwt_bound_issuer":                     config.JWTBoundIssuer,
+			"jwt_bound_audiences":                  config.JWTBoundAudiences,
 		},
 	}
+	if err := addCredentialStatus(ctx, req.Storage, config, resp.Data); err != nil {
+		return nil, err
+	}
+	if config.CFJWTBearerSigningKey != "" {
+		// The public key is what UAA's identity provider is configured to trust.
+		publicKey, err := jwtBearerPublicKey(config)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data["cf_jwt_bearer_public_key"] = publicKey
+	}
 	// Populate any deprecated values and warn about them. These should just be stripped when we go to
 	// version 2 of the config.
 	if len(config.PCFAPICertificates) > 0 {
@@ -387,9 +1588,19 @@ func (b *backend) operationConfigDelete(ctx context.Context, req *logical.Reques
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	before, err := changeSnapshot(config)
+	if err != nil {
+		return nil, err
+	}
 	if err := req.Storage.Delete(ctx, configStorageKey); err != nil {
 		return nil, err
 	}
+	b.sendEvent(ctx, eventTypeConfigDelete, "path", req.Path, "modified", "true")
+	b.recordChange(ctx, req.Storage, newConfigChange(req, ""), before, (*models.Configuration)(nil))
 	return nil, nil
 }
 
@@ -407,7 +1618,8 @@ func getConfig(ctx context.Context, storage logical.Storage) (*models.Configurat
 		return nil, err
 	}
 
-	// Perform config version migrations if needed.
+	// Perform config version migrations if needed. They're stored when the storage is
+	// upgraded, since nodes that can't write to storage read the config too.
 	if config.Version == 0 {
 		if config.CFAPIAddr == "" && config.PCFAPIAddr != "" {
 			config.CFAPIAddr = config.PCFAPIAddr
@@ -422,9 +1634,6 @@ func getConfig(ctx context.Context, storage logical.Storage) (*models.Configurat
 			config.CFPassword = config.PCFPassword
 		}
 		config.Version = 1
-		if err := storeConfig(ctx, storage, config); err != nil {
-			return nil, err
-		}
 	}
 	return config, nil
 }
@@ -0,0 +1,186 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// caExpiryWarningPeriod is how long before an identity CA certificate expires that
+// the health check warns about it.
+const caExpiryWarningPeriod = 30 * 24 * time.Hour
+
+func (b *backend) pathConfigCheck() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/check",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationConfigCheckRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb:   "check",
+					OperationSuffix: "configuration",
+				},
+			},
+		},
+		HelpSynopsis:    pathConfigCheckSyn,
+		HelpDescription: pathConfigCheckDesc,
+	}
+}
+
+func (b *backend) operationConfigCheckRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	ctx = withRequestInfo(ctx, req)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("no configuration has been written"), nil
+	}
+
+	report := &checkReport{}
+	checkIdentityCACertificates(report, config, time.Now())
+	if config.CredHubIdentityCAPath != "" {
+		_, err := fetchCredHubIdentityCA(ctx, config)
+		report.check("credhub", err)
+	}
+	if len(config.IdentityCAURLs) > 0 {
+		_, err := fetchIdentityCAURLs(ctx, config)
+		report.check("identity_ca_urls", err)
+	}
+	b.checkCFAPI(ctx, report, config)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"healthy": !report.failed,
+			"checks":  report.checks,
+		},
+	}, nil
+}
+
+// checkIdentityCACertificates checks that each identity CA certificate parses and
+// hasn't expired, and warns about those that expire soon.
+func checkIdentityCACertificates(report *checkReport, config *models.Configuration, now time.Time) {
+	if len(config.AllIdentityCACertificates()) == 0 {
+		report.add("identity_ca_certificates", checkFailed, errors.New("no identity CA certificates are configured"))
+		return
+	}
+	for i, caCert := range config.AllIdentityCACertificates() {
+		name := fmt.Sprintf("identity_ca_certificates[%d]", i)
+		if n := len(config.IdentityCACertificates) + len(config.CredHubIdentityCACertificates); i >= n {
+			name = fmt.Sprintf("url_identity_ca_certificates[%d]", i-n)
+		} else if i >= len(config.IdentityCACertificates) {
+			name = fmt.Sprintf("credhub_identity_ca_certificates[%d]", i-len(config.IdentityCACertificates))
+		}
+		certs, err := parseCertificatesPEM(caCert)
+		if err != nil {
+			report.add(name, checkFailed, err)
+			continue
+		}
+		for _, cert := range certs {
+			var check map[string]interface{}
+			switch {
+			case now.Before(cert.NotBefore):
+				check = report.add(name, checkFailed, fmt.Errorf("certificate isn't valid until %s", cert.NotBefore.Format(time.RFC3339)))
+			case !now.Before(cert.NotAfter):
+				check = report.add(name, checkFailed, fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339)))
+			case now.Add(caExpiryWarningPeriod).After(cert.NotAfter):
+				check = report.add(name, checkWarning, fmt.Errorf("certificate expires soon, at %s", cert.NotAfter.Format(time.RFC3339)))
+			default:
+				check = report.add(name, checkPassed, nil)
+			}
+			check["subject"] = cert.Subject.String()
+			check["not_after"] = cert.NotAfter.Format(time.RFC3339)
+		}
+	}
+}
+
+// parseCertificatesPEM parses every certificate in the PEM-encoded contents.
+func parseCertificatesPEM(contents string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(contents)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM-encoded certificates found")
+	}
+	return certs, nil
+}
+
+// checkCFAPI checks that the CF API can be reached, and that UAA accepts the configured
+// credentials. A new client is used, so that the check reflects the configuration as it
+// is now and doesn't disturb the client used for logins.
+func (b *backend) checkCFAPI(ctx context.Context, report *checkReport, config *models.Configuration) {
+	// Building the client discovers the UAA endpoint from the CF API's root.
+	client, err := b.newCFClient(ctx, config)
+	if err != nil {
+		report.add("cf_api", checkFailed, err)
+		report.add("uaa_credentials", checkSkipped, nil)
+		return
+	}
+	report.add("cf_api", checkPassed, nil)
+	report.check("uaa_credentials", fetchUAAToken(ctx, client))
+}
+
+// verifyCFConnection checks that the CF API can be reached with the configuration, and
+// that UAA accepts its credentials.
+func (b *backend) verifyCFConnection(ctx context.Context, config *models.Configuration) error {
+	client, err := b.newCFClient(ctx, config)
+	if err != nil {
+		return fmt.Errorf("CF’s API couldn't be reached: %w", err)
+	}
+	if err := fetchUAAToken(ctx, client); err != nil {
+		return fmt.Errorf("UAA didn't accept the credentials: %w", err)
+	}
+	return nil
+}
+
+// fetchUAAToken authenticates to UAA with the client's credentials.
+func fetchUAAToken(ctx context.Context, client *cfclient.Client) error {
+	tokenSource, err := client.Config.CreateOAuth2TokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tokenSource.Token()
+	return err
+}
+
+const pathConfigCheckSyn = `
+Check that the configuration works end to end.
+`
+
+const pathConfigCheckDesc = `
+Checks that each identity CA certificate parses and hasn't expired, warning
+about those that expire within 30 days, that the identity CA can be read from
+CredHub if it's configured and downloaded from its URLs if any are configured,
+that CF's API can be reached, and that UAA accepts the configured credentials.
+Each check is reported along with
+whether it passed, and "healthy" is false if any check failed, so that the
+endpoint can be used for monitoring.
+`
@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestCheckIdentityCACertificates(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	config := &models.Configuration{
+		IdentityCACertificates: []string{testCerts.CACertificate, "not a certificate"},
+	}
+
+	// The test CA is valid for 100 years.
+	for name, tt := range map[string]struct {
+		now  time.Time
+		want string
+	}{
+		"valid":         {now: time.Now(), want: checkPassed},
+		"expiring":      {now: time.Now().Add(100*365*24*time.Hour - 48*time.Hour), want: checkWarning},
+		"expired":       {now: time.Now().Add(101 * 365 * 24 * time.Hour), want: checkFailed},
+		"not yet valid": {now: time.Now().Add(-time.Hour), want: checkFailed},
+	} {
+		report := &checkReport{}
+		checkIdentityCACertificates(report, config, tt.now)
+		if len(report.checks) != 2 {
+			t.Fatalf("%s: expected 2 checks but received %#v", name, report.checks)
+		}
+		if result := report.checks[0]["result"]; result != tt.want {
+			t.Fatalf("%s: expected the CA check to be %s but received %#v", name, tt.want, report.checks[0])
+		}
+		if result := report.checks[1]["result"]; result != checkFailed {
+			t.Fatalf("%s: expected the unparseable CA to fail but received %#v", name, report.checks[1])
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathConfigClientStatus() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/client-status",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationConfigClientStatusRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "client-status",
+				},
+			},
+		},
+		HelpSynopsis:    pathConfigClientStatusSyn,
+		HelpDescription: pathConfigClientStatusDesc,
+	}
+}
+
+func (b *backend) operationConfigClientStatusRead(_ context.Context, _ *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	status := b.cfClientStatus.status()
+	b.cfClientMu.RLock()
+	status["initialized"] = b.cfClient != nil
+	status["tainted"] = b.cfClientTainted
+	b.cfClientMu.RUnlock()
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+const pathConfigClientStatusSyn = `
+Read the state of the client used to call the CF API.
+`
+
+const pathConfigClientStatusDesc = `
+Logins reuse a CF client, along with the token it got from UAA, until the
+configuration changes or a call fails in a way that the client should be
+rebuilt for. This path reports whether the client has been built and whether
+it's to be rebuilt, when it was last built, when its UAA token expires, and the
+most recent error that kept it from being built or from serving a call. The
+state is that of the node that handles the request.
+`
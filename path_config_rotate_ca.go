@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+// walKindCARotation is the kind of the WAL entries written while the identity CA is
+// rotated, so that a rotation interrupted by Vault stopping is rolled back.
+const walKindCARotation = "identity-ca-rotation"
+
+// caRotationWAL is what's needed to roll back an interrupted identity CA rotation.
+type caRotationWAL struct {
+	// PreviousIdentityCACertificates are the CA certificates trusted before the
+	// rotation, TransitionIdentityCACertificates are those trusted on the way to the
+	// new ones, the previous ones along with the new ones, and
+	// FinalIdentityCACertificates are those trusted once the rotation completes, which
+	// are the transition ones if the previous ones are kept.
+	PreviousIdentityCACertificates   []string `json:"previous_identity_ca_certificates"`
+	TransitionIdentityCACertificates []string `json:"transition_identity_ca_certificates"`
+	FinalIdentityCACertificates      []string `json:"final_identity_ca_certificates"`
+}
+
+func (b *backend) pathConfigRotateCA() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/rotate-identity-ca",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"identity_ca_certificates": {
+				Type: framework.TypeStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Identity CA Certificates",
+				},
+				Description: "The PEM-encoded CA certificates to trust instead of the currently configured ones.",
+			},
+			"verify_certificate": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Verify Certificate",
+				},
+				Description: `An instance certificate, along with its intermediate, as found at CF_INSTANCE_CERT. If set,
+the rotation is only made if it chains to one of the new CA certificates.`,
+			},
+			"keep_previous": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Keep Previous",
+				},
+				Description: `If true, the currently configured CA certificates remain trusted along with the new ones,
+so that a later rotation can remove them once every instance has a certificate issued by the new ones.`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationConfigRotateCAUpdate,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb:   "rotate",
+					OperationSuffix: "identity-ca",
+				},
+			},
+		},
+		HelpSynopsis:    pathConfigRotateCASyn,
+		HelpDescription: pathConfigRotateCADesc,
+	}
+}
+
+func (b *backend) operationConfigRotateCAUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("the mount must be configured before its identity CA can be rotated"), nil
+	}
+	newCACerts := data.Get("identity_ca_certificates").([]string)
+	if len(newCACerts) == 0 {
+		return logical.ErrorResponse("'identity_ca_certificates' is required"), nil
+	}
+	if err := checkCACertificates(newCACerts); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'identity_ca_certificates' is invalid: %s", err)), nil
+	}
+
+	if certContents := data.Get("verify_certificate").(string); certContents != "" {
+		if err := verifyChainsTo(newCACerts, certContents); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("the identity CA wasn't rotated, as 'verify_certificate' doesn't chain to the new CA certificates: %s", err)), nil
+		}
+	}
+
+	before, err := changeSnapshot(config)
+	if err != nil {
+		return nil, err
+	}
+	previousCACerts := config.IdentityCACertificates
+	wal := &caRotationWAL{
+		PreviousIdentityCACertificates:   previousCACerts,
+		TransitionIdentityCACertificates: append(slices.Clone(previousCACerts), newCACerts...),
+	}
+	wal.FinalIdentityCACertificates = wal.TransitionIdentityCACertificates
+	if !data.Get("keep_previous").(bool) {
+		wal.FinalIdentityCACertificates = newCACerts
+	}
+	walID, err := framework.PutWAL(ctx, req.Storage, walKindCARotation, wal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trust the new CA certificates along with the previous ones on the way to the final
+	// ones, so that logins with certificates from either keep succeeding throughout.
+	config.IdentityCACertificates = wal.TransitionIdentityCACertificates
+	if err := storeConfig(ctx, req.Storage, config); err != nil {
+		return nil, err
+	}
+	if !slices.Equal(wal.FinalIdentityCACertificates, wal.TransitionIdentityCACertificates) {
+		config.IdentityCACertificates = wal.FinalIdentityCACertificates
+		if err := storeConfig(ctx, req.Storage, config); err != nil {
+			return nil, err
+		}
+	}
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("rotated the identity CA", "previous_certificates", len(previousCACerts), "certificates", len(config.IdentityCACertificates))
+	b.sendEvent(ctx, eventTypeConfigWrite, "path", req.Path, "modified", "true", "identity_ca_certificates_updated", "true")
+	b.recordChange(ctx, req.Storage, newConfigChange(req, ""), before, config)
+	return nil, nil
+}
+
+// walRollback rolls back the WAL entries of operations interrupted by Vault stopping.
+func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walKindCARotation:
+	case walKindRoleImport:
+		return b.rollbackRoleImport(ctx, req.Storage, data)
+	default:
+		return fmt.Errorf("unknown WAL entry kind %q", kind)
+	}
+	// The entry is decoded as a map, so it's encoded again to be read as a caRotationWAL.
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	wal := &caRotationWAL{}
+	if err := json.Unmarshal(raw, wal); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil || config == nil {
+		return err
+	}
+	// The rotation was interrupted before the final CA certificates were stored, so the
+	// previous ones are restored. Otherwise, the rotation either completed, including
+	// when the final certificates are the transition ones, or never began, and the
+	// config is left as it is.
+	if slices.Equal(config.IdentityCACertificates, wal.FinalIdentityCACertificates) ||
+		!slices.Equal(config.IdentityCACertificates, wal.TransitionIdentityCACertificates) {
+		return nil
+	}
+	config.IdentityCACertificates = wal.PreviousIdentityCACertificates
+	if err := storeConfig(ctx, req.Storage, config); err != nil {
+		return err
+	}
+	b.Logger().Warn("rolled back an interrupted identity CA rotation")
+	return nil
+}
+
+// checkCACertificates ensures that each of the PEM blocks is a CA certificate.
+func checkCACertificates(caCerts []string) error {
+	for _, caCert := range caCerts {
+		rest := []byte(caCert)
+		found := false
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			if !cert.IsCA {
+				return fmt.Errorf("%q isn't a CA certificate", cert.Subject)
+			}
+			found = true
+		}
+		if !found {
+			return errors.New("no PEM-encoded certificate found")
+		}
+	}
+	return nil
+}
+
+// verifyChainsTo ensures that the instance certificate chains to one of the CA certificates.
+func verifyChainsTo(caCerts []string, certContents string) error {
+	intermediateCerts, identityCert, err := util.ExtractCertificates(certContents)
+	if err != nil {
+		return err
+	}
+	return util.Validate(caCerts, intermediateCerts, identityCert, identityCert)
+}
+
+const pathConfigRotateCASyn = `
+Rotate the identity CA certificates that instance certificates must chain to.
+`
+
+const pathConfigRotateCADesc = `
+Rotating the identity CA replaces the configured "identity_ca_certificates"
+in steps: "verify_certificate" is first checked against the new certificates,
+which are then trusted along with the previous ones, and the previous ones are
+finally removed, unless "keep_previous" is set. If the verification fails, the
+configured certificates aren't changed. A write-ahead log entry is kept while
+they are, so that a rotation interrupted by Vault stopping before it completes
+is rolled back to the previous certificates once Vault is running again.
+`
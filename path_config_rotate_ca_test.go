@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+)
+
+func TestRotateIdentityCA(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	previousCerts, err := certificates.Generate("instance-id", "org-id", "space-id", "app-id", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { previousCerts.Close() })
+	newCerts, err := certificates.Generate("instance-id", "org-id", "space-id", "app-id", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { newCerts.Close() })
+
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	rotate := func(t *testing.T, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/rotate-identity-ca",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectCACerts := func(t *testing.T, expected ...string) {
+		t.Helper()
+		config, err := getConfig(ctx, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Fields trim their values.
+		if !slices.EqualFunc(config.IdentityCACertificates, expected, func(a, b string) bool {
+			return strings.TrimSpace(a) == strings.TrimSpace(b)
+		}) {
+			t.Fatalf("expected %d CA certificates but received %d", len(expected), len(config.IdentityCACertificates))
+		}
+		wals, err := framework.ListWAL(ctx, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wals) != 0 {
+			t.Fatalf("expected no WAL entries to be left but received %v", wals)
+		}
+	}
+	setConfig := func(t *testing.T, caCerts ...string) {
+		t.Helper()
+		if err := storeConfig(ctx, storage, &models.Configuration{Version: 1, IdentityCACertificates: caCerts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		setConfig(t, previousCerts.CACertificate)
+		if resp := rotate(t, map[string]interface{}{
+			"identity_ca_certificates": []string{newCerts.CACertificate},
+			"verify_certificate":       newCerts.InstanceCertificate,
+		}); resp != nil {
+			t.Fatalf("expected the rotation to succeed but received %#v", resp)
+		}
+		expectCACerts(t, newCerts.CACertificate)
+	})
+
+	t.Run("keep previous", func(t *testing.T) {
+		setConfig(t, previousCerts.CACertificate)
+		if resp := rotate(t, map[string]interface{}{
+			"identity_ca_certificates": []string{newCerts.CACertificate},
+			"keep_previous":            true,
+		}); resp != nil {
+			t.Fatalf("expected the rotation to succeed but received %#v", resp)
+		}
+		expectCACerts(t, previousCerts.CACertificate, newCerts.CACertificate)
+	})
+
+	t.Run("failed verification", func(t *testing.T) {
+		setConfig(t, previousCerts.CACertificate)
+		resp := rotate(t, map[string]interface{}{
+			"identity_ca_certificates": []string{newCerts.CACertificate},
+			"verify_certificate":       previousCerts.InstanceCertificate,
+		})
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("expected a certificate from the previous CA to fail verification but received %#v", resp)
+		}
+		expectCACerts(t, previousCerts.CACertificate)
+		// It's verified before the rotation begins, so nothing is left to roll back.
+		if walIDs, err := framework.ListWAL(ctx, storage); err != nil || len(walIDs) != 0 {
+			t.Fatalf("expected no WAL entries but received %v, %v", walIDs, err)
+		}
+	})
+
+	t.Run("not a CA", func(t *testing.T) {
+		setConfig(t, previousCerts.CACertificate)
+		resp := rotate(t, map[string]interface{}{
+			"identity_ca_certificates": []string{newCerts.InstanceCertificate},
+		})
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("expected an instance certificate to be rejected as a CA but received %#v", resp)
+		}
+		expectCACerts(t, previousCerts.CACertificate)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		rollback := func(t *testing.T) {
+			t.Helper()
+			if _, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RollbackOperation,
+				Path:      "",
+				Storage:   storage,
+				Data:      map[string]interface{}{"immediate": true},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wal := &caRotationWAL{
+			PreviousIdentityCACertificates:   []string{previousCerts.CACertificate},
+			TransitionIdentityCACertificates: []string{previousCerts.CACertificate, newCerts.CACertificate},
+			FinalIdentityCACertificates:      []string{newCerts.CACertificate},
+		}
+
+		// Interrupted before the final CA certificates were stored.
+		setConfig(t, wal.TransitionIdentityCACertificates...)
+		if _, err := framework.PutWAL(ctx, storage, walKindCARotation, wal); err != nil {
+			t.Fatal(err)
+		}
+		rollback(t)
+		expectCACerts(t, previousCerts.CACertificate)
+
+		// Interrupted after the rotation completed.
+		setConfig(t, newCerts.CACertificate)
+		if _, err := framework.PutWAL(ctx, storage, walKindCARotation, wal); err != nil {
+			t.Fatal(err)
+		}
+		rollback(t)
+		expectCACerts(t, newCerts.CACertificate)
+
+		// Interrupted after a rotation keeping the previous CA certificates completed,
+		// whose final certificates are the transition ones.
+		keptWAL := *wal
+		keptWAL.FinalIdentityCACertificates = wal.TransitionIdentityCACertificates
+		setConfig(t, wal.TransitionIdentityCACertificates...)
+		if _, err := framework.PutWAL(ctx, storage, walKindCARotation, &keptWAL); err != nil {
+			t.Fatal(err)
+		}
+		rollback(t)
+		expectCACerts(t, previousCerts.CACertificate, newCerts.CACertificate)
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathFlushCache() *framework.Path {
+	return &framework.Path{
+		Pattern: "flush-cache",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationFlushCacheUpdate,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb:   "flush",
+					OperationSuffix: "cache",
+				},
+			},
+		},
+		HelpSynopsis:    pathFlushCacheSyn,
+		HelpDescription: pathFlushCacheDesc,
+	}
+}
+
+func (b *backend) operationFlushCacheUpdate(_ context.Context, _ *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	b.flushCaches()
+	b.Logger().Info("flushed the CF client and the name and validation caches")
+	return nil, nil
+}
+
+// flushCaches empties the name and validation caches, and marks the CF client to be
+// rebuilt the next time it's needed, so that what's next looked up is fresh from the
+// CF API and UAA.
+func (b *backend) flushCaches() {
+	b.cfClientMu.Lock()
+	defer b.cfClientMu.Unlock()
+	b.nameCache.purge()
+	b.validationCache.purge()
+	if b.cfClient != nil {
+		b.cfClientTainted = true
+	}
+}
+
+const pathFlushCacheSyn = `
+Flush the CF client and the caches of CF API lookups.
+`
+
+const pathFlushCacheDesc = `
+Logins cache the app, space, and org they look up in the CF API, and whether
+they passed the role's checks, for as long as "name_cache_ttl" and
+"validation_cache_ttl" allow. They also reuse the CF client, along with its UAA
+token and connections. Writing to this path empties the caches and rebuilds the
+client when it's next used, so that logins see the CF API's current state, for
+instance after platform maintenance. Only the node that handles the request is
+flushed. Signatures that have been used to log in are still remembered.
+`
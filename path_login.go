@@ -5,12 +5,16 @@ package cf
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/cloudfoundry-community/go-cfclient"
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
 	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/cidrutil"
@@ -31,13 +35,12 @@ func (b *backend) pathLogin() *framework.Path {
 		},
 		Fields: map[string]*framework.FieldSchema{
 			"role": {
-				Required: true,
-				Type:     framework.TypeString,
+				Type: framework.TypeString,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name:  "Role Name",
 					Value: "internally-defined-role",
 				},
-				Description: "The name of the role to authenticate against.",
+				Description: "The name of the role to authenticate against. If unset, the configured default role is used.",
 			},
 			"cf_instance_cert": {
 				Required: true,
@@ -47,6 +50,16 @@ func (b *backend) pathLogin() *framework.Path {
 				},
 				Description: "The full body of the file available at the CF_INSTANCE_CERT path on the CF instance.",
 			},
+			"encoding": {
+				Type:    framework.TypeString,
+				Default: util.CertEncodingAuto,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CF_INSTANCE_CERT Encoding",
+				},
+				AllowedValues: []interface{}{util.CertEncodingAuto, util.CertEncodingPEM, util.CertEncodingBase64},
+				Description: `The encoding of "cf_instance_cert", "pem" or "base64". If "auto", base64 encoded
+contents are decoded. The signature signs the decoded PEM contents.`,
+			},
 			"signing_time": {
 				Required: true,
 				Type:     framework.TypeString,
@@ -54,7 +67,8 @@ func (b *backend) pathLogin() *framework.Path {
 					Name:  "Signing Time",
 					Value: "2006-01-02T15:04:05Z",
 				},
-				Description: "The date and time used to construct the signature.",
+				Description: `The date and time used to construct the signature, as "2006-01-02T15:04:05Z",
+RFC 3339 with an optional fractional second, or Unix epoch seconds.`,
 			},
 			"signature": {
 				Required: true,
@@ -62,15 +76,31 @@ func (b *backend) pathLogin() *framework.Path {
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name: "Signature",
 				},
-				Description: "The signature generated by the client certificate's private key.",
+				Description: "The signature generated by the client certificate's private key, in the v1 or v2 format.",
+			},
+			"nonce": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Nonce",
+				},
+				Description: `The nonce issued by the "login/challenge" endpoint that the signature includes, if any.
+If set, the signing time isn't checked against the time the request is received.`,
+			},
+			"include_cf_metadata": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Include CF Metadata",
+				},
+				Description: `If true, the response's data includes the instance's org, space, and app IDs and names,
+and when its instance identity certificate expires.`,
 			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
-				Callback: b.operationLoginUpdate,
+				Callback: b.withLoginActivity("login", b.operationLoginUpdate, claimedCertificateAppID),
 			},
 			logical.ResolveRoleOperation: &framework.PathOperation{
-				Callback: b.resolveRole,
+				Callback: b.resolveRole(claimedCertificate),
 			},
 		},
 		HelpSynopsis:    pathLoginSyn,
@@ -78,22 +108,67 @@ func (b *backend) pathLogin() *framework.Path {
 	}
 }
 
-// resolveRole resolves the role that will be used from this login request.
-func (b *backend) resolveRole(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	roleName := data.Get("role").(string)
-	if roleName == "" {
-		return logical.ErrorResponse("role is required"), nil
+// resolveRole returns the callback resolving the role that will be used from a login
+// request. The claimedIdentity function returns the identity the request claims,
+// without verifying it, so that requests that can't meet the role's bound constraints
+// aren't resolved to it, and can't be counted against it by quotas.
+func (b *backend) resolveRole(claimedIdentity func(*models.Configuration, *framework.FieldData) (*models.CFCertificate, error)) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		roleName, err := b.loginRoleName(ctx, req.Storage, data)
+		if err != nil {
+			return nil, err
+		}
+		if roleName == "" {
+			return logical.ErrorResponse("role is required"), nil
+		}
+
+		role, err := getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid role name %q", roleName)), nil
+		}
+
+		// Ensure the claimed identity meets the role's constraints.
+		if hasBoundConstraints(role) {
+			b.mu.RLock()
+			config, err := getConfig(ctx, req.Storage)
+			b.mu.RUnlock()
+			if err != nil {
+				return nil, err
+			}
+			if config == nil {
+				config = &models.Configuration{}
+			}
+			cfCert, err := claimedIdentity(config, data)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			if err := validateBoundConstraints(role, cfCert); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+		return logical.ResolveRoleResponse(roleName)
 	}
+}
 
-	// Ensure the cf certificate meets the role's constraints.
-	role, err := getRole(ctx, req.Storage, roleName)
+// loginRoleName returns the role named by the login request, or the configured
+// default role if it doesn't name one.
+func (b *backend) loginRoleName(ctx context.Context, storage logical.Storage, data *framework.FieldData) (string, error) {
+	if roleName := data.Get("role").(string); roleName != "" {
+		return roleName, nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, storage)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if role == nil {
-		return logical.ErrorResponse(fmt.Sprintf("invalid role name %q", roleName)), nil
+	if config == nil {
+		return "", nil
 	}
-	return logical.ResolveRoleResponse(roleName)
+	return config.DefaultRole, nil
 }
 
 // operationLoginUpdate is called by those wanting to gain access to Vault.
@@ -105,9 +180,12 @@ func (b *backend) operationLoginUpdate(ctx context.Context, req *logical.Request
 	// Grab the time immediately for checking against the request's signingTime.
 	timeReceived := time.Now().UTC()
 
-	roleName := data.Get("role").(string)
+	roleName, err := b.loginRoleName(ctx, req.Storage, data)
+	if err != nil {
+		return nil, err
+	}
 	if roleName == "" {
-		return logical.ErrorResponse("'role-name' is required"), nil
+		return loginErrorResponse(errCodeInvalidRequest, "'role-name' is required"), nil
 	}
 
 	// Ensure the cf certificate meets the role's constraints.
@@ -116,7 +194,7 @@ func (b *backend) operationLoginUpdate(ctx context.Context, req *logical.Request
 		return nil, err
 	}
 	if role == nil {
-		return nil, errors.New("no matching role")
+		return loginErrorResponse(errCodeRoleNotFound, "no matching role"), nil
 	}
 
 	if len(role.TokenBoundCIDRs) > 0 {
@@ -131,21 +209,21 @@ func (b *backend) operationLoginUpdate(ctx context.Context, req *logical.Request
 
 	signature := data.Get("signature").(string)
 	if signature == "" {
-		return logical.ErrorResponse("'signature' is required"), nil
+		return loginErrorResponse(errCodeInvalidRequest, "'signature' is required"), nil
 	}
 
-	cfInstanceCertContents := data.Get("cf_instance_cert").(string)
-	if cfInstanceCertContents == "" {
-		return logical.ErrorResponse("'cf_instance_cert' is required"), nil
+	cfInstanceCertContents, err := instanceCertContents(data)
+	if err != nil {
+		return loginErrorResponse(errCodeInvalidRequest, err.Error()), nil
 	}
 
 	signingTimeRaw := data.Get("signing_time").(string)
 	if signingTimeRaw == "" {
-		return logical.ErrorResponse("'signing_time' is required"), nil
+		return loginErrorResponse(errCodeInvalidRequest, "'signing_time' is required"), nil
 	}
 	signingTime, err := parseTime(signingTimeRaw)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return loginErrorResponse(errCodeInvalidRequest, err.Error()), nil
 	}
 
 	b.mu.RLock()
@@ -155,106 +233,349 @@ func (b *backend) operationLoginUpdate(ctx context.Context, req *logical.Request
 		return nil, err
 	}
 	if config == nil {
-		return nil, errors.New("no CA is configured for verifying client certificates")
+		return loginErrorResponse(errCodeNotConfigured, "no CA is configured for verifying client certificates"), nil
+	}
+	if !sourceAllowed(config, req) {
+		return loginErrorResponse(errCodeSourceNotAllowed, fmt.Sprintf("IP address %q isn't within the mount's allowed source CIDRs", clientRemoteAddr(config, req))), nil
 	}
 
-	// Ensure the time it was signed isn't too far in the past or future.
-	oldestAllowableSigningTime := timeReceived.Add(-1 * config.LoginMaxSecNotBefore)
-	furthestFutureAllowableSigningTime := timeReceived.Add(config.LoginMaxSecNotAfter)
-	if signingTime.Before(oldestAllowableSigningTime) {
-		return logical.ErrorResponse(fmt.Sprintf("request is too old; signed at %s but received request at %s; allowable seconds old is %d", signingTime, timeReceived, config.LoginMaxSecNotBefore/time.Second)), nil
+	maxSecNotBefore, maxSecNotAfter := signingTimeWindow(config, role)
+	verifier := &signatures.Verifier{
+		Options:   signatures.VerifyOptions{FIPS: config.EnforceFIPSSignatures},
+		MaxAge:    maxSecNotBefore,
+		MaxFuture: maxSecNotAfter,
+		Now:       func() time.Time { return timeReceived },
 	}
-	if signingTime.After(furthestFutureAllowableSigningTime) {
-		return logical.ErrorResponse(fmt.Sprintf("request is too far in the future; signed at %s but received request at %s; allowable seconds in the future is %d", signingTime, timeReceived, config.LoginMaxSecNotAfter/time.Second)), nil
+
+	// A signature is accepted, and so remembered, until its nonce expires, if it signs
+	// one, or until its signing time is too old.
+	var signatureExpiry time.Time
+	nonce := data.Get("nonce").(string)
+	if nonce != "" {
+		key, err := loginChallengeKey(ctx, req.Storage, false)
+		if err != nil {
+			return nil, err
+		}
+		if signatureExpiry, err = parseLoginChallengeNonce(key, nonce, timeReceived); err != nil {
+			return loginErrorResponse(errCodeInvalidChallenge, err.Error()), nil
+		}
+	} else if config.RequireLoginChallenge {
+		return loginErrorResponse(errCodeChallengeRequired, "this mount requires logins to sign a nonce from the login/challenge endpoint"), nil
+	} else {
+		// Ensure the time it was signed isn't too far in the past or future.
+		if err := verifier.CheckSigningTime(signingTime); err != nil {
+			return loginErrorResponse(errCodeSigningTimeSkew, err.Error()), nil
+		}
+		signatureExpiry = signingTime.Add(maxSecNotBefore + time.Second)
 	}
 
-	intermediateCert, identityCert, err := util.ExtractCertificates(cfInstanceCertContents)
+	parsedSignature, err := signatures.Parse(signature)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return loginErrorResponse(errCodeInvalidSignature, err.Error()), nil
+	}
+	if requiredHash := loginSignatureHash(config); parsedSignature.Hash != requiredHash {
+		return loginErrorResponse(errCodeSignatureHashMismatch, fmt.Sprintf("signature uses the %q hash, but this mount requires v2 signatures using the %q hash", parsedSignature.Hash, requiredHash)), nil
+	}
+
+	intermediateCerts, identityCert, err := util.ExtractCertificates(cfInstanceCertContents)
+	if err != nil {
+		return loginErrorResponse(errCodeInvalidCertificate, err.Error()), nil
 	}
 
 	// Ensure the private key used to create the signature matches our identity
 	// certificate, and that it signed the same data as is presented in the body.
 	// This offers some protection against MITM attacks.
-	signingCert, err := signatures.Verify(signature, &signatures.SignatureData{
+	// The signature covers the role as it was sent, which is empty when the default
+	// role is used.
+	signatureData := &signatures.SignatureData{
 		SigningTime:            signingTime,
-		Role:                   roleName,
+		Role:                   data.Get("role").(string),
 		CFInstanceCertContents: cfInstanceCertContents,
-	})
+		Nonce:                  nonce,
+	}
+	if config.LoginAudienceVaultAddress != "" {
+		// Ensure the signature was meant for this cluster and mount.
+		signatureData.Audience = &signatures.Audience{
+			VaultAddress:  config.LoginAudienceVaultAddress,
+			MountAccessor: req.MountAccessor,
+		}
+	}
+	signingCert, err := verifier.Verify(ctx, signature, signatureData)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if errors.Is(err, signatures.ErrNotFIPSApproved) {
+			return loginErrorResponse(errCodeSignatureNotFIPSApproved, err.Error()), nil
+		}
+		if errors.Is(err, signatures.ErrAudienceMismatch) {
+			return loginErrorResponse(errCodeSignatureAudienceMismatch, fmt.Sprintf("signature must be bound to Vault address %q and mount accessor %q",
+				signatureData.Audience.VaultAddress, signatureData.Audience.MountAccessor)), nil
+		}
+		return loginErrorResponse(errCodeInvalidSignature, err.Error()), nil
 	}
 	// Make sure the identity/signing cert was actually issued by our CA.
-	if err := util.Validate(config.IdentityCACertificates, intermediateCert, identityCert, signingCert); err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+	chain, err := util.VerifiedChain(config.AllIdentityCACertificates(), intermediateCerts, identityCert, signingCert)
+	if err != nil {
+		return loginErrorResponse(errCodeUntrustedCertificate, err.Error()), nil
+	}
+	if config.EnforceIdentityCertKeyUsage {
+		if err := util.ValidateKeyUsage(intermediateCerts, identityCert); err != nil {
+			return loginErrorResponse(errCodeCertificateKeyUsage, err.Error()), nil
+		}
+	}
+
+	// Make sure this login request hasn't been used before. It's remembered by what was
+	// signed and which certificate signed it, rather than by its signature, since an
+	// ECDSA signature can be altered into a different one that's just as valid.
+	if b.seenSignatures.add(signedRequestKey(signingCert, signatureData), signatureExpiry, timeReceived) {
+		return loginErrorResponse(errCodeSignatureReused, "signature has already been used to log in, please sign a new request"), nil
+	}
+	if nonce != "" && b.usedNonces.add([]byte(nonce), signatureExpiry, timeReceived) {
+		return loginErrorResponse(errCodeChallengeReused, "nonce has already been used to log in, please request a new challenge"), nil
 	}
 
 	// Read CF's identity fields from the certificate.
-	cfCert, err := models.NewCFCertificateFromx509(signingCert)
+	cfCert, err := models.NewCFCertificateFromx509WithFieldSources(signingCert, config.IdentityCertFieldSources)
 	if err != nil {
-		return nil, err
+		return loginErrorResponse(errCodeInvalidCertificate, err.Error()), nil
 	}
 
 	// It may help some users to be able to easily view the incoming certificate information
 	// in an un-encoded format, as opposed to the encoded format that will appear in the Vault
 	// audit logs.
-	if b.Logger().IsDebug() {
-		b.Logger().Debug(fmt.Sprintf("handling login attempt from %+v", cfCert))
-	}
+	b.logLoginAttempt(config, "handling login attempt", cfCert)
 
-	client, err := b.getCFClientOrRefresh(ctx, config)
+	if err := checkNotDenied(config, cfCert); err != nil {
+		return loginErrorResponseFromErr(err, errCodeInternal), nil
+	}
+	if err := checkNotRevoked(ctx, req.Storage, cfCert); err != nil {
+		return loginErrorResponseFromErr(err, errCodeInternal), nil
+	}
+	cfResources, err := b.validate(ctx, config, role, cfCert, clientRemoteAddr(config, req))
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return loginFailure(err, errCodeInternal)
 	}
-
-	if err := b.validate(client, role, cfCert, req.Connection.RemoteAddr); err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+	cfResources, err = b.withInstanceDetails(ctx, config, role, cfCert, cfResources)
+	if err != nil {
+		return loginFailure(err, errCodeInternal)
 	}
+	b.trackLogin(ctx, req.Storage, config, cfCert.AppID, timeReceived)
+	b.annotateLoginInBackground(ctx, config, cfResources, roleName, cfCert.InstanceID, req.MountAccessor)
 
-	orgName, err := b.getOrgName(client, cfCert)
+	// Everything checks out. The certificates are kept so renewals can verify them again.
+	auth, err := newAuth(roleName, role, cfCert, cfResources, identityCert.NotAfter, displayNameTemplate(config, role))
 	if err != nil {
+		return loginErrorResponse(errCodePolicyTemplate, err.Error()), nil
+	}
+	if err := addMappedPolicies(ctx, req.Storage, auth, cfCert); err != nil {
 		return nil, err
 	}
-
-	appName, err := b.getAppName(client, cfCert)
-	if err != nil {
+	if err := applyTTLCaps(ctx, req.Storage, auth, cfCert); err != nil {
 		return nil, err
 	}
+	if role.SingleActiveToken {
+		if err := recordActiveToken(ctx, req.Storage, roleName, cfCert.InstanceID, auth, timeReceived); err != nil {
+			return nil, err
+		}
+	}
+	auth.InternalData["cf_instance_cert"] = cfInstanceCertContents
+	resp := &logical.Response{
+		Auth: auth,
+	}
+	if data.Get("include_cf_metadata").(bool) {
+		resp.Data = cfLoginData(role, cfCert, cfResources, identityCert.NotAfter)
+	}
+	for _, warning := range expiryWarnings(config, chain, timeReceived) {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
 
-	spaceName, err := b.getSpaceName(client, cfCert)
-	if err != nil {
-		return nil, err
+// expiryWarnings returns warnings about the certificates in the verified chain that
+// expire within the configured windows, so that apps and operators hear of it before
+// logins start failing.
+func expiryWarnings(config *models.Configuration, chain []*x509.Certificate, now time.Time) []string {
+	var warnings []string
+	for i, cert := range chain {
+		window, kind := config.IdentityCAExpiryWarning, "identity CA certificate"
+		if i == 0 {
+			window, kind = config.IdentityCertExpiryWarning, "instance identity certificate"
+		}
+		if window <= 0 || cert.NotAfter.Sub(now) > window {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("the %s %q expires at %s, in %s", kind, cert.Subject,
+			cert.NotAfter.UTC().Format(time.RFC3339), cert.NotAfter.Sub(now).Round(time.Second)))
 	}
+	return warnings
+}
 
-	// Everything checks out.
+// aliasMetadataFields are the fields that may be written to the alias metadata, and to
+// the token's metadata.
+var aliasMetadataFields = []string{"org_id", "app_id", "space_id", "org_name", "app_name", "space_name", "instance_index", "process_type", "spiffe_id"}
+
+// newAuth returns the auth for a successful login to the role by the given instance,
+// whose identity certificate or JWT expires at identityExpiry.
+func newAuth(roleName string, role *models.RoleEntry, cfCert *models.CFCertificate, cfResources *cfResources, identityExpiry time.Time, displayNameTemplate string) (*logical.Auth, error) {
+	now := time.Now().UTC()
 	auth := &logical.Auth{
 		InternalData: map[string]interface{}{
-			"role":        roleName,
-			"instance_id": cfCert.InstanceID,
-			"ip_address":  cfCert.IPAddress,
+			"role":            roleName,
+			"instance_id":     cfCert.InstanceID,
+			"ip_address":      cfCert.IPAddress,
+			"org_id":          cfCert.OrgID,
+			"app_id":          cfCert.AppID,
+			"space_id":        cfCert.SpaceID,
+			"last_validated":  now.Format(time.RFC3339Nano),
+			"identity_expiry": identityExpiry.UTC().Format(time.RFC3339Nano),
 		},
-		DisplayName: cfCert.InstanceID,
 		Alias: &logical.Alias{
 			Name: cfCert.AppID,
-			Metadata: map[string]string{
-				"org_id":     cfCert.OrgID,
-				"app_id":     cfCert.AppID,
-				"space_id":   cfCert.SpaceID,
-				"org_name":   orgName,
-				"app_name":   appName,
-				"space_name": spaceName,
-			},
 		},
 	}
-
+	metadata := map[string]string{
+		"org_id":   cfCert.OrgID,
+		"app_id":   cfCert.AppID,
+		"space_id": cfCert.SpaceID,
+	}
+	// The names are known when the CF API was checked, or when the certificate carries them.
+	// Roles that don't resolve them only use the certificate's.
+	namedResources := cfResources
+	if role.DisableNameResolution {
+		namedResources = cfResources.withoutNames()
+	}
+	for field, value := range resourceNames(cfCert, namedResources) {
+		metadata[field] = value
+	}
+	if cfCert.SPIFFEID != "" {
+		metadata["spiffe_id"] = cfCert.SPIFFEID
+	}
+	if cfResources.instance != nil {
+		metadata["instance_index"] = strconv.Itoa(cfResources.instance.index)
+		metadata["process_type"] = cfResources.instance.processType
+	}
+	// The token's metadata and display name are written to audit logs, so that tokens can
+	// be attributed to the workloads they were issued to.
+	auth.DisplayName = renderDisplayName(displayNameTemplate, cfCert, metadata)
+	auth.Metadata = selectMetadata(metadata, role.AuthMetadata)
+	auth.Alias.Metadata = selectMetadata(metadata, role.AliasMetadata)
+	for key, value := range role.StaticAliasMetadata {
+		auth.Alias.Metadata[key] = value
+	}
+	if cfResources.app != nil && cfResources.app.Metadata != nil {
+		customMetadata := make(map[string]string)
+		copyCFMetadata(customMetadata, cfResources.app.Metadata.Labels, role.AliasCustomMetadataLabels)
+		copyCFMetadata(customMetadata, cfResources.app.Metadata.Annotations, role.AliasCustomMetadataAnnotations)
+		if len(customMetadata) > 0 {
+			auth.Alias.CustomMetadata = customMetadata
+		}
+	}
 	role.PopulateTokenAuth(auth)
+	policies, err := renderPolicies(auth.Policies, cfCert, namedResources)
+	if err != nil {
+		return nil, err
+	}
+	auth.Policies = policies
+	if role.CapTTLAtIdentityExpiry {
+		capMaxTTL(auth, identityExpiry, now)
+	}
+	return auth, nil
+}
 
-	return &logical.Response{
-		Auth: auth,
-	}, nil
+// cfLoginData returns the instance's CF context, for logins that ask for it in the
+// response's data, so that apps can learn their org, space, and app names without
+// querying the CF API themselves. Names are only included when they're known.
+func cfLoginData(role *models.RoleEntry, cfCert *models.CFCertificate, cfResources *cfResources, identityExpiry time.Time) map[string]interface{} {
+	namedResources := cfResources
+	if role.DisableNameResolution {
+		namedResources = cfResources.withoutNames()
+	}
+	data := map[string]interface{}{
+		"instance_id":     cfCert.InstanceID,
+		"org_id":          cfCert.OrgID,
+		"space_id":        cfCert.SpaceID,
+		"app_id":          cfCert.AppID,
+		"identity_expiry": identityExpiry.UTC().Format(time.RFC3339),
+	}
+	for field, name := range resourceNames(cfCert, namedResources) {
+		data[field] = name
+	}
+	return data
+}
+
+// refreshAliasNames updates the org, space, and app names in the auth's alias metadata
+// to the ones the CF API was just checked for, leaving its other metadata as it was
+// issued.
+func refreshAliasNames(auth *logical.Auth, role *models.RoleEntry, cfCert *models.CFCertificate, cfResources *cfResources) {
+	if auth.Alias == nil {
+		return
+	}
+	if auth.Alias.Metadata == nil {
+		auth.Alias.Metadata = make(map[string]string)
+	}
+	for field, name := range selectMetadata(resourceNames(cfCert, cfResources), role.AliasMetadata) {
+		auth.Alias.Metadata[field] = name
+	}
+}
+
+// selectMetadata returns the metadata with only the given fields, or all of it if no fields
+// are given.
+func selectMetadata(metadata map[string]string, fields []string) map[string]string {
+	selected := make(map[string]string, len(metadata))
+	for field, value := range metadata {
+		if len(fields) == 0 || strutil.StrListContains(fields, field) {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+// resourceNames returns the org, space, and app names that are known for the instance,
+// from the CF API if it was checked, or else from the certificate.
+func resourceNames(cfCert *models.CFCertificate, cfResources *cfResources) map[string]string {
+	names := make(map[string]string)
+	for field, name := range map[string]string{
+		"org_name":   cfCert.OrgName,
+		"space_name": cfCert.SpaceName,
+		"app_name":   cfCert.AppName,
+	} {
+		if name != "" {
+			names[field] = name
+		}
+	}
+	if cfResources.org != nil {
+		names["org_name"] = cfResources.org.Name
+	}
+	if cfResources.space != nil {
+		names["space_name"] = cfResources.space.Name
+	}
+	if cfResources.app != nil {
+		names["app_name"] = cfResources.app.Name
+	}
+	return names
+}
+
+// copyCFMetadata copies the CF labels or annotations with the given keys that are set.
+func copyCFMetadata(to map[string]string, from map[string]*string, keys []string) {
+	for _, key := range keys {
+		if value := from[key]; value != nil {
+			to[key] = *value
+		}
+	}
+}
+
+// capMaxTTL lowers the auth's max TTL, which is relative to the token's issue
+// time, so that the token expires no later than expiry.
+func capMaxTTL(auth *logical.Auth, expiry, issueTime time.Time) {
+	maxTTL := expiry.Sub(issueTime)
+	if auth.MaxTTL == 0 || auth.MaxTTL > maxTTL {
+		auth.MaxTTL = maxTTL
+	}
 }
 
 func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ctx = withRequestInfo(ctx, req)
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	config, err := getConfig(ctx, req.Storage)
@@ -278,138 +599,636 @@ func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, data
 		return nil, errors.New("no matching role")
 	}
 
-	instanceID, err := getOrErr("instance_id", req.Auth.InternalData)
+	var cfCert *models.CFCertificate
+	if cfInstanceCertContents, ok := req.Auth.InternalData["cf_instance_cert"].(string); ok {
+		// Make sure the certificate the token was issued for hasn't expired, and
+		// still chains to one of the configured CAs.
+		intermediateCerts, identityCert, err := util.ExtractCertificates(cfInstanceCertContents)
+		if err != nil {
+			return nil, err
+		}
+		if err := util.Validate(config.AllIdentityCACertificates(), intermediateCerts, identityCert, identityCert); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("the instance identity certificate is no longer valid: %s", err)), nil
+		}
+		if config.EnforceIdentityCertKeyUsage {
+			if err := util.ValidateKeyUsage(intermediateCerts, identityCert); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("the instance identity certificate is no longer valid: %s", err)), nil
+			}
+		}
+		if cfCert, err = models.NewCFCertificateFromx509WithFieldSources(identityCert, config.IdentityCertFieldSources); err != nil {
+			return nil, err
+		}
+	} else {
+		// Tokens issued with a JWT, or before the certificates were kept, only have
+		// the certificate's fields.
+		if cfCert, err = getCFCertificate(req.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	// The app may have been revoked, or found deleted, since the CF API was last checked.
+	if err := checkNotDenied(config, cfCert); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := checkNotRevoked(ctx, req.Storage, cfCert); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.SingleActiveToken {
+		active, err := isActiveToken(ctx, req.Storage, roleName, cfCert.InstanceID, req.Auth)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return logical.ErrorResponse(fmt.Sprintf("instance %s has been issued a newer token by role %q, and only it can be renewed", cfCert.InstanceID, roleName)), nil
+		}
+	}
+
+	resp := &logical.Response{Auth: req.Auth}
+	now := time.Now().UTC()
+	renewals := getRenewalsSinceValidation(req.Auth.InternalData)
+	if !needsRevalidation(role, req.Auth.InternalData, renewals, now) {
+		// The CF API was checked recently enough for this role, so only its constraints are checked.
+		if err := validateConstraints(role, cfCert, clientRemoteAddr(config, req)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		resp.Auth.InternalData["renewals_since_validation"] = renewals + 1
+	} else if cfResources, err := b.validate(ctx, config, role, cfCert, clientRemoteAddr(config, req)); err != nil {
+		// taint the client on error so that it will be refreshed on the next login attempt
+		b.taintCFClient()
+
+		// If the CF API is down, a token that was recently validated can still be renewed.
+		lastValidated, ok := getLastValidated(req.Auth.InternalData)
+		inGracePeriod := ok && now.Before(lastValidated.Add(config.RenewalGracePeriod))
+		cfAPIUnavailable := errors.Is(err, errCFAPIUnavailable) || errors.Is(err, errCFAPIRateLimited)
+		if !cfAPIUnavailable || !inGracePeriod {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		b.Logger().Warn("renewing token without checking the CF API", "instance_id", cfCert.InstanceID, "last_validated", lastValidated, "error", err)
+		resp.AddWarning(fmt.Sprintf("the CF API couldn't be reached, so the token was renewed based on its last successful validation at %s: %s",
+			lastValidated.Format(time.RFC3339), err))
+	} else {
+		resp.Auth.InternalData["last_validated"] = now.Format(time.RFC3339Nano)
+		resp.Auth.InternalData["renewals_since_validation"] = 0
+		if role.RefreshAliasMetadata {
+			refreshAliasNames(resp.Auth, role, cfCert, cfResources)
+		}
+	}
+
+	resp.Auth.TTL = role.TokenTTL
+	resp.Auth.MaxTTL = role.TokenMaxTTL
+	resp.Auth.Period = role.TokenPeriod
+	if err := applyTTLCaps(ctx, req.Storage, resp.Auth, cfCert); err != nil {
+		return nil, err
+	}
+	if role.CapTTLAtIdentityExpiry {
+		// Tokens issued before the expiry was recorded aren't capped.
+		if identityExpiry, ok := getTimeData(req.Auth.InternalData, "identity_expiry"); ok {
+			if !now.Before(identityExpiry) {
+				return logical.ErrorResponse(fmt.Sprintf("the instance identity expired at %s", identityExpiry.Format(time.RFC3339))), nil
+			}
+			capMaxTTL(resp.Auth, identityExpiry, req.Auth.IssueTime)
+		}
+	}
+	return resp, nil
+}
+
+// getCFCertificate reconstructs the CF certificate that the auth was issued for from
+// its InternalData.
+func getCFCertificate(auth *logical.Auth) (*models.CFCertificate, error) {
+	instanceID, err := getOrErr("instance_id", auth.InternalData)
 	if err != nil {
 		return nil, err
 	}
 
-	ipAddr, err := getOrErr("ip_address", req.Auth.InternalData)
+	ipAddr, err := getOrErr("ip_address", auth.InternalData)
 	if err != nil {
 		return nil, err
 	}
 
-	orgID, err := getOrErr("org_id", req.Auth.Alias.Metadata)
+	orgID, err := getIdentityField("org_id", auth)
 	if err != nil {
 		return nil, err
 	}
 
-	spaceID, err := getOrErr("space_id", req.Auth.Alias.Metadata)
+	spaceID, err := getIdentityField("space_id", auth)
 	if err != nil {
 		return nil, err
 	}
 
-	appID, err := getOrErr("app_id", req.Auth.Alias.Metadata)
+	appID, err := getIdentityField("app_id", auth)
 	if err != nil {
 		return nil, err
 	}
 
-	// Reconstruct the certificate and ensure it still meets all constraints.
-	cfCert, err := models.NewCFCertificate(instanceID, orgID, spaceID, appID, ipAddr)
+	return models.NewCFCertificate(instanceID, orgID, spaceID, appID, ipAddr)
+}
 
+// validateConstraints ensures the given certificate meets the role's constraints, without
+// consulting the CF API.
+func validateConstraints(role *models.RoleEntry, cfCert *models.CFCertificate, reqConnRemoteAddr string) error {
+	if !role.DisableIPMatching {
+		if !matchesCertificateIPAddress(reqConnRemoteAddr, cfCert) {
+			return withErrorCode(errCodeIPAddressMismatch, errors.New("no matching IP address"))
+		}
+	}
+	return validateBoundConstraints(role, cfCert)
+}
+
+// hasBoundConstraints reports whether the role is bound to any instances, apps, orgs,
+// or spaces.
+func hasBoundConstraints(role *models.RoleEntry) bool {
+	return len(role.BoundInstanceIDs) > 0 || len(role.BoundAppIDs) > 0 || len(role.BoundOrgIDs) > 0 || len(role.BoundSpaceIDs) > 0 ||
+		len(role.BoundAppNames) > 0 || len(role.BoundOrgNames) > 0 || len(role.BoundSpaceNames) > 0 || len(role.BoundSPIFFEIDs) > 0
+}
+
+// validateBoundConstraints ensures the certificate's instance, app, org, and space
+// meet the role's bound constraints.
+func validateBoundConstraints(role *models.RoleEntry, cfCert *models.CFCertificate) error {
+	if !meetsBoundIDConstraints(cfCert.InstanceID, role.BoundInstanceIDs) {
+		return withErrorCode(errCodeBoundInstanceMismatch, fmt.Errorf("instance ID %s doesn't match role constraints of %s", cfCert.InstanceID, describeBoundIDs(role.BoundInstanceIDs)))
+	}
+	if !meetsBoundIDConstraints(cfCert.AppID, role.BoundAppIDs) {
+		return withErrorCode(errCodeBoundAppMismatch, fmt.Errorf("app ID %s doesn't match role constraints of %s", cfCert.AppID, describeBoundIDs(role.BoundAppIDs)))
+	}
+	if !meetsBoundIDConstraints(cfCert.OrgID, role.BoundOrgIDs) {
+		return withErrorCode(errCodeBoundOrgMismatch, fmt.Errorf("org ID %s doesn't match role constraints of %s", cfCert.OrgID, describeBoundIDs(role.BoundOrgIDs)))
+	}
+	if !meetsBoundIDConstraints(cfCert.SpaceID, role.BoundSpaceIDs) {
+		return withErrorCode(errCodeBoundSpaceMismatch, fmt.Errorf("space ID %s doesn't match role constraints of %s", cfCert.SpaceID, describeBoundIDs(role.BoundSpaceIDs)))
+	}
+	// The names are only checked against the certificate, so certificates that don't
+	// carry them can't meet the constraints.
+	if !meetsBoundConstraints(cfCert.AppName, role.BoundAppNames) {
+		return withErrorCode(errCodeBoundAppMismatch, fmt.Errorf("app name %q doesn't match role constraints of %s", cfCert.AppName, role.BoundAppNames))
+	}
+	if !meetsBoundConstraints(cfCert.OrgName, role.BoundOrgNames) {
+		return withErrorCode(errCodeBoundOrgMismatch, fmt.Errorf("org name %q doesn't match role constraints of %s", cfCert.OrgName, role.BoundOrgNames))
+	}
+	if !meetsBoundConstraints(cfCert.SpaceName, role.BoundSpaceNames) {
+		return withErrorCode(errCodeBoundSpaceMismatch, fmt.Errorf("space name %q doesn't match role constraints of %s", cfCert.SpaceName, role.BoundSpaceNames))
+	}
+	// Like the names, SPIFFE IDs are only carried by some certificates.
+	if !meetsBoundConstraints(cfCert.SPIFFEID, role.BoundSPIFFEIDs) {
+		return withErrorCode(errCodeBoundSPIFFEIDMismatch, fmt.Errorf("SPIFFE ID %q doesn't match role constraints of %s", cfCert.SPIFFEID, role.BoundSPIFFEIDs))
+	}
+	if !certificateIPAddressInCIDRs(cfCert, role.BoundCertIPCIDRs) {
+		return withErrorCode(errCodeBoundCertIPMismatch, fmt.Errorf("certificate's IP addresses %s don't match role constraints of %s", cfCert.AllIPAddresses(), role.BoundCertIPCIDRs))
+	}
+	return nil
+}
+
+// cfResources are the CF API objects backing the app, space, and org on a CF certificate.
+type cfResources struct {
+	app   *resource.App
+	space *resource.Space
+	org   *resource.Organization
+
+	// instance is only looked up for roles that include instance details, and is never
+	// cached.
+	instance *instanceDetails
+}
+
+// withoutNames returns the resources without the objects the names are resolved from.
+func (r *cfResources) withoutNames() *cfResources {
+	return &cfResources{instance: r.instance}
+}
+
+// validate ensures the given certificate meets the role's constraints, and that the app, space,
+// and org it describes exist in the CF API. The app, space and org are fetched together in a single
+// request and returned so callers can use them without making further API calls. For roles that
+// disable the CF API checks, only the role's constraints are checked and no resources are returned.
+func (b *backend) validate(ctx context.Context, config *models.Configuration, role *models.RoleEntry, cfCert *models.CFCertificate, reqConnRemoteAddr string) (*cfResources, error) {
+	if err := validateConstraints(role, cfCert, reqConnRemoteAddr); err != nil {
+		return nil, err
+	}
+	if role.DisableCFAPIChecks {
+		// The role trusts the identity CA's certificates on their own.
+		return &cfResources{}, nil
+	}
+	return b.validateWithCFAPI(ctx, config, role, cfCert)
+}
+
+// validateWithCFAPI ensures that the app, space, and org the given certificate describes
+// exist in the CF API, and returns them.
+func (b *backend) validateWithCFAPI(ctx context.Context, config *models.Configuration, role *models.RoleEntry, cfCert *models.CFCertificate) (*cfResources, error) {
+	// An app, space, and org that recently passed the checks below for a role with
+	// the same constraints don't need to be checked against the CF API again.
+	validationCache := b.getValidationCache()
+	validationCacheKey, err := getValidationCacheKey(role, cfCert)
+	if err != nil {
+		return nil, err
+	}
+	if resources, ok := validationCache.get(validationCacheKey); ok {
+		return resources, nil
+	}
+
+	// Use the CF API to ensure everything still exists and to verify whatever we can.
 	client, err := b.getCFClientOrRefresh(ctx, config)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return nil, withErrorCode(errCodeCFAPIUnavailable, cfAPIError(err))
 	}
 
-	if err := b.validate(client, role, cfCert, req.Connection.RemoteAddr); err != nil {
-		// taint the client on error so that it will be refreshed on the next login attempt
-		b.cfClientTainted = true
-		return logical.ErrorResponse(err.Error()), nil
+	// The instance ID is only reported in process stats by recent versions of CF's
+	// API, so it's checked along with the instance details, if the config verifies it.
+
+	// The org is only included with the app when the space is, so roles that don't
+	// check the space look the certificate's org up on its own.
+	checkSpace := !role.DisableSpaceAPICheck
+	checkOrg := !role.DisableOrgAPICheck
+	resources, err := b.getCFResources(ctx, client, cfCert.AppID, checkSpace, checkOrg && checkSpace)
+	if err != nil {
+		return nil, cfAPILookupError(err)
 	}
+	if checkOrg && !checkSpace {
+		var org *resource.Organization
+		err = b.callCFAPI("get_org", func() (err error) {
+			org, err = client.Organizations.Get(ctx, cfCert.OrgID)
+			return err
+		})
+		if err != nil {
+			return nil, cfAPILookupError(err)
+		}
+		resources = &cfResources{app: resources.app, org: org}
+	}
+	app, space, org := resources.app, resources.space, resources.org
 
-	resp := &logical.Response{Auth: req.Auth}
-	resp.Auth.TTL = role.TokenTTL
-	resp.Auth.MaxTTL = role.TokenMaxTTL
-	resp.Auth.Period = role.TokenPeriod
-	return resp, nil
-}
+	// Check everything we can using the app.
+	if app.GUID != cfCert.AppID {
+		return nil, withErrorCode(errCodeCFAPIMismatch, fmt.Errorf("cert app ID %s doesn't match API's expected one of %s", cfCert.AppID, app.GUID))
+	}
+	if appSpaceGUID := relationshipGUID(app.Relationships.Space); appSpaceGUID != cfCert.SpaceID {
+		return nil, withErrorCode(errCodeCFAPIMismatch, fmt.Errorf("cert space ID %s doesn't match API's expected one of %s", cfCert.SpaceID, appSpaceGUID))
+	}
+	if stack := app.Lifecycle.BuildpackData.Stack; !meetsBoundConstraints(stack, role.BoundStacks) {
+		return nil, withErrorCode(errCodeBoundStackMismatch, fmt.Errorf("app's stack %q doesn't match role constraints of %s", stack, role.BoundStacks))
+	}
+	if lifecycleType := app.Lifecycle.Type; !meetsBoundConstraints(lifecycleType, role.BoundLifecycleTypes) {
+		return nil, withErrorCode(errCodeBoundLifecycleMismatch, fmt.Errorf("app's lifecycle type %q doesn't match role constraints of %s", lifecycleType, role.BoundLifecycleTypes))
+	}
+	// The buildpacks and Docker image an app runs with are only known from its droplet.
+	checkDockerImage := len(role.BoundDockerImages) > 0 && app.Lifecycle.Type == lifecycleTypeDocker
+	checkDroplet := len(role.BoundCurrentDroplets) > 0 || role.RequireCurrentRevision
+	if len(role.BoundBuildpacks) > 0 || checkDockerImage || checkDroplet {
+		var droplet *resource.Droplet
+		err = b.callCFAPI("get_app_droplet", func() (err error) {
+			droplet, err = client.Droplets.GetCurrentForApp(ctx, cfCert.AppID)
+			return err
+		})
+		if err != nil {
+			return nil, cfAPILookupError(err)
+		}
+		if len(role.BoundBuildpacks) > 0 {
+			if err := validateBuildpacks(droplet, role.BoundBuildpacks); err != nil {
+				return nil, err
+			}
+		}
+		if checkDockerImage {
+			if err := validateDockerImage(droplet, role.BoundDockerImages); err != nil {
+				return nil, err
+			}
+		}
+		if !meetsBoundConstraints(droplet.GUID, role.BoundCurrentDroplets) {
+			return nil, withErrorCode(errCodeBoundDropletMismatch, fmt.Errorf("app's current droplet %s doesn't match role constraints of %s", droplet.GUID, role.BoundCurrentDroplets))
+		}
+		if role.RequireCurrentRevision {
+			var revisions []*resource.Revision
+			err = b.callCFAPI("list_app_deployed_revisions", func() (err error) {
+				revisions, err = client.Revisions.ListForAppDeployedAll(ctx, cfCert.AppID, nil)
+				return err
+			})
+			if err != nil {
+				return nil, cfAPILookupError(err)
+			}
+			if err := validateDeployedRevisions(revisions, droplet.GUID); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-func (b *backend) validate(client *cfclient.Client, role *models.RoleEntry, cfCert *models.CFCertificate, reqConnRemoteAddr string) error {
-	if !role.DisableIPMatching {
-		if !matchesIPAddress(reqConnRemoteAddr, net.ParseIP(cfCert.IPAddress)) {
-			return errors.New("no matching IP address")
+	if role.RequiredServiceInstance != "" {
+		var bound bool
+		err = b.callCFAPI("list_app_service_bindings", func() (err error) {
+			bound, err = isBoundToServiceInstance(ctx, client, cfCert.AppID, role.RequiredServiceInstance)
+			return err
+		})
+		if err != nil {
+			return nil, cfAPILookupError(err)
+		}
+		if !bound {
+			return nil, withErrorCode(errCodeServiceBindingRequired, fmt.Errorf("app isn't bound to the service instance %q that the role requires", role.RequiredServiceInstance))
 		}
 	}
-	if !meetsBoundConstraints(cfCert.InstanceID, role.BoundInstanceIDs) {
-		return fmt.Errorf("instance ID %s doesn't match role constraints of %s", cfCert.InstanceID, role.BoundInstanceIDs)
+
+	if role.RequireSSHDisabled {
+		var ssh *resource.AppSSHEnabled
+		err = b.callCFAPI("get_app_ssh_enabled", func() (err error) {
+			ssh, err = client.Applications.SSHEnabled(ctx, cfCert.AppID)
+			return err
+		})
+		if err != nil {
+			return nil, cfAPILookupError(err)
+		}
+		if ssh.Enabled {
+			return nil, withErrorCode(errCodeSSHEnabled, errors.New("app accepts SSH connections, which the role requires to be disabled"))
+		}
 	}
-	if !meetsBoundConstraints(cfCert.AppID, role.BoundAppIDs) {
-		return fmt.Errorf("app ID %s doesn't match role constraints of %s", cfCert.AppID, role.BoundAppIDs)
+
+	switch role.RequiredAppState {
+	case models.AppStateExists:
+	case models.AppStateStarted:
+		// Apps scaled to zero between scheduled runs are still STARTED.
+		if app.State != appStateStarted {
+			return nil, withErrorCode(errCodeAppNotStarted, fmt.Errorf("app's state is %s rather than %s", app.State, appStateStarted))
+		}
+	default:
+		if err := b.validateLiveInstances(ctx, client, cfCert.AppID, role.MinimumInstances); err != nil {
+			return nil, err
+		}
 	}
-	if !meetsBoundConstraints(cfCert.OrgID, role.BoundOrgIDs) {
-		return fmt.Errorf("org ID %s doesn't match role constraints of %s", cfCert.OrgID, role.BoundOrgIDs)
+
+	// Check everything we can using the org. Roles that don't resolve names still check
+	// it, and only leave its name out of the login.
+	if checkOrg && org != nil && org.GUID != cfCert.OrgID {
+		return nil, withErrorCode(errCodeCFAPIMismatch, fmt.Errorf("cert org ID %s doesn't match API's expected one of %s", cfCert.OrgID, org.GUID))
 	}
-	if !meetsBoundConstraints(cfCert.SpaceID, role.BoundSpaceIDs) {
-		return fmt.Errorf("space ID %s doesn't match role constraints of %s", cfCert.SpaceID, role.BoundSpaceIDs)
+
+	// Check everything we can using the space.
+	if checkSpace {
+		if space.GUID != cfCert.SpaceID {
+			return nil, withErrorCode(errCodeCFAPIMismatch, fmt.Errorf("cert space ID %s doesn't match API's expected one of %s", cfCert.SpaceID, space.GUID))
+		}
+		var spaceOrgGUID string
+		if space.Relationships != nil && space.Relationships.Organization != nil {
+			spaceOrgGUID = relationshipGUID(*space.Relationships.Organization)
+		}
+		if spaceOrgGUID != cfCert.OrgID {
+			return nil, withErrorCode(errCodeCFAPIMismatch, fmt.Errorf("cert org ID %s doesn't match API's expected one of %s", cfCert.OrgID, spaceOrgGUID))
+		}
 	}
-	// Use the CF API to ensure everything still exists and to verify whatever we can.
+	validationCache.add(validationCacheKey, resources)
+	return resources, nil
+}
 
-	// Here, if it were possible, we _would_ do an API call to check the instance ID,
-	// but currently there's no known way to do that via the cf API.
+// getLastValidated returns when a token was last validated, at login or renewal.
+func getLastValidated(internalData map[string]interface{}) (time.Time, bool) {
+	return getTimeData(internalData, "last_validated")
+}
 
-	// Check everything we can using the app ID.
-	app, err := client.AppByGuid(cfCert.AppID)
+// getTimeData returns the time stored under the key in a token's InternalData.
+func getTimeData(internalData map[string]interface{}, key string) (time.Time, bool) {
+	raw, ok := internalData[key].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
 	if err != nil {
-		return err
+		return time.Time{}, false
 	}
-	if app.Guid != cfCert.AppID {
-		return fmt.Errorf("cert app ID %s doesn't match API's expected one of %s", cfCert.AppID, app.Guid)
+	return t, true
+}
+
+// getRenewalsSinceValidation returns how many times a token has been renewed without
+// checking the CF API since it was last validated.
+func getRenewalsSinceValidation(internalData map[string]interface{}) int {
+	// InternalData is stored as JSON, so the number may come back as any of these.
+	switch renewals := internalData["renewals_since_validation"].(type) {
+	case int:
+		return renewals
+	case float64:
+		return int(renewals)
+	case json.Number:
+		n, _ := renewals.Int64()
+		return int(n)
+	default:
+		return 0
 	}
-	if app.SpaceGuid != cfCert.SpaceID {
-		return fmt.Errorf("cert space ID %s doesn't match API's expected one of %s", cfCert.SpaceID, app.SpaceGuid)
+}
+
+// needsRevalidation reports whether renewing a token for the role must check the CF
+// API again, given the role's revalidation cadence.
+func needsRevalidation(role *models.RoleEntry, internalData map[string]interface{}, renewalsSinceValidation int, now time.Time) bool {
+	if role.RevalidationInterval <= 0 && role.RevalidateEveryNRenewals <= 0 {
+		return true
 	}
-	if app.Instances <= 0 {
-		return errors.New("app doesn't have any live instances")
+	lastValidated, ok := getLastValidated(internalData)
+	if !ok {
+		return true
 	}
+	if role.RevalidationInterval > 0 && !now.Before(lastValidated.Add(role.RevalidationInterval)) {
+		return true
+	}
+	if role.RevalidateEveryNRenewals > 0 && renewalsSinceValidation+1 >= role.RevalidateEveryNRenewals {
+		return true
+	}
+	return false
+}
+
+// signingTimeWindow returns how old and how far in the future a signing time can be
+// for logins to the role, which may override the config's window.
+func signingTimeWindow(config *models.Configuration, role *models.RoleEntry) (notBefore, notAfter time.Duration) {
+	notBefore, notAfter = config.LoginMaxSecNotBefore, config.LoginMaxSecNotAfter
+	if role.LoginMaxSecNotBefore > 0 {
+		notBefore = role.LoginMaxSecNotBefore
+	}
+	if role.LoginMaxSecNotAfter > 0 {
+		notAfter = role.LoginMaxSecNotAfter
+	}
+	return notBefore, notAfter
+}
 
-	// Check everything we can using the org ID.
-	org, err := client.GetOrgByGuid(cfCert.OrgID)
+// loginSignatureHash returns the hash that login signatures must use.
+func loginSignatureHash(config *models.Configuration) string {
+	if config.LoginSignatureHash == "" {
+		return signatures.HashSHA256
+	}
+	return config.LoginSignatureHash
+}
+
+// getValidationCacheKey returns the key under which the result of validating the given
+// certificate's app, space, and org is cached. The key covers the role's constraints so
+// that changing them invalidates any results cached beforehand.
+func getValidationCacheKey(role *models.RoleEntry, cfCert *models.CFCertificate) (string, error) {
+	constraintsHash, err := role.ConstraintsHash()
 	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s/%x", cfCert.AppID, cfCert.SpaceID, cfCert.OrgID, constraintsHash), nil
+}
+
+// getCFResources fetches the app along with, if includeSpace is set, its parent space
+// and, if includeOrg is also set, its org, using the name cache when it holds an
+// unexpired entry for the app.
+func (b *backend) getCFResources(ctx context.Context, client *cfclient.Client, appGUID string, includeSpace, includeOrg bool) (*cfResources, error) {
+	nameCache := b.getNameCache()
+	if resources, ok := nameCache.get(appGUID); ok {
+		return resources, nil
+	}
+	cacheKey := appGUID
+	switch {
+	case !includeSpace:
+		cacheKey += "/app"
+	case !includeOrg:
+		cacheKey += "/space"
+	}
+	if resources, ok := nameCache.get(cacheKey); ok {
+		return resources, nil
+	}
+	var app *resource.App
+	var space *resource.Space
+	var org *resource.Organization
+	err := b.callCFAPI("get_app", func() (err error) {
+		if !includeSpace {
+			app, err = client.Applications.Get(ctx, appGUID)
+			return err
+		}
+		if !includeOrg {
+			app, space, err = client.Applications.GetIncludeSpace(ctx, appGUID)
+			return err
+		}
+		app, space, org, err = client.Applications.GetIncludeSpaceAndOrganization(ctx, appGUID)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if org.Guid != cfCert.OrgID {
-		return fmt.Errorf("cert org ID %s doesn't match API's expected one of %s", cfCert.OrgID, org.Guid)
+	resources := &cfResources{
+		app:   app,
+		space: space,
+		org:   org,
 	}
+	nameCache.add(cacheKey, resources)
+	return resources, nil
+}
 
-	// Check everything we can using the space ID.
-	space, err := client.GetSpaceByGuid(cfCert.SpaceID)
+// appInstances returns the total number of instances across all of an app's processes.
+func appInstances(ctx context.Context, client *cfclient.Client, appGUID string) (int, error) {
+	processes, err := client.Processes.ListForAppAll(ctx, appGUID, nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	instances := 0
+	for _, process := range processes {
+		instances += process.Instances
 	}
-	if space.Guid != cfCert.SpaceID {
-		return fmt.Errorf("cert space ID %s doesn't match API's expected one of %s", cfCert.SpaceID, space.Guid)
+	return instances, nil
+}
+
+// validateBuildpacks ensures the droplet was built with buildpacks, and only with those
+// the role is bound to.
+func validateBuildpacks(droplet *resource.Droplet, boundBuildpacks []string) error {
+	if len(droplet.Buildpacks) == 0 {
+		return withErrorCode(errCodeBoundBuildpackMismatch, fmt.Errorf("app's current droplet wasn't built with buildpacks, so it doesn't match role constraints of %s", boundBuildpacks))
 	}
-	if space.OrganizationGuid != cfCert.OrgID {
-		return fmt.Errorf("cert org ID %s doesn't match API's expected one of %s", cfCert.OrgID, space.OrganizationGuid)
+	for _, buildpack := range droplet.Buildpacks {
+		if !strutil.StrListContains(boundBuildpacks, buildpack.Name) {
+			return withErrorCode(errCodeBoundBuildpackMismatch, fmt.Errorf("app's buildpack %q doesn't match role constraints of %s", buildpack.Name, boundBuildpacks))
+		}
 	}
 	return nil
 }
 
-func (b *backend) getOrgName(client *cfclient.Client, cfCert *models.CFCertificate) (string, error) {
-	org, err := client.GetOrgByGuid(cfCert.OrgID)
-	if err != nil {
-		return "", err
+// validateDeployedRevisions ensures that each of the app's deployed revisions is of its
+// current droplet, so that no instances still run code the app has moved on from.
+func validateDeployedRevisions(revisions []*resource.Revision, currentDropletGUID string) error {
+	for _, revision := range revisions {
+		if revision.Droplet.GUID != currentDropletGUID {
+			return withErrorCode(errCodeStaleRevision, fmt.Errorf("app's deployed revision %d runs droplet %s rather than its current droplet %s", revision.Version, revision.Droplet.GUID, currentDropletGUID))
+		}
 	}
+	return nil
+}
+
+// lifecycleTypeDocker is the lifecycle type of apps that run a Docker image.
+const lifecycleTypeDocker = "docker"
 
-	return org.Name, nil
+// appStateStarted is the state of apps that are meant to be running.
+const appStateStarted = "STARTED"
+
+// validateDockerImage ensures the droplet runs a Docker image the role is bound to.
+func validateDockerImage(droplet *resource.Droplet, boundDockerImages []string) error {
+	var image string
+	if droplet.Image != nil {
+		image = *droplet.Image
+	}
+	if !strutil.StrListContainsGlob(boundDockerImages, image) {
+		return withErrorCode(errCodeBoundDockerImageMismatch, fmt.Errorf("app's Docker image %q doesn't match role constraints of %s", image, boundDockerImages))
+	}
+	return nil
 }
 
-func (b *backend) getAppName(client *cfclient.Client, cfCert *models.CFCertificate) (string, error) {
-	app, err := client.AppByGuid(cfCert.AppID)
+// validateLiveInstances returns an error unless the app has at least the minimum
+// number of live instances. An app that's only running tasks meets a minimum of one.
+func (b *backend) validateLiveInstances(ctx context.Context, client *cfclient.Client, appGUID string, minimum int) error {
+	if minimum <= 0 {
+		return nil
+	}
+	// The v3 API no longer reports instance counts on the app itself, they
+	// live on the app's processes instead.
+	var instances int
+	err := b.callCFAPI("list_app_processes", func() (err error) {
+		instances, err = appInstances(ctx, client, appGUID)
+		return err
+	})
 	if err != nil {
-		return "", err
+		return cfAPILookupError(err)
+	}
+	if instances >= minimum {
+		return nil
 	}
+	if minimum > 1 {
+		return withErrorCode(errCodeTooFewInstances, fmt.Errorf("app has %d live instances, fewer than the role's minimum of %d", instances, minimum))
+	}
+	// Tasks, such as migrations and batch jobs, run apart from the app's processes,
+	// so an app without any live instances may still be running them.
+	var tasks int
+	err = b.callCFAPI("list_app_tasks", func() (err error) {
+		tasks, err = runningTasks(ctx, client, appGUID)
+		return err
+	})
+	if err != nil {
+		return cfAPILookupError(err)
+	}
+	if tasks <= 0 {
+		return withErrorCode(errCodeNoLiveInstances, errors.New("app doesn't have any live instances or running tasks"))
+	}
+	return nil
+}
 
-	return app.Name, nil
+// isBoundToServiceInstance reports whether the app is bound to the service instance
+// with the given name or GUID.
+func isBoundToServiceInstance(ctx context.Context, client *cfclient.Client, appGUID, serviceInstance string) (bool, error) {
+	opts := cfclient.NewServiceCredentialBindingListOptions()
+	opts.AppGUIDs.EqualTo(appGUID)
+	opts.Type.EqualTo("app")
+	_, serviceInstances, err := client.ServiceCredentialBindings.ListIncludeServiceInstancesAll(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	for _, instance := range serviceInstances {
+		if instance.GUID == serviceInstance || instance.Name == serviceInstance {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (b *backend) getSpaceName(client *cfclient.Client, cfCert *models.CFCertificate) (string, error) {
-	space, err := client.GetSpaceByGuid(cfCert.SpaceID)
+// runningTasks returns how many of the app's tasks are running.
+func runningTasks(ctx context.Context, client *cfclient.Client, appGUID string) (int, error) {
+	opts := cfclient.NewTaskListOptions()
+	opts.States.EqualTo("RUNNING")
+	tasks, err := client.Tasks.ListForAppAll(ctx, appGUID, opts)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
+	return len(tasks), nil
+}
 
-	return space.Name, nil
+// relationshipGUID returns the GUID of a to-one relationship, or an empty string if it isn't set.
+func relationshipGUID(relationship resource.ToOneRelationship) string {
+	if relationship.Data == nil {
+		return ""
+	}
+	return relationship.Data.GUID
 }
 
 func meetsBoundConstraints(certValue string, constraints []string) bool {
@@ -421,30 +1240,130 @@ func meetsBoundConstraints(certValue string, constraints []string) bool {
 	return strutil.StrListContains(constraints, certValue)
 }
 
+// checkNotDenied returns an error if the certificate's org or space is on the mount's
+// deny lists.
+func checkNotDenied(config *models.Configuration, cfCert *models.CFCertificate) error {
+	if strutil.StrListContains(config.DeniedOrgIDs, cfCert.OrgID) {
+		return withErrorCode(errCodeDenied, fmt.Errorf("org %s is denied by the mount's config", cfCert.OrgID))
+	}
+	if strutil.StrListContains(config.DeniedSpaceIDs, cfCert.SpaceID) {
+		return withErrorCode(errCodeDenied, fmt.Errorf("space %s is denied by the mount's config", cfCert.SpaceID))
+	}
+	return nil
+}
+
 func matchesIPAddress(remoteAddr string, certIP net.IP) bool {
+	reqIPAddr := parseRemoteIP(remoteAddr)
+	if reqIPAddr == nil {
+		return false
+	}
+	// IPv4 addresses also match their IPv4-mapped IPv6 form, as used on
+	// dual-stack networks.
+	return certIP.Equal(reqIPAddr)
+}
+
+// sourceAllowed reports whether the request comes from within the mount's allowed
+// source CIDRs, if it has any.
+func sourceAllowed(config *models.Configuration, req *logical.Request) bool {
+	if len(config.AllowedSourceCIDRs) == 0 {
+		return true
+	}
+	return remoteAddrInCIDRs(clientRemoteAddr(config, req), config.AllowedSourceCIDRs)
+}
+
+// matchesCertificateIPAddress reports whether the remote address matches any of the
+// certificate's IP addresses.
+func matchesCertificateIPAddress(remoteAddr string, cfCert *models.CFCertificate) bool {
+	for _, ipAddress := range cfCert.AllIPAddresses() {
+		if matchesIPAddress(remoteAddr, net.ParseIP(ipAddress)) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateIPAddressInCIDRs reports whether any of the certificate's IP addresses
+// is within the CIDRs, or whether there are no CIDRs to be within.
+func certificateIPAddressInCIDRs(cfCert *models.CFCertificate, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	for _, ipAddress := range cfCert.AllIPAddresses() {
+		if remoteAddrInCIDRs(ipAddress, cidrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRemoteIP parses the IP address out of a remote address, which may be an
+// IPv4 or IPv6 address with a port, a subnet mask, or a zone ID, such as
+// "10.255.181.105:8200", "[2001:db8::1]:8200", or "fe80::1%eth0".
+func parseRemoteIP(remoteAddr string) net.IP {
 	// Some remote addresses may arrive like "10.255.181.105/32"
 	// but the certificate will only have the IP address without
 	// the subnet mask, so that's what we want to match against.
 	// For those wanting to also match the subnet, use bound_cidrs.
-	parts := strings.Split(remoteAddr, "/")
-	reqIPAddr := net.ParseIP(parts[0])
-	if certIP.Equal(reqIPAddr) {
-		return true
+	addr, _, _ := strings.Cut(remoteAddr, "/")
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
-	return false
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	// Zone IDs only scope link-local addresses to an interface, which the
+	// certificate's IP address doesn't have.
+	addr, _, _ = strings.Cut(addr, "%")
+	return net.ParseIP(addr)
 }
 
-// Try parsing this as ISO 8601 AND the way that is default provided by Bash to make it easier to give via the CLI as well.
+// instanceCertContents returns the request's "cf_instance_cert" as PEM, decoding it
+// from its "encoding".
+func instanceCertContents(data *framework.FieldData) (string, error) {
+	raw := data.Get("cf_instance_cert").(string)
+	if raw == "" {
+		return "", errors.New("'cf_instance_cert' is required")
+	}
+	contents, err := util.DecodeCertificateContents(raw, data.Get("encoding").(string))
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't decode 'cf_instance_cert'")
+	}
+	return contents, nil
+}
+
+// parseTime parses a signing time in the package's TimeFormat, RFC 3339 with
+// an optional fractional second, the Bash or PowerShell date formats, or Unix
+// epoch seconds.
+// Whatever the format, signatures are made over the time in TimeFormat.
 func parseTime(signingTime string) (time.Time, error) {
 	if signingTime, err := time.Parse(signatures.TimeFormat, signingTime); err == nil {
 		return signingTime, nil
 	}
+	if signingTime, err := time.Parse(time.RFC3339Nano, signingTime); err == nil {
+		return signingTime, nil
+	}
 	if signingTime, err := time.Parse(util.BashTimeFormat, signingTime); err == nil {
 		return signingTime, nil
 	}
+	if signingTime, err := time.Parse(util.PowerShellTimeFormat, signingTime); err == nil {
+		return signingTime, nil
+	}
+	if epochSeconds, err := strconv.ParseInt(signingTime, 10, 64); err == nil {
+		return time.Unix(epochSeconds, 0).UTC(), nil
+	}
 	return time.Time{}, fmt.Errorf("couldn't parse %s", signingTime)
 }
 
+// getIdentityField returns one of the IDs identifying the instance an auth was issued
+// for. Tokens issued before the alias metadata could be configured only have the IDs
+// in their alias metadata.
+func getIdentityField(fieldName string, auth *logical.Auth) (string, error) {
+	if _, ok := auth.InternalData[fieldName]; ok {
+		return getOrErr(fieldName, auth.InternalData)
+	}
+	return getOrErr(fieldName, auth.Alias.Metadata)
+}
+
 // getOrErr is a convenience method for pulling a string from a map.
 func getOrErr(fieldName string, from interface{}) (string, error) {
 	switch givenMap := from.(type) {
@@ -0,0 +1,222 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+func (b *backend) pathLoginActivity() *framework.Path {
+	return &framework.Path{
+		Pattern: "login-activity",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "If set, only login attempts against this role are returned.",
+				Query:       true,
+			},
+			"app_id": {
+				Type:        framework.TypeString,
+				Description: "If set, only login attempts by this app are returned.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationLoginActivityRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "login-activity",
+				},
+			},
+		},
+		HelpSynopsis:    pathLoginActivitySyn,
+		HelpDescription: pathLoginActivityDesc,
+	}
+}
+
+func (b *backend) operationLoginActivityRead(_ context.Context, _ *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	role := data.Get("role").(string)
+	appID := data.Get("app_id").(string)
+
+	attempts := []map[string]interface{}{}
+	for _, attempt := range b.loginActivity.list() {
+		if (role != "" && attempt.Role != role) || (appID != "" && attempt.AppID != appID) {
+			continue
+		}
+		a := map[string]interface{}{
+			"time":    attempt.Time.Format(time.RFC3339),
+			"path":    attempt.Path,
+			"role":    attempt.Role,
+			"app_id":  attempt.AppID,
+			"success": !attempt.Failed,
+		}
+		if attempt.Failed {
+			a["reason"] = attempt.Reason
+			a["error_code"] = attempt.ErrorCode
+		}
+		attempts = append(attempts, a)
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"attempts": attempts,
+		},
+	}, nil
+}
+
+// withLoginActivity records the outcome of each call to the login callback, emits its
+// metrics and event, and refuses logins from apps and addresses that have failed too
+// often. The claimedAppID function returns, if it can, the app ID that a login request
+// claims before it has been verified, so that failed attempts can be told apart by app.
+// As the claim can't be trusted, failed attempts are also counted per address whichever
+// app they claim. Attempts through trusted proxies are told apart by the address they
+// forward.
+func (b *backend) withLoginActivity(path string, callback framework.OperationFunc, claimedAppID func(*models.Configuration, *framework.FieldData) string) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		ctx = withRequestInfo(ctx, req)
+		start := time.Now()
+		b.mu.RLock()
+		config, err := getConfig(ctx, req.Storage)
+		b.mu.RUnlock()
+		if err != nil {
+			b.Logger().Warn("unable to read the configuration to tell apart login attempts", "error", err)
+		}
+		var remoteAddr, appID string
+		if config != nil {
+			remoteAddr = clientRemoteAddr(config, req)
+		} else if req.Connection != nil {
+			remoteAddr = req.Connection.RemoteAddr
+		}
+		if claimedAppID != nil {
+			appID = claimedAppID(config, data)
+		}
+		throttleKey := loginThrottleKey(appID, remoteAddr)
+		addressThrottleKey := loginAddressThrottleKey(remoteAddr)
+
+		var resp *logical.Response
+		until, throttled := b.loginThrottle.blockedUntil(throttleKey, start)
+		if addressUntil, addressThrottled := b.loginThrottle.blockedUntil(addressThrottleKey, start); addressThrottled && addressUntil.After(until) {
+			until, throttled = addressUntil, true
+		}
+		if throttled {
+			err = logical.CodedError(http.StatusTooManyRequests, loginErrorMessage(errCodeTooManyFailedLogins,
+				fmt.Sprintf("too many failed logins, try again after %s", until.Format(time.RFC3339))))
+		} else {
+			resp, err = callback(ctx, req, data)
+		}
+
+		attempt := loginAttempt{
+			Time: time.Now().UTC(),
+			Path: path,
+			Role: data.Get("role").(string),
+		}
+		switch {
+		case err != nil:
+			attempt.Failed = true
+			attempt.Reason = err.Error()
+		case resp == nil || resp.Auth == nil:
+			attempt.Failed = true
+			if resp != nil && resp.IsError() {
+				attempt.Reason = resp.Error().Error()
+				attempt.ErrorCode = parseErrorCode(attempt.Reason)
+			}
+		}
+		if !attempt.Failed {
+			b.loginThrottle.reset(throttleKey)
+			b.loginThrottle.reset(addressThrottleKey)
+			attempt.AppID = resp.Auth.Alias.Name
+			// Logins that don't name a role use the default one.
+			if roleName, ok := resp.Auth.InternalData["role"].(string); ok {
+				attempt.Role = roleName
+			}
+		} else {
+			attempt.AppID = appID
+			if !throttled {
+				b.countLoginFailure(ctx, req.Storage, throttleKey, addressThrottleKey, attempt.Time)
+			}
+		}
+		b.loginActivity.add(attempt)
+		emitLoginMetrics(attempt, start)
+		if attempt.Failed {
+			b.sendEvent(ctx, eventTypeLoginFailed, "path", path, "role", attempt.Role, "app_id", attempt.AppID, "reason", loginFailureReason(attempt.Reason), "error_code", attempt.ErrorCode)
+		} else {
+			b.sendEvent(ctx, eventTypeLogin, "path", path, "role", attempt.Role, "app_id", attempt.AppID)
+		}
+
+		return resp, err
+	}
+}
+
+// countLoginFailure counts a failed login towards the configured limits for the app and
+// address and for the address, if there are any.
+func (b *backend) countLoginFailure(ctx context.Context, storage logical.Storage, throttleKey, addressThrottleKey string, now time.Time) {
+	b.mu.RLock()
+	config, err := getConfig(ctx, storage)
+	b.mu.RUnlock()
+	if err != nil {
+		b.Logger().Warn("unable to read the configuration to count a failed login", "error", err)
+		return
+	}
+	if config == nil {
+		return
+	}
+	if config.LoginFailureLimit > 0 {
+		b.loginThrottle.addFailure(throttleKey, config.LoginFailureLimit, loginFailureWindow(config), loginFailureCooldown(config), loginFailureMaxCooldown(config), now)
+	}
+	if limit := loginFailureAddressLimit(config); limit > 0 {
+		b.loginThrottle.addFailure(addressThrottleKey, limit, loginFailureWindow(config), loginFailureCooldown(config), loginFailureMaxCooldown(config), now)
+	}
+}
+
+// claimedCertificateAppID returns the app ID in the login request's instance
+// certificate, without verifying it. It's read from where the config's field sources
+// say it is, as logins read it.
+func claimedCertificateAppID(config *models.Configuration, data *framework.FieldData) string {
+	cfCert, err := claimedCertificate(config, data)
+	if err != nil {
+		return ""
+	}
+	return cfCert.AppID
+}
+
+// claimedCertificate returns the instance described by the login request's instance
+// certificate, without verifying it.
+func claimedCertificate(config *models.Configuration, data *framework.FieldData) (*models.CFCertificate, error) {
+	contents, err := instanceCertContents(data)
+	if err != nil {
+		return nil, err
+	}
+	_, identityCert, err := util.ExtractCertificates(contents)
+	if err != nil {
+		return nil, err
+	}
+	var fieldSources map[string]string
+	if config != nil {
+		fieldSources = config.IdentityCertFieldSources
+	}
+	return models.NewCFCertificateFromx509WithFieldSources(identityCert, fieldSources)
+}
+
+const pathLoginActivitySyn = `
+Read the most recent login attempts.
+`
+
+const pathLoginActivityDesc = `
+Returns the most recent login attempts handled by this Vault node, newest
+first, with the role and app ID they were made for, whether they succeeded,
+and why they failed. For failed attempts, the app ID is the one claimed by
+the instance certificate presented and may not have been verified. Attempts
+can be filtered by "role" and "app_id".
+`
@@ -0,0 +1,183 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const (
+	// loginChallengeKeyStorageKey is where the key that login challenge nonces are
+	// authenticated with is stored.
+	loginChallengeKeyStorageKey = "login-challenge-key"
+
+	defaultLoginChallengeTTL = 30 * time.Second
+
+	// A nonce is its expiry, in Unix nanoseconds, and random bytes, followed by their
+	// HMAC.
+	nonceExpiryLen = 8
+	nonceRandomLen = 16
+	nonceLen       = nonceExpiryLen + nonceRandomLen + sha256.Size
+)
+
+var errInvalidNonce = errors.New("nonce wasn't issued by this mount")
+
+func (b *backend) pathLoginChallenge() *framework.Path {
+	return &framework.Path{
+		Pattern: "login/challenge",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "login-challenge",
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationLoginChallengeUpdate,
+			},
+		},
+		HelpSynopsis:    pathLoginChallengeSyn,
+		HelpDescription: pathLoginChallengeDesc,
+	}
+}
+
+func (b *backend) operationLoginChallengeUpdate(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	b.mu.RLock()
+	config, err := getConfig(ctx, req.Storage)
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return loginErrorResponse(errCodeNotConfigured, "no CA is configured for verifying client certificates"), nil
+	}
+	if !sourceAllowed(config, req) {
+		return loginErrorResponse(errCodeSourceNotAllowed, fmt.Sprintf("IP address %q isn't within the mount's allowed source CIDRs", clientRemoteAddr(config, req))), nil
+	}
+
+	key, err := b.createLoginChallengeKey(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().UTC().Add(loginChallengeTTL(config))
+	nonce, err := newLoginChallengeNonce(key, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"nonce":      nonce,
+			"expires_at": expiresAt.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// loginChallengeTTL returns how long a login challenge nonce can be logged in with.
+func loginChallengeTTL(config *models.Configuration) time.Duration {
+	if config.LoginChallengeTTL > 0 {
+		return config.LoginChallengeTTL
+	}
+	return defaultLoginChallengeTTL
+}
+
+// createLoginChallengeKey returns the key that login challenge nonces are authenticated
+// with, creating it if this is the first challenge. It's created under the write lock,
+// once storage has been read again, so that concurrent first challenges don't each
+// store a different key. Nodes that can't write to storage refuse to create it, and the
+// challenge is forwarded to the active node.
+func (b *backend) createLoginChallengeKey(ctx context.Context, storage logical.Storage) ([]byte, error) {
+	b.mu.RLock()
+	key, err := loginChallengeKey(ctx, storage, false)
+	b.mu.RUnlock()
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return loginChallengeKey(ctx, storage, true)
+}
+
+// loginChallengeKey returns the key that login challenge nonces are authenticated
+// with. It's only created if create is set, and is otherwise nil if it doesn't exist
+// yet.
+func loginChallengeKey(ctx context.Context, storage logical.Storage, create bool) ([]byte, error) {
+	entry, err := storage.Get(ctx, loginChallengeKeyStorageKey)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return entry.Value, nil
+	}
+	if !create {
+		return nil, nil
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: loginChallengeKeyStorageKey, Value: key}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newLoginChallengeNonce returns a nonce that can be logged in with until it expires.
+// Nonces carry their own expiry and are authenticated with the key, so that any node
+// can check them without them being stored.
+func newLoginChallengeNonce(key []byte, expiresAt time.Time) (string, error) {
+	nonce := make([]byte, nonceExpiryLen+nonceRandomLen, nonceLen)
+	binary.BigEndian.PutUint64(nonce, uint64(expiresAt.UnixNano()))
+	if _, err := rand.Read(nonce[nonceExpiryLen:]); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nonce)), nil
+}
+
+// parseLoginChallengeNonce checks that the nonce was issued with the key and hasn't
+// expired, returning when it expires.
+func parseLoginChallengeNonce(key []byte, nonce string, now time.Time) (time.Time, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != nonceLen || key == nil {
+		return time.Time{}, errInvalidNonce
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw[:nonceExpiryLen+nonceRandomLen])
+	if !hmac.Equal(mac.Sum(nil), raw[nonceExpiryLen+nonceRandomLen:]) {
+		return time.Time{}, errInvalidNonce
+	}
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(raw))).UTC()
+	if !now.Before(expiresAt) {
+		return time.Time{}, fmt.Errorf("nonce expired at %s", expiresAt.Format(time.RFC3339))
+	}
+	return expiresAt, nil
+}
+
+const pathLoginChallengeSyn = `
+Issue a nonce for a login to sign.
+`
+
+const pathLoginChallengeDesc = `
+Writing to this path returns a short-lived nonce, which a login includes in
+the data it signs and sends as "nonce". A login signing a nonce is checked
+against when the nonce expires rather than against its signing time, so it
+doesn't depend on the client's clock. The nonces that have been logged in with
+are remembered in memory, so each can only be logged in with once on the node
+that handled the login; until it expires, it can still be logged in with on
+other nodes. Set "require_login_challenge" in the config to refuse logins that
+don't sign a nonce.
+`
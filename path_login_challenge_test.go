@@ -0,0 +1,129 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestLoginChallengeNonce(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("test-key")
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Minute)
+	nonce, err := newLoginChallengeNonce(key, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedExpiry, err := parseLoginChallengeNonce(key, nonce, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsedExpiry.Equal(expiresAt) {
+		t.Fatalf("expected the nonce to expire at %s but received %s", expiresAt, parsedExpiry)
+	}
+
+	if _, err := parseLoginChallengeNonce(key, nonce, expiresAt); err == nil {
+		t.Fatal("expected an expired nonce to be refused")
+	}
+	if _, err := parseLoginChallengeNonce([]byte("other-key"), nonce, now); err != errInvalidNonce {
+		t.Fatalf("expected a nonce issued with another key to be refused but received %v", err)
+	}
+	if _, err := parseLoginChallengeNonce(nil, nonce, now); err != errInvalidNonce {
+		t.Fatalf("expected a nonce to be refused without a key but received %v", err)
+	}
+
+	// Pushing the expiry back invalidates the HMAC.
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[0]++
+	if _, err := parseLoginChallengeNonce(key, base64.RawURLEncoding.EncodeToString(raw), now); err != errInvalidNonce {
+		t.Fatalf("expected a tampered nonce to be refused but received %v", err)
+	}
+	if _, err := parseLoginChallengeNonce(key, "not-a-nonce", now); err != errInvalidNonce {
+		t.Fatalf("expected a malformed nonce to be refused but received %v", err)
+	}
+}
+
+// racingReadsStorage holds the first two reads of the key until both have been made,
+// so that the requests that made them race to create it.
+type racingReadsStorage struct {
+	logical.Storage
+	key     string
+	reads   atomic.Int32
+	arrived sync.WaitGroup
+}
+
+func (s *racingReadsStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	entry, err := s.Storage.Get(ctx, key)
+	if key == s.key && s.reads.Add(1) <= 2 {
+		s.arrived.Done()
+		s.arrived.Wait()
+	}
+	return entry, err
+}
+
+func TestLoginChallengeKeyCreatedOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &racingReadsStorage{Storage: &logical.InmemStorage{}, key: loginChallengeKeyStorageKey}
+	storage.arrived.Add(2)
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeConfig(ctx, storage, &models.Configuration{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent first challenges both issue nonces with the one key that's stored.
+	nonces := make([]string, 2)
+	var wg sync.WaitGroup
+	for i := range nonces {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := lb.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "login/challenge",
+				Storage:   storage,
+			})
+			if err != nil || resp == nil || resp.IsError() {
+				t.Errorf("expected a challenge but received %#v, %v", resp, err)
+				return
+			}
+			nonces[i] = resp.Data["nonce"].(string)
+		}(i)
+	}
+	wg.Wait()
+
+	key, err := loginChallengeKey(ctx, storage, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nonce := range nonces {
+		if _, err := parseLoginChallengeNonce(key, nonce, time.Now()); err != nil {
+			t.Fatalf("expected each nonce to be issued with the stored key but received %v", err)
+		}
+	}
+}
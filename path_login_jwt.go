@@ -0,0 +1,270 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/hashicorp/vault/sdk/helper/cidrutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/pkg/errors"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// jwtSignatureAlgorithms are the algorithms instance identity JWTs may be signed with.
+var jwtSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// instanceIdentityClaims are the claims describing the instance in a CF instance
+// identity JWT. They carry the same fields as an instance identity certificate.
+type instanceIdentityClaims struct {
+	InstanceID string `json:"instance_id"`
+	OrgID      string `json:"org_id"`
+	SpaceID    string `json:"space_id"`
+	AppID      string `json:"app_id"`
+	IPAddress  string `json:"ip_address"`
+}
+
+func (b *backend) pathLoginJWT() *framework.Path {
+	return &framework.Path{
+		Pattern: "login-jwt",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "login",
+			OperationSuffix: "jwt",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Role Name",
+					Value: "internally-defined-role",
+				},
+				Description: "The name of the role to authenticate against. If unset, the configured default role is used.",
+			},
+			"jwt": {
+				Required: true,
+				Type:     framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "JWT",
+				},
+				Description: "The CF instance identity JWT.",
+			},
+			"include_cf_metadata": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Include CF Metadata",
+				},
+				Description: `If true, the response's data includes the instance's org, space, and app IDs and names,
+and when its instance identity JWT expires.`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.withLoginActivity("login-jwt", b.operationLoginJWTUpdate, nil),
+			},
+			logical.ResolveRoleOperation: &framework.PathOperation{
+				Callback: b.resolveRole(claimedJWTIdentity),
+			},
+		},
+		HelpSynopsis:    pathLoginJWTSyn,
+		HelpDescription: pathLoginJWTDesc,
+	}
+}
+
+// operationLoginJWTUpdate logs in an instance presenting a CF instance identity JWT
+// signed by one of the configured issuer keys. The instance described by the JWT's
+// claims must meet the same role constraints and CF API checks as with certificates.
+func (b *backend) operationLoginJWTUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName, err := b.loginRoleName(ctx, req.Storage, data)
+	if err != nil {
+		return nil, err
+	}
+	if roleName == "" {
+		return loginErrorResponse(errCodeInvalidRequest, "'role' is required"), nil
+	}
+
+	rawJWT := data.Get("jwt").(string)
+	if rawJWT == "" {
+		return loginErrorResponse(errCodeInvalidRequest, "'jwt' is required"), nil
+	}
+
+	role, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return loginErrorResponse(errCodeRoleNotFound, "no matching role"), nil
+	}
+
+	if len(role.TokenBoundCIDRs) > 0 {
+		if req.Connection == nil {
+			b.Logger().Warn("token bound CIDRs found but no connection information available for validation")
+			return nil, logical.ErrPermissionDenied
+		}
+		if !cidrutil.RemoteAddrIsOk(req.Connection.RemoteAddr, role.TokenBoundCIDRs) {
+			return nil, logical.ErrPermissionDenied
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || len(config.JWTValidationPubKeys) == 0 {
+		return loginErrorResponse(errCodeNotConfigured, "JWT login isn't configured, 'jwt_validation_pubkeys' must be set"), nil
+	}
+	if !sourceAllowed(config, req) {
+		return loginErrorResponse(errCodeSourceNotAllowed, fmt.Sprintf("IP address %q isn't within the mount's allowed source CIDRs", clientRemoteAddr(config, req))), nil
+	}
+
+	claims, expiry, err := verifyInstanceIdentityJWT(config, rawJWT, time.Now())
+	if err != nil {
+		return loginErrorResponse(errCodeInvalidJWT, err.Error()), nil
+	}
+	cfCert, err := models.NewCFCertificate(claims.InstanceID, claims.OrgID, claims.SpaceID, claims.AppID, claims.IPAddress)
+	if err != nil {
+		return loginErrorResponse(errCodeInvalidJWT, fmt.Sprintf("invalid JWT claims: %s", err)), nil
+	}
+
+	b.logLoginAttempt(config, "handling JWT login attempt", cfCert)
+
+	if err := checkNotDenied(config, cfCert); err != nil {
+		return loginErrorResponseFromErr(err, errCodeInternal), nil
+	}
+	if err := checkNotRevoked(ctx, req.Storage, cfCert); err != nil {
+		return loginErrorResponseFromErr(err, errCodeInternal), nil
+	}
+	cfResources, err := b.validate(ctx, config, role, cfCert, clientRemoteAddr(config, req))
+	if err != nil {
+		return loginFailure(err, errCodeInternal)
+	}
+	cfResources, err = b.withInstanceDetails(ctx, config, role, cfCert, cfResources)
+	if err != nil {
+		return loginFailure(err, errCodeInternal)
+	}
+	b.trackLogin(ctx, req.Storage, config, cfCert.AppID, time.Now().UTC())
+	b.annotateLoginInBackground(ctx, config, cfResources, roleName, cfCert.InstanceID, req.MountAccessor)
+
+	auth, err := newAuth(roleName, role, cfCert, cfResources, expiry, displayNameTemplate(config, role))
+	if err != nil {
+		return loginErrorResponse(errCodePolicyTemplate, err.Error()), nil
+	}
+	if err := addMappedPolicies(ctx, req.Storage, auth, cfCert); err != nil {
+		return nil, err
+	}
+	if err := applyTTLCaps(ctx, req.Storage, auth, cfCert); err != nil {
+		return nil, err
+	}
+	if role.SingleActiveToken {
+		if err := recordActiveToken(ctx, req.Storage, roleName, cfCert.InstanceID, auth, time.Now().UTC()); err != nil {
+			return nil, err
+		}
+	}
+	resp := &logical.Response{
+		Auth: auth,
+	}
+	if data.Get("include_cf_metadata").(bool) {
+		resp.Data = cfLoginData(role, cfCert, cfResources, expiry)
+	}
+	return resp, nil
+}
+
+// verifyInstanceIdentityJWT verifies the JWT's signature against the configured keys,
+// checks its registered claims, and returns the claims describing the instance along
+// with the JWT's expiration time.
+func verifyInstanceIdentityJWT(config *models.Configuration, rawJWT string, now time.Time) (*instanceIdentityClaims, time.Time, error) {
+	token, err := jwt.ParseSigned(rawJWT, jwtSignatureAlgorithms)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to parse JWT: %w", err)
+	}
+	keys, err := parseJWTValidationPubKeys(config.JWTValidationPubKeys)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var result error
+	for _, key := range keys {
+		registeredClaims := &jwt.Claims{}
+		claims := &instanceIdentityClaims{}
+		if err := token.Claims(key, registeredClaims, claims); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		if registeredClaims.Expiry == nil {
+			return nil, time.Time{}, errors.New("JWT has no expiration time")
+		}
+		expected := jwt.Expected{
+			Issuer: config.JWTBoundIssuer,
+			Time:   now,
+		}
+		if len(config.JWTBoundAudiences) > 0 {
+			expected.AnyAudience = config.JWTBoundAudiences
+		}
+		if err := registeredClaims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid JWT: %w", err)
+		}
+		return claims, registeredClaims.Expiry.Time(), nil
+	}
+	return nil, time.Time{}, fmt.Errorf("JWT isn't signed by any of the configured keys: %w", result)
+}
+
+// claimedJWTIdentity returns the instance described by the login request's JWT, without
+// verifying it.
+func claimedJWTIdentity(_ *models.Configuration, data *framework.FieldData) (*models.CFCertificate, error) {
+	rawJWT := data.Get("jwt").(string)
+	if rawJWT == "" {
+		return nil, errors.New("'jwt' is required")
+	}
+	token, err := jwt.ParseSigned(rawJWT, jwtSignatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JWT: %w", err)
+	}
+	claims := &instanceIdentityClaims{}
+	if err := token.UnsafeClaimsWithoutVerification(claims); err != nil {
+		return nil, fmt.Errorf("unable to parse JWT: %w", err)
+	}
+	return models.NewCFCertificate(claims.InstanceID, claims.OrgID, claims.SpaceID, claims.AppID, claims.IPAddress)
+}
+
+// parseJWTValidationPubKeys parses the PEM-encoded public keys of JWT issuers.
+func parseJWTValidationPubKeys(pemKeys []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(pemKeys))
+	for _, pemKey := range pemKeys {
+		key, err := certutil.ParsePublicKeyPEM([]byte(pemKey))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+const pathLoginJWTSyn = `
+Authenticates an entity with Vault using a CF instance identity JWT.
+`
+
+const pathLoginJWTDesc = `
+Authenticate CF entities using an instance identity JWT signed by one of the
+keys in the config's "jwt_validation_pubkeys". The JWT's "instance_id",
+"org_id", "space_id", "app_id", and "ip_address" claims are held to the role's
+constraints and checked against the CF API, just like the fields of an
+instance identity certificate.
+`
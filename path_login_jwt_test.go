@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func (e *Env) LoginJWT(t *testing.T) {
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&issuerKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(rawJWT string) *logical.Response {
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login-jwt",
+			Storage:   e.Storage,
+			Data: map[string]interface{}{
+				"role": "test-role",
+				"jwt":  rawJWT,
+			},
+			Connection: &logical.Connection{
+				RemoteAddr: "10.255.181.105",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	signJWT := func(key *ecdsa.PrivateKey, claims jwt.Claims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawJWT, err := jwt.Signed(signer).Claims(claims).Claims(instanceIdentityClaims{
+			InstanceID: cf.FoundServiceGUID,
+			OrgID:      cf.FoundOrgGUID,
+			SpaceID:    cf.FoundSpaceGUID,
+			AppID:      cf.FoundAppGUID,
+			IPAddress:  "10.255.181.105",
+		}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rawJWT
+	}
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   "https://uaa.example.com",
+			Audience: jwt.Audience{"vault"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}
+	}
+
+	// JWT login is only enabled once issuer keys are configured.
+	if resp := login(signJWT(issuerKey, validClaims())); resp == nil || !resp.IsError() {
+		t.Fatalf("expected JWT login to be disabled but received %#v", resp)
+	}
+
+	e.updateConfig(t, map[string]interface{}{
+		"jwt_validation_pubkeys": []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}))},
+		"jwt_bound_issuer":       "https://uaa.example.com",
+		"jwt_bound_audiences":    []string{"vault"},
+	})
+	defer e.updateConfig(t, map[string]interface{}{
+		"jwt_validation_pubkeys": []string{},
+	})
+
+	resp := login(signJWT(issuerKey, validClaims()))
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("expected JWT login to succeed but received %#v", resp)
+	}
+	if resp.Auth.Alias.Name != cf.FoundAppGUID || resp.Auth.InternalData["instance_id"] != cf.FoundServiceGUID {
+		t.Fatalf("expected the auth to describe the JWT's instance but received %#v", resp.Auth)
+	}
+
+	wrongIssuer := validClaims()
+	wrongIssuer.Issuer = "https://other.example.com"
+	wrongAudience := validClaims()
+	wrongAudience.Audience = jwt.Audience{"other"}
+	expired := validClaims()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := validClaims()
+	noExpiry.Expiry = nil
+
+	for name, tt := range map[string]struct {
+		rawJWT  string
+		wantErr string
+	}{
+		"wrong key":      {rawJWT: signJWT(otherKey, validClaims()), wantErr: "isn't signed by any of the configured keys"},
+		"wrong issuer":   {rawJWT: signJWT(issuerKey, wrongIssuer), wantErr: "issuer"},
+		"wrong audience": {rawJWT: signJWT(issuerKey, wrongAudience), wantErr: "audience"},
+		"expired":        {rawJWT: signJWT(issuerKey, expired), wantErr: "expired"},
+		"no expiry":      {rawJWT: signJWT(issuerKey, noExpiry), wantErr: "no expiration time"},
+		"not a JWT":      {rawJWT: "not-a-jwt", wantErr: "unable to parse JWT"},
+	} {
+		resp := login(tt.rawJWT)
+		if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), tt.wantErr) {
+			t.Fatalf("%s: expected an error containing %q but received %#v", name, tt.wantErr, resp)
+		}
+	}
+}
@@ -4,16 +4,32 @@
 package cf
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
 	"golang.org/x/net/context"
 
 	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
 )
 
 func TestResolveRole(t *testing.T) {
@@ -67,6 +83,55 @@ func TestResolveRole(t *testing.T) {
 	}
 }
 
+func TestResolveRole_DefaultRole(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	backend, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: time.Hour,
+			MaxLeaseTTLVal:     time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role := "testrole"
+
+	for key, value := range map[string]interface{}{
+		roleStoragePrefix + role: &models.RoleEntry{},
+		configStorageKey:         &models.Configuration{Version: 1, DefaultRole: role},
+	} {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := backend.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ResolveRoleOperation,
+		Path:      "login",
+		Storage:   storage,
+		Data:      map[string]interface{}{},
+		Connection: &logical.Connection{
+			RemoteAddr: "127.0.0.1",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["role"] != role {
+		t.Fatalf("Role was not as expected. Expected %s, received %s", role, resp.Data["role"])
+	}
+}
+
 func TestResolveRole_RoleDoesNotExist(t *testing.T) {
 	t.Parallel()
 
@@ -114,6 +179,70 @@ func TestResolveRole_RoleDoesNotExist(t *testing.T) {
 	}
 }
 
+func (e *Env) ResolveRole(t *testing.T) {
+	otherCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, "other-app", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := otherCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	resolveRole := func(path string, data map[string]interface{}) *logical.Response {
+		data["role"] = "test-role"
+		resp, err := e.Backend.HandleRequest(e.Ctx, &logical.Request{
+			Operation: logical.ResolveRoleOperation,
+			Path:      path,
+			Storage:   e.Storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := resolveRole("login", map[string]interface{}{"cf_instance_cert": e.TestCerts.InstanceCertificate})
+	if resp == nil || resp.IsError() || resp.Data["role"] != "test-role" {
+		t.Fatalf("expected the role to be resolved but received %#v", resp)
+	}
+	resp = resolveRole("login", map[string]interface{}{"cf_instance_cert": otherCerts.InstanceCertificate})
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "doesn't match role constraints") {
+		t.Fatalf("expected resolving the role for another app to fail but received %#v", resp)
+	}
+	resp = resolveRole("login", map[string]interface{}{})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected resolving the role without a certificate to fail but received %#v", resp)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for appID, shouldResolve := range map[string]bool{cf.FoundAppGUID: true, "other-app": false} {
+		rawJWT, err := jwt.Signed(signer).Claims(instanceIdentityClaims{
+			InstanceID: cf.FoundServiceGUID,
+			OrgID:      cf.FoundOrgGUID,
+			SpaceID:    cf.FoundSpaceGUID,
+			AppID:      appID,
+			IPAddress:  "10.255.181.105",
+		}).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = resolveRole("login-jwt", map[string]interface{}{"jwt": rawJWT})
+		if resp == nil || resp.IsError() == shouldResolve {
+			t.Fatalf("expected the role to be resolved for app %s to be %t but received %#v", appID, shouldResolve, resp)
+		}
+	}
+}
+
 func TestMatchesIPAddr(t *testing.T) {
 	t.Parallel()
 
@@ -135,6 +264,66 @@ func TestMatchesIPAddr(t *testing.T) {
 	}
 }
 
+func TestMatchesCertificateIPAddress(t *testing.T) {
+	t.Parallel()
+
+	cfCert := &models.CFCertificate{
+		IPAddress:   "10.255.181.105",
+		IPAddresses: []string{"10.255.181.105", "2001:db8::68"},
+	}
+	for _, remoteAddr := range []string{"10.255.181.105", "[2001:db8::68]:8200"} {
+		if !matchesCertificateIPAddress(remoteAddr, cfCert) {
+			t.Fatalf("%s should match", remoteAddr)
+		}
+	}
+	if matchesCertificateIPAddress("10.255.181.106", cfCert) {
+		t.Fatal("shouldn't match")
+	}
+
+	// Certificates that only have the IP address set still match against it.
+	if !matchesCertificateIPAddress("10.255.181.105", &models.CFCertificate{IPAddress: "10.255.181.105"}) {
+		t.Fatal("should match")
+	}
+}
+
+func TestMatchesIPAddrIPv6(t *testing.T) {
+	t.Parallel()
+
+	certIP := net.ParseIP("2001:db8::68")
+	for _, remoteAddr := range []string{
+		"2001:db8::68",
+		"2001:db8:0:0:0:0:0:68",
+		"2001:db8::68/128",
+		"[2001:db8::68]",
+		"[2001:db8::68]:8200",
+		"2001:db8::68%eth0",
+		"[2001:db8::68%eth0]:8200",
+	} {
+		if !matchesIPAddress(remoteAddr, certIP) {
+			t.Fatalf("%s should match", remoteAddr)
+		}
+	}
+	for _, remoteAddr := range []string{
+		"2001:db8::69",
+		"[2001:db8::69]:8200",
+		"::1",
+		"10.255.181.105",
+		"[2001:db8::68",
+	} {
+		if matchesIPAddress(remoteAddr, certIP) {
+			t.Fatalf("%s shouldn't match", remoteAddr)
+		}
+	}
+
+	// IPv4 addresses match whether or not they arrive IPv4-mapped.
+	certIP = net.ParseIP("10.255.181.105")
+	for _, remoteAddr := range []string{"10.255.181.105:8200", "::ffff:10.255.181.105", "[::ffff:10.255.181.105]:8200"} {
+		if !matchesIPAddress(remoteAddr, certIP) {
+			t.Fatalf("%s should match", remoteAddr)
+		}
+	}
+}
+
 func TestMeetsBoundConstraints(t *testing.T) {
 	t.Parallel()
 
@@ -151,3 +340,920 @@ func TestMeetsBoundConstraints(t *testing.T) {
 		t.Fatal("shouldn't meet constraints")
 	}
 }
+
+func TestValidateBoundNames(t *testing.T) {
+	t.Parallel()
+
+	role := &models.RoleEntry{
+		BoundAppNames:   []string{"payments-api"},
+		BoundSpaceNames: []string{"production"},
+		BoundOrgNames:   []string{"payments"},
+	}
+	cfCert := &models.CFCertificate{
+		AppName:   "payments-api",
+		SpaceName: "production",
+		OrgName:   "payments",
+	}
+	if err := validateBoundConstraints(role, cfCert); err != nil {
+		t.Fatal(err)
+	}
+
+	cfCert.SpaceName = "staging"
+	err := validateBoundConstraints(role, cfCert)
+	if errorCodeOf(err, "") != errCodeBoundSpaceMismatch {
+		t.Fatalf("expected %s but received %v", errCodeBoundSpaceMismatch, err)
+	}
+
+	// Certificates that don't carry the names can't meet the constraints.
+	if err := validateBoundConstraints(role, &models.CFCertificate{}); err == nil {
+		t.Fatal("expected a certificate without names to fail")
+	}
+}
+
+func TestValidateBoundSPIFFEIDs(t *testing.T) {
+	t.Parallel()
+
+	role := &models.RoleEntry{
+		BoundSPIFFEIDs: []string{"spiffe://cf.example.com/app/payments-api"},
+	}
+	if !hasBoundConstraints(role) || role.IsUnconstrained() {
+		t.Fatal("expected a role bound to SPIFFE IDs to be constrained")
+	}
+	if err := validateBoundConstraints(role, &models.CFCertificate{SPIFFEID: "spiffe://cf.example.com/app/payments-api"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, spiffeID := range []string{"spiffe://cf.example.com/app/billing", ""} {
+		err := validateBoundConstraints(role, &models.CFCertificate{SPIFFEID: spiffeID})
+		if errorCodeOf(err, "") != errCodeBoundSPIFFEIDMismatch {
+			t.Fatalf("expected %s for %q but received %v", errCodeBoundSPIFFEIDMismatch, spiffeID, err)
+		}
+	}
+}
+
+func TestGetValidationCacheKey(t *testing.T) {
+	t.Parallel()
+
+	cfCert := &models.CFCertificate{
+		InstanceID: "instance",
+		OrgID:      "org",
+		SpaceID:    "space",
+		AppID:      "app",
+		IPAddress:  "10.255.181.105",
+	}
+	role := &models.RoleEntry{
+		BoundAppIDs: []string{"app"},
+	}
+	key, err := getValidationCacheKey(role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token params aren't constraints on who can log in, so they shouldn't change the key.
+	role.TokenPolicies = []string{"default"}
+	sameKey, err := getValidationCacheKey(role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != sameKey {
+		t.Fatalf("expected %q but received %q", key, sameKey)
+	}
+
+	role.BoundSpaceIDs = []string{"space"}
+	changedKey, err := getValidationCacheKey(role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == changedKey {
+		t.Fatal("changing the role's constraints should change the key")
+	}
+}
+
+func TestValidateDockerImage(t *testing.T) {
+	t.Parallel()
+
+	image := "registry.example.com/payments/api:1.2.3"
+	for _, tc := range []struct {
+		bound []string
+		image *string
+		valid bool
+	}{
+		{[]string{image}, &image, true},
+		{[]string{"registry.example.com/payments/*"}, &image, true},
+		{[]string{"docker.io/library/*", "registry.example.com/*"}, &image, true},
+		{[]string{"registry.example.com/billing/*"}, &image, false},
+		{[]string{"registry.example.com/payments/api"}, &image, false},
+		{[]string{"registry.example.com/*"}, nil, false},
+	} {
+		err := validateDockerImage(&resource.Droplet{Image: tc.image}, tc.bound)
+		if valid := err == nil; valid != tc.valid {
+			t.Fatalf("expected image %v to be valid for %v to be %t but received %v", tc.image, tc.bound, tc.valid, err)
+		}
+		if err != nil && errorCodeOf(err, errCodeInternal) != errCodeBoundDockerImageMismatch {
+			t.Fatalf("expected error code %s but received %v", errCodeBoundDockerImageMismatch, err)
+		}
+	}
+}
+
+func TestValidateDeployedRevisions(t *testing.T) {
+	t.Parallel()
+
+	revision := func(version int, dropletGUID string) *resource.Revision {
+		return &resource.Revision{Version: version, Droplet: resource.Relationship{GUID: dropletGUID}}
+	}
+	for _, tc := range []struct {
+		revisions []*resource.Revision
+		valid     bool
+	}{
+		{nil, true},
+		{[]*resource.Revision{revision(3, cf.FoundDropletGUID)}, true},
+		{[]*resource.Revision{revision(2, "old-droplet"), revision(3, cf.FoundDropletGUID)}, false},
+		{[]*resource.Revision{revision(2, "old-droplet")}, false},
+	} {
+		err := validateDeployedRevisions(tc.revisions, cf.FoundDropletGUID)
+		if valid := err == nil; valid != tc.valid {
+			t.Fatalf("expected revisions %v to be valid to be %t but received %v", tc.revisions, tc.valid, err)
+		}
+		if err != nil && errorCodeOf(err, errCodeInternal) != errCodeStaleRevision {
+			t.Fatalf("expected error code %s but received %v", errCodeStaleRevision, err)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	t.Parallel()
+
+	want := time.Date(2019, 5, 20, 22, 8, 40, 0, time.UTC)
+	tests := map[string]time.Time{
+		"2019-05-20T22:08:40Z":           want,
+		"2019-05-20T22:08:40.123456789Z": want.Add(123456789 * time.Nanosecond),
+		"2019-05-20T15:08:40-07:00":      want,
+		"Mon May 20 22:08:40 UTC 2019":   want,
+		"2019-05-20 22:08:40Z":           want,
+		"2019-05-20T22:08:40.1234567Z":   want.Add(123456700 * time.Nanosecond),
+		"1558390120":                     want,
+	}
+	for raw, want := range tests {
+		got, err := parseTime(raw)
+		if err != nil {
+			t.Fatalf("%s: %s", raw, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("%s: expected %s but received %s", raw, want, got)
+		}
+	}
+
+	for _, raw := range []string{"", "yesterday", "1558390120.5", "2019-05-20"} {
+		if _, err := parseTime(raw); err == nil {
+			t.Fatalf("expected %q not to parse", raw)
+		}
+	}
+}
+
+func TestLoginRenewGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	renew, faults := newRenewalTestBackend(t, &models.Configuration{
+		RenewalGracePeriod: time.Hour,
+	}, &models.RoleEntry{})
+
+	// A healthy CF API records the renewal as the last validation.
+	resp, err := renew(time.Now().Add(-2*time.Hour), nil)
+	if err != nil || resp.IsError() || len(resp.Warnings) > 0 {
+		t.Fatalf("expected renewal to succeed but received %#v, %v", resp, err)
+	}
+	if lastValidated, ok := getLastValidated(resp.Auth.InternalData); !ok || time.Since(lastValidated) > time.Minute {
+		t.Fatalf("expected the renewal to update last_validated but received %v", resp.Auth.InternalData["last_validated"])
+	}
+
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusServiceUnavailable})
+
+	resp, err = renew(time.Now().Add(-time.Minute), nil)
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal within the grace period to succeed but received %#v, %v", resp, err)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "couldn't be reached") {
+		t.Fatalf("expected a warning about the CF API but received %v", resp.Warnings)
+	}
+
+	resp, err = renew(time.Now().Add(-2*time.Hour), nil)
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected renewal after the grace period to fail but received %#v, %v", resp, err)
+	}
+}
+
+func TestLoginRenewRevalidationCadence(t *testing.T) {
+	t.Parallel()
+
+	renew, faults := newRenewalTestBackend(t, &models.Configuration{}, &models.RoleEntry{
+		RevalidateEveryNRenewals: 3,
+		RevalidationInterval:     time.Hour,
+	})
+
+	// With the CF API down, renewals only succeed when they don't need to check it.
+	faults.Add(cf.Fault{PathPrefix: "/v3/apps", Status: http.StatusServiceUnavailable})
+
+	resp, err := renew(time.Now().Add(-time.Minute), nil)
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to skip the CF API but received %#v, %v", resp, err)
+	}
+	if renewals := getRenewalsSinceValidation(resp.Auth.InternalData); renewals != 1 {
+		t.Fatalf("expected 1 renewal since validation but received %d", renewals)
+	}
+
+	// The counter may come back from storage as a float.
+	resp, err = renew(time.Now().Add(-time.Minute), map[string]interface{}{"renewals_since_validation": float64(1)})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to skip the CF API but received %#v, %v", resp, err)
+	}
+
+	resp, err = renew(time.Now().Add(-time.Minute), map[string]interface{}{"renewals_since_validation": 2})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected the third renewal to check the CF API but received %#v, %v", resp, err)
+	}
+
+	resp, err = renew(time.Now().Add(-2*time.Hour), nil)
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected renewal after the interval to check the CF API but received %#v, %v", resp, err)
+	}
+
+	faults.Clear()
+
+	resp, err = renew(time.Now().Add(-2*time.Hour), map[string]interface{}{"renewals_since_validation": 2})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to succeed but received %#v, %v", resp, err)
+	}
+	if renewals := getRenewalsSinceValidation(resp.Auth.InternalData); renewals != 0 {
+		t.Fatalf("expected validation to reset the renewal count but received %d", renewals)
+	}
+}
+
+// newRenewalTestBackend stores the config and role as "test-role" in a new backend
+// whose CF API injects the returned faults. It returns a function renewing a token
+// issued and last validated at the given time, with any additional InternalData.
+func newRenewalTestBackend(t *testing.T, config *models.Configuration, role *models.RoleEntry) (func(lastValidated time.Time, internalData map[string]interface{}) (*logical.Response, error), *cf.Faults) {
+	ctx := context.Background()
+
+	faults := &cf.Faults{}
+	s := cf.MockServerWithFaults(false, nil, faults)
+	t.Cleanup(s.Close)
+
+	config.Version = 1
+	config.CFAPIAddr = s.URL
+	config.CFUsername = cf.AuthUsername
+	config.CFPassword = cf.AuthPassword
+	role.BoundAppIDs = []string{cf.FoundAppGUID}
+	role.DisableIPMatching = true
+
+	storage := &logical.InmemStorage{}
+	for key, value := range map[string]interface{}{configStorageKey: config, roleStoragePrefix + "test-role": role} {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	return func(lastValidated time.Time, internalData map[string]interface{}) (*logical.Response, error) {
+		auth := &logical.Auth{
+			InternalData: map[string]interface{}{
+				"role":           "test-role",
+				"instance_id":    cf.FoundServiceGUID,
+				"ip_address":     "10.255.181.105",
+				"last_validated": lastValidated.Format(time.RFC3339Nano),
+			},
+			Alias: &logical.Alias{
+				Metadata: map[string]string{
+					"org_id":   cf.FoundOrgGUID,
+					"space_id": cf.FoundSpaceGUID,
+					"app_id":   cf.FoundAppGUID,
+				},
+			},
+		}
+		auth.IssueTime = lastValidated
+		for key, value := range internalData {
+			auth.InternalData[key] = value
+		}
+		return b.pathLoginRenew(ctx, &logical.Request{
+			Storage:    storage,
+			Auth:       auth,
+			Connection: &logical.Connection{RemoteAddr: "127.0.0.1"},
+		}, nil)
+	}, faults
+}
+
+func TestValidateWithCFAPIRunningTasks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// The app has no live instances, so it may only log in while it runs a task.
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+	noTasks, appStopped := new(int32), new(int32)
+	stopped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/apps/"+cf.FoundAppGUID) && atomic.LoadInt32(appStopped) == 1:
+			rec := httptest.NewRecorder()
+			s.Config.Handler.ServeHTTP(rec, r)
+			w.WriteHeader(rec.Code)
+			w.Write([]byte(strings.ReplaceAll(rec.Body.String(), `"state": "STARTED"`, `"state": "STOPPED"`)))
+		case strings.HasSuffix(r.URL.Path, "/processes"):
+			rec := httptest.NewRecorder()
+			s.Config.Handler.ServeHTTP(rec, r)
+			w.WriteHeader(rec.Code)
+			w.Write([]byte(strings.ReplaceAll(rec.Body.String(), `"instances": 1`, `"instances": 0`)))
+		case strings.HasSuffix(r.URL.Path, "/tasks") && atomic.LoadInt32(noTasks) == 1:
+			w.Write([]byte(`{"pagination":{"total_results":0,"total_pages":1,"next":null},"resources":[]}`))
+		default:
+			s.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(stopped.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  stopped.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := &models.RoleEntry{RequiredAppState: models.AppStateLiveInstances, MinimumInstances: 1}
+	if _, err := b.validateWithCFAPI(ctx, config, role, cfCert); err != nil {
+		t.Fatalf("expected an app running a task to be valid but received %v", err)
+	}
+	// Tasks don't count towards a higher minimum.
+	_, err = b.validateWithCFAPI(ctx, config, &models.RoleEntry{RequiredAppState: models.AppStateLiveInstances, MinimumInstances: 2}, cfCert)
+	if errorCodeOf(err, errCodeInternal) != errCodeTooFewInstances {
+		t.Fatalf("expected an app with fewer live instances than the minimum to be invalid but received %v", err)
+	}
+	atomic.StoreInt32(noTasks, 1)
+	_, err = b.validateWithCFAPI(ctx, config, role, cfCert)
+	if errorCodeOf(err, errCodeInternal) != errCodeNoLiveInstances {
+		t.Fatalf("expected an app without live instances or running tasks to be invalid but received %v", err)
+	}
+	if _, err := b.validateWithCFAPI(ctx, config, &models.RoleEntry{RequiredAppState: models.AppStateLiveInstances}, cfCert); err != nil {
+		t.Fatalf("expected an app without live instances to be valid for a role with no minimum but received %v", err)
+	}
+
+	// Roles can let apps that are scaled to zero log in.
+	for _, state := range []string{models.AppStateStarted, models.AppStateExists} {
+		if _, err := b.validateWithCFAPI(ctx, config, &models.RoleEntry{RequiredAppState: state}, cfCert); err != nil {
+			t.Fatalf("expected an app without live instances to be valid for a role requiring %q but received %v", state, err)
+		}
+	}
+	atomic.StoreInt32(appStopped, 1)
+	_, err = b.validateWithCFAPI(ctx, config, &models.RoleEntry{RequiredAppState: models.AppStateStarted}, cfCert)
+	if errorCodeOf(err, errCodeInternal) != errCodeAppNotStarted {
+		t.Fatalf("expected a stopped app to be invalid for a role requiring it to be started but received %v", err)
+	}
+	if _, err := b.validateWithCFAPI(ctx, config, &models.RoleEntry{RequiredAppState: models.AppStateExists}, cfCert); err != nil {
+		t.Fatalf("expected a stopped app to be valid for a role only requiring it to exist but received %v", err)
+	}
+}
+
+func TestValidateWithCFAPISingleLookup(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+	var appLookups, otherLookups int32
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v3/apps/"+cf.FoundAppGUID):
+			atomic.AddInt32(&appLookups, 1)
+		case strings.HasPrefix(r.URL.Path, "/v3/spaces"), strings.HasPrefix(r.URL.Path, "/v3/organizations"):
+			atomic.AddInt32(&otherLookups, 1)
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(counted.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  counted.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The app, space, and org that are validated are the ones the names come from.
+	role := &models.RoleEntry{RequiredAppState: models.AppStateExists}
+	resources, err := b.validateWithCFAPI(ctx, config, role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuth("test-role", role, cfCert, resources, time.Now().Add(time.Hour), "{{org_name}}-{{space_name}}-{{app_name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"org_name", "space_name", "app_name"} {
+		if auth.Alias.Metadata[field] == "" {
+			t.Fatalf("expected %s in the alias metadata but received %v", field, auth.Alias.Metadata)
+		}
+	}
+	if expected := auth.Alias.Metadata["org_name"] + "-" + auth.Alias.Metadata["space_name"] + "-" + auth.Alias.Metadata["app_name"]; auth.DisplayName != expected {
+		t.Fatalf("expected the display name %q but received %q", expected, auth.DisplayName)
+	}
+	if n := atomic.LoadInt32(&appLookups); n != 1 {
+		t.Fatalf("expected the app to be looked up once but it was looked up %d times", n)
+	}
+	if n := atomic.LoadInt32(&otherLookups); n != 0 {
+		t.Fatalf("expected the space and org to come with the app but they were looked up %d times", n)
+	}
+}
+
+func TestValidateWithCFAPIWithoutNameResolution(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+	var included atomic.Value
+	recorded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3/apps/"+cf.FoundAppGUID) {
+			included.Store(r.URL.Query().Get("include"))
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorded.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  recorded.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The org is still read and checked, only its name is left out of the login.
+	role := &models.RoleEntry{RequiredAppState: models.AppStateExists, DisableNameResolution: true}
+	resources, err := b.validateWithCFAPI(ctx, config, role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := included.Load().(string); !strings.Contains(got, "space.organization") {
+		t.Fatalf("expected the app to be looked up with its space and org but it included %q", got)
+	}
+	if resources.org == nil || resources.org.GUID != cf.FoundOrgGUID {
+		t.Fatalf("expected the certificate's org but received %#v", resources.org)
+	}
+	otherOrg, err := models.NewCFCertificate(cf.FoundServiceGUID, "some-other-org", cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.validateWithCFAPI(ctx, config, role, otherOrg)
+	if errorCodeOf(err, errCodeInternal) != errCodeCFAPIMismatch {
+		t.Fatalf("expected a certificate for another org to be invalid but received %v", err)
+	}
+	// Nor is it left unread when the space isn't checked, so an org the CF API doesn't
+	// know fails the login.
+	withoutSpace := &models.RoleEntry{RequiredAppState: models.AppStateExists, DisableNameResolution: true, DisableSpaceAPICheck: true}
+	_, err = b.validateWithCFAPI(ctx, config, withoutSpace, otherOrg)
+	if errorCodeOf(err, errCodeInternal) != errCodeCFAPILookupFailed {
+		t.Fatalf("expected the certificate's org to be looked up without the space check but received %v", err)
+	}
+
+	auth, err := newAuth("test-role", role, cfCert, resources, time.Now().Add(time.Hour), "{{org_name}}-{{space_name}}-{{app_name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"org_name", "space_name", "app_name"} {
+		if _, ok := auth.Alias.Metadata[field]; ok {
+			t.Fatalf("expected no %s without name resolution but received %v", field, auth.Alias.Metadata)
+		}
+	}
+	// Without the names, the token is named for its instance ID.
+	if auth.DisplayName != cfCert.InstanceID {
+		t.Fatalf("expected the display name %q but received %q", cfCert.InstanceID, auth.DisplayName)
+	}
+}
+
+func TestRenderDisplayName(t *testing.T) {
+	t.Parallel()
+
+	cfCert := &models.CFCertificate{InstanceID: "instance-id"}
+	metadata := map[string]string{"org_name": "org", "space_name": "space", "app_name": "app"}
+	for _, tc := range []struct {
+		template string
+		expected string
+	}{
+		{"", "instance-id"},
+		{"{{org_name}}-{{space_name}}-{{app_name}}", "org-space-app"},
+		{"{{ app_name }}/{{instance_id}}", "app/instance-id"},
+		{"{{app_name}}-{{process_type}}", "instance-id"},
+	} {
+		if got := renderDisplayName(tc.template, cfCert, metadata); got != tc.expected {
+			t.Fatalf("expected %q to render %q but received %q", tc.template, tc.expected, got)
+		}
+	}
+
+	if err := validateDisplayNameTemplate("{{org_name}}-{{instance_id}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateDisplayNameTemplate("{{org_name}}-{{role}}"); err == nil {
+		t.Fatal("expected a template referring to an unknown field to be invalid")
+	}
+}
+
+func TestValidateWithCFAPISkippedChecks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+	// The CF API user can read neither spaces nor orgs, even as included with the app.
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3/spaces/") || strings.HasPrefix(r.URL.Path, "/v3/organizations/") || r.URL.Query().Get("include") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": [{"code": 10003, "title": "CF-NotAuthorized", "detail": "You are not authorized to perform the requested action"}]}`))
+			return
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(forbidden.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  forbidden.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := &models.RoleEntry{RequiredAppState: models.AppStateExists, DisableSpaceAPICheck: true}
+	if _, err := b.validateWithCFAPI(ctx, config, role, cfCert); errorCodeOf(err, errCodeInternal) != errCodeCFAPILookupFailed {
+		t.Fatalf("expected the org lookup to fail but received %v", err)
+	}
+
+	role.DisableOrgAPICheck = true
+	resources, err := b.validateWithCFAPI(ctx, config, role, cfCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources.app == nil || resources.space != nil || resources.org != nil {
+		t.Fatalf("expected only the app but received %#v", resources)
+	}
+
+	// The app's space is still checked against the certificate's.
+	otherSpace, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, "some-other-space", cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.validateWithCFAPI(ctx, config, role, otherSpace)
+	if errorCodeOf(err, errCodeInternal) != errCodeCFAPIMismatch {
+		t.Fatalf("expected a certificate for another space to be invalid but received %v", err)
+	}
+}
+
+func TestWithInstanceDetailsVerifyInstanceIDs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+	var state atomic.Value
+	state.Store("RUNNING")
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/stats") {
+			w.Write([]byte(`{"resources": [{"type": "web", "index": 0, "state": "` + state.Load().(string) + `", "instance_guid": "` + cf.FoundServiceGUID + `"}]}`))
+			return
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(stats.Close)
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: &logical.InmemStorage{},
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+	config := &models.Configuration{
+		Version:           1,
+		CFAPIAddr:         stats.URL,
+		CFUsername:        cf.AuthUsername,
+		CFPassword:        cf.AuthPassword,
+		VerifyInstanceIDs: true,
+	}
+	cfCert, err := models.NewCFCertificate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	role := &models.RoleEntry{}
+
+	for _, live := range []string{"RUNNING", "STARTING"} {
+		state.Store(live)
+		if _, err := b.withInstanceDetails(ctx, config, role, cfCert, &cfResources{}); err != nil {
+			t.Fatalf("expected a %s instance to be live but received %v", live, err)
+		}
+	}
+	state.Store("CRASHED")
+	if _, err := b.withInstanceDetails(ctx, config, role, cfCert, &cfResources{}); errorCodeOf(err, errCodeInternal) != errCodeInstanceNotLive {
+		t.Fatalf("expected a crashed instance not to be live but received %v", err)
+	}
+
+	state.Store("RUNNING")
+	otherInstance, err := models.NewCFCertificate("some-other-instance", cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.withInstanceDetails(ctx, config, role, otherInstance, &cfResources{}); errorCodeOf(err, errCodeInternal) != errCodeInstanceNotLive {
+		t.Fatalf("expected an instance missing from the stats not to be live but received %v", err)
+	}
+
+	// Without the config verifying instance IDs, nothing is looked up.
+	config.VerifyInstanceIDs = false
+	if _, err := b.withInstanceDetails(ctx, config, role, otherInstance, &cfResources{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginRenewCapTTLAtIdentityExpiry(t *testing.T) {
+	t.Parallel()
+
+	renew, _ := newRenewalTestBackend(t, &models.Configuration{}, &models.RoleEntry{
+		CapTTLAtIdentityExpiry: true,
+	})
+
+	issueTime := time.Now().Add(-time.Minute)
+	resp, err := renew(issueTime, map[string]interface{}{
+		"identity_expiry": issueTime.Add(time.Hour).Format(time.RFC3339Nano),
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to succeed but received %#v, %v", resp, err)
+	}
+	if resp.Auth.MaxTTL != time.Hour {
+		t.Fatalf("expected the max TTL to be capped at the identity's expiry but received %s", resp.Auth.MaxTTL)
+	}
+
+	resp, err = renew(issueTime, map[string]interface{}{
+		"identity_expiry": time.Now().Add(-time.Second).Format(time.RFC3339Nano),
+	})
+	if err != nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "expired") {
+		t.Fatalf("expected renewal past the identity's expiry to fail but received %#v, %v", resp, err)
+	}
+}
+
+func TestLoginRenewRefreshAliasMetadata(t *testing.T) {
+	t.Parallel()
+
+	renew, _ := newRenewalTestBackend(t, &models.Configuration{}, &models.RoleEntry{
+		RefreshAliasMetadata: true,
+		AliasMetadata:        []string{"app_id", "app_name", "space_name"},
+	})
+
+	// The role checks the CF API on every renewal, so the names are looked up again.
+	resp, err := renew(time.Now().Add(-time.Minute), nil)
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to succeed but received %#v, %v", resp, err)
+	}
+	expected := map[string]string{
+		"org_id":     cf.FoundOrgGUID,
+		"space_id":   cf.FoundSpaceGUID,
+		"app_id":     cf.FoundAppGUID,
+		"app_name":   cf.FoundAppName,
+		"space_name": cf.FoundSpaceName,
+	}
+	if !reflect.DeepEqual(resp.Auth.Alias.Metadata, expected) {
+		t.Fatalf("expected the alias metadata %v but received %v", expected, resp.Auth.Alias.Metadata)
+	}
+}
+
+func TestLoginRenewReverifiesCertificate(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// These certificates are issued by a CA that isn't configured, as if it had been removed.
+	otherCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := otherCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	renew, _ := newRenewalTestBackend(t, &models.Configuration{
+		IdentityCACertificates: []string{testCerts.CACertificate},
+	}, &models.RoleEntry{})
+
+	resp, err := renew(time.Now(), map[string]interface{}{
+		"cf_instance_cert": testCerts.InstanceCertificate,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected renewal to succeed but received %#v, %v", resp, err)
+	}
+
+	resp, err = renew(time.Now(), map[string]interface{}{
+		"cf_instance_cert": otherCerts.InstanceCertificate,
+	})
+	if err != nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "no longer valid") {
+		t.Fatalf("expected renewal with an untrusted certificate to fail but received %#v, %v", resp, err)
+	}
+}
+
+func TestLoginRenewDenied(t *testing.T) {
+	t.Parallel()
+
+	testCerts, err := certificates.Generate(cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Tokens issued before the space was denied can't be renewed.
+	renew, _ := newRenewalTestBackend(t, &models.Configuration{
+		IdentityCACertificates: []string{testCerts.CACertificate},
+		DeniedSpaceIDs:         []string{cf.FoundSpaceGUID},
+	}, &models.RoleEntry{})
+
+	resp, err := renew(time.Now(), map[string]interface{}{
+		"cf_instance_cert": testCerts.InstanceCertificate,
+	})
+	if err != nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "denied by the mount's config") {
+		t.Fatalf("expected renewal for a denied space to fail but received %#v, %v", resp, err)
+	}
+}
+
+func TestLoginRejectsMalleatedECDSASignature(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	testCerts, err := certificates.GenerateECDSA(elliptic.P256(), cf.FoundServiceGUID, cf.FoundOrgGUID, cf.FoundSpaceGUID, cf.FoundAppGUID, "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	s := cf.MockServer(false, nil)
+	defer s.Close()
+
+	storage := &logical.InmemStorage{}
+	for key, value := range map[string]interface{}{
+		configStorageKey: &models.Configuration{
+			Version:                1,
+			IdentityCACertificates: []string{testCerts.CACertificate},
+			CFAPIAddr:              s.URL,
+			CFUsername:             cf.AuthUsername,
+			CFPassword:             cf.AuthPassword,
+			LoginMaxSecNotBefore:   5 * time.Second,
+			LoginMaxSecNotAfter:    time.Second,
+		},
+		roleStoragePrefix + "test-role": &models.RoleEntry{
+			BoundAppIDs:       []string{cf.FoundAppGUID},
+			DisableIPMatching: true,
+		},
+	} {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{DefaultLeaseTTLVal: time.Hour, MaxLeaseTTLVal: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := signatures.LoadPrivateKey(testCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingTime := time.Now().UTC()
+	signature, err := signatures.Sign(signer, &signatures.SignatureData{
+		SigningTime:            signingTime,
+		Role:                   "test-role",
+		CFInstanceCertContents: testCerts.InstanceCertificate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// (r, n-s) is just as valid a signature as (r, s).
+	parsed, err := signatures.Parse(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(parsed.Bytes, &sig); err != nil {
+		t.Fatal(err)
+	}
+	sig.S.Sub(elliptic.P256().Params().N, sig.S)
+	malleated, err := asn1.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(signature string) *logical.Response {
+		resp, err := lb.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"role":             "test-role",
+				"cf_instance_cert": testCerts.InstanceCertificate,
+				"signing_time":     signingTime.Format(signatures.TimeFormat),
+				"signature":        signature,
+			},
+			Connection: &logical.Connection{RemoteAddr: "127.0.0.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := login(signature); resp == nil || resp.IsError() {
+		t.Fatalf("expected login to succeed but received %#v", resp)
+	}
+	resp := login("v1:" + base64.StdEncoding.EncodeToString(malleated))
+	if resp == nil || !resp.IsError() || parseErrorCode(resp.Error().Error()) != string(errCodeSignatureReused) {
+		t.Fatalf("expected the malleated signature to be rejected as reused but received %#v", resp)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathLoginThrottle() *framework.Path {
+	return &framework.Path{
+		Pattern: "login-throttle",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationSuffix: "login-throttle",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"app_id": {
+				Type:        framework.TypeString,
+				Description: "The app whose failed logins are read or forgotten. Required to forget them.",
+				Query:       true,
+			},
+			"remote_address": {
+				Type:        framework.TypeString,
+				Description: "If set, only the app's failed logins from this address are forgotten.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationLoginThrottleRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.operationLoginThrottleDelete,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb: "reset",
+				},
+			},
+		},
+		HelpSynopsis:    pathLoginThrottleSyn,
+		HelpDescription: pathLoginThrottleDesc,
+	}
+}
+
+func (b *backend) operationLoginThrottleRead(_ context.Context, _ *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	appID := data.Get("app_id").(string)
+
+	throttled := []map[string]interface{}{}
+	addresses := []map[string]interface{}{}
+	for _, t := range b.loginThrottle.list(time.Now()) {
+		if !t.AnyApp && appID != "" && t.AppID != appID {
+			continue
+		}
+		entry := map[string]interface{}{
+			"remote_address": t.RemoteAddr,
+			"failures":       t.Failures,
+			"cooldowns":      t.Cooldowns,
+			"blocked":        !t.BlockedUntil.IsZero(),
+		}
+		if !t.BlockedUntil.IsZero() {
+			entry["blocked_until"] = t.BlockedUntil.UTC().Format(time.RFC3339)
+		}
+		if t.AnyApp {
+			addresses = append(addresses, entry)
+			continue
+		}
+		entry["app_id"] = t.AppID
+		throttled = append(throttled, entry)
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"apps":      throttled,
+			"addresses": addresses,
+		},
+	}, nil
+}
+
+func (b *backend) operationLoginThrottleDelete(_ context.Context, _ *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	appID := data.Get("app_id").(string)
+	if appID == "" {
+		return logical.ErrorResponse("'app_id' is required"), nil
+	}
+	cleared := b.loginThrottle.clear(appID, data.Get("remote_address").(string))
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"cleared": cleared,
+		},
+	}, nil
+}
+
+const pathLoginThrottleSyn = `
+Read or reset the failed logins counted against apps.
+`
+
+const pathLoginThrottleDesc = `
+Reading this path returns, for each app and address that has failed to log in
+within the login failure window, or that is in or just out of a cooldown, how
+many consecutive failures have been counted, how many cooldowns in a row it has
+been refused for, and until when its logins are refused, if they are. Apps in a
+cooldown are listed first. The same is returned under "addresses" for each
+address's failures, whichever apps they claimed, which are listed whatever the
+"app_id". These are counted in memory, so only the node that handles the
+request is read. Deleting it with an "app_id", and optionally a
+"remote_address", forgets the app's failures, and those of the addresses it
+failed from, so that its logins are accepted again right away.
+`
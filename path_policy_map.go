@@ -0,0 +1,218 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/policyutil"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const policyMapStoragePrefix = "policy-map/"
+
+// policyMapTypes are the kinds of CF resources that policies can be mapped to.
+var policyMapTypes = []interface{}{"orgs", "spaces"}
+
+// policyMapping is the policies mapped to an org or space, as it's reflected in
+// Vault's storage system.
+type policyMapping struct {
+	Policies []string `json:"policies"`
+}
+
+func (b *backend) pathListPolicyMap() *framework.Path {
+	return &framework.Path{
+		Pattern: "map/" + framework.GenericNameRegex("type") + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "list",
+			OperationSuffix: "policy-mappings",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"type": {
+				Type:          framework.TypeString,
+				AllowedValues: policyMapTypes,
+				Description:   `The type of CF resource to list the mappings of, "orgs" or "spaces".`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.operationPolicyMapList,
+			},
+		},
+		HelpSynopsis:    pathListPolicyMapSyn,
+		HelpDescription: pathListPolicyMapDesc,
+	}
+}
+
+func (b *backend) pathPolicyMap() *framework.Path {
+	return &framework.Path{
+		Pattern: "map/" + framework.GenericNameRegex("type") + "/" + framework.GenericNameRegex("guid"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationSuffix: "policy-mapping",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"type": {
+				Type:          framework.TypeString,
+				AllowedValues: policyMapTypes,
+				Description:   `The type of CF resource to map policies to, "orgs" or "spaces".`,
+			},
+			"guid": {
+				Type:        framework.TypeString,
+				Description: "The GUID of the org or space to map policies to.",
+			},
+			"policies": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The policies added to the tokens of the org's or space's apps.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationPolicyMapUpdate,
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationPolicyMapRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.operationPolicyMapDelete,
+			},
+		},
+		HelpSynopsis:    pathPolicyMapSyn,
+		HelpDescription: pathPolicyMapDesc,
+	}
+}
+
+// policyMapStorageKey returns the storage key for the mapping type and, if given, the
+// GUID, or an error response if the type can't be mapped.
+func policyMapStorageKey(mapType, guid string) (string, *logical.Response) {
+	for _, allowed := range policyMapTypes {
+		if mapType == allowed {
+			return policyMapStoragePrefix + mapType + "/" + guid, nil
+		}
+	}
+	return "", logical.ErrorResponse(fmt.Sprintf("'type' must be one of %v", policyMapTypes))
+}
+
+func (b *backend) operationPolicyMapList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	prefix, errResp := policyMapStorageKey(data.Get("type").(string), "")
+	if errResp != nil {
+		return errResp, nil
+	}
+	entries, err := req.Storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *backend) operationPolicyMapUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := policyMapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	mapping := &policyMapping{
+		Policies: policyutil.SanitizePolicies(data.Get("policies").([]string), policyutil.DoNotAddDefaultPolicy),
+	}
+	entry, err := logical.StorageEntryJSON(key, mapping)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) operationPolicyMapRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := policyMapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	mapping, err := getPolicyMapping(ctx, req.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if mapping == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"policies": mapping.Policies,
+		},
+	}, nil
+}
+
+func (b *backend) operationPolicyMapDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := policyMapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	if err := req.Storage.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func getPolicyMapping(ctx context.Context, storage logical.Storage, key string) (*policyMapping, error) {
+	entry, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	mapping := &policyMapping{}
+	if err := entry.DecodeJSON(mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// addMappedPolicies adds the policies mapped to the certificate's org and space to the
+// auth's policies.
+func addMappedPolicies(ctx context.Context, storage logical.Storage, auth *logical.Auth, cfCert *models.CFCertificate) error {
+	for _, key := range []string{
+		policyMapStoragePrefix + "orgs/" + cfCert.OrgID,
+		policyMapStoragePrefix + "spaces/" + cfCert.SpaceID,
+	} {
+		mapping, err := getPolicyMapping(ctx, storage, key)
+		if err != nil {
+			return err
+		}
+		if mapping == nil {
+			continue
+		}
+		for _, policy := range mapping.Policies {
+			auth.Policies = strutil.AppendIfMissing(auth.Policies, policy)
+		}
+	}
+	return nil
+}
+
+const pathListPolicyMapSyn = `
+List the orgs or spaces that policies are mapped to.
+`
+
+const pathListPolicyMapDesc = `
+Lists the GUIDs of the orgs, at map/orgs, or the spaces, at map/spaces, that
+have policies mapped to them.
+`
+
+const pathPolicyMapSyn = `
+Map policies to a CF org or space.
+`
+
+const pathPolicyMapDesc = `
+Writing policies to map/<type>/<guid>, where the type is "orgs" or "spaces",
+adds them to the tokens issued to the instances of that org or space, whichever
+role they log in with. This lets the policies for many orgs or spaces be
+assigned centrally, instead of with a role for each one. Tokens that were
+already issued keep the policies they were issued with.
+`
@@ -0,0 +1,176 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const revocationStoragePrefix = "revocations/"
+
+// revocableTypes are the kinds of CF resources whose tokens can be revoked.
+var revocableTypes = []interface{}{"app", "space", "org"}
+
+// revocation is an app, space, or org whose tokens have been revoked, as it's
+// reflected in Vault's storage system.
+type revocation struct {
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+func (b *backend) pathRevoke() *framework.Path {
+	return &framework.Path{
+		Pattern: "revoke/" + framework.GenericNameRegex("type") + "/" + framework.GenericNameRegex("guid"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationSuffix: "revocation",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"type": {
+				Type:          framework.TypeString,
+				AllowedValues: revocableTypes,
+				Description:   `The type of CF resource to revoke tokens for, "app", "space", or "org".`,
+			},
+			"guid": {
+				Type:        framework.TypeString,
+				Description: "The GUID of the app, space, or org to revoke tokens for.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationRevokeUpdate,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb: "revoke",
+				},
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationRevokeRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.operationRevokeDelete,
+			},
+		},
+		HelpSynopsis:    pathRevokeSyn,
+		HelpDescription: pathRevokeDesc,
+	}
+}
+
+// revocationStorageKey returns the storage key for a revocation, or an error response
+// if the type isn't revocable.
+func revocationStorageKey(data *framework.FieldData) (string, *logical.Response) {
+	revocationType := data.Get("type").(string)
+	for _, allowed := range revocableTypes {
+		if revocationType == allowed {
+			return revocationStoragePrefix + revocationType + "/" + data.Get("guid").(string), nil
+		}
+	}
+	return "", logical.ErrorResponse(fmt.Sprintf("'type' must be one of %v", revocableTypes))
+}
+
+func (b *backend) operationRevokeUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := revocationStorageKey(data)
+	if errResp != nil {
+		return errResp, nil
+	}
+	entry, err := logical.StorageEntryJSON(key, &revocation{RevokedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	resp := &logical.Response{}
+	resp.AddWarning("Tokens that were already issued can no longer be renewed, but remain valid until their current TTL runs out. " +
+		"To revoke them right away, revoke all of the mount's tokens with sys/leases/revoke-prefix.")
+	return resp, nil
+}
+
+func (b *backend) operationRevokeRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := revocationStorageKey(data)
+	if errResp != nil {
+		return errResp, nil
+	}
+	revoked, err := getRevocation(ctx, req.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if revoked == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"revoked_at": revoked.RevokedAt.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+func (b *backend) operationRevokeDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := revocationStorageKey(data)
+	if errResp != nil {
+		return errResp, nil
+	}
+	if err := req.Storage.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func getRevocation(ctx context.Context, storage logical.Storage, key string) (*revocation, error) {
+	entry, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	revoked := &revocation{}
+	if err := entry.DecodeJSON(revoked); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// checkNotRevoked returns an error if the certificate's app, space, or org has been
+// revoked, or reconciliation has found its app deleted.
+func checkNotRevoked(ctx context.Context, storage logical.Storage, cfCert *models.CFCertificate) error {
+	if err := checkAppNotDeleted(ctx, storage, cfCert.AppID); err != nil {
+		return err
+	}
+	for _, revocable := range []struct {
+		revocationType string
+		guid           string
+	}{
+		{"app", cfCert.AppID},
+		{"space", cfCert.SpaceID},
+		{"org", cfCert.OrgID},
+	} {
+		revoked, err := getRevocation(ctx, storage, revocationStoragePrefix+revocable.revocationType+"/"+revocable.guid)
+		if err != nil {
+			return err
+		}
+		if revoked != nil {
+			return withErrorCode(errCodeRevoked, fmt.Errorf("tokens for %s %s were revoked at %s", revocable.revocationType, revocable.guid, revoked.RevokedAt.Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+const pathRevokeSyn = `
+Revoke the tokens issued to a CF app, space, or org.
+`
+
+const pathRevokeDesc = `
+Writing to revoke/<type>/<guid>, where the type is "app", "space", or "org",
+stops the instances of that app, space, or org from logging in, and stops the
+tokens already issued to them from being renewed. Vault doesn't let auth
+methods revoke tokens themselves, so tokens that were already issued remain
+valid until their current TTL runs out. Reading the path returns when the
+tokens were revoked, and deleting it allows logins again.
+`
@@ -6,7 +6,11 @@ package cf
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/hashicorp/vault-plugin-auth-cf/models"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
@@ -23,6 +27,20 @@ func (b *backend) pathListRoles() *framework.Path {
 			OperationVerb:   "list",
 			OperationSuffix: "roles",
 		},
+		Fields: map[string]*framework.FieldSchema{
+			"bound_application_id": {
+				Type:        framework.TypeString,
+				Description: "If set, only list the roles that the app with this ID may log in with.",
+			},
+			"bound_space_id": {
+				Type:        framework.TypeString,
+				Description: "If set, only list the roles that apps in the space with this ID may log in with.",
+			},
+			"bound_organization_id": {
+				Type:        framework.TypeString,
+				Description: "If set, only list the roles that apps in the org with this ID may log in with.",
+			},
+		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ListOperation: &framework.PathOperation{
 				Callback: b.operationRolesList,
@@ -33,12 +51,37 @@ func (b *backend) pathListRoles() *framework.Path {
 	}
 }
 
-func (b *backend) operationRolesList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+func (b *backend) operationRolesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	entries, err := req.Storage.List(ctx, roleStoragePrefix)
 	if err != nil {
 		return nil, err
 	}
-	return logical.ListResponse(entries), nil
+	appID := data.Get("bound_application_id").(string)
+	spaceID := data.Get("bound_space_id").(string)
+	orgID := data.Get("bound_organization_id").(string)
+	if appID == "" && spaceID == "" && orgID == "" {
+		return logical.ListResponse(entries), nil
+	}
+
+	// Roles that don't bind an ID admit any, so they're listed along with those that
+	// bind the given one.
+	admits := func(id string, bound []string) bool {
+		return id == "" || meetsBoundIDConstraints(id, bound)
+	}
+	var roleNames []string
+	for _, roleName := range entries {
+		role, err := getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		if admits(appID, role.BoundAppIDs) && admits(spaceID, role.BoundSpaceIDs) && admits(orgID, role.BoundOrgIDs) {
+			roleNames = append(roleNames, roleName)
+		}
+	}
+	return logical.ListResponse(roleNames), nil
 }
 
 func (b *backend) pathRoles() *framework.Path {
@@ -86,6 +129,173 @@ func (b *backend) pathRoles() *framework.Path {
 				},
 				Description: "Require that the client certificate presented has at least one of these instance IDs.",
 			},
+			"bound_cert_ip_cidrs": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Certificate IP CIDRs",
+					Value: "10.255.0.0/16",
+				},
+				Description: `Require that one of the client certificate's IP addresses is within one of these CIDRs,
+such as the environment's container network, whatever address the login comes from.`,
+			},
+			"bound_spiffe_ids": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound SPIFFE IDs",
+					Value: "spiffe://cf.example.com/org/payments/space/production/app/payments-api",
+				},
+				Description: `Require that the client certificate presented carries one of these SPIFFE IDs in its URI SANs.
+Each must be a valid SPIFFE ID of a workload, with a trust domain and a path.`,
+			},
+			"bound_application_names": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Application Names",
+					Value: "payments-api",
+				},
+				Description: "Require that the client certificate presented carries at least one of these app names.",
+			},
+			"bound_space_names": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Space Names",
+					Value: "production",
+				},
+				Description: "Require that the client certificate presented carries at least one of these space names.",
+			},
+			"bound_organization_names": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Organization Names",
+					Value: "payments",
+				},
+				Description: "Require that the client certificate presented carries at least one of these org names.",
+			},
+			"bound_stacks": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Stacks",
+					Value: "cflinuxfs4",
+				},
+				Description: `Require that the app logging in runs on one of these stacks, as configured on the app in
+CF’s API.`,
+			},
+			"bound_lifecycle_types": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Lifecycle Types",
+					Value: "buildpack",
+				},
+				Description: `Require that the app logging in has one of these lifecycle types, such as "buildpack" or
+"docker", as configured on the app in CF’s API.`,
+			},
+			"bound_docker_images": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Docker Images",
+					Value: "registry.example.com/team/*",
+				},
+				Description: `Require that Docker apps logging in run one of these images, as reported for their current
+droplet by CF’s API. An image ending in "*" matches any image starting with the rest of it, such as a repository.
+Apps with other lifecycle types aren't affected.`,
+			},
+			"bound_buildpacks": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Buildpacks",
+					Value: "java_buildpack",
+				},
+				Description: `Require that the app logging in was built only with these buildpacks, as reported for its
+current droplet by CF’s API. Apps whose droplets weren't built with buildpacks, such as Docker apps, can't log in.`,
+			},
+			"bound_current_droplets": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Bound Current Droplets",
+				},
+				Description: `Require that the app logging in has one of these droplet GUIDs as its current droplet, as
+reported by CF’s API, so that apps rolled back to or still staged with other droplets can't log in.`,
+			},
+			"require_current_revision": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Require Current Revision",
+				},
+				Description: `If true, refuse logins while any of the app's deployed revisions, those with running
+instances, is of a droplet other than the app's current one, as reported by CF’s API. Logins are refused while a
+rolling deployment replaces the old instances.`,
+			},
+			"required_service_instance": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Required Service Instance",
+					Value: "vault-access",
+				},
+				Description: `The name or GUID of a service instance, such as a user-provided service, that the app logging
+in must be bound to, as reported by CF’s API.`,
+			},
+			"require_ssh_disabled": {
+				Type: framework.TypeBool,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Require SSH Disabled",
+				},
+				Description: `If true, refuse logins from apps that accept SSH connections, as reported by CF’s API, so
+that developers can't cf ssh into an instance to read its token. SSH may be enabled for the app, its space, or
+globally.`,
+			},
+			"required_app_state": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Required App State",
+					Value: models.AppStateLiveInstances,
+				},
+				Description: `What CF’s API must report about the app logging in. "live_instances" requires live
+instances or running tasks, "started" requires the app to be STARTED even if it's scaled to zero, and "exists" only
+requires the app to exist.`,
+				AllowedValues: []interface{}{models.AppStateLiveInstances, models.AppStateStarted, models.AppStateExists},
+				Default:       models.AppStateLiveInstances,
+			},
+			"minimum_instances": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Minimum Instances",
+					Value: 1,
+				},
+				Description: `How many live instances the app logging in must have, as reported by CF’s API, when
+"required_app_state" is "live_instances". With the default of 1, an app that's only running tasks may also log in.
+0 lets apps that are scaled to zero log in.`,
+				Default: 1,
+			},
+			"bound_process_types": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Process Types",
+					Value: "web",
+				},
+				Description: `Require that the instance logging in runs as one of these process types, such as web,
+or the name of a task or sidecar process. The process type is looked up in CF’s API at login, which needs a CF
+API that reports instance GUIDs in process stats.`,
+			},
+			"bound_instance_indexes": {
+				Type: framework.TypeCommaIntSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Bound Instance Indexes",
+					Value: "0",
+				},
+				Description: `Require that the instance logging in has one of these indexes, such as 0 to let only
+one of an app's instances use the role. The index is looked up in CF’s API at login, which needs a CF API that
+reports instance GUIDs in process stats.`,
+			},
+			"allow_unconstrained": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Allow Unconstrained",
+					Value: "false",
+				},
+				Description: `If set to true, the role may be written without binding any application, space,
+organization, or instance IDs or names, so that any app on the foundation may log in with it.`,
+			},
 			"disable_ip_matching": {
 				Type:    framework.TypeBool,
 				Default: false,
@@ -95,6 +305,176 @@ func (b *backend) pathRoles() *framework.Path {
 				},
 				Description: `If set to true, disables the default behavior that logging in must be performed from 
 an acceptable IP address described by the certificate presented.`,
+			},
+			"disable_cf_api_checks": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Disable CF API Checks",
+					Value: "false",
+				},
+				Description: `If set to true, logins don't check the app, space, and org against the CF API, and
+are authenticated on the certificate chain, signature, and bound constraints alone. Useful when Vault
+trusts the identity CA but can't reach the CF API.`,
+			},
+			"disable_name_resolution": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Disable Name Resolution",
+					Value: "false",
+				},
+				Description: `If set to true, logins leave the org, space, and app names resolved in the CF API out,
+and only the names the certificate carries are written to the alias metadata and templated policies. The app,
+space, and org are still checked in the CF API; to not read the org, set 'disable_org_api_check'.`,
+			},
+			"disable_space_api_check": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Disable Space API Check",
+					Value: "false",
+				},
+				Description: `If set to true, logins don't look up the app's space in the CF API, or check the
+certificate's org against it, while the app is still checked. Useful when the CF API user can't read spaces.`,
+			},
+			"disable_org_api_check": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Disable Org API Check",
+					Value: "false",
+				},
+				Description: `If set to true, logins don't look up the org in the CF API, while the app is still
+checked. Useful when the CF API user can't read orgs.`,
+			},
+			"cap_ttl_at_identity_expiry": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Cap TTL At Identity Expiry",
+					Value: "false",
+				},
+				Description: `If set to true, tokens can't be issued or renewed past the expiry of the instance
+identity certificate or JWT they were logged in with.`,
+			},
+			"single_active_token": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Single Active Token",
+					Value: "false",
+				},
+				Description: `If set to true, a login by an instance stops the tokens it was issued before with
+this role from being renewed, so they expire at the end of their current TTL.`,
+			},
+			"revalidate_every_n_renewals": {
+				Type: framework.TypeInt,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Revalidate Every N Renewals",
+				},
+				Description: `If set, token renewals only check the app, space, and org against the CF API every
+this many renewals, and otherwise only check the role's constraints. If neither this nor "revalidation_interval"
+is set, every renewal checks the CF API.`,
+			},
+			"revalidation_interval": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Revalidation Interval",
+				},
+				Description: `If set, token renewals only check the app, space, and org against the CF API once this
+long has passed since the token was last checked, and otherwise only check the role's constraints.`,
+			},
+			"alias_metadata": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Alias Metadata",
+					Value: "app_id,space_id,org_id",
+				},
+				Description: fmt.Sprintf(`The fields to write to the alias metadata of tokens issued for the role,
+out of %s. If unset, all of them are written.`, strings.Join(aliasMetadataFields, ", ")),
+			},
+			"static_alias_metadata": {
+				Type: framework.TypeKVPairs,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Static Alias Metadata",
+				},
+				Description: `Key and value pairs added to the alias metadata of tokens issued for the role as they are.
+The keys must not be the names of the fields that "alias_metadata" chooses from.`,
+			},
+			"refresh_alias_metadata": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Refresh Alias Metadata",
+					Value: "false",
+				},
+				Description: `If set to true, renewals that check the CF API update the org, space, and app names in
+the alias metadata, so that they follow renames.`,
+			},
+			"auth_metadata": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Auth Metadata",
+					Value: "app_id,space_id,org_id",
+				},
+				Description: fmt.Sprintf(`The fields to write to the metadata of tokens issued for the role, which audit
+logs record, out of %s. If unset, all of them are written.`, strings.Join(aliasMetadataFields, ", ")),
+			},
+			"display_name_template": {
+				Type: framework.TypeString,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Display Name Template",
+					Value: "{{org_name}}-{{space_name}}-{{app_name}}",
+				},
+				Description: fmt.Sprintf(`The template of the display name of tokens issued for the role, referring to %s.
+If unset, the config's is used. If a field isn't known for a login, the token is named for its instance ID.`, strings.Join(displayNameFields, ", ")),
+			},
+			"include_instance_details": {
+				Type:    framework.TypeBool,
+				Default: false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Include Instance Details",
+					Value: "false",
+				},
+				Description: `If set to true, logins look up the instance's index and process type, such as web or
+worker, in CF’s API, and write them to the token and alias metadata as "instance_index" and "process_type".
+This takes an extra call to CF’s API per process of the app, and needs a CF API that reports instance GUIDs in
+process stats. Logins still succeed if they can't be looked up.`,
+			},
+			"alias_custom_metadata_labels": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Alias Custom Metadata Labels",
+					Value: "team",
+				},
+				Description: `The keys of the app's CF labels to copy to the alias custom metadata at login. Labels
+are only read when logins check CF’s API.`,
+			},
+			"alias_custom_metadata_annotations": {
+				Type: framework.TypeCommaStringSlice,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:  "Alias Custom Metadata Annotations",
+					Value: "cost-center",
+				},
+				Description: `The keys of the app's CF annotations to copy to the alias custom metadata at login.
+Annotations are only read when logins check CF’s API, and take precedence over labels with the same key.`,
+			},
+			"login_max_seconds_not_before": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Max Seconds Old",
+				},
+				Description: `Duration in seconds for the maximum acceptable age of a "signing_time", overriding
+the config's login_max_seconds_not_before for this role. If unset or 0, the config's value is used.`,
+			},
+			"login_max_seconds_not_after": {
+				Type: framework.TypeDurationSecond,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Login Max Seconds Ahead",
+				},
+				Description: `Duration in seconds for the maximum acceptable length in the future a "signing_time" can be,
+overriding the config's login_max_seconds_not_after for this role. If unset or 0, the config's value is used.`,
 			},
 			"policies": &framework.FieldSchema{
 				Type:        framework.TypeCommaStringSlice,
@@ -156,16 +536,42 @@ func (b *backend) operationRolesExistenceCheck(ctx context.Context, req *logical
 func (b *backend) operationRolesCreateUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleName := data.Get("role").(string)
 
+	storedRole, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	before, err := changeSnapshot(storedRole)
+	if err != nil {
+		return nil, err
+	}
 	role := &models.RoleEntry{}
-	if req.Operation == logical.UpdateOperation {
-		storedRole, err := getRole(ctx, req.Storage, roleName)
-		if err != nil {
-			return nil, err
-		}
-		if storedRole != nil {
-			role = storedRole
-		}
+	if req.Operation == logical.UpdateOperation && storedRole != nil {
+		role = storedRole
+	}
+	if resp, err := parseRoleFields(req, data, role); resp != nil || err != nil {
+		return resp, err
+	}
+
+	sortBoundIDs(role)
+	if err := storeRole(ctx, req.Storage, roleName, role); err != nil {
+		return nil, err
 	}
+	b.sendEvent(ctx, eventTypeRoleWrite, "path", req.Path, "role", roleName, "modified", "true")
+	b.recordChange(ctx, req.Storage, newConfigChange(req, roleName), before, role)
+
+	resp := &logical.Response{}
+	for _, warning := range b.roleWarnings(role) {
+		resp.AddWarning(warning)
+	}
+	if len(resp.Warnings) > 0 {
+		return resp, nil
+	}
+	return nil, nil
+}
+
+// parseRoleFields sets the role's fields from those in the request, and returns an
+// error response if the role they make is invalid.
+func parseRoleFields(req *logical.Request, data *framework.FieldData, role *models.RoleEntry) (*logical.Response, error) {
 	if raw, ok := data.GetOk("bound_application_ids"); ok {
 		role.BoundAppIDs = raw.([]string)
 	}
@@ -178,9 +584,147 @@ func (b *backend) operationRolesCreateUpdate(ctx context.Context, req *logical.R
 	if raw, ok := data.GetOk("bound_instance_ids"); ok {
 		role.BoundInstanceIDs = raw.([]string)
 	}
+	if raw, ok := data.GetOk("bound_cert_ip_cidrs"); ok {
+		role.BoundCertIPCIDRs = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_spiffe_ids"); ok {
+		role.BoundSPIFFEIDs = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_application_names"); ok {
+		role.BoundAppNames = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_space_names"); ok {
+		role.BoundSpaceNames = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_organization_names"); ok {
+		role.BoundOrgNames = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_stacks"); ok {
+		role.BoundStacks = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_lifecycle_types"); ok {
+		role.BoundLifecycleTypes = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_docker_images"); ok {
+		role.BoundDockerImages = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_buildpacks"); ok {
+		role.BoundBuildpacks = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_current_droplets"); ok {
+		role.BoundCurrentDroplets = raw.([]string)
+	}
+	if raw, ok := data.GetOk("require_current_revision"); ok {
+		role.RequireCurrentRevision = raw.(bool)
+	}
+	if raw, ok := data.GetOk("required_service_instance"); ok {
+		role.RequiredServiceInstance = raw.(string)
+	}
+	if raw, ok := data.GetOk("require_ssh_disabled"); ok {
+		role.RequireSSHDisabled = raw.(bool)
+	}
+	if raw, ok := data.GetOk("required_app_state"); ok {
+		role.RequiredAppState = raw.(string)
+	} else if role.RequiredAppState == "" {
+		role.RequiredAppState = data.Get("required_app_state").(string)
+	}
+	if raw, ok := data.GetOk("minimum_instances"); ok {
+		role.MinimumInstances = raw.(int)
+	} else if req.Operation == logical.CreateOperation {
+		role.MinimumInstances = data.Get("minimum_instances").(int)
+	}
+	if raw, ok := data.GetOk("bound_process_types"); ok {
+		role.BoundProcessTypes = raw.([]string)
+	}
+	if raw, ok := data.GetOk("bound_instance_indexes"); ok {
+		role.BoundInstanceIndexes = raw.([]int)
+	}
+	if raw, ok := data.GetOk("allow_unconstrained"); ok {
+		role.AllowUnconstrained = raw.(bool)
+	}
 	if raw, ok := data.GetOk("disable_ip_matching"); ok {
 		role.DisableIPMatching = raw.(bool)
 	}
+	if raw, ok := data.GetOk("disable_cf_api_checks"); ok {
+		role.DisableCFAPIChecks = raw.(bool)
+	}
+	if raw, ok := data.GetOk("disable_name_resolution"); ok {
+		role.DisableNameResolution = raw.(bool)
+	}
+	if raw, ok := data.GetOk("disable_space_api_check"); ok {
+		role.DisableSpaceAPICheck = raw.(bool)
+	}
+	if raw, ok := data.GetOk("disable_org_api_check"); ok {
+		role.DisableOrgAPICheck = raw.(bool)
+	}
+	if raw, ok := data.GetOk("cap_ttl_at_identity_expiry"); ok {
+		role.CapTTLAtIdentityExpiry = raw.(bool)
+	}
+	if raw, ok := data.GetOk("single_active_token"); ok {
+		role.SingleActiveToken = raw.(bool)
+	}
+	if raw, ok := data.GetOk("revalidate_every_n_renewals"); ok {
+		role.RevalidateEveryNRenewals = raw.(int)
+	}
+	if raw, ok := data.GetOk("revalidation_interval"); ok {
+		role.RevalidationInterval = time.Duration(raw.(int)) * time.Second
+	}
+	if role.RevalidateEveryNRenewals < 0 || role.RevalidationInterval < 0 {
+		return logical.ErrorResponse("'revalidate_every_n_renewals' and 'revalidation_interval' must not be negative"), nil
+	}
+	if raw, ok := data.GetOk("login_max_seconds_not_before"); ok {
+		role.LoginMaxSecNotBefore = time.Duration(raw.(int)) * time.Second
+	}
+	if raw, ok := data.GetOk("login_max_seconds_not_after"); ok {
+		role.LoginMaxSecNotAfter = time.Duration(raw.(int)) * time.Second
+	}
+	if role.LoginMaxSecNotBefore < 0 || role.LoginMaxSecNotAfter < 0 {
+		return logical.ErrorResponse("'login_max_seconds_not_before' and 'login_max_seconds_not_after' must not be negative"), nil
+	}
+
+	if raw, ok := data.GetOk("alias_metadata"); ok {
+		role.AliasMetadata = raw.([]string)
+	}
+	for _, field := range role.AliasMetadata {
+		if !strutil.StrListContains(aliasMetadataFields, field) {
+			return logical.ErrorResponse(fmt.Sprintf("'alias_metadata' must only contain %s", strings.Join(aliasMetadataFields, ", "))), nil
+		}
+	}
+	if raw, ok := data.GetOk("static_alias_metadata"); ok {
+		role.StaticAliasMetadata = raw.(map[string]string)
+	}
+	for key := range role.StaticAliasMetadata {
+		if strutil.StrListContains(aliasMetadataFields, key) {
+			return logical.ErrorResponse(fmt.Sprintf("'static_alias_metadata' must not contain %q, which is written by 'alias_metadata'", key)), nil
+		}
+	}
+	if raw, ok := data.GetOk("refresh_alias_metadata"); ok {
+		role.RefreshAliasMetadata = raw.(bool)
+	}
+	if raw, ok := data.GetOk("auth_metadata"); ok {
+		role.AuthMetadata = raw.([]string)
+	}
+	for _, field := range role.AuthMetadata {
+		if !strutil.StrListContains(aliasMetadataFields, field) {
+			return logical.ErrorResponse(fmt.Sprintf("'auth_metadata' must only contain %s", strings.Join(aliasMetadataFields, ", "))), nil
+		}
+	}
+	if raw, ok := data.GetOk("display_name_template"); ok {
+		role.DisplayNameTemplate = raw.(string)
+	}
+	if err := validateDisplayNameTemplate(role.DisplayNameTemplate); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if raw, ok := data.GetOk("include_instance_details"); ok {
+		role.IncludeInstanceDetails = raw.(bool)
+	}
+	if raw, ok := data.GetOk("alias_custom_metadata_labels"); ok {
+		role.AliasCustomMetadataLabels = raw.([]string)
+	}
+	if raw, ok := data.GetOk("alias_custom_metadata_annotations"); ok {
+		role.AliasCustomMetadataAnnotations = raw.([]string)
+	}
 
 	if err := role.ParseTokenFields(req, data); err != nil {
 		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
@@ -209,26 +753,91 @@ func (b *backend) operationRolesCreateUpdate(ctx context.Context, req *logical.R
 		}
 	}
 
-	if role.TokenMaxTTL > 0 && role.TokenTTL > role.TokenMaxTTL {
-		return logical.ErrorResponse("ttl exceeds max ttl"), nil
+	for _, cidr := range role.BoundCertIPCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'bound_cert_ip_cidrs' is invalid: %s", err)), nil
+		}
+	}
+	for _, id := range role.BoundSPIFFEIDs {
+		_, path, err := models.ParseSPIFFEID(id)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("'bound_spiffe_ids' is invalid: %s", err)), nil
+		}
+		if path == "" {
+			return logical.ErrorResponse(fmt.Sprintf("'bound_spiffe_ids' is invalid: %q names a trust domain rather than a workload", id)), nil
+		}
+	}
+	if len(role.BoundProcessTypes) > 0 && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_process_types' can't be used with 'disable_cf_api_checks', since process types are looked up in CF’s API"), nil
+	}
+	for _, index := range role.BoundInstanceIndexes {
+		if index < 0 {
+			return logical.ErrorResponse(fmt.Sprintf("'bound_instance_indexes' can't include %d, since instance indexes start at 0", index)), nil
+		}
+	}
+	if len(role.BoundInstanceIndexes) > 0 && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_instance_indexes' can't be used with 'disable_cf_api_checks', since instance indexes are looked up in CF’s API"), nil
+	}
+	if len(role.BoundStacks) > 0 && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_stacks' can't be used with 'disable_cf_api_checks', since the app's stack is looked up in CF’s API"), nil
+	}
+	if len(role.BoundBuildpacks) > 0 && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_buildpacks' can't be used with 'disable_cf_api_checks', since the app's buildpacks are looked up in CF’s API"), nil
+	}
+	if (len(role.BoundCurrentDroplets) > 0 || role.RequireCurrentRevision) && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_current_droplets' and 'require_current_revision' can't be used with 'disable_cf_api_checks', since the app's droplet and revisions are looked up in CF’s API"), nil
+	}
+	if role.RequiredServiceInstance != "" && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'required_service_instance' can't be used with 'disable_cf_api_checks', since the app's service bindings are looked up in CF’s API"), nil
+	}
+	if role.RequireSSHDisabled && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'require_ssh_disabled' can't be used with 'disable_cf_api_checks', since whether the app accepts SSH connections is looked up in CF’s API"), nil
+	}
+	if role.RefreshAliasMetadata && (role.DisableCFAPIChecks || role.DisableNameResolution) {
+		return logical.ErrorResponse("'refresh_alias_metadata' can't be used with 'disable_cf_api_checks' or 'disable_name_resolution', since the names are looked up in CF’s API"), nil
+	}
+	if role.MinimumInstances < 0 {
+		return logical.ErrorResponse("'minimum_instances' must not be negative"), nil
+	}
+	if role.MinimumInstances != 1 && role.RequiredAppState != models.AppStateLiveInstances {
+		return logical.ErrorResponse("'minimum_instances' can only be used when 'required_app_state' is %q", models.AppStateLiveInstances), nil
+	}
+	if role.MinimumInstances != 1 && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'minimum_instances' can't be used with 'disable_cf_api_checks', since the app's instances are looked up in CF’s API"), nil
+	}
+	if role.RequiredAppState != models.AppStateLiveInstances && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'required_app_state' can't be used with 'disable_cf_api_checks', since the app's state is looked up in CF’s API"), nil
+	}
+	if (len(role.BoundLifecycleTypes) > 0 || len(role.BoundDockerImages) > 0) && role.DisableCFAPIChecks {
+		return logical.ErrorResponse("'bound_lifecycle_types' and 'bound_docker_images' can't be used with 'disable_cf_api_checks', since the app's lifecycle is looked up in CF’s API"), nil
 	}
 
-	entry, err := logical.StorageEntryJSON(roleStoragePrefix+roleName, role)
-	if err != nil {
-		return nil, err
+	if role.IsUnconstrained() && !role.AllowUnconstrained {
+		return logical.ErrorResponse("the role must bind application, space, organization, or instance IDs or names, or SPIFFE IDs, or set 'allow_unconstrained' to let any app on the foundation log in with it"), nil
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
-		return nil, err
+
+	if err := validatePolicyTemplates(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if role.TokenTTL > b.System().MaxLeaseTTL() {
-		resp := &logical.Response{}
-		resp.AddWarning(fmt.Sprintf("ttl of %d exceeds the system max ttl of %d, the latter will be used during login", role.TokenTTL, b.System().MaxLeaseTTL()))
-		return resp, nil
+	if role.TokenMaxTTL > 0 && role.TokenTTL > role.TokenMaxTTL {
+		return logical.ErrorResponse("ttl exceeds max ttl"), nil
 	}
 	return nil, nil
 }
 
+// roleWarnings returns the warnings about a role that was written.
+func (b *backend) roleWarnings(role *models.RoleEntry) []string {
+	var warnings []string
+	if role.IsUnconstrained() {
+		warnings = append(warnings, "the role binds no application, space, organization, or instance IDs or names, or SPIFFE IDs, so any app on the foundation may log in with it")
+	}
+	if role.TokenTTL > b.System().MaxLeaseTTL() {
+		warnings = append(warnings, fmt.Sprintf("ttl of %d exceeds the system max ttl of %d, the latter will be used during login", role.TokenTTL, b.System().MaxLeaseTTL()))
+	}
+	return warnings
+}
+
 func (b *backend) operationRolesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleName := data.Get("role").(string)
 	role, err := getRole(ctx, req.Storage, roleName)
@@ -238,21 +847,8 @@ func (b *backend) operationRolesRead(ctx context.Context, req *logical.Request,
 	if role == nil {
 		return nil, nil
 	}
-	cidrs := make([]string, len(role.BoundCIDRs))
-	for i, cidr := range role.BoundCIDRs {
-		cidrs[i] = cidr.String()
-	}
-
-	d := map[string]interface{}{
-		"bound_application_ids":  role.BoundAppIDs,
-		"bound_space_ids":        role.BoundSpaceIDs,
-		"bound_organization_ids": role.BoundOrgIDs,
-		"bound_instance_ids":     role.BoundInstanceIDs,
-		"disable_ip_matching":    role.DisableIPMatching,
-	}
-
-	role.PopulateTokenData(d)
 
+	d := roleData(role)
 	if len(role.Policies) > 0 {
 		d["policies"] = d["token_policies"]
 	}
@@ -274,14 +870,90 @@ func (b *backend) operationRolesRead(ctx context.Context, req *logical.Request,
 	}, nil
 }
 
+// roleData returns the role's fields, as they're written, other than the deprecated
+// ones that the token fields replace.
+func roleData(role *models.RoleEntry) map[string]interface{} {
+	d := map[string]interface{}{
+		"bound_application_ids":     role.BoundAppIDs,
+		"bound_space_ids":           role.BoundSpaceIDs,
+		"bound_stacks":              role.BoundStacks,
+		"bound_lifecycle_types":     role.BoundLifecycleTypes,
+		"bound_docker_images":       role.BoundDockerImages,
+		"bound_buildpacks":          role.BoundBuildpacks,
+		"bound_current_droplets":    role.BoundCurrentDroplets,
+		"require_current_revision":  role.RequireCurrentRevision,
+		"bound_process_types":       role.BoundProcessTypes,
+		"bound_instance_indexes":    role.BoundInstanceIndexes,
+		"required_service_instance": role.RequiredServiceInstance,
+		"require_ssh_disabled":      role.RequireSSHDisabled,
+		"required_app_state":        role.RequiredAppState,
+		"minimum_instances":         role.MinimumInstances,
+		"bound_organization_ids":    role.BoundOrgIDs,
+		"bound_instance_ids":        role.BoundInstanceIDs,
+		"bound_cert_ip_cidrs":       role.BoundCertIPCIDRs,
+		"bound_spiffe_ids":          role.BoundSPIFFEIDs,
+		"bound_application_names":   role.BoundAppNames,
+		"bound_space_names":         role.BoundSpaceNames,
+		"bound_organization_names":  role.BoundOrgNames,
+		"allow_unconstrained":       role.AllowUnconstrained,
+		"disable_ip_matching":       role.DisableIPMatching,
+		"disable_cf_api_checks":     role.DisableCFAPIChecks,
+		"disable_name_resolution":   role.DisableNameResolution,
+		"disable_space_api_check":   role.DisableSpaceAPICheck,
+		"disable_org_api_check":     role.DisableOrgAPICheck,
+
+		"cap_ttl_at_identity_expiry":   role.CapTTLAtIdentityExpiry,
+		"single_active_token":          role.SingleActiveToken,
+		"revalidate_every_n_renewals":  role.RevalidateEveryNRenewals,
+		"revalidation_interval":        int64(role.RevalidationInterval.Seconds()),
+		"login_max_seconds_not_before": int64(role.LoginMaxSecNotBefore.Seconds()),
+		"login_max_seconds_not_after":  int64(role.LoginMaxSecNotAfter.Seconds()),
+		"alias_metadata":               role.AliasMetadata,
+		"static_alias_metadata":        role.StaticAliasMetadata,
+		"refresh_alias_metadata":       role.RefreshAliasMetadata,
+		"auth_metadata":                role.AuthMetadata,
+		"display_name_template":        role.DisplayNameTemplate,
+
+		"include_instance_details":          role.IncludeInstanceDetails,
+		"alias_custom_metadata_labels":      role.AliasCustomMetadataLabels,
+		"alias_custom_metadata_annotations": role.AliasCustomMetadataAnnotations,
+	}
+
+	role.PopulateTokenData(d)
+	return d
+}
+
 func (b *backend) operationRolesDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleName := data.Get("role").(string)
-	if err := req.Storage.Delete(ctx, roleStoragePrefix+roleName); err != nil {
+	role, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	before, err := changeSnapshot(role)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteRole(ctx, req.Storage, roleName); err != nil {
 		return nil, err
 	}
+	b.sendEvent(ctx, eventTypeRoleDelete, "path", req.Path, "role", roleName, "modified", "true")
+	b.recordChange(ctx, req.Storage, newConfigChange(req, roleName), before, (*models.RoleEntry)(nil))
 	return nil, nil
 }
 
+// deleteRole deletes the role, along with the chunks of its bound IDs.
+func deleteRole(ctx context.Context, storage logical.Storage, roleName string) error {
+	if err := storage.Delete(ctx, roleStoragePrefix+roleName); err != nil {
+		return err
+	}
+	for field := range boundIDFields(&models.RoleEntry{}) {
+		if err := deleteBoundIDChunks(ctx, storage, roleName, field, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getRole(ctx context.Context, storage logical.Storage, roleName string) (*models.RoleEntry, error) {
 	role := &models.RoleEntry{}
 	entry, err := storage.Get(ctx, roleStoragePrefix+roleName)
@@ -294,6 +966,11 @@ func getRole(ctx context.Context, storage logical.Storage, roleName string) (*mo
 	if err := entry.DecodeJSON(role); err != nil {
 		return nil, err
 	}
+	if err := loadBoundIDChunks(ctx, storage, roleName, role); err != nil {
+		return nil, err
+	}
+	// Roles written before the bound IDs were sorted are sorted as they're read.
+	sortBoundIDs(role)
 
 	if role.TokenTTL == 0 && role.TTL > 0 {
 		role.TokenTTL = role.TTL
@@ -310,13 +987,23 @@ func getRole(ctx context.Context, storage logical.Storage, roleName string) (*mo
 	if len(role.TokenBoundCIDRs) == 0 && len(role.BoundCIDRs) > 0 {
 		role.TokenBoundCIDRs = role.BoundCIDRs
 	}
+	// Roles written before the app state could be configured required a live instance.
+	if role.RequiredAppState == "" {
+		role.RequiredAppState = models.AppStateLiveInstances
+		role.MinimumInstances = 1
+	}
 
 	return role, nil
 }
 
 const pathListRolesHelpSyn = "List the existing roles in this backend."
 
-const pathListRolesHelpDesc = "Roles will be listed by the role name."
+const pathListRolesHelpDesc = `
+Roles will be listed by the role name. To find the roles that an app, or the apps
+in a space or org, may log in with, set "bound_application_id", "bound_space_id",
+or "bound_organization_id". Roles that bind no IDs of that kind are listed too,
+since they admit any.
+`
 
 const pathRolesHelpSyn = `
 Read, write and reference policies and roles that tokens can be made for.
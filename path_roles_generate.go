@@ -0,0 +1,233 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cfclient "github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const (
+	// generatedRoleTokenTTL and generatedRoleTokenMaxTTL are the token TTLs of generated
+	// roles that aren't given any, so that their tokens don't live as long as the
+	// mount's.
+	generatedRoleTokenTTL    = time.Hour
+	generatedRoleTokenMaxTTL = 24 * time.Hour
+)
+
+func (b *backend) pathGenerateRole() *framework.Path {
+	p := &framework.Path{
+		Pattern: "roles/generate/" + framework.GenericNameRegex("role"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "generate",
+			OperationSuffix: "role",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "The name of the role to generate.",
+			},
+			"space_id": {
+				Type:        framework.TypeString,
+				Description: "The ID of the space whose apps may log in with the role.",
+			},
+			"organization_name": {
+				Type:        framework.TypeString,
+				Description: "The name of the org the space is in. Used with 'space_name' instead of 'space_id'.",
+			},
+			"space_name": {
+				Type:        framework.TypeString,
+				Description: "The name of the space whose apps may log in with the role. Used with 'organization_name' instead of 'space_id'.",
+			},
+			"overwrite": {
+				Type:        framework.TypeBool,
+				Description: "If set, an existing role with the same name is replaced.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationGenerateRoleUpdate,
+			},
+		},
+		HelpSynopsis:    pathGenerateRoleHelpSyn,
+		HelpDescription: pathGenerateRoleHelpDesc,
+	}
+	tokenutil.AddTokenFields(p.Fields)
+	return p
+}
+
+// operationGenerateRoleUpdate looks a space up in the CF API, and writes a role that
+// binds it and its org.
+func (b *backend) operationGenerateRoleUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ctx = withRequestInfo(ctx, req)
+	roleName := data.Get("role").(string)
+	spaceID := data.Get("space_id").(string)
+	orgName := data.Get("organization_name").(string)
+	spaceName := data.Get("space_name").(string)
+	switch {
+	case spaceID != "" && (orgName != "" || spaceName != ""):
+		return logical.ErrorResponse("'space_id' can't be used with 'organization_name' or 'space_name'"), nil
+	case spaceID == "" && (orgName == "" || spaceName == ""):
+		return logical.ErrorResponse("either 'space_id', or 'organization_name' and 'space_name', are required"), nil
+	}
+
+	existing, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && !data.Get("overwrite").(bool) {
+		return logical.ErrorResponse(fmt.Sprintf("role %q already exists, set 'overwrite' to replace it", roleName)), nil
+	}
+	before, err := changeSnapshot(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	role := &models.RoleEntry{
+		RequiredAppState: models.AppStateLiveInstances,
+		MinimumInstances: 1,
+	}
+	if err := role.ParseTokenFields(req, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	if _, ok := data.GetOk("token_ttl"); !ok {
+		role.TokenTTL = generatedRoleTokenTTL
+	}
+	if _, ok := data.GetOk("token_max_ttl"); !ok {
+		role.TokenMaxTTL = generatedRoleTokenMaxTTL
+	}
+	if err := validatePolicyTemplates(role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.TokenMaxTTL > 0 && role.TokenTTL > role.TokenMaxTTL {
+		return logical.ErrorResponse("ttl exceeds max ttl"), nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("no configuration has been written"), nil
+	}
+	client, err := b.getCFClientOrRefresh(ctx, config)
+	if err != nil {
+		return logical.ErrorResponse(cfAPIError(err).Error()), nil
+	}
+	space, org, err := b.lookUpSpace(ctx, client, spaceID, orgName, spaceName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	role.BoundSpaceIDs = []string{space.GUID}
+	role.BoundOrgIDs = []string{org.GUID}
+	sortBoundIDs(role)
+	if err := storeRole(ctx, req.Storage, roleName, role); err != nil {
+		return nil, err
+	}
+	b.sendEvent(ctx, eventTypeRoleWrite, "path", req.Path, "role", roleName, "modified", "true")
+	b.recordChange(ctx, req.Storage, newConfigChange(req, roleName), before, role)
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"role":                   roleName,
+			"bound_space_ids":        role.BoundSpaceIDs,
+			"bound_organization_ids": role.BoundOrgIDs,
+			"space_name":             space.Name,
+			"organization_name":      org.Name,
+			"token_policies":         role.TokenPolicies,
+			"token_ttl":              int64(role.TokenTTL.Seconds()),
+			"token_max_ttl":          int64(role.TokenMaxTTL.Seconds()),
+		},
+	}
+	for _, warning := range b.roleWarnings(role) {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
+
+// lookUpSpace returns the space with the ID, or with the name in the org with the
+// name, along with its org.
+func (b *backend) lookUpSpace(ctx context.Context, client *cfclient.Client, spaceID, orgName, spaceName string) (*resource.Space, *resource.Organization, error) {
+	var space *resource.Space
+	var org *resource.Organization
+	if spaceID != "" {
+		err := b.callCFAPI("get_space", func() (err error) {
+			space, err = client.Spaces.Get(ctx, spaceID)
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't look up space %q: %w", spaceID, err)
+		}
+		var orgID string
+		if space.Relationships.Organization != nil {
+			orgID = relationshipGUID(*space.Relationships.Organization)
+		}
+		err = b.callCFAPI("get_org", func() (err error) {
+			org, err = client.Organizations.Get(ctx, orgID)
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't look up org %q of space %q: %w", orgID, spaceID, err)
+		}
+		return space, org, nil
+	}
+
+	err := b.callCFAPI("list_orgs", func() (err error) {
+		opts := cfclient.NewOrganizationListOptions()
+		opts.Names.EqualTo(orgName)
+		org, err = client.Organizations.Single(ctx, opts)
+		if errors.Is(err, cfclient.ErrExactlyOneResultNotReturned) {
+			// A name that isn't found isn't a failure of the CF API.
+			return nil
+		}
+		return err
+	})
+	if err == nil && org == nil {
+		return nil, nil, fmt.Errorf("org %q doesn't exist", orgName)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't look up org %q: %w", orgName, err)
+	}
+	err = b.callCFAPI("list_spaces", func() (err error) {
+		opts := cfclient.NewSpaceListOptions()
+		opts.Names.EqualTo(spaceName)
+		opts.OrganizationGUIDs.EqualTo(org.GUID)
+		space, err = client.Spaces.Single(ctx, opts)
+		if errors.Is(err, cfclient.ErrExactlyOneResultNotReturned) {
+			return nil
+		}
+		return err
+	})
+	if err == nil && space == nil {
+		return nil, nil, fmt.Errorf("space %q doesn't exist in org %q", spaceName, orgName)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't look up space %q in org %q: %w", spaceName, orgName, err)
+	}
+	return space, org, nil
+}
+
+const pathGenerateRoleHelpSyn = "Generate a role that binds a CF space."
+
+const pathGenerateRoleHelpDesc = `
+Looks up a space in CF's API, either by its ID or by its org's and its own names,
+and writes a role that binds the space's and the org's IDs. Unless they're given,
+the role's tokens have a TTL of 1 hour and a max TTL of 24 hours. Any other token
+fields may be given as for roles. An existing role is only replaced if 'overwrite'
+is set. The role may then be tuned at roles/<role>.
+`
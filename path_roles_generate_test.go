@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestGenerateRole(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{DefaultLeaseTTLVal: 24 * time.Hour, MaxLeaseTTLVal: 32 * 24 * time.Hour},
+	})
+	require.NoError(t, err)
+	require.NoError(t, storeConfig(ctx, storage, &models.Configuration{
+		Version:    1,
+		CFAPIAddr:  s.URL,
+		CFUsername: cf.AuthUsername,
+		CFPassword: cf.AuthPassword,
+	}))
+
+	generate := func(name string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := lb.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/generate/" + name,
+			Storage:   storage,
+			Data:      data,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// A role is generated for a space's ID, binding it and its org, with the default
+	// token TTLs.
+	resp := generate("by-id", map[string]interface{}{
+		"space_id":       cf.FoundSpaceGUID,
+		"token_policies": "default,payments",
+	})
+	require.False(t, resp.IsError(), resp.Error())
+	assert.Equal(t, cf.FoundSpaceName, resp.Data["space_name"])
+	assert.Equal(t, cf.FoundOrgName, resp.Data["organization_name"])
+	role, err := getRole(ctx, storage, "by-id")
+	require.NoError(t, err)
+	assert.Equal(t, []string{cf.FoundSpaceGUID}, role.BoundSpaceIDs)
+	assert.Equal(t, []string{cf.FoundOrgGUID}, role.BoundOrgIDs)
+	assert.Equal(t, []string{"default", "payments"}, role.TokenPolicies)
+	assert.Equal(t, generatedRoleTokenTTL, role.TokenTTL)
+	assert.Equal(t, generatedRoleTokenMaxTTL, role.TokenMaxTTL)
+	assert.Equal(t, models.AppStateLiveInstances, role.RequiredAppState)
+	assert.Equal(t, 1, role.MinimumInstances)
+
+	// Or for its org's and its own names, with the given TTLs.
+	resp = generate("by-name", map[string]interface{}{
+		"organization_name": cf.FoundOrgName,
+		"space_name":        cf.FoundSpaceName,
+		"token_ttl":         "10m",
+	})
+	require.False(t, resp.IsError(), resp.Error())
+	role, err = getRole(ctx, storage, "by-name")
+	require.NoError(t, err)
+	assert.Equal(t, []string{cf.FoundSpaceGUID}, role.BoundSpaceIDs)
+	assert.Equal(t, []string{cf.FoundOrgGUID}, role.BoundOrgIDs)
+	assert.Equal(t, 10*time.Minute, role.TokenTTL)
+
+	// Existing roles are only replaced when asked to.
+	resp = generate("by-id", map[string]interface{}{"space_id": cf.FoundSpaceGUID})
+	assert.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), "already exists")
+	resp = generate("by-id", map[string]interface{}{"space_id": cf.FoundSpaceGUID, "overwrite": true})
+	assert.False(t, resp.IsError(), resp.Error())
+
+	// Roles aren't generated for spaces that don't exist, or without one to look up.
+	for _, data := range []map[string]interface{}{
+		{"space_id": cf.UnfoundSpaceGUID},
+		{"organization_name": "unfound", "space_name": cf.FoundSpaceName},
+		{"organization_name": cf.FoundOrgName, "space_name": "unfound"},
+		{"space_id": cf.FoundSpaceGUID, "space_name": cf.FoundSpaceName},
+		{"organization_name": cf.FoundOrgName},
+	} {
+		resp = generate("invalid", data)
+		assert.True(t, resp.IsError(), data)
+	}
+	role, err = getRole(ctx, storage, "invalid")
+	require.NoError(t, err)
+	assert.Nil(t, role)
+}
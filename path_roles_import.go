@@ -0,0 +1,300 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// walKindRoleImport is the kind of the WAL entries written while roles are imported,
+// so that an import interrupted by Vault stopping is rolled back.
+const walKindRoleImport = "role-import"
+
+// roleNameRegex matches the role names that the roles path accepts.
+var roleNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("role") + "$")
+
+// roleImportWAL is what's needed to roll back an interrupted role import.
+type roleImportWAL struct {
+	// PreviousRoles are the imported roles as they were before the import, with
+	// those that didn't exist yet being nil.
+	PreviousRoles map[string]*models.RoleEntry `json:"previous_roles"`
+}
+
+func (b *backend) pathExportRoles() *framework.Path {
+	return &framework.Path{
+		Pattern: "export-roles",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "export",
+			OperationSuffix: "roles",
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationExportRolesRead,
+			},
+		},
+		HelpSynopsis:    pathExportRolesHelpSyn,
+		HelpDescription: pathExportRolesHelpDesc,
+	}
+}
+
+func (b *backend) pathImportRoles() *framework.Path {
+	return &framework.Path{
+		Pattern: "import-roles",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "import",
+			OperationSuffix: "roles",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"roles": {
+				Required:    true,
+				Type:        framework.TypeMap,
+				Description: "The roles to write, by name, each with the fields it would be written to roles/<role> with.",
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "If set, the roles are validated and the changes importing them would make are returned, but no roles are written.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationImportRolesUpdate,
+			},
+		},
+		HelpSynopsis:    pathImportRolesHelpSyn,
+		HelpDescription: pathImportRolesHelpDesc,
+	}
+}
+
+func (b *backend) operationExportRolesRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roleNames, err := req.Storage.List(ctx, roleStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	roles := map[string]interface{}{}
+	for _, roleName := range roleNames {
+		role, err := getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			roles[roleName] = roleData(role)
+		}
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"roles": roles,
+		},
+	}, nil
+}
+
+// operationImportRolesUpdate validates every role in the document before writing
+// any, and restores the roles already written if writing one fails, so that either
+// all of them are imported or none are.
+func (b *backend) operationImportRolesUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	rawRoles := data.Get("roles").(map[string]interface{})
+	if len(rawRoles) == 0 {
+		return logical.ErrorResponse("'roles' is required"), nil
+	}
+	dryRun := data.Get("dry_run").(bool)
+
+	roleSchema := b.pathRoles().Fields
+	roles := map[string]*models.RoleEntry{}
+	previousRoles := map[string]*models.RoleEntry{}
+	var created, updated, unchanged []string
+	resp := &logical.Response{}
+	for rawName, rawRole := range rawRoles {
+		roleName := strings.ToLower(rawName)
+		if !roleNameRegex.MatchString(roleName) {
+			return logical.ErrorResponse(fmt.Sprintf("%q isn't a valid role name", rawName)), nil
+		}
+		if _, ok := roles[roleName]; ok {
+			return logical.ErrorResponse(fmt.Sprintf("role %q is given more than once", roleName)), nil
+		}
+		fields, ok := rawRole.(map[string]interface{})
+		if !ok {
+			return logical.ErrorResponse(fmt.Sprintf("role %q must be a map of its fields", roleName)), nil
+		}
+		for field, value := range fields {
+			if _, ok := roleSchema[field]; !ok || field == "role" {
+				return logical.ErrorResponse(fmt.Sprintf("role %q: unknown field %q", roleName, field)), nil
+			}
+			// Exported fields that are null were never set.
+			if value == nil {
+				delete(fields, field)
+			}
+		}
+
+		// Each role is written as a whole, as if it were created anew, so that the
+		// document describes the roles fully.
+		fieldData := &framework.FieldData{Raw: fields, Schema: roleSchema}
+		if err := fieldData.Validate(); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q: %s", roleName, err)), nil
+		}
+		role := &models.RoleEntry{}
+		if errResp, err := parseRoleFields(&logical.Request{Operation: logical.CreateOperation}, fieldData, role); errResp != nil || err != nil {
+			if errResp == nil || !errResp.IsError() {
+				return nil, err
+			}
+			return logical.ErrorResponse(fmt.Sprintf("role %q: %s", roleName, errResp.Error())), nil
+		}
+		sortBoundIDs(role)
+		roles[roleName] = role
+		for _, warning := range b.roleWarnings(role) {
+			resp.AddWarning(fmt.Sprintf("role %q: %s", roleName, warning))
+		}
+
+		previous, err := getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		previousRoles[roleName] = previous
+		switch {
+		case previous == nil:
+			created = append(created, roleName)
+		case roleDataJSON(previous) == roleDataJSON(role):
+			unchanged = append(unchanged, roleName)
+		default:
+			updated = append(updated, roleName)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(updated)
+	sort.Strings(unchanged)
+	resp.Data = map[string]interface{}{
+		"created":   created,
+		"updated":   updated,
+		"unchanged": unchanged,
+		"dry_run":   dryRun,
+	}
+	if dryRun {
+		return resp, nil
+	}
+
+	walID, err := framework.PutWAL(ctx, req.Storage, walKindRoleImport, &roleImportWAL{PreviousRoles: previousRoles})
+	if err != nil {
+		return nil, err
+	}
+	written := append(append([]string{}, created...), updated...)
+	for i, roleName := range written {
+		if err := storeRole(ctx, req.Storage, roleName, roles[roleName]); err != nil {
+			if restoreErr := restoreRoles(ctx, req.Storage, previousRoles, written[:i+1]); restoreErr != nil {
+				// The WAL is kept, so that the import is rolled back later.
+				return nil, fmt.Errorf("failed to write role %q: %w, and failed to restore the roles already written: %s", roleName, err, restoreErr)
+			}
+			if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("no roles were imported, as role %q failed to be written: %w", roleName, err)
+		}
+	}
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, err
+	}
+
+	for _, roleName := range written {
+		b.sendEvent(ctx, eventTypeRoleWrite, "path", req.Path, "role", roleName, "modified", "true")
+		before, err := changeSnapshot(previousRoles[roleName])
+		if err != nil {
+			return nil, err
+		}
+		b.recordChange(ctx, req.Storage, newConfigChange(req, roleName), before, roles[roleName])
+	}
+	b.Logger().Info("imported roles", "created", len(created), "updated", len(updated), "unchanged", len(unchanged))
+	return resp, nil
+}
+
+// roleDataJSON returns the role's fields as they'd be exported, to compare roles by.
+// Empty lists and maps are the same as unset ones.
+func roleDataJSON(role *models.RoleEntry) string {
+	raw, _ := json.Marshal(roleData(role))
+	d := map[string]interface{}{}
+	json.Unmarshal(raw, &d)
+	for field, value := range d {
+		switch value := value.(type) {
+		case []interface{}:
+			if len(value) == 0 {
+				d[field] = nil
+			}
+		case map[string]interface{}:
+			if len(value) == 0 {
+				d[field] = nil
+			}
+		}
+	}
+	raw, _ = json.Marshal(d)
+	return string(raw)
+}
+
+// restoreRoles writes the roles back to how they were before an import, deleting
+// those that didn't exist.
+func restoreRoles(ctx context.Context, storage logical.Storage, previousRoles map[string]*models.RoleEntry, roleNames []string) error {
+	for _, roleName := range roleNames {
+		previous := previousRoles[roleName]
+		if previous == nil {
+			if err := deleteRole(ctx, storage, roleName); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := storeRole(ctx, storage, roleName, previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackRoleImport restores the roles of an import interrupted by Vault stopping.
+func (b *backend) rollbackRoleImport(ctx context.Context, storage logical.Storage, data interface{}) error {
+	// The entry is decoded as a map, so it's encoded again to be read as a roleImportWAL.
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	wal := &roleImportWAL{}
+	if err := json.Unmarshal(raw, wal); err != nil {
+		return err
+	}
+	roleNames := make([]string, 0, len(wal.PreviousRoles))
+	for roleName := range wal.PreviousRoles {
+		roleNames = append(roleNames, roleName)
+	}
+	if err := restoreRoles(ctx, storage, wal.PreviousRoles, roleNames); err != nil {
+		return err
+	}
+	b.Logger().Warn("rolled back an interrupted role import", "roles", len(roleNames))
+	return nil
+}
+
+const pathExportRolesHelpSyn = "Export every role as a single document."
+
+const pathExportRolesHelpDesc = `
+Returns every role's fields, by the role's name, as "roles". The document can be
+written to import-roles as it is, so that roles can be kept in version control.
+`
+
+const pathImportRolesHelpSyn = "Create or replace a set of roles at once."
+
+const pathImportRolesHelpDesc = `
+Writes each of the "roles", by name, with the fields it would be written to
+roles/<role> with, as exported by export-roles. Each role is replaced as a whole,
+with any fields it doesn't give taking their defaults. Roles that aren't in the
+document are left as they are.
+
+Every role is validated before any is written, and if writing one fails, the roles
+already written are restored, so that either all of them are imported or none are.
+The roles that are created, updated, and left unchanged are returned. If "dry_run"
+is set, they're returned without writing any role.
+`
@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestExportImportRoles(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{DefaultLeaseTTLVal: 24 * time.Hour, MaxLeaseTTLVal: 32 * 24 * time.Hour},
+	})
+	require.NoError(t, err)
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := lb.HandleRequest(ctx, &logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	request(logical.CreateOperation, "roles/payments", map[string]interface{}{
+		"bound_space_ids":   cf.FoundSpaceGUID,
+		"token_policies":    "payments",
+		"token_bound_cidrs": "10.0.0.0/8",
+		"token_ttl":         "1h",
+	})
+	request(logical.CreateOperation, "roles/billing", map[string]interface{}{
+		"bound_organization_ids": cf.FoundOrgGUID,
+	})
+
+	// The export is read, as a client would, through JSON.
+	resp := request(logical.ReadOperation, "export-roles", nil)
+	raw, err := json.Marshal(resp.Data)
+	require.NoError(t, err)
+	var document map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &document))
+	exported := document["roles"].(map[string]interface{})
+	require.Len(t, exported, 2)
+
+	// Importing the export changes nothing.
+	resp = request(logical.UpdateOperation, "import-roles", map[string]interface{}{"roles": exported})
+	require.False(t, resp.IsError(), resp.Error())
+	assert.Equal(t, []string{"billing", "payments"}, resp.Data["unchanged"])
+	assert.Empty(t, resp.Data["created"])
+	assert.Empty(t, resp.Data["updated"])
+
+	// A dry run reports what importing would change, without writing any role.
+	exported["reporting"] = map[string]interface{}{"bound_space_ids": []interface{}{cf.FoundSpaceGUID}}
+	exported["billing"].(map[string]interface{})["token_policies"] = []interface{}{"billing"}
+	resp = request(logical.UpdateOperation, "import-roles", map[string]interface{}{"roles": exported, "dry_run": true})
+	require.False(t, resp.IsError(), resp.Error())
+	assert.Equal(t, []string{"reporting"}, resp.Data["created"])
+	assert.Equal(t, []string{"billing"}, resp.Data["updated"])
+	assert.Equal(t, []string{"payments"}, resp.Data["unchanged"])
+	role, err := getRole(ctx, storage, "reporting")
+	require.NoError(t, err)
+	assert.Nil(t, role)
+
+	resp = request(logical.UpdateOperation, "import-roles", map[string]interface{}{"roles": exported})
+	require.False(t, resp.IsError(), resp.Error())
+	role, err = getRole(ctx, storage, "reporting")
+	require.NoError(t, err)
+	require.NotNil(t, role)
+	assert.Equal(t, []string{cf.FoundSpaceGUID}, role.BoundSpaceIDs)
+	role, err = getRole(ctx, storage, "billing")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"billing"}, role.TokenPolicies)
+	role, err = getRole(ctx, storage, "payments")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, role.TokenTTL)
+	assert.Equal(t, "10.0.0.0/8", role.TokenBoundCIDRs[0].String())
+
+	// If any role is invalid, none are written.
+	resp = request(logical.UpdateOperation, "import-roles", map[string]interface{}{"roles": map[string]interface{}{
+		"new":     map[string]interface{}{"bound_space_ids": cf.FoundSpaceGUID},
+		"invalid": map[string]interface{}{},
+	}})
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), `role "invalid"`)
+	resp = request(logical.UpdateOperation, "import-roles", map[string]interface{}{"roles": map[string]interface{}{
+		"new": map[string]interface{}{"bound_space_ids": cf.FoundSpaceGUID, "unknown": true},
+	}})
+	require.True(t, resp.IsError())
+	assert.Contains(t, resp.Error().Error(), `unknown field "unknown"`)
+	role, err = getRole(ctx, storage, "new")
+	require.NoError(t, err)
+	assert.Nil(t, role)
+}
+
+func TestRollbackRoleImport(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+
+	previous := &models.RoleEntry{BoundSpaceIDs: []string{cf.FoundSpaceGUID}}
+	require.NoError(t, storeRole(ctx, storage, "updated", &models.RoleEntry{BoundOrgIDs: []string{cf.FoundOrgGUID}}))
+	require.NoError(t, storeRole(ctx, storage, "created", &models.RoleEntry{BoundOrgIDs: []string{cf.FoundOrgGUID}}))
+
+	// The roles of an interrupted import are restored to how they were before it. WAL
+	// entries are decoded as maps before they're rolled back.
+	raw, err := json.Marshal(&roleImportWAL{PreviousRoles: map[string]*models.RoleEntry{"updated": previous, "created": nil}})
+	require.NoError(t, err)
+	var wal map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &wal))
+	require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: storage}, walKindRoleImport, wal))
+	role, err := getRole(ctx, storage, "updated")
+	require.NoError(t, err)
+	assert.Equal(t, []string{cf.FoundSpaceGUID}, role.BoundSpaceIDs)
+	assert.Empty(t, role.BoundOrgIDs)
+	role, err = getRole(ctx, storage, "created")
+	require.NoError(t, err)
+	assert.Nil(t, role)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+func (b *backend) pathSimulateLogin() *framework.Path {
+	return &framework.Path{
+		Pattern: "simulate-login",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "simulate",
+			OperationSuffix: "login",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Required:    true,
+				Type:        framework.TypeString,
+				Description: "The name of the role to simulate logging in to.",
+			},
+			"cf_instance_cert": {
+				Required:    true,
+				Type:        framework.TypeString,
+				Description: "The full body of the file available at the CF_INSTANCE_CERT path on the CF instance.",
+			},
+			"encoding": {
+				Type:          framework.TypeString,
+				Default:       util.CertEncodingAuto,
+				AllowedValues: []interface{}{util.CertEncodingAuto, util.CertEncodingPEM, util.CertEncodingBase64},
+				Description:   `The encoding of "cf_instance_cert", as login accepts it.`,
+			},
+			"remote_address": {
+				Type: framework.TypeString,
+				Description: `The address the instance would log in from. If unset, the check that it matches
+the certificate's IP address is skipped.`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationSimulateLoginUpdate,
+			},
+		},
+		HelpSynopsis:    pathSimulateLoginSyn,
+		HelpDescription: pathSimulateLoginDesc,
+	}
+}
+
+// operationSimulateLoginUpdate runs the same checks as a login with the given instance
+// certificate would, other than those on the signature, and reports which of them
+// would pass or fail. No token is issued.
+func (b *backend) operationSimulateLoginUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ctx = withRequestInfo(ctx, req)
+	roleName := data.Get("role").(string)
+	if roleName == "" {
+		return logical.ErrorResponse("'role' is required"), nil
+	}
+	cfInstanceCertContents, err := instanceCertContents(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	remoteAddr := data.Get("remote_address").(string)
+
+	role, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid role name %q", roleName)), nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("no CA is configured for verifying client certificates"), nil
+	}
+
+	report := &checkReport{}
+	if cfCert := simulateCertificateChecks(report, config, cfInstanceCertContents); cfCert != nil {
+		b.simulateRoleChecks(ctx, report, req.Storage, config, role, cfCert, remoteAddr)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"role":          roleName,
+			"would_succeed": !report.failed,
+			"checks":        report.checks,
+		},
+	}, nil
+}
+
+// simulateCertificateChecks checks the instance certificate's chain and identity,
+// returning the identity, if it could be read, for the remaining checks.
+func simulateCertificateChecks(report *checkReport, config *models.Configuration, cfInstanceCertContents string) *models.CFCertificate {
+	intermediateCerts, identityCert, err := util.ExtractCertificates(cfInstanceCertContents)
+	if err != nil {
+		report.add("certificate_chain", checkFailed, err)
+		report.add("instance_identity", checkSkipped, nil)
+		return nil
+	}
+	report.check("certificate_chain", util.Validate(config.AllIdentityCACertificates(), intermediateCerts, identityCert, identityCert))
+	if config.EnforceIdentityCertKeyUsage {
+		report.check("certificate_key_usage", util.ValidateKeyUsage(intermediateCerts, identityCert))
+	}
+
+	cfCert, err := models.NewCFCertificateFromx509WithFieldSources(identityCert, config.IdentityCertFieldSources)
+	report.check("instance_identity", err)
+	return cfCert
+}
+
+// simulateRoleChecks checks the instance against the role's constraints, any
+// revocations, and the CF API.
+func (b *backend) simulateRoleChecks(ctx context.Context, report *checkReport, storage logical.Storage, config *models.Configuration, role *models.RoleEntry, cfCert *models.CFCertificate, remoteAddr string) {
+	switch {
+	case role.DisableIPMatching, remoteAddr == "":
+		report.add("ip_address", checkSkipped, nil)
+	case !matchesCertificateIPAddress(remoteAddr, cfCert):
+		report.add("ip_address", checkFailed, fmt.Errorf("remote address %s doesn't match the certificate's IP addresses %s", remoteAddr, cfCert.AllIPAddresses()))
+	default:
+		report.add("ip_address", checkPassed, nil)
+	}
+
+	for _, bound := range []struct {
+		name        string
+		value       string
+		constraints []string
+	}{
+		{"bound_instance_ids", cfCert.InstanceID, role.BoundInstanceIDs},
+		{"bound_application_ids", cfCert.AppID, role.BoundAppIDs},
+		{"bound_space_ids", cfCert.SpaceID, role.BoundSpaceIDs},
+		{"bound_organization_ids", cfCert.OrgID, role.BoundOrgIDs},
+		{"bound_application_names", cfCert.AppName, role.BoundAppNames},
+		{"bound_space_names", cfCert.SpaceName, role.BoundSpaceNames},
+		{"bound_organization_names", cfCert.OrgName, role.BoundOrgNames},
+	} {
+		if meetsBoundConstraints(bound.value, bound.constraints) {
+			report.add(bound.name, checkPassed, nil)
+		} else {
+			report.add(bound.name, checkFailed, fmt.Errorf("%s doesn't match role constraints of %s", bound.value, bound.constraints))
+		}
+	}
+
+	if certificateIPAddressInCIDRs(cfCert, role.BoundCertIPCIDRs) {
+		report.add("bound_cert_ip_cidrs", checkPassed, nil)
+	} else {
+		report.add("bound_cert_ip_cidrs", checkFailed, fmt.Errorf("%s don't match role constraints of %s", cfCert.AllIPAddresses(), role.BoundCertIPCIDRs))
+	}
+
+	report.check("denied", checkNotDenied(config, cfCert))
+	report.check("revocation", checkNotRevoked(ctx, storage, cfCert))
+
+	if role.DisableCFAPIChecks {
+		report.add("cf_api", checkSkipped, nil)
+		return
+	}
+	_, err := b.validateWithCFAPI(ctx, config, role, cfCert)
+	report.check("cf_api", err)
+
+	if config.VerifyInstanceIDs {
+		_, err = b.withInstanceDetails(ctx, config, &models.RoleEntry{}, cfCert, &cfResources{})
+		report.check("instance_id", err)
+	}
+	// Whether the instance is live is reported on its own above, and each constraint on
+	// the instance's details is reported apart from the other.
+	unverified := *config
+	unverified.VerifyInstanceIDs = false
+	if len(role.BoundProcessTypes) > 0 {
+		_, err = b.withInstanceDetails(ctx, &unverified, &models.RoleEntry{BoundProcessTypes: role.BoundProcessTypes}, cfCert, &cfResources{})
+		report.check("bound_process_types", err)
+	}
+	if len(role.BoundInstanceIndexes) > 0 {
+		_, err = b.withInstanceDetails(ctx, &unverified, &models.RoleEntry{BoundInstanceIndexes: role.BoundInstanceIndexes}, cfCert, &cfResources{})
+		report.check("bound_instance_indexes", err)
+	}
+}
+
+const pathSimulateLoginSyn = `
+Report which checks a login with an instance certificate would pass or fail.
+`
+
+const pathSimulateLoginDesc = `
+Runs the checks a login to the role would make with the given instance
+certificate, without requiring a signature and without issuing a token. The
+report lists the result of each check: the certificate chain, the identity in
+the certificate, the IP address match, each bound constraint, any revocations,
+the CF API lookups, whether the instance is live, for mounts verifying
+instance IDs, and, for roles bound to process types, the instance's process
+type. This is meant for troubleshooting why an app can't log in, so it
+should only be available to operators.
+`
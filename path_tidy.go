@@ -0,0 +1,137 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func (b *backend) pathTidy() *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationTidyUpdate,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb: "tidy",
+				},
+			},
+		},
+		HelpSynopsis:    pathTidySyn,
+		HelpDescription: pathTidyDesc,
+	}
+}
+
+func (b *backend) operationTidyUpdate(_ context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	resp := &logical.Response{}
+	if !b.tidyRunning.CompareAndSwap(false, true) {
+		resp.AddWarning("A tidy operation is already running.")
+		return resp, nil
+	}
+
+	// The tidy outlives the request, so it can't use the request's context.
+	storage := req.Storage
+	go func() {
+		defer b.tidyRunning.Store(false)
+		ctx := context.Background()
+
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		config, err := getConfig(ctx, storage)
+		if err != nil {
+			b.Logger().Error("unable to read the config to tidy", "error", err)
+			return
+		}
+		if err := b.tidy(ctx, storage, config, time.Now().UTC()); err != nil {
+			b.Logger().Error("unable to tidy", "error", err)
+		}
+	}()
+
+	resp.AddWarning("Tidy operation successfully started. Any information from the operation will be printed to Vault's server logs.")
+	return logical.RespondWithStatusCode(resp, req, http.StatusAccepted)
+}
+
+// periodicTidy tidies once per the configured tidy interval, unless a tidy is already
+// running.
+func (b *backend) periodicTidy(ctx context.Context, storage logical.Storage, config *models.Configuration, now time.Time) error {
+	if config.TidyInterval <= 0 || !b.tidyRunning.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer b.tidyRunning.Store(false)
+	if now.Before(b.lastTidy.Add(config.TidyInterval)) {
+		return nil
+	}
+	b.lastTidy = now
+	return b.tidy(ctx, storage, config, now)
+}
+
+// tidy drops the signatures, failed login counts, and cached CF API lookups that have
+// expired on this node. Where this node may write to storage, it also stops tracking
+// the apps that have outlived their tokens, which are otherwise only dropped while
+// reconciliation is enabled and the CF API can be reached, and drops the instances'
+// active tokens that the tokens issued before them can't outlive.
+func (b *backend) tidy(ctx context.Context, storage logical.Storage, config *models.Configuration, now time.Time) error {
+	window := defaultLoginFailureWindow
+	if config != nil {
+		window = loginFailureWindow(config)
+	}
+	signatures := b.seenSignatures.sweep(now)
+	nonces := b.usedNonces.sweep(now)
+	failures := b.loginThrottle.sweep(window, now)
+	cacheEntries := b.getNameCache().sweep() + b.getValidationCache().sweep()
+
+	trackedApps, activeTokens := 0, 0
+	if b.canReconcile() {
+		appIDs, err := storage.List(ctx, trackedAppStoragePrefix)
+		if err != nil {
+			return err
+		}
+		maxLeaseTTL := b.System().MaxLeaseTTL()
+		for _, appID := range appIDs {
+			app, err := getTrackedApp(ctx, storage, appID)
+			if err != nil {
+				return err
+			}
+			if app == nil || !app.outlivedTokens(maxLeaseTTL, now) {
+				continue
+			}
+			if err := storage.Delete(ctx, trackedAppStoragePrefix+appID); err != nil {
+				return err
+			}
+			trackedApps++
+		}
+		if activeTokens, err = tidyActiveTokens(ctx, storage, maxLeaseTTL, now); err != nil {
+			return err
+		}
+	}
+
+	b.Logger().Info("tidied", "signatures", signatures, "nonces", nonces, "login_failures", failures,
+		"cache_entries", cacheEntries, "tracked_apps", trackedApps, "active_tokens", activeTokens)
+	return nil
+}
+
+const pathTidySyn = `
+Drop expired login state and the apps that have outlived their tokens.
+`
+
+const pathTidyDesc = `
+Writing to this path starts a tidy in the background, which drops the
+signatures and login challenge nonces remembered to refuse replayed logins once
+they're too old to log in with, the failed login counts whose window has passed, and the
+CF API lookups whose cache TTL has passed. These are held in memory, so only
+the node that handles the request is tidied. It also stops tracking the apps
+none of whose tokens can still be live, which reconciliation only does while
+it's enabled, and forgets the newest tokens of instances of roles with
+"single_active_token" set once none of their older tokens can still be live. Set "tidy_interval" in the config to tidy periodically instead.
+`
@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestTidy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System: &logical.StaticSystemView{
+			MaxLeaseTTLVal: 24 * time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	now := time.Now().UTC()
+	b.seenSignatures.add([]byte("expired"), now.Add(-time.Second), now.Add(-time.Minute))
+	b.seenSignatures.add([]byte("live"), now.Add(time.Minute), now.Add(-time.Minute))
+	b.loginThrottle.addFailure("expired", 5, time.Minute, time.Minute, 0, now.Add(-time.Hour))
+	b.loginThrottle.addFailure("live", 5, time.Minute, time.Minute, 0, now)
+	b.nameCache, err = newResourceCache(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.nameCache.now = func() time.Time { return now.Add(-time.Hour) }
+	b.nameCache.add("expired", &cfResources{})
+	b.nameCache.now = func() time.Time { return now }
+	b.nameCache.add("live", &cfResources{})
+	// Reconciliation isn't enabled, so nothing else drops the stale app.
+	if err := storeTrackedApp(ctx, storage, "stale-app", &trackedApp{LastLogin: now.Add(-48 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeTrackedApp(ctx, storage, "recent-app", &trackedApp{LastLogin: now.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for instanceID, issuedAt := range map[string]time.Time{"stale-instance": now.Add(-48 * time.Hour), "recent-instance": now.Add(-time.Hour)} {
+		entry, err := logical.StorageEntryJSON(activeTokenStorageKey("test-role", instanceID), &activeToken{LoginID: instanceID, IssuedAt: issuedAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.tidy(ctx, storage, &models.Configuration{}, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.seenSignatures.expirations) != 1 || !b.seenSignatures.add([]byte("live"), now.Add(time.Minute), now) {
+		t.Fatalf("expected only the live signature to be remembered but received %v", b.seenSignatures.expirations)
+	}
+	if _, ok := b.loginThrottle.failures["expired"]; ok || len(b.loginThrottle.failures) != 1 {
+		t.Fatalf("expected only the live failures to be counted but received %v", b.loginThrottle.failures)
+	}
+	if n := b.nameCache.cache.Len(); n != 1 {
+		t.Fatalf("expected only the live cache entry to be kept but received %d", n)
+	}
+	appIDs, err := storage.List(ctx, trackedAppStoragePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appIDs) != 1 || appIDs[0] != "recent-app" {
+		t.Fatalf("expected only the recent app to be tracked but received %v", appIDs)
+	}
+	instanceIDs, err := storage.List(ctx, activeTokenStoragePrefix+"test-role/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instanceIDs) != 1 || instanceIDs[0] != "recent-instance" {
+		t.Fatalf("expected only the recent instance's active token to be kept but received %v", instanceIDs)
+	}
+}
+
+func TestTidyEndpoint(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	// A tidy that's already running isn't started again.
+	b.tidyRunning.Store(true)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || len(resp.Warnings) != 1 || resp.Data[logical.HTTPStatusCode] != nil {
+		t.Fatalf("expected a warning that a tidy is already running but received %#v, %v", resp, err)
+	}
+	b.tidyRunning.Store(false)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.Data[logical.HTTPStatusCode] != http.StatusAccepted {
+		t.Fatalf("expected the tidy to be accepted but received %#v, %v", resp, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for b.tidyRunning.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the tidy to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
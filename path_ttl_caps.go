@@ -0,0 +1,247 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const ttlCapStoragePrefix = "ttl-caps/"
+
+// ttlCapping is the longest TTL and max TTL of tokens issued to an org's or space's apps,
+// as it's reflected in Vault's storage system. Zero leaves that TTL uncapped.
+type ttlCapping struct {
+	TTL    time.Duration `json:"ttl"`
+	MaxTTL time.Duration `json:"max_ttl"`
+}
+
+func (b *backend) pathListTTLCaps() *framework.Path {
+	return &framework.Path{
+		Pattern: "ttl-caps/" + framework.GenericNameRegex("type") + "/?$",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "list",
+			OperationSuffix: "ttl-caps",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"type": {
+				Type:          framework.TypeString,
+				AllowedValues: policyMapTypes,
+				Description:   `The type of CF resource to list the TTL caps of, "orgs" or "spaces".`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.operationTTLCapList,
+			},
+		},
+		HelpSynopsis:    pathListTTLCapsSyn,
+		HelpDescription: pathListTTLCapsDesc,
+	}
+}
+
+func (b *backend) pathTTLCaps() *framework.Path {
+	return &framework.Path{
+		Pattern: "ttl-caps/" + framework.GenericNameRegex("type") + "/" + framework.GenericNameRegex("guid"),
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationSuffix: "ttl-cap",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"type": {
+				Type:          framework.TypeString,
+				AllowedValues: policyMapTypes,
+				Description:   `The type of CF resource to cap the token TTLs of, "orgs" or "spaces".`,
+			},
+			"guid": {
+				Type:        framework.TypeString,
+				Description: "The GUID of the org or space to cap the token TTLs of.",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The longest TTL of the tokens issued to the org's or space's apps. If unset, it isn't capped.",
+			},
+			"max_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The longest max TTL of the tokens issued to the org's or space's apps. If unset, it isn't capped.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationTTLCapUpdate,
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.operationTTLCapRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.operationTTLCapDelete,
+			},
+		},
+		HelpSynopsis:    pathTTLCapsSyn,
+		HelpDescription: pathTTLCapsDesc,
+	}
+}
+
+// ttlCapStorageKey returns the storage key for the cap's type and, if given, the GUID,
+// or an error response if the type can't be capped.
+func ttlCapStorageKey(capType, guid string) (string, *logical.Response) {
+	for _, allowed := range policyMapTypes {
+		if capType == allowed {
+			return ttlCapStoragePrefix + capType + "/" + guid, nil
+		}
+	}
+	return "", logical.ErrorResponse(fmt.Sprintf("'type' must be one of %v", policyMapTypes))
+}
+
+func (b *backend) operationTTLCapList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	prefix, errResp := ttlCapStorageKey(data.Get("type").(string), "")
+	if errResp != nil {
+		return errResp, nil
+	}
+	entries, err := req.Storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *backend) operationTTLCapUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := ttlCapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	capping := &ttlCapping{
+		TTL:    time.Duration(data.Get("ttl").(int)) * time.Second,
+		MaxTTL: time.Duration(data.Get("max_ttl").(int)) * time.Second,
+	}
+	if capping.TTL < 0 || capping.MaxTTL < 0 {
+		return logical.ErrorResponse("'ttl' and 'max_ttl' must not be negative"), nil
+	}
+	if capping.TTL == 0 && capping.MaxTTL == 0 {
+		return logical.ErrorResponse("at least one of 'ttl' or 'max_ttl' is required"), nil
+	}
+	if capping.MaxTTL > 0 && capping.TTL > capping.MaxTTL {
+		return logical.ErrorResponse("'ttl' must not be longer than 'max_ttl'"), nil
+	}
+	entry, err := logical.StorageEntryJSON(key, capping)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) operationTTLCapRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := ttlCapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	capping, err := getTTLCapping(ctx, req.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if capping == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"ttl":     int64(capping.TTL.Seconds()),
+			"max_ttl": int64(capping.MaxTTL.Seconds()),
+		},
+	}, nil
+}
+
+func (b *backend) operationTTLCapDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	key, errResp := ttlCapStorageKey(data.Get("type").(string), data.Get("guid").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	if err := req.Storage.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func getTTLCapping(ctx context.Context, storage logical.Storage, key string) (*ttlCapping, error) {
+	entry, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	capping := &ttlCapping{}
+	if err := entry.DecodeJSON(capping); err != nil {
+		return nil, err
+	}
+	return capping, nil
+}
+
+// applyTTLCaps lowers the auth's TTLs to the caps of the certificate's org and space,
+// whichever is shorter. The max TTL is capped as an explicit max TTL too, which
+// renewals can't extend, and periodic tokens' periods are capped like TTLs.
+func applyTTLCaps(ctx context.Context, storage logical.Storage, auth *logical.Auth, cfCert *models.CFCertificate) error {
+	for _, key := range []string{
+		ttlCapStoragePrefix + "orgs/" + cfCert.OrgID,
+		ttlCapStoragePrefix + "spaces/" + cfCert.SpaceID,
+	} {
+		capping, err := getTTLCapping(ctx, storage, key)
+		if err != nil {
+			return err
+		}
+		if capping == nil {
+			continue
+		}
+		if capping.TTL > 0 {
+			auth.TTL = capDuration(auth.TTL, capping.TTL)
+			if auth.Period > capping.TTL {
+				auth.Period = capping.TTL
+			}
+		}
+		if capping.MaxTTL > 0 {
+			auth.MaxTTL = capDuration(auth.MaxTTL, capping.MaxTTL)
+			auth.ExplicitMaxTTL = capDuration(auth.ExplicitMaxTTL, capping.MaxTTL)
+		}
+	}
+	return nil
+}
+
+// capDuration returns the shorter of the duration and the limit, with a zero duration,
+// meaning the mount's or system's default, being capped too.
+func capDuration(d, limit time.Duration) time.Duration {
+	if d == 0 || d > limit {
+		return limit
+	}
+	return d
+}
+
+const pathListTTLCapsSyn = `
+List the orgs or spaces that cap token TTLs.
+`
+
+const pathListTTLCapsDesc = `
+Lists the GUIDs of the orgs, at ttl-caps/orgs, or the spaces, at ttl-caps/spaces,
+that have TTL caps.
+`
+
+const pathTTLCapsSyn = `
+Cap the TTLs of tokens issued to a CF org's or space's apps.
+`
+
+const pathTTLCapsDesc = `
+Writing a "ttl" or "max_ttl" to ttl-caps/<type>/<guid>, where the type is "orgs"
+or "spaces", caps the TTLs of the tokens issued to the instances of that org or
+space, whichever role they log in with, so that a role shared with lower-trust
+environments can't issue them long-lived tokens. If both the org and the space
+have caps, the shorter of each applies. Renewals are capped too.
+`
@@ -0,0 +1,212 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
+)
+
+func (b *backend) pathVerifySignature() *framework.Path {
+	return &framework.Path{
+		Pattern: "verify-signature",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefixCloudFoundry,
+			OperationVerb:   "verify",
+			OperationSuffix: "signature",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "The name of the role, as the login would send it and sign it. It may be empty.",
+			},
+			"cf_instance_cert": {
+				Required:    true,
+				Type:        framework.TypeString,
+				Description: "The full body of the file available at the CF_INSTANCE_CERT path on the CF instance.",
+			},
+			"encoding": {
+				Type:          framework.TypeString,
+				Default:       util.CertEncodingAuto,
+				AllowedValues: []interface{}{util.CertEncodingAuto, util.CertEncodingPEM, util.CertEncodingBase64},
+				Description:   `The encoding of "cf_instance_cert", as login accepts it.`,
+			},
+			"signing_time": {
+				Required:    true,
+				Type:        framework.TypeString,
+				Description: "The date and time used to construct the signature, in any of the formats login accepts.",
+			},
+			"signature": {
+				Required:    true,
+				Type:        framework.TypeString,
+				Description: "The signature to verify, in the v1 or v2 format.",
+			},
+			"nonce": {
+				Type: framework.TypeString,
+				Description: `The nonce that the signature includes, if any. It's signed as it's given, without
+checking that the login/challenge endpoint issued it.`,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.operationVerifySignatureUpdate,
+			},
+		},
+		HelpSynopsis:    pathVerifySignatureSyn,
+		HelpDescription: pathVerifySignatureDesc,
+	}
+}
+
+// operationVerifySignatureUpdate makes the checks a login would make of the signature,
+// and returns the payload the signature should have signed. It doesn't check the CF
+// API, remember the signature, or issue a token, so a signature that verifies can
+// still be used to log in.
+func (b *backend) operationVerifySignatureUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	timeReceived := time.Now().UTC()
+	signature := data.Get("signature").(string)
+	if signature == "" {
+		return logical.ErrorResponse("'signature' is required"), nil
+	}
+	cfInstanceCertContents, err := instanceCertContents(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	signingTime, err := parseTime(data.Get("signing_time").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	roleName := data.Get("role").(string)
+
+	// The role's signing time window applies, if it exists.
+	role := &models.RoleEntry{}
+	if roleName != "" {
+		existing, err := getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			role = existing
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("no CA is configured for verifying client certificates"), nil
+	}
+
+	signatureData := &signatures.SignatureData{
+		SigningTime:            signingTime,
+		Role:                   roleName,
+		CFInstanceCertContents: cfInstanceCertContents,
+		Nonce:                  data.Get("nonce").(string),
+	}
+	if config.LoginAudienceVaultAddress != "" {
+		signatureData.Audience = &signatures.Audience{
+			VaultAddress:  config.LoginAudienceVaultAddress,
+			MountAccessor: req.MountAccessor,
+		}
+	}
+	respData := map[string]interface{}{
+		"signed_payload": signatureData.Payload(),
+	}
+
+	report := &checkReport{}
+	maxSecNotBefore, maxSecNotAfter := signingTimeWindow(config, role)
+	verifier := &signatures.Verifier{
+		Options:   signatures.VerifyOptions{FIPS: config.EnforceFIPSSignatures},
+		MaxAge:    maxSecNotBefore,
+		MaxFuture: maxSecNotAfter,
+		Now:       func() time.Time { return timeReceived },
+	}
+	if signatureData.Nonce != "" {
+		report.add("signing_time", checkSkipped, nil)
+	} else {
+		report.check("signing_time", verifier.CheckSigningTime(signingTime))
+	}
+
+	parsedSignature, err := signatures.Parse(signature)
+	report.check("signature_format", err)
+	if err != nil {
+		report.add("signature_hash", checkSkipped, nil)
+		report.add("signature", checkSkipped, nil)
+		report.add("certificate_chain", checkSkipped, nil)
+		return verifySignatureResponse(respData, report), nil
+	}
+	respData["signature_version"] = parsedSignature.Version
+	respData["signature_hash"] = parsedSignature.Hash
+	if parsedSignature.Algorithm != "" {
+		respData["signature_algorithm"] = parsedSignature.Algorithm
+	}
+	if digest, err := signatureData.Digest(parsedSignature.Hash); err == nil {
+		respData["signed_digest"] = hex.EncodeToString(digest)
+	}
+	if requiredHash := loginSignatureHash(config); parsedSignature.Hash != requiredHash {
+		report.add("signature_hash", checkFailed, fmt.Errorf("signature uses the %q hash, but this mount requires v2 signatures using the %q hash", parsedSignature.Hash, requiredHash))
+	} else {
+		report.add("signature_hash", checkPassed, nil)
+	}
+
+	signingCert, err := verifier.Verify(ctx, signature, signatureData)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		report.check("signature", err)
+		report.add("certificate_chain", checkSkipped, nil)
+		return verifySignatureResponse(respData, report), nil
+	}
+	report.add("signature", checkPassed, nil)
+
+	intermediateCerts, identityCert, err := util.ExtractCertificates(cfInstanceCertContents)
+	if err != nil {
+		report.check("certificate_chain", err)
+		return verifySignatureResponse(respData, report), nil
+	}
+	respData["signing_certificate"] = map[string]interface{}{
+		"subject":       signingCert.Subject.String(),
+		"issuer":        signingCert.Issuer.String(),
+		"serial_number": signingCert.SerialNumber.String(),
+		"not_after":     signingCert.NotAfter.UTC().Format(time.RFC3339),
+		"is_identity":   signingCert.Equal(identityCert),
+	}
+	// Signatures made with an intermediate certificate's key fail the chain's check.
+	_, err = util.VerifiedChain(config.AllIdentityCACertificates(), intermediateCerts, identityCert, signingCert)
+	report.check("certificate_chain", err)
+	return verifySignatureResponse(respData, report), nil
+}
+
+func verifySignatureResponse(data map[string]interface{}, report *checkReport) *logical.Response {
+	data["verified"] = !report.failed
+	data["checks"] = report.checks
+	return &logical.Response{
+		Data: data,
+	}
+}
+
+const pathVerifySignatureSyn = `
+Check a login signature without logging in.
+`
+
+const pathVerifySignatureDesc = `
+Takes the same fields as login, and reports whether the signature verifies, which
+certificate's key made it, and the payload and digest that it should sign, so that
+implementations of the signing algorithm in other languages can be compared against
+this one. Its signing time and hash are checked as a login would check them, and
+the signing certificate's chain is checked against the configured CA. The CF API
+isn't checked, the signature isn't remembered, and no token is issued.
+`
@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// policyTemplatePattern matches the placeholders in templated token policies, such as
+// "cf-{{org_name}}-{{space_name}}".
+var policyTemplatePattern = regexp.MustCompile(`{{\s*([^{}\s]*)\s*}}`)
+
+// policyTemplateIDs and policyTemplateNames are the fields token policies may refer
+// to. The names are only known when logins check the CF API, or when the instance
+// certificate carries them, so logins without them fail.
+var (
+	policyTemplateIDs   = []string{"org_id", "space_id", "app_id"}
+	policyTemplateNames = []string{"org_name", "space_name", "app_name"}
+)
+
+// validatePolicyTemplates checks that the role's token policies only refer to fields
+// that will be known at login.
+func validatePolicyTemplates(role *models.RoleEntry) error {
+	for _, policy := range role.TokenPolicies {
+		for _, match := range policyTemplatePattern.FindAllStringSubmatch(policy, -1) {
+			field := match[1]
+			switch {
+			case strutil.StrListContains(policyTemplateIDs, field):
+			case strutil.StrListContains(policyTemplateNames, field):
+			default:
+				return fmt.Errorf("token policy %q refers to %q, which isn't one of %s", policy, field,
+					strings.Join(append(append([]string{}, policyTemplateIDs...), policyTemplateNames...), ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// renderPolicies resolves the placeholders in the policies for the instance.
+func renderPolicies(policies []string, cfCert *models.CFCertificate, cfResources *cfResources) ([]string, error) {
+	values := map[string]string{
+		"org_id":   cfCert.OrgID,
+		"space_id": cfCert.SpaceID,
+		"app_id":   cfCert.AppID,
+	}
+	for field, name := range resourceNames(cfCert, cfResources) {
+		values[field] = name
+	}
+
+	rendered := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		var err error
+		policy = policyTemplatePattern.ReplaceAllStringFunc(policy, func(placeholder string) string {
+			field := policyTemplatePattern.FindStringSubmatch(placeholder)[1]
+			value, ok := values[field]
+			if !ok && err == nil {
+				err = fmt.Errorf("token policy %q refers to %q, which isn't known for this login", policy, field)
+			}
+			// Vault's policy names are lowercase.
+			return strings.ToLower(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, policy)
+	}
+	return rendered, nil
+}
+
+// displayNameFields are the fields token display name templates may refer to.
+var displayNameFields = append([]string{"instance_id"}, aliasMetadataFields...)
+
+// validateDisplayNameTemplate checks that the display name template only refers to
+// fields that may be known at login.
+func validateDisplayNameTemplate(template string) error {
+	for _, match := range policyTemplatePattern.FindAllStringSubmatch(template, -1) {
+		if !strutil.StrListContains(displayNameFields, match[1]) {
+			return fmt.Errorf("display name template %q refers to %q, which isn't one of %s", template, match[1], strings.Join(displayNameFields, ", "))
+		}
+	}
+	return nil
+}
+
+// displayNameTemplate returns the role's display name template, or the config's if the
+// role doesn't have one.
+func displayNameTemplate(config *models.Configuration, role *models.RoleEntry) string {
+	if role.DisplayNameTemplate != "" {
+		return role.DisplayNameTemplate
+	}
+	return config.DisplayNameTemplate
+}
+
+// renderDisplayName resolves the placeholders in the display name template from the
+// login's metadata. Tokens are only named for display, so logins where a field isn't
+// known aren't refused, but are named for their instance ID as they are without a
+// template.
+func renderDisplayName(template string, cfCert *models.CFCertificate, metadata map[string]string) string {
+	if template == "" {
+		return cfCert.InstanceID
+	}
+	known := true
+	displayName := policyTemplatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		field := policyTemplatePattern.FindStringSubmatch(placeholder)[1]
+		if field == "instance_id" {
+			return cfCert.InstanceID
+		}
+		value, ok := metadata[field]
+		known = known && ok
+		return value
+	})
+	if !known {
+		return cfCert.InstanceID
+	}
+	return displayName
+}
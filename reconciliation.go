@@ -0,0 +1,200 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+const trackedAppStoragePrefix = "tracked-apps/"
+
+// trackedApp is an app that tokens have been issued to, as it's reflected in Vault's
+// storage system. Tracked apps are periodically checked against the CF API so that
+// tokens for deleted apps can't be renewed.
+type trackedApp struct {
+	LastLogin time.Time `json:"last_login"`
+
+	// DeletedAt is when the app was found to no longer exist in the CF API.
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func getTrackedApp(ctx context.Context, storage logical.Storage, appID string) (*trackedApp, error) {
+	entry, err := storage.Get(ctx, trackedAppStoragePrefix+appID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	app := &trackedApp{}
+	if err := entry.DecodeJSON(app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func storeTrackedApp(ctx context.Context, storage logical.Storage, appID string, app *trackedApp) error {
+	entry, err := logical.StorageEntryJSON(trackedAppStoragePrefix+appID, app)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, entry)
+}
+
+// outlivedTokens reports whether the max lease TTL has passed since the app's last login
+// or deletion, in which case none of its tokens can still be live.
+func (a *trackedApp) outlivedTokens(maxLeaseTTL time.Duration, now time.Time) bool {
+	lastSeen := a.LastLogin
+	if !a.DeletedAt.IsZero() {
+		lastSeen = a.DeletedAt
+	}
+	return maxLeaseTTL > 0 && now.After(lastSeen.Add(maxLeaseTTL))
+}
+
+// checkAppNotDeleted returns an error if reconciliation has found the app deleted.
+func checkAppNotDeleted(ctx context.Context, storage logical.Storage, appID string) error {
+	app, err := getTrackedApp(ctx, storage, appID)
+	if err != nil {
+		return err
+	}
+	if app != nil && !app.DeletedAt.IsZero() {
+		return withErrorCode(errCodeAppDeleted, fmt.Errorf("app %s no longer exists in CF, as found at %s", appID, app.DeletedAt.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// trackLogin records a login by the app so that reconciliation checks it. Tracking an
+// app is best effort, a failure to do so doesn't fail the login.
+func (b *backend) trackLogin(ctx context.Context, storage logical.Storage, config *models.Configuration, appID string, now time.Time) {
+	if config.ReconciliationInterval <= 0 || !b.canReconcile() {
+		return
+	}
+	app, err := getTrackedApp(ctx, storage, appID)
+	if err != nil {
+		b.Logger().Warn("unable to read tracked app", "app_id", appID, "error", err)
+		return
+	}
+	// To avoid a storage write on every login, the last login is only updated once
+	// per interval. It's only used to stop tracking apps with no outstanding tokens.
+	if app != nil && now.Before(app.LastLogin.Add(config.ReconciliationInterval)) {
+		return
+	}
+	if app == nil {
+		app = &trackedApp{}
+	}
+	app.LastLogin = now
+	if err := storeTrackedApp(ctx, storage, appID, app); err != nil {
+		b.Logger().Warn("unable to track app", "app_id", appID, "error", err)
+	}
+}
+
+// canReconcile reports whether this node may write the tracked apps to storage.
+func (b *backend) canReconcile() bool {
+	replicationState := b.System().ReplicationState()
+	return !replicationState.HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby)
+}
+
+// periodicFunc refreshes the identity CA from CredHub and its URLs, tidies once per the configured
+// tidy interval, and reconciles the tracked apps with the CF API once per the configured
+// reconciliation interval.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	ctx = withRequestInfo(ctx, req)
+	if err := b.refreshCredHubIdentityCA(ctx, req.Storage, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := b.refreshIdentityCAURLs(ctx, req.Storage, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return nil
+	}
+	if err := b.periodicTidy(ctx, req.Storage, config, time.Now().UTC()); err != nil {
+		return err
+	}
+	b.refreshCFClientToken(ctx, config, time.Now())
+	if config.ReconciliationInterval <= 0 || !b.canReconcile() {
+		return nil
+	}
+
+	b.reconciliationMu.Lock()
+	defer b.reconciliationMu.Unlock()
+	now := time.Now().UTC()
+	if now.Before(b.lastReconciliation.Add(config.ReconciliationInterval)) {
+		return nil
+	}
+	b.lastReconciliation = now
+	return b.reconcile(ctx, req.Storage, config, now)
+}
+
+// reconcile checks every tracked app against the CF API, and marks the apps that no
+// longer exist as deleted so that their tokens can't be renewed. Vault doesn't let auth
+// methods revoke tokens, so such tokens remain valid until their current TTL runs out.
+func (b *backend) reconcile(ctx context.Context, storage logical.Storage, config *models.Configuration, now time.Time) error {
+	appIDs, err := storage.List(ctx, trackedAppStoragePrefix)
+	if err != nil {
+		return err
+	}
+	if len(appIDs) == 0 {
+		return nil
+	}
+	client, err := b.getCFClientOrRefresh(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	// Apps that have outlived their tokens are no longer tracked.
+	maxLeaseTTL := b.System().MaxLeaseTTL()
+	for _, appID := range appIDs {
+		app, err := getTrackedApp(ctx, storage, appID)
+		if err != nil {
+			return err
+		}
+		if app == nil {
+			continue
+		}
+		if app.outlivedTokens(maxLeaseTTL, now) {
+			if err := storage.Delete(ctx, trackedAppStoragePrefix+appID); err != nil {
+				return err
+			}
+			continue
+		}
+		if !app.DeletedAt.IsZero() {
+			continue
+		}
+
+		err = b.callCFAPI("reconcile_app", func() error {
+			_, err := client.Applications.Get(ctx, appID)
+			return err
+		})
+		if resource.IsResourceNotFoundError(err) {
+			b.Logger().Info("app no longer exists in CF, its tokens can no longer be renewed", "app_id", appID)
+			app.DeletedAt = now
+			if err := storeTrackedApp(ctx, storage, appID, app); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			// Don't mark any apps as deleted based on a CF API that isn't answering.
+			b.taintCFClient()
+			return fmt.Errorf("unable to reconcile app %s with the CF API: %w", appID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/cf"
+)
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := cf.MockServer(false, nil)
+	t.Cleanup(s.Close)
+
+	storage := &logical.InmemStorage{}
+	config := &models.Configuration{
+		Version:                1,
+		CFAPIAddr:              s.URL,
+		CFUsername:             cf.AuthUsername,
+		CFPassword:             cf.AuthPassword,
+		ReconciliationInterval: time.Minute,
+	}
+	if err := storeConfig(ctx, storage, config); err != nil {
+		t.Fatal(err)
+	}
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System: &logical.StaticSystemView{
+			MaxLeaseTTLVal: 24 * time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.(*backend)
+
+	now := time.Now().UTC()
+	b.trackLogin(ctx, storage, config, cf.FoundAppGUID, now)
+	b.trackLogin(ctx, storage, config, cf.UnfoundAppGUID, now)
+	// None of this app's tokens can outlive the max lease TTL.
+	if err := storeTrackedApp(ctx, storage, "stale-app", &trackedApp{LastLogin: now.Add(-48 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.periodicFunc(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkAppNotDeleted(ctx, storage, cf.FoundAppGUID); err != nil {
+		t.Fatalf("expected the found app not to be deleted but received %s", err)
+	}
+	if err := checkAppNotDeleted(ctx, storage, cf.UnfoundAppGUID); err == nil || !strings.Contains(err.Error(), "no longer exists") {
+		t.Fatalf("expected the unfound app to be deleted but received %v", err)
+	}
+	if app, err := getTrackedApp(ctx, storage, "stale-app"); err != nil || app != nil {
+		t.Fatalf("expected the stale app to no longer be tracked but received %#v, %v", app, err)
+	}
+
+	// Until the interval has passed, the CF API isn't checked again.
+	s.Close()
+	if err := b.periodicFunc(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatalf("expected reconciliation to wait for the interval but received %s", err)
+	}
+	b.lastReconciliation = time.Time{}
+	if err := b.periodicFunc(ctx, &logical.Request{Storage: storage}); err == nil {
+		t.Fatal("expected reconciliation to fail with the CF API down")
+	}
+	if err := checkAppNotDeleted(ctx, storage, cf.FoundAppGUID); err != nil {
+		t.Fatalf("expected the found app not to be deleted while the CF API is down but received %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// defaultResourceCacheMaxEntries is the number of entries kept by a resource
+// cache when it is enabled but no maximum has been configured.
+const defaultResourceCacheMaxEntries = 1000
+
+// resourceCache holds app, space, and org resources looked up from the CF API.
+// Many instances of the same app tend to log in within a short window of each
+// other, so this spares the CF API from serving the same lookups for each of
+// them. A nil *resourceCache is valid and caches nothing.
+type resourceCache struct {
+	ttl   time.Duration
+	cache *lru.Cache
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+type resourceCacheEntry struct {
+	resources *cfResources
+	expiresAt time.Time
+}
+
+// newResourceCache returns a cache whose entries live for the given TTL, holding
+// at most maxEntries entries. A TTL of zero disables caching, in which case a nil
+// cache is returned.
+func newResourceCache(ttl time.Duration, maxEntries int) (*resourceCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultResourceCacheMaxEntries
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceCache{
+		ttl:   ttl,
+		cache: cache,
+		now:   time.Now,
+	}, nil
+}
+
+// get returns the unexpired resources cached under the given key, if any.
+func (c *resourceCache) get(key string) (*cfResources, bool) {
+	if c == nil {
+		return nil, false
+	}
+	raw, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := raw.(*resourceCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.cache.Remove(key)
+		return nil, false
+	}
+	return entry.resources, true
+}
+
+// add caches the resources under the given key, evicting the least recently
+// used entry if the cache is full.
+func (c *resourceCache) add(key string, resources *cfResources) {
+	if c == nil {
+		return
+	}
+	c.cache.Add(key, &resourceCacheEntry{
+		resources: resources,
+		expiresAt: c.now().Add(c.ttl),
+	})
+}
+
+// sweep removes the expired entries from the cache, returning how many were removed.
+func (c *resourceCache) sweep() int {
+	if c == nil {
+		return 0
+	}
+	now := c.now()
+	swept := 0
+	for _, key := range c.cache.Keys() {
+		raw, ok := c.cache.Peek(key)
+		if ok && !now.Before(raw.(*resourceCacheEntry).expiresAt) {
+			c.cache.Remove(key)
+			swept++
+		}
+	}
+	return swept
+}
+
+// purge removes every entry from the cache.
+func (c *resourceCache) purge() {
+	if c == nil {
+		return
+	}
+	c.cache.Purge()
+}
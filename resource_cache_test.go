@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+)
+
+func TestResourceCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("disabled", func(t *testing.T) {
+		c, err := newResourceCache(0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != nil {
+			t.Fatal("expected a nil cache when the TTL is zero")
+		}
+		c.add("app", &cfResources{})
+		if _, ok := c.get("app"); ok {
+			t.Fatal("a disabled cache shouldn't return anything")
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		c, err := newResourceCache(time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		expected := &cfResources{app: &resource.App{Name: "app-name"}}
+		c.add("app", expected)
+
+		now = now.Add(59 * time.Second)
+		actual, ok := c.get("app")
+		if !ok {
+			t.Fatal("expected the app to be cached")
+		}
+		if actual != expected {
+			t.Fatalf("expected %+v but received %+v", expected, actual)
+		}
+
+		now = now.Add(time.Second)
+		if _, ok := c.get("app"); ok {
+			t.Fatal("expected the cached app to have expired")
+		}
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		c, err := newResourceCache(time.Minute, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.add("app1", &cfResources{})
+		c.add("app2", &cfResources{})
+		c.add("app3", &cfResources{})
+		if _, ok := c.get("app1"); ok {
+			t.Fatal("expected the least recently used app to have been evicted")
+		}
+		for _, appGUID := range []string{"app2", "app3"} {
+			if _, ok := c.get(appGUID); !ok {
+				t.Fatalf("expected %s to be cached", appGUID)
+			}
+		}
+	})
+}
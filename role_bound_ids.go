@@ -0,0 +1,161 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+// boundIDChunkSize is the most bound IDs of a kind kept in the role's storage entry.
+// Roles binding more have them split across entries of their own, so that the role's
+// entry doesn't grow past what Vault's storage backends accept.
+const boundIDChunkSize = 1000
+
+// roleBoundIDsStoragePrefix is where the chunks of roles' bound IDs are stored, under
+// the role's name and the name of the field they're for.
+const roleBoundIDsStoragePrefix = "role-bound-ids/"
+
+// maxBoundIDsInErrors is the most bound IDs that are listed in login errors, so that
+// roles binding thousands don't make for unreadable errors.
+const maxBoundIDsInErrors = 10
+
+// boundIDFields returns the role's bound ID lists by the name of their field.
+func boundIDFields(role *models.RoleEntry) map[string]*[]string {
+	return map[string]*[]string{
+		"bound_application_ids":  &role.BoundAppIDs,
+		"bound_space_ids":        &role.BoundSpaceIDs,
+		"bound_organization_ids": &role.BoundOrgIDs,
+		"bound_instance_ids":     &role.BoundInstanceIDs,
+	}
+}
+
+// sortBoundIDs sorts the role's bound IDs and drops duplicates, so that logins can
+// search them in logarithmic time.
+func sortBoundIDs(role *models.RoleEntry) {
+	for _, ids := range boundIDFields(role) {
+		slices.Sort(*ids)
+		*ids = slices.Compact(*ids)
+	}
+}
+
+// meetsBoundIDConstraints is like meetsBoundConstraints, for bound IDs that have been
+// sorted by sortBoundIDs.
+func meetsBoundIDConstraints(id string, sortedIDs []string) bool {
+	if len(sortedIDs) == 0 {
+		return true
+	}
+	_, found := slices.BinarySearch(sortedIDs, id)
+	return found
+}
+
+// describeBoundIDs returns the bound IDs as they're given in login errors.
+func describeBoundIDs(ids []string) string {
+	if len(ids) > maxBoundIDsInErrors {
+		return fmt.Sprintf("%v and %d more", ids[:maxBoundIDsInErrors], len(ids)-maxBoundIDsInErrors)
+	}
+	return fmt.Sprint(ids)
+}
+
+// storeRole stores the role, with the bound IDs of kinds it binds more than
+// boundIDChunkSize of split into chunks.
+func storeRole(ctx context.Context, storage logical.Storage, roleName string, role *models.RoleEntry) error {
+	stored := *role
+	stored.BoundIDChunks = nil
+	chunkCounts := map[string]int{}
+	for field, ids := range boundIDFields(&stored) {
+		if len(*ids) <= boundIDChunkSize {
+			continue
+		}
+		chunks := 0
+		for start := 0; start < len(*ids); start += boundIDChunkSize {
+			chunk := (*ids)[start:min(start+boundIDChunkSize, len(*ids))]
+			entry, err := logical.StorageEntryJSON(boundIDChunkKey(roleName, field, chunks), chunk)
+			if err != nil {
+				return err
+			}
+			if err := storage.Put(ctx, entry); err != nil {
+				return err
+			}
+			chunks++
+		}
+		chunkCounts[field] = chunks
+		*ids = nil
+	}
+	if len(chunkCounts) > 0 {
+		stored.BoundIDChunks = chunkCounts
+	}
+
+	entry, err := logical.StorageEntryJSON(roleStoragePrefix+roleName, &stored)
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		return err
+	}
+	// The chunks a previous version of the role used, beyond those this one uses, are
+	// only dropped once nothing refers to them.
+	for field := range boundIDFields(&stored) {
+		if err := deleteBoundIDChunks(ctx, storage, roleName, field, chunkCounts[field]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBoundIDChunks reads the role's chunked bound IDs back into it.
+func loadBoundIDChunks(ctx context.Context, storage logical.Storage, roleName string, role *models.RoleEntry) error {
+	fields := boundIDFields(role)
+	for field, chunks := range role.BoundIDChunks {
+		ids, ok := fields[field]
+		if !ok {
+			return fmt.Errorf("role %q has chunks of unknown field %q", roleName, field)
+		}
+		for i := 0; i < chunks; i++ {
+			entry, err := storage.Get(ctx, boundIDChunkKey(roleName, field, i))
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				return fmt.Errorf("role %q is missing chunk %d of its %s", roleName, i, field)
+			}
+			var chunk []string
+			if err := entry.DecodeJSON(&chunk); err != nil {
+				return err
+			}
+			*ids = append(*ids, chunk...)
+		}
+	}
+	role.BoundIDChunks = nil
+	return nil
+}
+
+// deleteBoundIDChunks deletes the chunks of the role's bound IDs for the field, other
+// than the first keep of them.
+func deleteBoundIDChunks(ctx context.Context, storage logical.Storage, roleName, field string, keep int) error {
+	prefix := roleBoundIDsStoragePrefix + roleName + "/" + field + "/"
+	keys, err := storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if i, err := strconv.Atoi(key); err == nil && i < keep {
+			continue
+		}
+		if err := storage.Delete(ctx, prefix+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boundIDChunkKey(roleName, field string, i int) string {
+	return roleBoundIDsStoragePrefix + roleName + "/" + field + "/" + strconv.Itoa(i)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestStoreRoleChunksBoundIDs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	var appIDs []string
+	for i := 2*boundIDChunkSize + 1; i > 0; i-- {
+		appIDs = append(appIDs, fmt.Sprintf("app-%05d", i))
+	}
+	role := &models.RoleEntry{
+		BoundAppIDs:   append(appIDs, appIDs[0]),
+		BoundSpaceIDs: []string{"space-2", "space-1"},
+	}
+	sortBoundIDs(role)
+	require.NoError(t, storeRole(ctx, storage, "many-apps", role))
+
+	// The app IDs are kept out of the role's own entry, and the space IDs in it.
+	stored := &models.RoleEntry{}
+	entry, err := storage.Get(ctx, roleStoragePrefix+"many-apps")
+	require.NoError(t, err)
+	require.NoError(t, entry.DecodeJSON(stored))
+	assert.Empty(t, stored.BoundAppIDs)
+	assert.Equal(t, []string{"space-1", "space-2"}, stored.BoundSpaceIDs)
+	assert.Equal(t, map[string]int{"bound_application_ids": 3}, stored.BoundIDChunks)
+
+	read, err := getRole(ctx, storage, "many-apps")
+	require.NoError(t, err)
+	assert.Len(t, read.BoundAppIDs, len(appIDs))
+	assert.Nil(t, read.BoundIDChunks)
+	assert.True(t, meetsBoundIDConstraints("app-00001", read.BoundAppIDs))
+	assert.True(t, meetsBoundIDConstraints(fmt.Sprintf("app-%05d", 2*boundIDChunkSize+1), read.BoundAppIDs))
+	assert.False(t, meetsBoundIDConstraints("app-00000", read.BoundAppIDs))
+
+	// Chunks that a shorter list no longer uses are dropped.
+	read.BoundAppIDs = read.BoundAppIDs[:boundIDChunkSize+1]
+	require.NoError(t, storeRole(ctx, storage, "many-apps", read))
+	keys, err := storage.List(ctx, roleBoundIDsStoragePrefix+"many-apps/bound_application_ids/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"0", "1"}, keys)
+
+	read.BoundAppIDs = []string{"app-00001"}
+	require.NoError(t, storeRole(ctx, storage, "many-apps", read))
+	keys, err = storage.List(ctx, roleBoundIDsStoragePrefix+"many-apps/bound_application_ids/")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	read, err = getRole(ctx, storage, "many-apps")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app-00001"}, read.BoundAppIDs)
+}
+
+func TestDescribeBoundIDs(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "[a b]", describeBoundIDs([]string{"a", "b"}))
+	ids := make([]string, maxBoundIDsInErrors+5)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	assert.Equal(t, "[0 1 2 3 4 5 6 7 8 9] and 5 more", describeBoundIDs(ids))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/signatures"
+)
+
+// seenSignaturesSweepInterval is how often expired signatures are dropped.
+const seenSignaturesSweepInterval = time.Minute
+
+// seenSignatures remembers the login signatures that have been used, so that an
+// intercepted login request can't be replayed while its signing time is still
+// within the allowed window. Signatures are only kept in memory on the node that
+// handled the login.
+type seenSignatures struct {
+	mu          sync.Mutex
+	expirations map[[sha256.Size]byte]time.Time
+	lastSweep   time.Time
+}
+
+// signedRequestKey returns what a login request is remembered by: the fingerprint of
+// the certificate that signed it, followed by the digest of the payload it signed.
+// Every signature of the same payload by the same certificate is remembered as one.
+func signedRequestKey(signingCert *x509.Certificate, signatureData *signatures.SignatureData) []byte {
+	fingerprint := sha256.Sum256(signingCert.Raw)
+	digest := sha256.Sum256([]byte(signatureData.Payload()))
+	return append(fingerprint[:], digest[:]...)
+}
+
+func newSeenSignatures() *seenSignatures {
+	return &seenSignatures{
+		expirations: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// add records the signature as used until the given expiry, and reports whether
+// it had already been used.
+func (s *seenSignatures) add(signature []byte, expiresAt, now time.Time) (seen bool) {
+	key := sha256.Sum256(signature)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= seenSignaturesSweepInterval {
+		s.sweepLocked(now)
+	}
+
+	if expiry, ok := s.expirations[key]; ok && now.Before(expiry) {
+		return true
+	}
+	s.expirations[key] = expiresAt
+	return false
+}
+
+// sweep drops the signatures that have expired, returning how many were dropped.
+func (s *seenSignatures) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked(now)
+}
+
+func (s *seenSignatures) sweepLocked(now time.Time) int {
+	swept := 0
+	for k, expiry := range s.expirations {
+		if !now.Before(expiry) {
+			delete(s.expirations, k)
+			swept++
+		}
+	}
+	s.lastSweep = now
+	return swept
+}
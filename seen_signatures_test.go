@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeenSignatures(t *testing.T) {
+	t.Parallel()
+
+	s := newSeenSignatures()
+	now := time.Now()
+	expiresAt := now.Add(5 * time.Minute)
+
+	if s.add([]byte("signature"), expiresAt, now) {
+		t.Fatal("signature shouldn't have been seen yet")
+	}
+	if !s.add([]byte("signature"), expiresAt, now.Add(time.Minute)) {
+		t.Fatal("signature should have been seen")
+	}
+	if s.add([]byte("other-signature"), expiresAt, now.Add(time.Minute)) {
+		t.Fatal("other signature shouldn't have been seen yet")
+	}
+
+	// Once expired, signatures are no longer remembered.
+	if s.add([]byte("signature"), expiresAt.Add(5*time.Minute), expiresAt) {
+		t.Fatal("expired signature shouldn't be reported as seen")
+	}
+	s.add([]byte("newer-signature"), expiresAt.Add(10*time.Minute), expiresAt.Add(5*time.Minute))
+	if len(s.expirations) != 1 {
+		t.Fatalf("expected expired signatures to be swept but %d remain", len(s.expirations))
+	}
+}
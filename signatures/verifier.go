@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package signatures
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSigningTimeSkew is wrapped by the errors CheckSigningTime returns for signing
+// times outside of the verifier's window.
+var ErrSigningTimeSkew = errors.New("signing time is outside of the allowed window")
+
+// ErrAudienceMismatch is returned by Verify for signatures that don't verify with the
+// signature data's audience, but do without one, and so weren't bound to it.
+var ErrAudienceMismatch = errors.New("signature isn't bound to the audience")
+
+// Verifier verifies signatures, as Verify does, and their signing times. Its clock can
+// be replaced, so that signing times are checked deterministically, and its
+// verifications take a context, so that they can be cancelled. The zero Verifier
+// verifies signatures as Verify does.
+type Verifier struct {
+	// Options change which signatures are accepted.
+	Options VerifyOptions
+
+	// MaxAge and MaxFuture are how old and how far in the future a signing time may be.
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+
+	// Now returns the time signing times are checked against. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Verify is like VerifyWithOptions with the verifier's options, but returns the
+// context's error if it's done before a matching certificate is found. It doesn't
+// check the signing time, which CheckSigningTime does. If the signature data has an
+// audience, and the signature only verifies without it, ErrAudienceMismatch is returned.
+func (v *Verifier) Verify(ctx context.Context, signature string, signatureData *SignatureData) (*x509.Certificate, error) {
+	if signatureData == nil {
+		return nil, errors.New("signatureData must be provided")
+	}
+
+	parsed, err := Parse(signature)
+	if err != nil {
+		return nil, err
+	}
+	instanceCert, err := v.verifyLineEndings(ctx, signature, parsed, signatureData)
+	if err == nil {
+		return instanceCert, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if signatureData.Audience != nil {
+		unbound := *signatureData
+		unbound.Audience = nil
+		if _, unboundErr := v.verifyLineEndings(ctx, signature, parsed, &unbound); unboundErr == nil {
+			return nil, ErrAudienceMismatch
+		}
+	}
+	return nil, err
+}
+
+// verifyLineEndings verifies the parsed signature against the signature data, or
+// against the data with the instance certificate's line endings changed.
+func (v *Verifier) verifyLineEndings(ctx context.Context, signature string, parsed *Signature, signatureData *SignatureData) (*x509.Certificate, error) {
+	instanceCert, err := verifyParsed(ctx, signature, parsed, signatureData, v.Options)
+	if err == nil {
+		return instanceCert, nil
+	}
+	// Clients on Windows cells may sign the instance certificate with other line
+	// endings than the ones it's sent with, which doesn't change the certificate.
+	for _, contents := range lineEndingVariants(signatureData.CFInstanceCertContents) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		variant := *signatureData
+		variant.CFInstanceCertContents = contents
+		if instanceCert, variantErr := verifyParsed(ctx, signature, parsed, &variant, v.Options); variantErr == nil {
+			return instanceCert, nil
+		}
+	}
+	return nil, err
+}
+
+// CheckSigningTime returns an error wrapping ErrSigningTimeSkew if the signing time is
+// older than MaxAge, or further in the future than MaxFuture.
+func (v *Verifier) CheckSigningTime(signingTime time.Time) error {
+	now := v.now()
+	if signingTime.Before(now.Add(-v.MaxAge)) {
+		return &signingTimeError{fmt.Sprintf("request is too old; signed at %s but received request at %s; allowable seconds old is %d", signingTime, now, v.MaxAge/time.Second)}
+	}
+	if signingTime.After(now.Add(v.MaxFuture)) {
+		return &signingTimeError{fmt.Sprintf("request is too far in the future; signed at %s but received request at %s; allowable seconds in the future is %d", signingTime, now, v.MaxFuture/time.Second)}
+	}
+	return nil
+}
+
+func (v *Verifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// signingTimeError is the error CheckSigningTime returns, which says how far the
+// signing time is off without repeating ErrSigningTimeSkew's message.
+type signingTimeError struct {
+	message string
+}
+
+func (e *signingTimeError) Error() string {
+	return e.message
+}
+
+func (e *signingTimeError) Unwrap() error {
+	return ErrSigningTimeSkew
+}
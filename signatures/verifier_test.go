@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package signatures
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+)
+
+func TestVerifierCheckSigningTime(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	verifier := &Verifier{
+		MaxAge:    5 * time.Minute,
+		MaxFuture: time.Minute,
+		Now:       func() time.Time { return now },
+	}
+	for name, tc := range map[string]struct {
+		signingTime time.Time
+		skewed      bool
+	}{
+		"now":                 {now, false},
+		"oldest allowed":      {now.Add(-5 * time.Minute), false},
+		"too old":             {now.Add(-5*time.Minute - time.Second), true},
+		"furthest allowed":    {now.Add(time.Minute), false},
+		"too far into future": {now.Add(time.Minute + time.Second), true},
+	} {
+		err := verifier.CheckSigningTime(tc.signingTime)
+		if tc.skewed != errors.Is(err, ErrSigningTimeSkew) {
+			t.Fatalf("%s: expected skewed to be %t but received %v", name, tc.skewed, err)
+		}
+	}
+}
+
+func TestVerifierVerify(t *testing.T) {
+	testCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	signatureData := &SignatureData{
+		SigningTime:            time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Role:                   "my-role",
+		CFInstanceCertContents: testCerts.InstanceCertificate,
+	}
+	signature, err := SignV2(loadSigner(t, testCerts.PathToInstanceKey), signatureData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &Verifier{Options: VerifyOptions{FIPS: true}}
+	if _, err := verifier.Verify(context.Background(), signature, signatureData); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := verifier.Verify(ctx, signature, signatureData); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled verification to fail with %v but received %v", context.Canceled, err)
+	}
+}
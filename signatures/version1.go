@@ -4,10 +4,14 @@
 package signatures
 
 import (
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
@@ -18,6 +22,8 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/util"
 )
 
 const TimeFormat = "2006-01-02T15:04:05Z"
@@ -33,6 +39,28 @@ type SignatureData struct {
 	// identity certificate itself, and the second one is the intermediate
 	// certificate that issued it.
 	CFInstanceCertContents string
+
+	// Audience is the Vault cluster and mount the signature is meant for. If
+	// set, it's signed along with the other fields so that the signature can't
+	// be used to log in to a different cluster or mount.
+	Audience *Audience
+
+	// Nonce is the challenge the login endpoint issued for this login, if the
+	// login uses one. If set, it's signed along with the other fields, so that
+	// the signature can only be used with the challenge it was made for.
+	Nonce string
+}
+
+// Audience identifies the Vault cluster and auth mount a login signature is
+// meant for.
+type Audience struct {
+	// VaultAddress is the address of the Vault cluster, such as
+	// "https://vault.example.com:8200".
+	VaultAddress string
+
+	// MountAccessor is the accessor of the CF auth mount, such as
+	// "auth_cf_1a2b3c4d".
+	MountAccessor string
 }
 
 func (s *SignatureData) hash() []byte {
@@ -40,74 +68,190 @@ func (s *SignatureData) hash() []byte {
 	return sum[:]
 }
 
+// hashWith hashes the data with the named hash algorithm.
+func (s *SignatureData) hashWith(hashName string) (crypto.Hash, []byte, error) {
+	switch hashName {
+	case HashSHA256:
+		return crypto.SHA256, s.hash(), nil
+	case HashSHA384:
+		sum := sha512.Sum384([]byte(s.toSign()))
+		return crypto.SHA384, sum[:], nil
+	case HashSHA512:
+		sum := sha512.Sum512([]byte(s.toSign()))
+		return crypto.SHA512, sum[:], nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported signature hash %q", hashName)
+	}
+}
+
+// Payload returns the string that's hashed and signed for the data, so that
+// implementations of the signing algorithm can compare theirs against it.
+func (s *SignatureData) Payload() string {
+	return s.toSign()
+}
+
+// Digest returns the payload's digest with the named hash, one of HashSHA256,
+// HashSHA384, or HashSHA512, which is what signatures using the hash sign.
+func (s *SignatureData) Digest(hashName string) ([]byte, error) {
+	_, digest, err := s.hashWith(hashName)
+	return digest, err
+}
+
 func (s *SignatureData) toSign() string {
 	toHash := ""
 	for _, field := range []string{s.SigningTime.UTC().Format(TimeFormat), s.CFInstanceCertContents, s.Role} {
 		toHash += field
 	}
+	if s.Audience != nil {
+		// Separate the audience from the role, so that signatures without an
+		// audience can never be taken as having one.
+		toHash += "\naudience:" + strings.TrimRight(s.Audience.VaultAddress, "/") + "\n" + s.Audience.MountAccessor
+	}
+	if s.Nonce != "" {
+		toHash += "\nnonce:" + s.Nonce
+	}
 	return toHash
 }
 
-func Sign(pathToPrivateKey string, signatureData *SignatureData) (string, error) {
+// Sign signs the given data with the signer, producing a v1 signature. The signer
+// must hold the instance identity key, which may be an RSA key, used with PSS, or
+// an ECDSA key on the P-256 or P-384 curve. Keys kept in an HSM or KMS can be used
+// through a crypto.Signer; keys in a file can be read with LoadPrivateKey.
+func Sign(signer crypto.Signer, signatureData *SignatureData) (string, error) {
 	if signatureData == nil {
 		return "", errors.New("signatureData must be provided")
 	}
-
-	keyBytes, err := ioutil.ReadFile(pathToPrivateKey)
+	_, signatureBytes, err := sign(signer, crypto.SHA256, signatureData.hash(), rsa.PSSSaltLengthAuto)
 	if err != nil {
 		return "", err
 	}
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		return "", fmt.Errorf("unable to decode RSA private key from %s", keyBytes)
-	}
-	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	return fmt.Sprintf("%s:%s", signatureVersion, base64.StdEncoding.EncodeToString(signatureBytes)), nil
+}
+
+// LoadPrivateKey reads the PEM-encoded private key at the given path, such as the
+// one at CF_INSTANCE_KEY, for use with Sign.
+func LoadPrivateKey(pathToPrivateKey string) (crypto.Signer, error) {
+	return LoadEncryptedPrivateKey(pathToPrivateKey, nil)
+}
+
+// LoadEncryptedPrivateKey is like LoadPrivateKey, but decrypts the key with the
+// passphrase if it's encrypted.
+func LoadEncryptedPrivateKey(pathToPrivateKey string, passphrase []byte) (crypto.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(pathToPrivateKey)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	// This resolves to using a saltLength of 222.
-	signatureBytes, err := rsa.SignPSS(rand.Reader, rsaPrivateKey, crypto.SHA256, signatureData.hash(), nil)
+	signer, err := util.ParsePrivateKey(keyBytes, passphrase)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("unable to load private key from %s: %w", pathToPrivateKey, err)
 	}
-	return fmt.Sprintf("%s:%s", signatureVersion, base64.StdEncoding.EncodeToString(signatureBytes)), nil
+	return signer, nil
 }
 
-// Verify ensures that a given signature was created by a private key
-// matching one of the given instance certificates. It returns the matching
-// certificate, which should further be verified to be the identity certificate,
-// and to be issued by a chain leading to the root CA certificate. There's a
-// util function for this named Validate.
-func Verify(signature string, signatureData *SignatureData) (*x509.Certificate, error) {
-	var signatureBytes []byte
-	var err error
+// sign signs the digest with the given signer, returning the algorithm that was used.
+// RSA signatures are made with the given PSS salt length.
+func sign(signer crypto.Signer, hash crypto.Hash, digest []byte, saltLength int) (string, []byte, error) {
+	if signer == nil {
+		return "", nil, errors.New("signer must be provided")
+	}
+	switch publicKey := signer.Public().(type) {
+	case *rsa.PublicKey:
+		// With PSSSaltLengthAuto, SHA-256 and a 2048 bit key, this resolves to using a
+		// saltLength of 222.
+		signatureBytes, err := signer.Sign(rand.Reader, digest, &rsa.PSSOptions{
+			SaltLength: saltLength,
+			Hash:       hash,
+		})
+		return AlgorithmRSAPSS, signatureBytes, err
+	case *ecdsa.PublicKey:
+		if err := checkCurve(publicKey.Curve); err != nil {
+			return "", nil, err
+		}
+		// ECDSA signers return ASN.1 encoded signatures.
+		signatureBytes, err := signer.Sign(rand.Reader, digest, hash)
+		return AlgorithmECDSA, signatureBytes, err
+	default:
+		return "", nil, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
 
-	if signatureData == nil {
-		return nil, errors.New("signatureData must be provided")
+// checkCurve ensures that an ECDSA key is on one of the supported curves.
+func checkCurve(curve elliptic.Curve) error {
+	switch curve {
+	case elliptic.P256(), elliptic.P384():
+		return nil
+	default:
+		return fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
 	}
+}
 
+// Parse parses a signature in any of the formats accepted by Verify.
+func Parse(signature string) (*Signature, error) {
 	// Parse signature format
 	parts := strings.Split(signature, ":")
 
 	switch len(parts) {
 	// Original release using URL-safe encoding and no embedded version
 	case 1:
-		signatureBytes, err = base64.URLEncoding.DecodeString(parts[0])
+		signatureBytes, err := base64.URLEncoding.DecodeString(parts[0])
 		if err != nil {
 			return nil, err
 		}
+		return &Signature{Version: signatureVersion, Hash: HashSHA256, Bytes: signatureBytes}, nil
 	case 2:
-		if parts[0] != "v1" {
+		if parts[0] != signatureVersion {
 			return nil, fmt.Errorf("invalid signature version %q", parts[0])
 		}
-		signatureBytes, err = base64.StdEncoding.DecodeString(parts[1])
+		signatureBytes, err := base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
 			return nil, err
 		}
+		return &Signature{Version: signatureVersion, Hash: HashSHA256, Bytes: signatureBytes}, nil
 	default:
+		if parts[0] == signatureVersion2 {
+			return parseV2(parts)
+		}
 		return nil, errors.New("invalid signature format")
 	}
+}
+
+// ErrNotFIPSApproved is wrapped by the errors VerifyWithOptions returns for signatures
+// that are rejected because FIPS mode doesn't approve of how they were made.
+var ErrNotFIPSApproved = errors.New("not FIPS approved")
+
+// VerifyOptions change which signatures VerifyWithOptions accepts.
+type VerifyOptions struct {
+	// FIPS only accepts signatures made with the algorithms, key sizes, and hashes
+	// FIPS 186-5 approves of: RSA-PSS with a key of at least 2048 bits and a salt as
+	// long as the hash, or ECDSA on the P-256 or P-384 curve, over SHA-256, SHA-384,
+	// or SHA-512. Of the signatures made by this package, only v2 ones meet these for
+	// RSA keys, since v1 ones use the longest salt that fits instead.
+	FIPS bool
+}
+
+// minFIPSRSAKeyBits is the smallest RSA key FIPS 186-5 approves of for signatures.
+const minFIPSRSAKeyBits = 2048
+
+// Verify ensures that a given signature was created by a private key
+// matching one of the given instance certificates. It returns the matching
+// certificate, which should further be verified to be the identity certificate,
+// and to be issued by a chain leading to the root CA certificate. There's a
+// util function for this named Validate.
+func Verify(signature string, signatureData *SignatureData) (*x509.Certificate, error) {
+	return VerifyWithOptions(signature, signatureData, VerifyOptions{})
+}
+
+// VerifyWithOptions is like Verify, but only accepts the signatures the options allow.
+func VerifyWithOptions(signature string, signatureData *SignatureData, opts VerifyOptions) (*x509.Certificate, error) {
+	return (&Verifier{Options: opts}).Verify(context.Background(), signature, signatureData)
+}
+
+// verifyParsed verifies the parsed signature against the signature data, as Verify does.
+func verifyParsed(ctx context.Context, signature string, parsed *Signature, signatureData *SignatureData, opts VerifyOptions) (*x509.Certificate, error) {
+	hash, digest, err := signatureData.hashWith(parsed.Hash)
+	if err != nil {
+		return nil, err
+	}
 
 	// Use the CA certificate to verify the signature we've received.
 	cfInstanceCertContentsBytes := []byte(signatureData.CFInstanceCertContents)
@@ -124,12 +268,10 @@ func Verify(signature string, signatureData *SignatureData) (*x509.Certificate,
 			continue
 		}
 		for _, instanceCert := range instanceCerts {
-			publicKey, ok := instanceCert.PublicKey.(*rsa.PublicKey)
-			if !ok {
-				result = multierror.Append(result, fmt.Errorf("not an rsa public key, it's a %t", instanceCert.PublicKey))
-				continue
+			if err := ctx.Err(); err != nil {
+				return nil, err
 			}
-			if err := rsa.VerifyPSS(publicKey, crypto.SHA256, signatureData.hash(), signatureBytes, nil); err != nil {
+			if err := verifySignature(instanceCert.PublicKey, parsed, hash, digest, opts); err != nil {
 				result = multierror.Append(result, err)
 				continue
 			}
@@ -142,3 +284,52 @@ func Verify(signature string, signatureData *SignatureData) (*x509.Certificate,
 	}
 	return nil, result
 }
+
+// lineEndingVariants returns the contents with LF and with CRLF line endings, other
+// than the contents themselves.
+func lineEndingVariants(contents string) []string {
+	lf := strings.ReplaceAll(contents, "\r\n", "\n")
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+	var variants []string
+	for _, variant := range []string{lf, crlf} {
+		if variant != contents {
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// verifySignature verifies the signature over the digest with the given public key. v1
+// signatures don't name their algorithm, so it's taken from the type of the key.
+func verifySignature(publicKey interface{}, signature *Signature, hash crypto.Hash, digest []byte, opts VerifyOptions) error {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		if signature.Algorithm != "" && signature.Algorithm != AlgorithmRSAPSS {
+			return fmt.Errorf("signature algorithm %q doesn't match rsa public key", signature.Algorithm)
+		}
+		if !opts.FIPS {
+			return rsa.VerifyPSS(publicKey, hash, digest, signature.Bytes, nil)
+		}
+		if bits := publicKey.N.BitLen(); bits < minFIPSRSAKeyBits {
+			return fmt.Errorf("rsa key is %d bits, but FIPS mode requires at least %d: %w", bits, minFIPSRSAKeyBits, ErrNotFIPSApproved)
+		}
+		err := rsa.VerifyPSS(publicKey, hash, digest, signature.Bytes, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil && rsa.VerifyPSS(publicKey, hash, digest, signature.Bytes, nil) == nil {
+			return fmt.Errorf("rsa-pss salt isn't as long as the hash, as FIPS mode requires and v2 signatures use: %w", ErrNotFIPSApproved)
+		}
+		return err
+	case *ecdsa.PublicKey:
+		if signature.Algorithm != "" && signature.Algorithm != AlgorithmECDSA {
+			return fmt.Errorf("signature algorithm %q doesn't match ecdsa public key", signature.Algorithm)
+		}
+		if err := checkCurve(publicKey.Curve); err != nil {
+			return err
+		}
+		if !ecdsa.VerifyASN1(publicKey, digest, signature.Bytes) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("not an rsa or ecdsa public key, it's a %T", publicKey)
+	}
+}
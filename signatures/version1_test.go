@@ -4,8 +4,13 @@
 package signatures
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,7 +35,7 @@ func TestSignVerifyIssuedByFakes(t *testing.T) {
 		CFInstanceCertContents: testCerts.InstanceCertificate,
 	}
 
-	signature, err := Sign(testCerts.PathToInstanceKey, signatureData)
+	signature, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), signatureData)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,6 +55,262 @@ func TestSignVerifyIssuedByFakes(t *testing.T) {
 	}
 }
 
+func TestVerifyLineEndings(t *testing.T) {
+	testCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The certificate is signed with CRLF line endings, as read on a Windows cell,
+	// but sent with LF line endings, and the other way around.
+	lf := strings.ReplaceAll(testCerts.InstanceCertificate, "\r\n", "\n")
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+	for signed, sent := range map[string]string{crlf: lf, lf: crlf} {
+		signingTime := time.Now()
+		signature, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), &SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "my-role",
+			CFInstanceCertContents: signed,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Verify(signature, &SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "my-role",
+			CFInstanceCertContents: sent,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Verify(signature, &SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "other-role",
+			CFInstanceCertContents: sent,
+		}); err == nil {
+			t.Fatal("expected a signature for another role to fail")
+		}
+	}
+}
+
+func TestSignVerifyECDSA(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			testCerts, err := certificates.GenerateECDSA(curve, "doesn't", "really", "matter", "here", "10.255.181.105")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := testCerts.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			signatureData := &SignatureData{
+				SigningTime:            time.Now(),
+				Role:                   "my-role",
+				CFInstanceCertContents: testCerts.InstanceCertificate,
+			}
+
+			signature, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), signatureData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signingCert, err := Verify(signature, signatureData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			intermediateCert, identityCert, err := util.ExtractCertificates(testCerts.InstanceCertificate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := util.Validate([]string{testCerts.CACertificate}, intermediateCert, identityCert, signingCert); err != nil {
+				t.Fatal(err)
+			}
+
+			// The signature shouldn't verify for different data.
+			signatureData.Role = "other-role"
+			if _, err := Verify(signature, signatureData); err == nil {
+				t.Fatal("expected signature not to verify for a different role")
+			}
+		})
+	}
+}
+
+func TestSignECDSAUnsupportedCurve(t *testing.T) {
+	testCerts, err := certificates.GenerateECDSA(elliptic.P224(), "doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), &SignatureData{
+		SigningTime:            time.Now(),
+		Role:                   "my-role",
+		CFInstanceCertContents: testCerts.InstanceCertificate,
+	}); err == nil {
+		t.Fatal("expected signing with a P-224 key to fail")
+	}
+}
+
+// opaqueSigner hides the type of the key behind it, like a signer backed by an HSM.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestSignVerifyOpaqueSigner(t *testing.T) {
+	rsaCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCerts, err := certificates.GenerateECDSA(elliptic.P256(), "doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, testCerts := range map[string]*certificates.TestCertificates{"rsa": rsaCerts, "ecdsa": ecdsaCerts} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if err := testCerts.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			signer := opaqueSigner{loadSigner(t, testCerts.PathToInstanceKey)}
+			signatureData := &SignatureData{
+				SigningTime:            time.Now(),
+				Role:                   "my-role",
+				CFInstanceCertContents: testCerts.InstanceCertificate,
+			}
+
+			signature, err := Sign(signer, signatureData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(signature, signatureData); err != nil {
+				t.Fatal(err)
+			}
+
+			signature, err = SignV2WithHash(signer, signatureData, HashSHA384)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(signature, signatureData); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSignVerifyAudience(t *testing.T) {
+	testCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	signingTime := time.Now()
+	signatureData := func(audience *Audience) *SignatureData {
+		return &SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "my-role",
+			CFInstanceCertContents: testCerts.InstanceCertificate,
+			Audience:               audience,
+		}
+	}
+
+	signature, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), signatureData(&Audience{
+		VaultAddress:  "https://vault.example.com:8200/",
+		MountAccessor: "auth_cf_1234",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A trailing slash on the address doesn't matter.
+	if _, err := Verify(signature, signatureData(&Audience{
+		VaultAddress:  "https://vault.example.com:8200",
+		MountAccessor: "auth_cf_1234",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, audience := range map[string]*Audience{
+		"no audience":          nil,
+		"different cluster":    {VaultAddress: "https://other.example.com:8200", MountAccessor: "auth_cf_1234"},
+		"different mount":      {VaultAddress: "https://vault.example.com:8200", MountAccessor: "auth_cf_5678"},
+		"empty mount accessor": {VaultAddress: "https://vault.example.com:8200"},
+		"empty vault address":  {MountAccessor: "auth_cf_1234"},
+	} {
+		if _, err := Verify(signature, signatureData(audience)); err == nil {
+			t.Fatalf("expected signature not to verify with %s", name)
+		} else if audience != nil && errors.Is(err, ErrAudienceMismatch) {
+			t.Fatalf("expected a signature bound to another audience not to be reported as unbound with %s", name)
+		}
+	}
+
+	// A signature that isn't bound to any audience is told apart from a bad one.
+	unbound, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), signatureData(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(unbound, signatureData(&Audience{
+		VaultAddress:  "https://vault.example.com:8200",
+		MountAccessor: "auth_cf_1234",
+	})); !errors.Is(err, ErrAudienceMismatch) {
+		t.Fatalf("expected %v but received %v", ErrAudienceMismatch, err)
+	}
+}
+
+func TestSignVerifyNonce(t *testing.T) {
+	testCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := testCerts.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	signingTime := time.Now()
+	signatureData := func(nonce string) *SignatureData {
+		return &SignatureData{
+			SigningTime:            signingTime,
+			Role:                   "my-role",
+			CFInstanceCertContents: testCerts.InstanceCertificate,
+			Nonce:                  nonce,
+		}
+	}
+
+	signature, err := Sign(loadSigner(t, testCerts.PathToInstanceKey), signatureData("my-nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(signature, signatureData("my-nonce")); err != nil {
+		t.Fatal(err)
+	}
+	for _, nonce := range []string{"", "other-nonce"} {
+		if _, err := Verify(signature, signatureData(nonce)); err == nil {
+			t.Fatalf("expected signature not to verify with nonce %q", nonce)
+		}
+	}
+}
+
 func TestSignVerifyIssuedByReal(t *testing.T) {
 	certBytes, err := ioutil.ReadFile("../testdata/real-certificates/instance.crt")
 	if err != nil {
@@ -61,7 +322,7 @@ func TestSignVerifyIssuedByReal(t *testing.T) {
 		CFInstanceCertContents: string(certBytes),
 	}
 
-	signature, err := Sign("../testdata/real-certificates/instance.key", signatureData)
+	signature, err := Sign(loadSigner(t, "../testdata/real-certificates/instance.key"), signatureData)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -117,7 +378,7 @@ func TestSignature(t *testing.T) {
 		Role:                   sampleRole,
 		CFInstanceCertContents: string(certBytes),
 	}
-	signature, err := Sign(sampleKey, signatureData)
+	signature, err := Sign(loadSigner(t, sampleKey), signatureData)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -131,3 +392,44 @@ func TestSignature(t *testing.T) {
 
 	}
 }
+
+func TestSignatureDataPayload(t *testing.T) {
+	signingTime, err := time.Parse(TimeFormat, "2019-05-20T22:08:40Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certBytes, err := ioutil.ReadFile("../testdata/real-certificates/instance.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureData := &SignatureData{
+		SigningTime:            signingTime,
+		Role:                   "sample-role",
+		CFInstanceCertContents: string(certBytes),
+		Nonce:                  "nonce",
+	}
+	expected := "2019-05-20T22:08:40Z" + string(certBytes) + "sample-role\nnonce:nonce"
+	if payload := signatureData.Payload(); payload != expected {
+		t.Fatalf("expected payload %q but received %q", expected, payload)
+	}
+
+	digest, err := signatureData.Digest(HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, signatureData.hash()) {
+		t.Fatalf("expected the SHA-256 digest to be the signed hash")
+	}
+	if _, err := signatureData.Digest("md5"); err == nil {
+		t.Fatal("expected an unsupported hash to fail")
+	}
+}
+
+func loadSigner(t *testing.T, pathToPrivateKey string) crypto.Signer {
+	t.Helper()
+	signer, err := LoadPrivateKey(pathToPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package signatures
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version 2 signatures name the algorithm and hash that produced them, in the format
+// "v2:<algorithm>:<hash>:<base64-encoded signature>", so that algorithms can be added
+// without clients and Vault having to agree on them out of band.
+const signatureVersion2 = "v2"
+
+const (
+	// AlgorithmRSAPSS is RSA with PSS padding.
+	AlgorithmRSAPSS = "rsa-pss"
+
+	// AlgorithmECDSA is ECDSA with an ASN.1 encoded signature.
+	AlgorithmECDSA = "ecdsa"
+
+	// HashSHA256 is SHA-256, the only hash used by v1 signatures.
+	HashSHA256 = "sha256"
+
+	// HashSHA384 is SHA-384.
+	HashSHA384 = "sha384"
+
+	// HashSHA512 is SHA-512.
+	HashSHA512 = "sha512"
+)
+
+// Signature is a parsed signature along with what's needed to verify it.
+type Signature struct {
+	Version string
+
+	// Algorithm is empty for v1 signatures, which are verified using the
+	// algorithm matching the type of the instance certificate's key.
+	Algorithm string
+	Hash      string
+	Bytes     []byte
+}
+
+// String returns the signature in the v2 format.
+func (s *Signature) String() string {
+	return strings.Join([]string{
+		signatureVersion2,
+		s.Algorithm,
+		s.Hash,
+		base64.StdEncoding.EncodeToString(s.Bytes),
+	}, ":")
+}
+
+// SignV2 is like Sign, but produces a v2 signature. Versions of Vault that only
+// understand v1 signatures can't verify it.
+func SignV2(signer crypto.Signer, signatureData *SignatureData) (string, error) {
+	return SignV2WithHash(signer, signatureData, HashSHA256)
+}
+
+// SignV2WithHash is like SignV2, but hashes the data with the named hash, which
+// is one of HashSHA256, HashSHA384, or HashSHA512.
+func SignV2WithHash(signer crypto.Signer, signatureData *SignatureData, hashName string) (string, error) {
+	if signatureData == nil {
+		return "", errors.New("signatureData must be provided")
+	}
+	hash, digest, err := signatureData.hashWith(hashName)
+	if err != nil {
+		return "", err
+	}
+	// A salt as long as the hash is what FIPS 186-5 approves of, and verifiers that
+	// predate it detect the salt length, so they accept it too.
+	algorithm, signatureBytes, err := sign(signer, hash, digest, rsa.PSSSaltLengthEqualsHash)
+	if err != nil {
+		return "", err
+	}
+	signature := &Signature{
+		Version:   signatureVersion2,
+		Algorithm: algorithm,
+		Hash:      hashName,
+		Bytes:     signatureBytes,
+	}
+	return signature.String(), nil
+}
+
+func parseV2(parts []string) (*Signature, error) {
+	if len(parts) != 4 {
+		return nil, errors.New("invalid v2 signature format")
+	}
+	switch parts[1] {
+	case AlgorithmRSAPSS, AlgorithmECDSA:
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q", parts[1])
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Version:   signatureVersion2,
+		Algorithm: parts[1],
+		Hash:      parts[2],
+		Bytes:     signatureBytes,
+	}, nil
+}
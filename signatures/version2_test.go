@@ -0,0 +1,166 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package signatures
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/testing/certificates"
+)
+
+func TestSignVerifyV2(t *testing.T) {
+	rsaCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsaCerts.Close()
+
+	ecdsaCerts, err := certificates.GenerateECDSA(elliptic.P256(), "doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ecdsaCerts.Close()
+
+	tests := []struct {
+		name          string
+		testCerts     *certificates.TestCertificates
+		wantAlgorithm string
+	}{
+		{name: "rsa", testCerts: rsaCerts, wantAlgorithm: AlgorithmRSAPSS},
+		{name: "ecdsa", testCerts: ecdsaCerts, wantAlgorithm: AlgorithmECDSA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signatureData := &SignatureData{
+				SigningTime:            time.Now(),
+				Role:                   "my-role",
+				CFInstanceCertContents: tt.testCerts.InstanceCertificate,
+			}
+
+			for _, hash := range []string{HashSHA256, HashSHA384, HashSHA512} {
+				signature, err := SignV2WithHash(loadSigner(t, tt.testCerts.PathToInstanceKey), signatureData, hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantPrefix := "v2:" + tt.wantAlgorithm + ":" + hash + ":"
+				if !strings.HasPrefix(signature, wantPrefix) {
+					t.Fatalf("expected signature to begin with %q but received %q", wantPrefix, signature)
+				}
+
+				if _, err := Verify(signature, signatureData); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyV2Invalid(t *testing.T) {
+	testCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testCerts.Close()
+
+	signatureData := &SignatureData{
+		SigningTime:            time.Now(),
+		Role:                   "my-role",
+		CFInstanceCertContents: testCerts.InstanceCertificate,
+	}
+	signature, err := SignV2(loadSigner(t, testCerts.PathToInstanceKey), signatureData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(signature, ":")
+
+	tests := map[string]string{
+		"mismatched algorithm": strings.Join([]string{parts[0], AlgorithmECDSA, parts[2], parts[3]}, ":"),
+		"unknown algorithm":    strings.Join([]string{parts[0], "ed25519", parts[2], parts[3]}, ":"),
+		"unknown hash":         strings.Join([]string{parts[0], parts[1], "md5", parts[3]}, ":"),
+		"missing parts":        strings.Join([]string{parts[0], parts[1], parts[3]}, ":"),
+	}
+	for name, signature := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Verify(signature, signatureData); err == nil {
+				t.Fatalf("expected %q not to verify", signature)
+			}
+		})
+	}
+}
+
+func TestVerifyFIPS(t *testing.T) {
+	rsaCerts, err := certificates.Generate("doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsaCerts.Close()
+
+	smallRSACerts, err := certificates.GenerateRSA(1024, "doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smallRSACerts.Close()
+
+	ecdsaCerts, err := certificates.GenerateECDSA(elliptic.P384(), "doesn't", "really", "matter", "here", "10.255.181.105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ecdsaCerts.Close()
+
+	tests := []struct {
+		name         string
+		testCerts    *certificates.TestCertificates
+		sign         func(*testing.T, *certificates.TestCertificates, *SignatureData) (string, error)
+		wantApproved bool
+	}{
+		{name: "rsa v2", testCerts: rsaCerts, sign: signWith(SignV2), wantApproved: true},
+		{name: "rsa v2 sha512", testCerts: rsaCerts, sign: signWithHash(HashSHA512), wantApproved: true},
+		{name: "rsa v1", testCerts: rsaCerts, sign: signWith(Sign)},
+		{name: "small rsa key v2", testCerts: smallRSACerts, sign: signWith(SignV2)},
+		{name: "ecdsa v1", testCerts: ecdsaCerts, sign: signWith(Sign), wantApproved: true},
+		{name: "ecdsa v2", testCerts: ecdsaCerts, sign: signWith(SignV2), wantApproved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signatureData := &SignatureData{
+				SigningTime:            time.Now(),
+				Role:                   "my-role",
+				CFInstanceCertContents: tt.testCerts.InstanceCertificate,
+			}
+			signature, err := tt.sign(t, tt.testCerts, signatureData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Without FIPS mode, every signature verifies.
+			if _, err := Verify(signature, signatureData); err != nil {
+				t.Fatal(err)
+			}
+			_, err = VerifyWithOptions(signature, signatureData, VerifyOptions{FIPS: true})
+			if tt.wantApproved && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantApproved && !errors.Is(err, ErrNotFIPSApproved) {
+				t.Fatalf("expected a FIPS error but received %v", err)
+			}
+		})
+	}
+}
+
+func signWith(signFunc func(crypto.Signer, *SignatureData) (string, error)) func(*testing.T, *certificates.TestCertificates, *SignatureData) (string, error) {
+	return func(t *testing.T, testCerts *certificates.TestCertificates, signatureData *SignatureData) (string, error) {
+		return signFunc(loadSigner(t, testCerts.PathToInstanceKey), signatureData)
+	}
+}
+
+func signWithHash(hashName string) func(*testing.T, *certificates.TestCertificates, *SignatureData) (string, error) {
+	return func(t *testing.T, testCerts *certificates.TestCertificates, signatureData *SignatureData) (string, error) {
+		return SignV2WithHash(loadSigner(t, testCerts.PathToInstanceKey), signatureData, hashName)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// storageVersionKey is where the version of the layout that the mount's storage entries
+// are in is stored.
+const storageVersionKey = "storage-version"
+
+// Storage versions:
+//
+//	0: entries as written by the PCF-era plugin. The config may be at version 0, with
+//	   the API address and credentials in its pcf_ fields, and roles may have their
+//	   policies, TTLs and CIDRs in the fields that predate the token_ ones.
+//	1: the config is at version 1 and has only the cf_ fields, and roles have only
+//	   the token_ fields.
+const currentStorageVersion = 1
+
+type storageVersion struct {
+	Version int `json:"version"`
+}
+
+// upgradeStorage migrates the mount's storage entries to the current layout, so that
+// they don't depend on the migrations made as they're read. It's only run on the node
+// that can write to storage, and only once per storage version.
+func (b *backend) upgradeStorage(ctx context.Context, storage logical.Storage) error {
+	if b.System() != nil && !b.canReconcile() {
+		return nil
+	}
+	version := &storageVersion{}
+	entry, err := storage.Get(ctx, storageVersionKey)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(version); err != nil {
+			return err
+		}
+	}
+	if version.Version >= currentStorageVersion {
+		return nil
+	}
+
+	b.Logger().Info("upgrading storage", "from_version", version.Version, "to_version", currentStorageVersion)
+	if err := upgradeConfigStorage(ctx, storage); err != nil {
+		return err
+	}
+	if err := upgradeRoleStorage(ctx, storage); err != nil {
+		return err
+	}
+
+	entry, err = logical.StorageEntryJSON(storageVersionKey, &storageVersion{Version: currentStorageVersion})
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, entry)
+}
+
+// upgradeConfigStorage stores the config as it's migrated to version 1, without the
+// pcf_ fields it was migrated from.
+func upgradeConfigStorage(ctx context.Context, storage logical.Storage) error {
+	config, err := getConfig(ctx, storage)
+	if err != nil || config == nil {
+		return err
+	}
+	config.PCFAPICertificates = nil
+	config.PCFAPIAddr = ""
+	config.PCFUsername = ""
+	config.PCFPassword = ""
+	return storeConfig(ctx, storage, config)
+}
+
+// upgradeRoleStorage stores each role as it's migrated when read, without the fields
+// that predate the token_ ones.
+func upgradeRoleStorage(ctx context.Context, storage logical.Storage) error {
+	roleNames, err := storage.List(ctx, roleStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, roleName := range roleNames {
+		role, err := getRole(ctx, storage, roleName)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			continue
+		}
+		role.TTL = 0
+		role.MaxTTL = 0
+		role.Period = 0
+		role.Policies = nil
+		role.BoundCIDRs = nil
+		if err := storeRole(ctx, storage, roleName, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/vault-plugin-auth-cf/models"
+)
+
+func TestUpgradeStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	putJSON := func(key string, value interface{}) {
+		entry, err := logical.StorageEntryJSON(key, value)
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(ctx, entry))
+	}
+	getJSON := func(key string) map[string]interface{} {
+		entry, err := storage.Get(ctx, key)
+		require.NoError(t, err)
+		require.NotNil(t, entry, key)
+		raw := map[string]interface{}{}
+		require.NoError(t, entry.DecodeJSON(&raw))
+		return raw
+	}
+
+	// Entries as the PCF-era plugin wrote them.
+	putJSON(configStorageKey, map[string]interface{}{
+		"identity_ca_certificates":     []string{"ca-cert"},
+		"pcf_api_trusted_certificates": []string{"api-cert"},
+		"pcf_api_addr":                 "https://api.sys.example.com",
+		"pcf_username":                 "username",
+		"pcf_password":                 "password",
+	})
+	putJSON(roleStoragePrefix+"legacy-role", map[string]interface{}{
+		"bound_application_ids": []string{"app-id"},
+		"policies":              []string{"app-policy"},
+		"ttl":                   time.Hour,
+		"max_ttl":               2 * time.Hour,
+	})
+
+	lb, err := Factory(ctx, &logical.BackendConfig{
+		StorageView: storage,
+		Logger:      hclog.Default(),
+		System:      &logical.StaticSystemView{},
+	})
+	require.NoError(t, err)
+	b := lb.(*backend)
+	require.NoError(t, b.initialize(ctx, &logical.InitializationRequest{Storage: storage}))
+
+	config := getJSON(configStorageKey)
+	assert.Equal(t, json.Number("1"), config["version"])
+	assert.Equal(t, "https://api.sys.example.com", config["cf_api_addr"])
+	assert.Equal(t, "username", config["cf_username"])
+	assert.Equal(t, "password", config["cf_password"])
+	assert.Equal(t, []interface{}{"api-cert"}, config["cf_api_trusted_certificates"])
+	assert.Empty(t, config["pcf_api_addr"])
+	assert.Empty(t, config["pcf_username"])
+	assert.Empty(t, config["pcf_password"])
+	assert.Empty(t, config["pcf_api_trusted_certificates"])
+
+	role := getJSON(roleStoragePrefix + "legacy-role")
+	assert.Equal(t, []interface{}{"app-policy"}, role["token_policies"])
+	assert.Equal(t, json.Number(fmt.Sprint(int64(time.Hour))), role["token_ttl"])
+	assert.Equal(t, json.Number(fmt.Sprint(int64(2*time.Hour))), role["token_max_ttl"])
+	assert.Equal(t, models.AppStateLiveInstances, role["required_app_state"])
+	assert.Empty(t, role["policies"])
+	assert.Equal(t, json.Number("0"), role["ttl"])
+	assert.Equal(t, json.Number("0"), role["max_ttl"])
+
+	assert.Equal(t, json.Number(fmt.Sprint(currentStorageVersion)), getJSON(storageVersionKey)["version"])
+
+	// The upgrade is only made once.
+	putJSON(roleStoragePrefix+"later-role", map[string]interface{}{"policies": []string{"app-policy"}})
+	require.NoError(t, b.upgradeStorage(ctx, storage))
+	assert.Equal(t, []interface{}{"app-policy"}, getJSON(roleStoragePrefix + "later-role")["policies"])
+
+	// And the upgraded entries read as they did before.
+	upgradedRole, err := getRole(ctx, storage, "legacy-role")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app-policy"}, upgradedRole.TokenPolicies)
+	assert.Equal(t, time.Hour, upgradedRole.TokenTTL)
+	upgradedConfig, err := getConfig(ctx, storage)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.sys.example.com", upgradedConfig.CFAPIAddr)
+}
@@ -5,6 +5,8 @@ package certificates
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -40,7 +42,29 @@ import (
 //			}
 //	}()
 func Generate(instanceID, orgID, spaceID, appID, ipAddress string) (*TestCertificates, error) {
-	caCert, instanceCert, instanceKey, err := generate(instanceID, orgID, spaceID, appID, ipAddress)
+	return GenerateRSA(2048, instanceID, orgID, spaceID, appID, ipAddress)
+}
+
+// GenerateRSA is like Generate, but the client certificate has an RSA key of the given size.
+func GenerateRSA(bits int, instanceID, orgID, spaceID, appID, ipAddress string) (*TestCertificates, error) {
+	identityPriv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return generateWithIdentityKey(identityPriv, instanceID, orgID, spaceID, appID, ipAddress)
+}
+
+// GenerateECDSA is like Generate, but the client certificate has an ECDSA key on the given curve.
+func GenerateECDSA(curve elliptic.Curve, instanceID, orgID, spaceID, appID, ipAddress string) (*TestCertificates, error) {
+	identityPriv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return generateWithIdentityKey(identityPriv, instanceID, orgID, spaceID, appID, ipAddress)
+}
+
+func generateWithIdentityKey(identityPriv interface{}, instanceID, orgID, spaceID, appID, ipAddress string) (*TestCertificates, error) {
+	caCert, instanceCert, instanceKey, err := generate(identityPriv, instanceID, orgID, spaceID, appID, ipAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -179,7 +203,7 @@ func (e *TestMTLSCertificates) Close() error {
 	return e.cleanup()
 }
 
-func generate(instanceID, orgID, spaceID, appID, ipAddress string) (caCert, instanceCert, instanceKey string, err error) {
+func generate(identityPriv interface{}, instanceID, orgID, spaceID, appID, ipAddress string) (caCert, instanceCert, instanceKey string, err error) {
 	caCert, caPriv, err := generateCA("", nil)
 	if err != nil {
 		return "", "", "", err
@@ -190,7 +214,7 @@ func generate(instanceID, orgID, spaceID, appID, ipAddress string) (caCert, inst
 		return "", "", "", err
 	}
 
-	identityCert, identityPriv, err := generateIdentity(intermediateCert, intermediatePriv, instanceID, orgID, spaceID, appID, ipAddress)
+	identityCert, err := generateIdentity(intermediateCert, intermediatePriv, identityPriv, instanceID, orgID, spaceID, appID, ipAddress)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -214,7 +238,7 @@ func generateCA(caCert string, caPriv *rsa.PrivateKey) (string, *rsa.PrivateKey,
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 100),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
@@ -258,17 +282,17 @@ func generateCA(caCert string, caPriv *rsa.PrivateKey) (string, *rsa.PrivateKey,
 	return cert, priv, nil
 }
 
-func generateIdentity(caCert string, caPriv *rsa.PrivateKey, instanceID, orgID, spaceID, appID, ipAddress string) (string, *rsa.PrivateKey, error) {
+func generateIdentity(caCert string, caPriv *rsa.PrivateKey, priv interface{}, instanceID, orgID, spaceID, appID, ipAddress string) (string, error) {
 	block, certBytes := pem.Decode([]byte(caCert))
 	if block == nil {
-		return "", nil, errors.New("block shouldn't be nil")
+		return "", errors.New("block shouldn't be nil")
 	}
 	if len(certBytes) > 0 {
-		return "", nil, errors.New("there shouldn't be more bytes")
+		return "", errors.New("there shouldn't be more bytes")
 	}
 	ca509cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
 
 	template := x509.Certificate{
@@ -287,26 +311,21 @@ func generateIdentity(caCert string, caPriv *rsa.PrivateKey, instanceID, orgID,
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 100),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 		IPAddresses:           []net.IP{net.ParseIP(ipAddress)},
 	}
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return "", nil, err
-	}
-
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca509cert, publicKey(priv), caPriv)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
 
 	out := &bytes.Buffer{}
 	pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	cert := out.String()
-	return cert, priv, nil
+	return cert, nil
 }
 
 func generateSignedCert(caCert string, caPrivateKey *rsa.PrivateKey) (string, *rsa.PrivateKey, error) {
@@ -377,6 +396,8 @@ func publicKey(priv interface{}) interface{} {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
 		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
 	default:
 		return nil
 	}
@@ -386,6 +407,12 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
 		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
 	default:
 		return nil
 	}
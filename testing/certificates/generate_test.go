@@ -31,8 +31,13 @@ func TestGenerate(t *testing.T) {
 		Role:                   "test-role",
 	}
 
+	signer, err := signatures.LoadPrivateKey(testCerts.PathToInstanceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Create a signature.
-	signature, err := signatures.Sign(testCerts.PathToInstanceKey, signatureData)
+	signature, err := signatures.Sign(signer, signatureData)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cf
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is a failure a mock server injects into its responses.
+type Fault struct {
+	// PathPrefix, if set, limits the fault to requests whose path starts with it, such
+	// as "/v3/apps" for app lookups, or "/oauth/token" for UAA token requests.
+	PathPrefix string
+
+	// Status, if set, is what the faulted requests are responded to with instead, such
+	// as 429 or 503. A 429 has the CF API's rate limit error as its body, and other
+	// statuses have a plain body, as the router in front of the CF API sends when the
+	// API can't be reached.
+	Status int
+
+	// RetryAfter, if set, is sent as the Retry-After header of the faulted responses.
+	RetryAfter time.Duration
+
+	// Latency delays the faulted responses, or until the request is canceled.
+	Latency time.Duration
+
+	// Count is how many requests are faulted before the fault is removed. If zero,
+	// requests are faulted until the faults are cleared.
+	Count int
+}
+
+// Faults are the failures a mock server injects, so that retries, failover and the
+// circuit breaker can be tested deterministically. They may be changed while the
+// server runs. Each request is faulted by the first fault it matches.
+type Faults struct {
+	mu       sync.Mutex
+	faults   []*Fault
+	served   int
+	requests map[int]int
+}
+
+// Add injects the fault into the following requests.
+func (f *Faults) Add(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Clear removes the faults, so that requests are responded to as usual.
+func (f *Faults) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// Requests returns how many requests the server has received, faulted or not.
+func (f *Faults) Requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.served
+}
+
+// Faulted returns how many requests have been responded to with the status, or that
+// have been delayed without changing their status if it's zero.
+func (f *Faults) Faulted(status int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[status]
+}
+
+// next returns the fault to inject into the request, if any.
+func (f *Faults) next(r *http.Request) *Fault {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.served++
+	for i, fault := range f.faults {
+		if !strings.HasPrefix(r.URL.Path, fault.PathPrefix) {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			}
+		}
+		if f.requests == nil {
+			f.requests = make(map[int]int)
+		}
+		f.requests[fault.Status]++
+		return fault
+	}
+	return nil
+}
+
+// inject applies the fault to the request, and reports whether it has been responded
+// to.
+func (fault *Fault) inject(w http.ResponseWriter, r *http.Request) bool {
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if fault.Status == 0 {
+		return false
+	}
+	if fault.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter.Seconds())))
+	}
+	if fault.Status == http.StatusTooManyRequests {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fault.Status)
+		w.Write([]byte(rateLimitExceededResponse))
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(fault.Status)
+	w.Write([]byte(fmt.Sprintf("%d %s\n", fault.Status, http.StatusText(fault.Status))))
+	return true
+}
+
+const rateLimitExceededResponse = `{
+	"errors": [
+		{
+			"detail": "Rate Limit Exceeded",
+			"title": "CF-RateLimitExceeded",
+			"code": 10013
+		}
+	]
+}`
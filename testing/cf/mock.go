@@ -30,6 +30,18 @@ const (
 	FoundSpaceName   = "cfdev-space"
 	FoundOrgName     = "system"
 
+	FoundDropletGUID   = "740ebd2b-162b-469a-bd72-3edb96fabd9a"
+	FoundAppStack      = "cflinuxfs4"
+	FoundAppBuildpack  = "java_buildpack"
+	FoundProcessType   = "web"
+	FoundInstanceIndex = "2"
+
+	BoundServiceInstanceGUID = "5a8e8ff2-38e6-4b43-a8c4-9c29bb4d6f02"
+	BoundServiceInstanceName = "vault-access"
+
+	FoundAppTeamLabel            = "payments"
+	FoundAppCostCenterAnnotation = "cc-1234"
+
 	UnfoundServiceGUID = "service-id-unfound"
 	UnfoundAppGUID     = "app-id-unfound"
 	UnfoundOrgID       = "org-id-unfound"
@@ -37,17 +49,39 @@ const (
 )
 
 var (
-	testServerUrl = ""
-	logger        = hclog.Default()
+	// appWithIncludedResponse is the app response when its parent space and org are requested
+	// through the "include" query parameter.
+	appWithIncludedResponse = strings.TrimSuffix(appResponse, "}") +
+		`,"included":{"spaces":[` + spaceResponse + `],"organizations":[` + orgResponse + `]}}`
+
+	logger = hclog.Default()
 )
 
+// listResponse is a single page listing the resources.
+func listResponse(resources ...string) string {
+	return fmt.Sprintf(`{"pagination":{"total_results":%d,"total_pages":1,"first":{"href":""},"last":{"href":""},"next":null,"previous":null},"resources":[%s]}`,
+		len(resources), strings.Join(resources, ","))
+}
+
 func MockServer(loud bool, casToTrust []string) *httptest.Server {
-	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return MockServerWithFaults(loud, casToTrust, nil)
+}
+
+// MockServerWithFaults is like MockServer, but injects the faults into its responses.
+// The faults may be nil, in which case none are injected.
+func MockServerWithFaults(loud bool, casToTrust []string, faults *Faults) *httptest.Server {
+	// The root response names the server's own URL.
+	var testServerUrl string
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		if loud {
 			logger.Info(fmt.Sprintf("%+v", r))
 		}
 
+		if fault := faults.next(r); fault != nil && fault.inject(w, r) {
+			return
+		}
+
 		// Below, 200's are returned by default, but are included anyways for explicitness.
 		pathFields := strings.Split(r.URL.EscapedPath(), "/")
 		lastPathField := pathFields[len(pathFields)-1]
@@ -57,9 +91,60 @@ func MockServer(loud bool, casToTrust []string) *httptest.Server {
 			w.WriteHeader(200)
 			w.Write([]byte(tokenResponse))
 
-		case "info":
+		case "":
+			// The root endpoint is used by the client to discover UAA and login endpoints.
+			w.WriteHeader(200)
+			w.Write([]byte(strings.Replace(rootResponse, "{{TEST_URL}}", testServerUrl, -1)))
+
+		case "processes":
+			w.WriteHeader(200)
+			w.Write([]byte(processesResponse))
+
+		case "stats":
+			w.WriteHeader(200)
+			w.Write([]byte(processStatsResponse))
+
+		case "current":
+			// The app's current droplet.
+			w.WriteHeader(200)
+			w.Write([]byte(dropletResponse))
+
+		case "deployed":
+			// The app's deployed revisions.
+			w.WriteHeader(200)
+			w.Write([]byte(deployedRevisionsResponse))
+
+		case "ssh_enabled":
+			// SSH is enabled for apps unless it's disabled.
+			w.WriteHeader(200)
+			w.Write([]byte(`{"enabled":true,"reason":""}`))
+
+		case "service_credential_bindings":
+			w.WriteHeader(200)
+			w.Write([]byte(serviceCredentialBindingsResponse))
+
+		case "tasks":
+			w.WriteHeader(200)
+			w.Write([]byte(tasksResponse))
+
+		case "organizations":
+			// Orgs are only listed to look them up by name.
 			w.WriteHeader(200)
-			w.Write([]byte(strings.Replace(infoResponse, "{{TEST_URL}}", testServerUrl, -1)))
+			if r.URL.Query().Get("names") != FoundOrgName {
+				w.Write([]byte(listResponse()))
+				return
+			}
+			w.Write([]byte(listResponse(orgResponse)))
+
+		case "spaces":
+			// Spaces are only listed to look them up by name within an org.
+			w.WriteHeader(200)
+			query := r.URL.Query()
+			if query.Get("names") != FoundSpaceName || query.Get("organization_guids") != FoundOrgGUID {
+				w.Write([]byte(listResponse()))
+				return
+			}
+			w.Write([]byte(listResponse(spaceResponse)))
 
 		case FoundServiceGUID:
 			w.WriteHeader(200)
@@ -71,6 +156,10 @@ func MockServer(loud bool, casToTrust []string) *httptest.Server {
 
 		case FoundAppGUID:
 			w.WriteHeader(200)
+			if r.URL.Query().Get("include") != "" {
+				w.Write([]byte(appWithIncludedResponse))
+				return
+			}
 			w.Write([]byte(appResponse))
 
 		case UnfoundAppGUID:
@@ -98,7 +187,6 @@ func MockServer(loud bool, casToTrust []string) *httptest.Server {
 			w.Write([]byte(fmt.Sprintf("unexpected object identifier: %s", lastPathField)))
 		}
 	}))
-	testServerUrl = testServer.URL
 
 	if len(casToTrust) > 0 {
 		clientCACertPool := x509.NewCertPool()
@@ -108,6 +196,8 @@ func MockServer(loud bool, casToTrust []string) *httptest.Server {
 		testServer.TLS = &tls.Config{}
 		testServer.TLS.ClientCAs = clientCACertPool
 	}
+	testServerUrl = "http://" + testServer.Listener.Addr().String()
+	testServer.Start()
 
 	// give the server time listen
 	time.Sleep(time.Millisecond * 250)
@@ -126,192 +216,503 @@ const (
 	"jti": "13cb302b1c66407d9f7036c2c2e1d120"
 }`
 
-	infoResponse = `{
-	"name": "",
-	"build": "",
-	"support": "",
-	"version": 0,
-	"description": "",
-	"authorization_endpoint": "https://login.dev.cfdev.sh",
-	"token_endpoint": "{{TEST_URL}}",
-	"min_cli_version": null,
-	"min_recommended_cli_version": null,
-	"app_ssh_endpoint": "ssh.dev.cfdev.sh:2222",
-	"app_ssh_host_key_fingerprint": "96:4d:89:2d:39:18:bc:16:e1:d3:d8:44:f8:16:af:85",
-	"app_ssh_oauth_client": "ssh-proxy",
-	"doppler_logging_endpoint": "wss://doppler.dev.cfdev.sh:443",
-	"api_version": "2.133.0",
-	"osbapi_version": "2.14",
-	"routing_endpoint": "https://api.dev.cfdev.sh/routing",
-	"user": "611c7eea-ffd0-4e98-82f0-f4b54aff6dcb"
+	rootResponse = `{
+	"links": {
+		"self": {
+			"href": "{{TEST_URL}}"
+		},
+		"cloud_controller_v2": null,
+		"cloud_controller_v3": {
+			"href": "{{TEST_URL}}/v3",
+			"meta": {
+				"version": "3.133.0"
+			}
+		},
+		"network_policy_v0": {
+			"href": "{{TEST_URL}}/networking/v0/external"
+		},
+		"network_policy_v1": {
+			"href": "{{TEST_URL}}/networking/v1/external"
+		},
+		"login": {
+			"href": "{{TEST_URL}}"
+		},
+		"uaa": {
+			"href": "{{TEST_URL}}"
+		},
+		"credhub": null,
+		"routing": {
+			"href": "{{TEST_URL}}/routing"
+		},
+		"logging": {
+			"href": "wss://doppler.dev.cfdev.sh:443"
+		},
+		"log_cache": {
+			"href": "https://log-cache.dev.cfdev.sh"
+		},
+		"log_stream": {
+			"href": "https://log-stream.dev.cfdev.sh"
+		},
+		"app_ssh": {
+			"href": "ssh.dev.cfdev.sh:2222",
+			"meta": {
+				"host_key_fingerprint": "96:4d:89:2d:39:18:bc:16:e1:d3:d8:44:f8:16:af:85",
+				"oauth_client": "ssh-proxy"
+			}
+		}
+	}
+}`
+
+	deployedRevisionsResponse = `{
+	"pagination": {
+		"total_results": 1,
+		"total_pages": 1,
+		"first": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/revisions/deployed?page=1&per_page=50"
+		},
+		"last": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/revisions/deployed?page=1&per_page=50"
+		},
+		"next": null,
+		"previous": null
+	},
+	"resources": [
+		{
+			"guid": "885735b5-aea4-4cf5-8e44-961af0e41920",
+			"version": 3,
+			"droplet": {
+				"guid": "` + FoundDropletGUID + `"
+			},
+			"processes": {
+				"web": {
+					"command": "java -jar app.jar"
+				}
+			},
+			"sidecars": [],
+			"description": "New droplet deployed.",
+			"deployable": true,
+			"relationships": {
+				"app": {
+					"data": {
+						"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+					}
+				}
+			},
+			"created_at": "2017-02-01T01:33:58Z",
+			"updated_at": "2017-02-01T01:33:58Z",
+			"metadata": {
+				"labels": {},
+				"annotations": {}
+			},
+			"links": {
+				"self": {
+					"href": "/v3/revisions/885735b5-aea4-4cf5-8e44-961af0e41920"
+				},
+				"app": {
+					"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+				}
+			}
+		}
+	]
 }`
 
 	serviceInstanceResponse = `{
-	"metadata": {
-		"guid": "1bf2e7f6-2d1d-41ec-501c-c70",
-		"url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70",
-		"created_at": "2016-06-08T16:41:29Z",
-		"updated_at": "2016-06-08T16:41:26Z"
+	"guid": "1bf2e7f6-2d1d-41ec-501c-c70",
+	"created_at": "2016-06-08T16:41:29Z",
+	"updated_at": "2016-06-08T16:41:26Z",
+	"name": "name-1508",
+	"tags": [
+		"accounting",
+		"mongodb"
+	],
+	"type": "managed",
+	"maintenance_info": {},
+	"upgrade_available": false,
+	"dashboard_url": null,
+	"last_operation": {
+		"type": "create",
+		"state": "succeeded",
+		"description": "service broker-provided description",
+		"updated_at": "2016-06-08T16:41:29Z",
+		"created_at": "2016-06-08T16:41:29Z"
 	},
-	"entity": {
-		"name": "name-1508",
-		"credentials": {
-			"creds-key-38": "creds-val-38"
+	"relationships": {
+		"service_plan": {
+			"data": {
+				"guid": "779d2df0-9cdd-48e8-9781-ea05301cedb1"
+			}
 		},
-		"service_guid": "a14baddf-1ccc-5299-0152-ab9s49de4422",
-		"service_plan_guid": "779d2df0-9cdd-48e8-9781-ea05301cedb1",
-		"space_guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"gateway_data": null,
-		"dashboard_url": null,
-		"type": "managed_service_instance",
-		"last_operation": {
-			"type": "create",
-			"state": "succeeded",
-			"description": "service broker-provided description",
-			"updated_at": "2016-06-08T16:41:29Z",
-			"created_at": "2016-06-08T16:41:29Z"
+		"space": {
+			"data": {
+				"guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
+			}
+		}
+	},
+	"metadata": {
+		"labels": {},
+		"annotations": {}
+	},
+	"links": {
+		"self": {
+			"href": "/v3/service_instances/1bf2e7f6-2d1d-41ec-501c-c70"
 		},
-		"tags": [
-			"accounting",
-			"mongodb"
-		],
-		"space_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"service_url": "/v2/services/a14baddf-1ccc-5299-0152-ab9s49de4422",
-		"service_plan_url": "/v2/service_plans/779d2df0-9cdd-48e8-9781-ea05301cedb1",
-		"service_bindings_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/service_bindings",
-		"service_keys_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/service_keys",
-		"routes_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/routes",
-		"shared_from_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/shared_from",
-		"shared_to_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/shared_to",
-		"service_instance_parameters_url": "/v2/service_instances/1bf2e7f6-2d1d-41ec-501c-c70/parameters"
+		"space": {
+			"href": "/v3/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
+		}
 	}
 }`
 
 	unfoundServiceInstanceResponse = `{
-	"description": "The service instance could not be found: service-id-unfound",
-	"error_code": "CF-ServiceInstanceNotFound",
-	"code": 60004
+	"errors": [
+		{
+			"detail": "Service instance not found",
+			"title": "CF-ResourceNotFound",
+			"code": 10010
+		}
+	]
 }`
 
 	appResponse = `{
+	"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1",
+	"created_at": "2016-06-08T16:41:44Z",
+	"updated_at": "2016-06-08T16:41:44Z",
+	"name": "name-2401",
+	"state": "STARTED",
+	"lifecycle": {
+		"type": "buildpack",
+		"data": {
+			"buildpacks": [
+				"` + FoundAppBuildpack + `"
+			],
+			"stack": "` + FoundAppStack + `"
+		}
+	},
+	"relationships": {
+		"space": {
+			"data": {
+				"guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
+			}
+		}
+	},
 	"metadata": {
-		"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1",
-		"url": "/v2/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1",
-		"created_at": "2016-06-08T16:41:44Z",
-		"updated_at": "2016-06-08T16:41:44Z"
+		"labels": {
+			"team": "` + FoundAppTeamLabel + `"
+		},
+		"annotations": {
+			"cost-center": "` + FoundAppCostCenterAnnotation + `"
+		}
 	},
-	"entity": {
-		"name": "name-2401",
-		"production": false,
-		"space_guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"stack_guid": "7e03186d-a438-4285-b3b7-c426532e1df2",
-		"buildpack": null,
-		"detected_buildpack": null,
-		"detected_buildpack_guid": null,
-		"environment_json": null,
-		"memory": 1024,
-		"instances": 1,
-		"disk_quota": 1024,
-		"state": "STOPPED",
-		"version": "df19a7ea-2003-4ecb-a909-e630e43f2719",
-		"command": null,
-		"console": false,
-		"debug": null,
-		"staging_task_id": null,
-		"package_state": "PENDING",
-		"health_check_http_endpoint": "",
-		"health_check_type": "port",
-		"health_check_timeout": null,
-		"staging_failed_reason": null,
-		"staging_failed_description": null,
-		"diego": false,
-		"docker_image": null,
-		"docker_credentials": {
-			"username": null,
-			"password": null
+	"links": {
+		"self": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+		},
+		"space": {
+			"href": "/v3/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
 		},
-		"package_updated_at": "2016-06-08T16:41:45Z",
-		"detected_start_command": "",
-		"enable_ssh": true,
-		"ports": null,
-		"space_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"stack_url": "/v2/stacks/7e03186d-a438-4285-b3b7-c426532e1df2",
-		"routes_url": "/v2/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/routes",
-		"events_url": "/v2/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/events",
-		"service_bindings_url": "/v2/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/service_bindings",
-		"route_mappings_url": "/v2/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/route_mappings"
+		"processes": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/processes"
+		}
 	}
 }`
 
 	unfoundAppResponse = `{
-	"description": "The app could not be found: app-id-unfound",
-	"error_code": "CF-AppNotFound",
-	"code": 100004
+	"errors": [
+		{
+			"detail": "App not found",
+			"title": "CF-ResourceNotFound",
+			"code": 10010
+		}
+	]
+}`
+
+	processesResponse = `{
+	"pagination": {
+		"total_results": 1,
+		"total_pages": 1,
+		"first": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/processes?page=1&per_page=50"
+		},
+		"last": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/processes?page=1&per_page=50"
+		},
+		"next": null,
+		"previous": null
+	},
+	"resources": [
+		{
+			"guid": "6a901b7c-9417-4dc1-8189-d3234aa0ab82",
+			"created_at": "2016-06-08T16:41:44Z",
+			"updated_at": "2016-06-08T16:41:44Z",
+			"type": "web",
+			"command": "[PRIVATE DATA HIDDEN IN LISTS]",
+			"instances": 1,
+			"memory_in_mb": 1024,
+			"disk_in_mb": 1024,
+			"health_check": {
+				"type": "port",
+				"data": {
+					"timeout": null
+				}
+			},
+			"relationships": {
+				"app": {
+					"data": {
+						"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+					}
+				},
+				"revision": null
+			},
+			"metadata": {
+				"labels": {},
+				"annotations": {}
+			},
+			"links": {
+				"self": {
+					"href": "/v3/processes/6a901b7c-9417-4dc1-8189-d3234aa0ab82"
+				},
+				"app": {
+					"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+				}
+			}
+		}
+	]
+}`
+
+	processStatsResponse = `{
+	"resources": [
+		{
+			"type": "` + FoundProcessType + `",
+			"index": ` + FoundInstanceIndex + `,
+			"state": "RUNNING",
+			"instance_guid": "1bf2e7f6-2d1d-41ec-501c-c70",
+			"host": "10.244.0.5",
+			"uptime": 9042,
+			"mem_quota": 268435456,
+			"disk_quota": 1073741824,
+			"fds_quota": 16384,
+			"isolation_segment": null,
+			"details": null
+		}
+	]
+}`
+
+	dropletResponse = `{
+	"guid": "` + FoundDropletGUID + `",
+	"state": "STAGED",
+	"error": null,
+	"lifecycle": {
+		"type": "buildpack",
+		"data": {}
+	},
+	"execution_metadata": "",
+	"process_types": {
+		"web": "java -jar app.jar"
+	},
+	"checksum": {
+		"type": "sha256",
+		"value": "3b0e8a3b5d36f9e4f6bd9332c13fc8bd67e5a30ede1bbd4ece27b6e2292bdcc1"
+	},
+	"buildpacks": [
+		{
+			"name": "` + FoundAppBuildpack + `",
+			"detect_output": "java",
+			"buildpack_name": "java",
+			"version": "4.66.0"
+		}
+	],
+	"stack": "` + FoundAppStack + `",
+	"image": null,
+	"created_at": "2016-03-28T23:39:34Z",
+	"updated_at": "2016-03-28T23:39:47Z",
+	"relationships": {
+		"app": {
+			"data": {
+				"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+			}
+		}
+	},
+	"metadata": {
+		"labels": {},
+		"annotations": {}
+	}
+}`
+
+	serviceCredentialBindingsResponse = `{
+	"pagination": {
+		"total_results": 1,
+		"total_pages": 1,
+		"first": {
+			"href": "/v3/service_credential_bindings?page=1&per_page=50"
+		},
+		"last": {
+			"href": "/v3/service_credential_bindings?page=1&per_page=50"
+		},
+		"next": null,
+		"previous": null
+	},
+	"resources": [
+		{
+			"guid": "7aa37bad-6ccb-4ef9-ba48-9ce3a91b2b62",
+			"created_at": "2015-11-13T17:02:56Z",
+			"updated_at": "2016-06-08T16:41:26Z",
+			"name": null,
+			"type": "app",
+			"last_operation": {
+				"type": "create",
+				"state": "succeeded",
+				"created_at": "2015-11-13T17:02:56Z",
+				"updated_at": "2016-06-08T16:41:26Z"
+			},
+			"metadata": {
+				"labels": {},
+				"annotations": {}
+			},
+			"relationships": {
+				"app": {
+					"data": {
+						"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+					}
+				},
+				"service_instance": {
+					"data": {
+						"guid": "` + BoundServiceInstanceGUID + `"
+					}
+				}
+			}
+		}
+	],
+	"included": {
+		"service_instances": [
+			{
+				"guid": "` + BoundServiceInstanceGUID + `",
+				"created_at": "2015-11-13T17:02:56Z",
+				"updated_at": "2016-06-08T16:41:26Z",
+				"name": "` + BoundServiceInstanceName + `",
+				"type": "user-provided",
+				"relationships": {
+					"space": {
+						"data": {
+							"guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
+						}
+					}
+				}
+			}
+		]
+	}
+}`
+
+	tasksResponse = `{
+	"pagination": {
+		"total_results": 1,
+		"total_pages": 1,
+		"first": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/tasks?page=1&per_page=50"
+		},
+		"last": {
+			"href": "/v3/apps/2d3e834a-3a25-4591-974c-fa5626d5d0a1/tasks?page=1&per_page=50"
+		},
+		"next": null,
+		"previous": null
+	},
+	"resources": [
+		{
+			"guid": "d5cc22ec-99a3-4e6a-af91-a44b4ab7b6fa",
+			"sequence_id": 1,
+			"name": "migrate",
+			"state": "RUNNING",
+			"memory_in_mb": 512,
+			"disk_in_mb": 1024,
+			"result": {
+				"failure_reason": null
+			},
+			"droplet_guid": "740ebd2b-162b-469a-bd72-3edb96fabd9a",
+			"relationships": {
+				"app": {
+					"data": {
+						"guid": "2d3e834a-3a25-4591-974c-fa5626d5d0a1"
+					}
+				}
+			},
+			"metadata": {
+				"labels": {},
+				"annotations": {}
+			},
+			"created_at": "2016-05-04T17:00:41Z",
+			"updated_at": "2016-05-04T17:00:42Z"
+		}
+	]
 }`
 
 	orgResponse = `{
+	"guid": "34a878d0-c2f9-4521-ba73-a9f664e82c7bf",
+	"created_at": "2019-05-17T22:49:40Z",
+	"updated_at": "2019-05-17T22:49:40Z",
+	"name": "system",
+	"suspended": false,
+	"relationships": {
+		"quota": {
+			"data": {
+				"guid": "b172ff20-ae6d-4a13-a554-dc22f3844fb0"
+			}
+		}
+	},
 	"metadata": {
-		"guid": "34a878d0-c2f9-4521-ba73-a9f664e82c7bf",
-		"url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf",
-		"created_at": "2019-05-17T22:49:40Z",
-		"updated_at": "2019-05-17T22:49:40Z"
+		"labels": {},
+		"annotations": {}
 	},
-	"entity": {
-		"name": "system",
-		"billing_enabled": false,
-		"quota_definition_guid": "b172ff20-ae6d-4a13-a554-dc22f3844fb0",
-		"status": "active",
-		"default_isolation_segment_guid": null,
-		"quota_definition_url": "/v2/quota_definitions/b172ff20-ae6d-4a13-a554-dc22f3844fb0",
-		"spaces_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/spaces",
-		"domains_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/domains",
-		"private_domains_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/private_domains",
-		"users_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/users",
-		"managers_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/managers",
-		"billing_managers_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/billing_managers",
-		"auditors_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/auditors",
-		"app_events_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/app_events",
-		"space_quota_definitions_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf/space_quota_definitions"
+	"links": {
+		"self": {
+			"href": "/v3/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf"
+		}
 	}
 }`
 
 	unfoundOrgResponse = `{
-	"description": "The organization could not be found: org-id-unfound",
-	"error_code": "CF-OrganizationNotFound",
-	"code": 30003
+	"errors": [
+		{
+			"detail": "Organization not found",
+			"title": "CF-ResourceNotFound",
+			"code": 10010
+		}
+	]
 }`
 
 	spaceResponse = `{
+	"guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
+	"created_at": "2019-05-17T22:53:30Z",
+	"updated_at": "2019-05-17T22:53:30Z",
+	"name": "cfdev-space",
+	"relationships": {
+		"organization": {
+			"data": {
+				"guid": "34a878d0-c2f9-4521-ba73-a9f664e82c7bf"
+			}
+		},
+		"quota": {
+			"data": null
+		}
+	},
 	"metadata": {
-		"guid": "3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9",
-		"created_at": "2019-05-17T22:53:30Z",
-		"updated_at": "2019-05-17T22:53:30Z"
+		"labels": {},
+		"annotations": {}
 	},
-	"entity": {
-		"name": "cfdev-space",
-		"organization_guid": "34a878d0-c2f9-4521-ba73-a9f664e82c7bf",
-		"space_quota_definition_guid": null,
-		"isolation_segment_guid": null,
-		"allow_ssh": true,
-		"organization_url": "/v2/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf",
-		"developers_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/developers",
-		"managers_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/managers",
-		"auditors_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/auditors",
-		"apps_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/apps",
-		"routes_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/routes",
-		"domains_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/domains",
-		"service_instances_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/service_instances",
-		"app_events_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/app_events",
-		"events_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/events",
-		"security_groups_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/security_groups",
-		"staging_security_groups_url": "/v2/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9/staging_security_groups"
+	"links": {
+		"self": {
+			"href": "/v3/spaces/3d2eba6b-ef19-44d5-91dd-1975b0db5cc9"
+		},
+		"organization": {
+			"href": "/v3/organizations/34a878d0-c2f9-4521-ba73-a9f664e82c7bf"
+		}
 	}
 }`
 
 	unfoundSpaceResponse = `{
-	"description": "The app space could not be found: space-id-unfound",
-	"error_code": "CF-SpaceNotFound",
-	"code": 40004
+	"errors": [
+		{
+			"detail": "Space not found",
+			"title": "CF-ResourceNotFound",
+			"code": 10010
+		}
+	]
 }`
 )
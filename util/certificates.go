@@ -5,23 +5,79 @@ package util
 
 import (
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 )
 
+const (
+	// CertEncodingAuto, CertEncodingPEM, and CertEncodingBase64 are the encodings the
+	// contents of the file at CF_INSTANCE_CERT may be sent in. Auto takes contents
+	// that are PEM as they are, and decodes those that are base64 encoded PEM.
+	CertEncodingAuto   = "auto"
+	CertEncodingPEM    = "pem"
+	CertEncodingBase64 = "base64"
+)
+
+// pemPrefix is what PEM encoded contents start with.
+const pemPrefix = "-----BEGIN "
+
+// DecodeCertificateContents returns the contents of the file at CF_INSTANCE_CERT, as
+// PEM, from the contents in the given encoding. Base64 encoded contents may use the
+// standard or URL-safe alphabet, with or without padding, and may be wrapped over
+// several lines. If the encoding is empty, it's CertEncodingAuto.
+func DecodeCertificateContents(contents, encoding string) (string, error) {
+	switch encoding {
+	case CertEncodingPEM:
+		return contents, nil
+	case "", CertEncodingAuto:
+		if strings.HasPrefix(strings.TrimSpace(contents), pemPrefix) {
+			return contents, nil
+		}
+		decoded, err := decodeBase64PEM(contents)
+		if err != nil {
+			// Contents that are neither are left for parsing them to fail.
+			return contents, nil
+		}
+		return decoded, nil
+	case CertEncodingBase64:
+		return decodeBase64PEM(contents)
+	default:
+		return "", fmt.Errorf("encoding must be one of %q, %q, or %q, but was %q", CertEncodingAuto, CertEncodingPEM, CertEncodingBase64, encoding)
+	}
+}
+
+// decodeBase64PEM decodes the base64 encoded contents, which must be PEM.
+func decodeBase64PEM(contents string) (string, error) {
+	compact := strings.Join(strings.Fields(contents), "")
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, err := encoding.DecodeString(compact)
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(strings.TrimSpace(string(decoded)), pemPrefix) {
+			return "", errors.New("base64 encoded certificate contents must be PEM")
+		}
+		return string(decoded), nil
+	}
+	return "", errors.New("certificate contents aren't base64 encoded")
+}
+
 // ExtractCertificates takes the contents of the file at CF_INSTANCE_CERT, which typically are
 // comprised of two certificates. One is the identity certificate, and one is an intermediate
 // CA certificate which is crucial in linking the identity cert back to the configured root
-// certificate. It splits these two certificates apart, and identifies the certificate marked
-// as a CA as the intermediate cert, and the one not marked as a CA as the identity certificate.
+// certificate. Some CF distributions issue identity certificates directly from the root, or
+// through several intermediates. It splits the certificates apart, and identifies those marked
+// as a CA as the intermediate certs, and the one not marked as a CA as the identity certificate.
 // It may error if the given file contents or certificates aren't as expected.
-func ExtractCertificates(cfInstanceCertContents string) (intermediateCert, identityCert *x509.Certificate, err error) {
+func ExtractCertificates(cfInstanceCertContents string) (intermediateCerts []*x509.Certificate, identityCert *x509.Certificate, err error) {
 	certPairBytes := []byte(cfInstanceCertContents)
-	numCerts := 0
+	numIdentityCerts := 0
 	var block *pem.Block
 	var result error
 	for {
@@ -36,47 +92,95 @@ func ExtractCertificates(cfInstanceCertContents string) (intermediateCert, ident
 		}
 		for _, cert := range certs {
 			if cert.IsCA {
-				intermediateCert = cert
+				intermediateCerts = append(intermediateCerts, cert)
 			} else {
 				identityCert = cert
+				numIdentityCerts++
 			}
-			numCerts++
 		}
 	}
-	if numCerts != 2 {
-		result = multierror.Append(fmt.Errorf("expected 2 certs but received %s", certPairBytes))
-	}
-	if intermediateCert == nil {
-		result = multierror.Append(fmt.Errorf("no intermediate certificate found in %s", certPairBytes))
+	if numIdentityCerts > 1 {
+		result = multierror.Append(result, fmt.Errorf("expected 1 identity cert but received %d", numIdentityCerts))
 	}
 	if identityCert == nil {
-		result = multierror.Append(fmt.Errorf("no identity cert found in %s", certPairBytes))
+		result = multierror.Append(result, fmt.Errorf("no identity cert found in %s", certPairBytes))
 	}
-	return intermediateCert, identityCert, result
+	return intermediateCerts, identityCert, result
 }
 
-// Validate takes a group of trusted CA certificates, an intermediate certificate, an identity certificate,
+// Validate takes a group of trusted CA certificates, any intermediate certificates, an identity certificate,
 // and a signing certificate, and makes sure they have the following properties:
 //   - The identity certificate is the same as the signing certificate
 //   - The identity certificate chains to at least one trusted CA
-func Validate(caCerts []string, intermediateCert, identityCert, signingCert *x509.Certificate) error {
+func Validate(caCerts []string, intermediateCerts []*x509.Certificate, identityCert, signingCert *x509.Certificate) error {
+	_, err := VerifiedChain(caCerts, intermediateCerts, identityCert, signingCert)
+	return err
+}
+
+// VerifiedChain validates the certificates as Validate does, and returns the chain from
+// the identity certificate to the CA it was verified against.
+func VerifiedChain(caCerts []string, intermediateCerts []*x509.Certificate, identityCert, signingCert *x509.Certificate) ([]*x509.Certificate, error) {
 	if !reflect.DeepEqual(identityCert, signingCert) {
-		return errors.New("signature not generated by identity cert")
+		return nil, errors.New("signature not generated by identity cert")
 	}
 	roots := x509.NewCertPool()
 	for _, caCert := range caCerts {
 		if ok := roots.AppendCertsFromPEM([]byte(caCert)); !ok {
-			return errors.New("couldn't append root certificate")
+			return nil, errors.New("couldn't append root certificate")
 		}
 	}
 	intermediates := x509.NewCertPool()
-	intermediates.AddCert(intermediateCert)
+	for _, intermediateCert := range intermediateCerts {
+		intermediates.AddCert(intermediateCert)
+	}
 	verifyOpts := x509.VerifyOptions{
 		Roots:         roots,
 		Intermediates: intermediates,
 	}
-	if _, err := signingCert.Verify(verifyOpts); err != nil {
-		return err
+	chains, err := signingCert.Verify(verifyOpts)
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// ValidateKeyUsage makes sure the certificates were issued for their purpose, as CF
+// issues them:
+//   - The identity certificate may be used for digital signatures and client authentication
+//   - The intermediate certificates are CAs that may sign certificates for client authentication
+//
+// Path length constraints are checked along with the chain by Validate.
+func ValidateKeyUsage(intermediateCerts []*x509.Certificate, identityCert *x509.Certificate) error {
+	if identityCert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return errors.New("identity certificate's key usage doesn't allow digital signatures")
+	}
+	if !allowsClientAuth(identityCert.ExtKeyUsage, false) {
+		return errors.New("identity certificate's extended key usage doesn't allow client authentication")
+	}
+	for _, intermediateCert := range intermediateCerts {
+		if !intermediateCert.BasicConstraintsValid || !intermediateCert.IsCA {
+			return fmt.Errorf("intermediate certificate %q's basic constraints don't mark it as a CA", intermediateCert.Subject)
+		}
+		if intermediateCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return fmt.Errorf("intermediate certificate %q's key usage doesn't allow signing certificates", intermediateCert.Subject)
+		}
+		// CAs without an extended key usage may issue certificates for any purpose.
+		if !allowsClientAuth(intermediateCert.ExtKeyUsage, true) {
+			return fmt.Errorf("intermediate certificate %q's extended key usage doesn't allow client authentication", intermediateCert.Subject)
+		}
 	}
 	return nil
 }
+
+// allowsClientAuth reports whether the extended key usages allow client authentication.
+func allowsClientAuth(extKeyUsages []x509.ExtKeyUsage, allowEmpty bool) bool {
+	if len(extKeyUsages) == 0 {
+		return allowEmpty
+	}
+	for _, usage := range extKeyUsages {
+		if usage == x509.ExtKeyUsageClientAuth || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
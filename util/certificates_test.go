@@ -4,8 +4,18 @@
 package util
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestExtractCertificates(t *testing.T) {
@@ -13,16 +23,193 @@ func TestExtractCertificates(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	intermediate, identity, err := ExtractCertificates(string(sampleCertBytes))
+	intermediates, identity, err := ExtractCertificates(string(sampleCertBytes))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(intermediates) != 1 {
+		t.Fatalf("expected 1 intermediate but received %d", len(intermediates))
+	}
 	expected := "CN=instanceIdentityCA,O=Cloud Foundry,C=USA"
-	if intermediate.Subject.String() != expected {
-		t.Fatalf("expected %q but received %q", expected, intermediate.Subject.String())
+	if intermediates[0].Subject.String() != expected {
+		t.Fatalf("expected %q but received %q", expected, intermediates[0].Subject.String())
 	}
 	expected = "CN=f9c7cd7d-1612-4f57-63a8-f995,OU=organization:34a878d0-c2f9-4521-ba73-a9f664e82c7b+OU=space:3d2eba6b-ef19-44d5-91dd-1975b0db5cc9+OU=app:2d3e834a-3a25-4591-974c-fa5626d5d0a1"
 	if identity.Subject.String() != expected {
 		t.Fatalf("expected %q but received %q", expected, identity.Subject.String())
 	}
+
+	// Certificates written on Windows cells have CRLF line endings.
+	crlf := strings.ReplaceAll(string(sampleCertBytes), "\n", "\r\n")
+	crlfIntermediates, crlfIdentity, err := ExtractCertificates(crlf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crlfIntermediates) != 1 || !crlfIdentity.Equal(identity) {
+		t.Fatal("expected the same certificates with CRLF line endings")
+	}
+}
+
+func TestDecodeCertificateContents(t *testing.T) {
+	sampleCertBytes, err := ioutil.ReadFile("../testdata/real-certificates/instance.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := string(sampleCertBytes)
+	encoded := base64.StdEncoding.EncodeToString(sampleCertBytes)
+	// Tools wrapping base64 at 76 characters, as base64 does, break it over lines.
+	var wrapped strings.Builder
+	for i := 0; i < len(encoded); i += 76 {
+		wrapped.WriteString(encoded[i:min(i+76, len(encoded))] + "\n")
+	}
+
+	for _, tc := range []struct {
+		contents string
+		encoding string
+		expected string
+		err      bool
+	}{
+		{contents, "", contents, false},
+		{contents, CertEncodingPEM, contents, false},
+		{encoded, "", contents, false},
+		{wrapped.String(), CertEncodingAuto, contents, false},
+		{base64.RawURLEncoding.EncodeToString(sampleCertBytes), CertEncodingBase64, contents, false},
+		{contents, CertEncodingBase64, "", true},
+		{base64.StdEncoding.EncodeToString([]byte("not a certificate")), CertEncodingBase64, "", true},
+		{"not a certificate", "", "not a certificate", false},
+		{contents, "der", "", true},
+	} {
+		decoded, err := DecodeCertificateContents(tc.contents, tc.encoding)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("expected decoding %.20q as %q to fail", tc.contents, tc.encoding)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != tc.expected {
+			t.Fatalf("expected decoding %.20q as %q to return %.20q but received %.20q", tc.contents, tc.encoding, tc.expected, decoded)
+		}
+	}
+}
+
+func TestValidateKeyUsage(t *testing.T) {
+	sampleCertBytes, err := ioutil.ReadFile("../testdata/real-certificates/instance.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates, identity, err := ExtractCertificates(string(sampleCertBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateKeyUsage(intermediates, identity); err != nil {
+		t.Fatalf("expected CF's certificates to be valid but received %v", err)
+	}
+
+	for name, misissue := range map[string]func(intermediate, identity *x509.Certificate){
+		"identity without digital signature": func(_, identity *x509.Certificate) {
+			identity.KeyUsage = x509.KeyUsageKeyEncipherment
+		},
+		"identity without client auth": func(_, identity *x509.Certificate) {
+			identity.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		},
+		"identity without extended key usage": func(_, identity *x509.Certificate) {
+			identity.ExtKeyUsage = nil
+		},
+		"intermediate that isn't a CA": func(intermediate, _ *x509.Certificate) {
+			intermediate.IsCA = false
+		},
+		"intermediate without cert sign": func(intermediate, _ *x509.Certificate) {
+			intermediate.KeyUsage = x509.KeyUsageDigitalSignature
+		},
+		"intermediate only for server auth": func(intermediate, _ *x509.Certificate) {
+			intermediate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		},
+	} {
+		intermediateCopy, identityCopy := *intermediates[0], *identity
+		misissue(&intermediateCopy, &identityCopy)
+		if err := ValidateKeyUsage([]*x509.Certificate{&intermediateCopy}, &identityCopy); err == nil {
+			t.Fatalf("%s: expected the certificates to be invalid", name)
+		}
+	}
+}
+
+func TestExtractAndValidateIntermediateChains(t *testing.T) {
+	root, rootKey := issueTestCert(t, "root", true, nil, nil)
+	rootPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))
+
+	for _, depth := range []int{0, 1, 3} {
+		parent, parentKey := root, rootKey
+		var chain []string
+		for i := 0; i < depth; i++ {
+			parent, parentKey = issueTestCert(t, "intermediate", true, parent, parentKey)
+			chain = append([]string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parent.Raw}))}, chain...)
+		}
+		identity, _ := issueTestCert(t, "identity", false, parent, parentKey)
+		contents := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Raw})) + strings.Join(chain, "")
+
+		intermediates, identityCert, err := ExtractCertificates(contents)
+		if err != nil {
+			t.Fatalf("%d intermediates: %v", depth, err)
+		}
+		if len(intermediates) != depth {
+			t.Fatalf("expected %d intermediates but received %d", depth, len(intermediates))
+		}
+		if err := Validate([]string{rootPEM}, intermediates, identityCert, identityCert); err != nil {
+			t.Fatalf("expected a chain with %d intermediates to be valid but received %v", depth, err)
+		}
+		if err := ValidateKeyUsage(intermediates, identityCert); err != nil {
+			t.Fatalf("expected a chain with %d intermediates to have valid key usage but received %v", depth, err)
+		}
+		// Every intermediate is needed to chain to the root.
+		if depth > 1 {
+			if err := Validate([]string{rootPEM}, intermediates[1:], identityCert, identityCert); err == nil {
+				t.Fatalf("expected a chain missing an intermediate to be invalid")
+			}
+		}
+	}
+
+	identity, _ := issueTestCert(t, "identity", false, root, rootKey)
+	other, _ := issueTestCert(t, "other", false, root, rootKey)
+	contents := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Raw})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}))
+	if _, _, err := ExtractCertificates(contents); err == nil {
+		t.Fatal("expected more than one identity certificate to be invalid")
+	}
+}
+
+// issueTestCert issues a certificate from the parent, or a self-signed one if the
+// parent is nil.
+func issueTestCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
 }
@@ -0,0 +1,184 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package util
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// ParsePrivateKey parses the first PEM-encoded private key in pemBytes, such as the
+// contents of the file at CF_INSTANCE_KEY. PKCS #1 RSA, SEC 1 EC, and PKCS #8 keys
+// are supported. Encrypted keys, either PKCS #8 keys encrypted with PBES2 or
+// legacy PEM blocks with a DEK-Info header, are decrypted with the passphrase,
+// which is ignored for keys that aren't encrypted.
+func ParsePrivateKey(pemBytes, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM-encoded private key found")
+	}
+
+	der := block.Bytes
+	blockType := block.Type
+	switch {
+	case blockType == "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key is encrypted but no passphrase was provided")
+		}
+		decrypted, err := decryptPKCS8(der, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		der = decrypted
+		blockType = "PRIVATE KEY"
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key is encrypted but no passphrase was provided")
+		}
+		// Legacy PEM encryption is weak, which is why DecryptPEMBlock is deprecated,
+		// but it's still what "openssl rsa -aes256" and similar tools produce.
+		decrypted, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt private key: %w", err)
+		}
+		der = decrypted
+	}
+
+	var privateKey interface{}
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, fmt.Errorf("unsupported private key PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	return signer, nil
+}
+
+// encryptedPrivateKeyInfo is the PKCS #8 EncryptedPrivateKeyInfo structure.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts a PKCS #8 private key encrypted with PBES2, using PBKDF2
+// and AES-CBC, which is what OpenSSL produces by default.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("unable to parse encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption algorithm %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("unable to parse PBES2 parameters: %w", err)
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("unable to parse PBKDF2 parameters: %w", err)
+	}
+	var prf func() hash.Hash
+	switch {
+	// SHA-1 is the default when no PRF is given.
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 pseudorandom function %s", kdfParams.PRF.Algorithm)
+	}
+
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("unable to parse cipher parameters: %w", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid cipher initialization vector")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key length")
+	}
+
+	key := pbkdf2.Key(passphrase, kdfParams.Salt, kdfParams.IterationCount, keyLength, prf)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	// Strip the PKCS #7 padding. A wrong passphrase almost always leaves invalid padding.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("unable to decrypt private key, the passphrase may be incorrect")
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("unable to decrypt private key, the passphrase may be incorrect")
+		}
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
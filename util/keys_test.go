@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	readKey := func(name string) []byte {
+		keyBytes, err := ioutil.ReadFile("../testdata/private-keys/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyBytes
+	}
+
+	want, err := ParsePrivateKey(readKey("rsa-pkcs1.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rsa-pkcs8.key", "rsa-pkcs8-encrypted.key", "rsa-pkcs1-encrypted.key"} {
+		signer, err := ParsePrivateKey(readKey(name), []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !want.(*rsa.PrivateKey).Equal(signer) {
+			t.Fatalf("%s: expected the same key as rsa-pkcs1.key", name)
+		}
+	}
+
+	want, err = ParsePrivateKey(readKey("ec.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ParsePrivateKey(readKey("ec-pkcs8-encrypted.key"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !want.(*ecdsa.PrivateKey).Equal(signer) {
+		t.Fatal("expected the same key as ec.key")
+	}
+
+	for _, name := range []string{"rsa-pkcs8-encrypted.key", "rsa-pkcs1-encrypted.key"} {
+		if _, err := ParsePrivateKey(readKey(name), nil); err == nil || !strings.Contains(err.Error(), "no passphrase") {
+			t.Fatalf("%s: expected a missing passphrase to fail, received %v", name, err)
+		}
+		if _, err := ParsePrivateKey(readKey(name), []byte("wrong")); err == nil {
+			t.Fatalf("%s: expected a wrong passphrase to fail", name)
+		}
+	}
+
+	// Keys written on Windows cells have CRLF line endings.
+	crlf := strings.ReplaceAll(string(readKey("ec.key")), "\n", "\r\n")
+	signer, err = ParsePrivateKey([]byte(crlf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !want.(*ecdsa.PrivateKey).Equal(signer) {
+		t.Fatal("expected the same key as ec.key")
+	}
+
+	if _, err := ParsePrivateKey([]byte("not a key"), nil); err == nil {
+		t.Fatal("expected parsing garbage to fail")
+	}
+}
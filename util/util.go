@@ -3,4 +3,28 @@
 
 package util
 
+import (
+	"path/filepath"
+	"strings"
+)
+
 const BashTimeFormat = "Mon Jan 2 15:04:05 MST 2006"
+
+// PowerShellTimeFormat is the format of PowerShell's universal sortable time, as in
+// (Get-Date).ToUniversalTime().ToString("u"), for signing times made on Windows cells.
+const PowerShellTimeFormat = "2006-01-02 15:04:05Z"
+
+// CleanPath returns a path to an instance's certificate or key, such as the one in
+// CF_INSTANCE_CERT, with the surrounding whitespace and quotes that Windows cells'
+// environments may leave on it removed, and its separators made the platform's. An
+// empty path is returned as it is.
+func CleanPath(path string) string {
+	path = strings.TrimSpace(path)
+	if len(path) >= 2 && path[0] == '"' && path[len(path)-1] == '"' {
+		path = path[1 : len(path)-1]
+	}
+	if path == "" {
+		return ""
+	}
+	return filepath.Clean(filepath.FromSlash(path))
+}
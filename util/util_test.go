@@ -0,0 +1,24 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package util
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]string{
+		"":   "",
+		`""`: "",
+		"/etc/cf-instance-credentials/instance.crt":      filepath.FromSlash("/etc/cf-instance-credentials/instance.crt"),
+		` "/etc/cf-instance-credentials/instance.crt" `:  filepath.FromSlash("/etc/cf-instance-credentials/instance.crt"),
+		"/etc/cf-instance-credentials//instance.crt\r\n": filepath.FromSlash("/etc/cf-instance-credentials/instance.crt"),
+	}
+	for path, expected := range tests {
+		if cleaned := CleanPath(path); cleaned != expected {
+			t.Fatalf("expected %q to be cleaned to %q but received %q", path, expected, cleaned)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package version
+
+import "fmt"
+
+var (
+	// GitCommit is the git commit the plugin was built from, set by scripts/build.sh.
+	GitCommit string
+
+	// Version is the plugin's version, and VersionPrerelease marks builds that come
+	// before it, such as "dev".
+	Version           = "0.20.0"
+	VersionPrerelease = "dev"
+)
+
+// GetVersion returns the plugin's version, such as "0.20.0-dev".
+func GetVersion() string {
+	if VersionPrerelease != "" {
+		return fmt.Sprintf("%s-%s", Version, VersionPrerelease)
+	}
+	return Version
+}